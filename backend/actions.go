@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Confirmation tokens are short-lived and single use; each action may only be
+// executed once per cooldown period.
+const (
+	actionTokenTTL = 60 * time.Second
+	actionCooldown = 10 * time.Second
+)
+
+// actionRequest is the body accepted by POST /api/actions/{action}
+type actionRequest struct {
+	Target string `json:"target,omitempty"` // device key for per-device actions
+	Token  string `json:"token,omitempty"`  // confirmation token from the first step
+}
+
+// actionConfirmation is returned by the first step of an action
+type actionConfirmation struct {
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// pendingAction is an issued but not yet redeemed confirmation token
+type pendingAction struct {
+	action  string
+	target  string
+	expires time.Time
+}
+
+// actionGuard issues confirmation tokens for disruptive actions and enforces
+// a per-action cooldown.
+type actionGuard struct {
+	mu       sync.Mutex
+	pending  map[string]pendingAction // token -> action
+	lastRuns map[string]time.Time     // action -> last execution
+}
+
+// newActionGuard creates an empty actionGuard
+func newActionGuard() *actionGuard {
+	return &actionGuard{
+		pending:  make(map[string]pendingAction),
+		lastRuns: make(map[string]time.Time),
+	}
+}
+
+// issue creates a confirmation token for action on target
+func (g *actionGuard) issue(action, target string) (actionConfirmation, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return actionConfirmation{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expires := time.Now().Add(actionTokenTTL)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Forget expired tokens so the map stays small
+	for t, p := range g.pending {
+		if time.Now().After(p.expires) {
+			delete(g.pending, t)
+		}
+	}
+	g.pending[token] = pendingAction{action: action, target: target, expires: expires}
+
+	return actionConfirmation{Action: action, Target: target, Token: token, ExpiresAt: expires}, nil
+}
+
+// redeem consumes token for action on target. It returns the HTTP status to
+// report when the token cannot be used.
+func (g *actionGuard) redeem(token, action, target string) (int, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	p, ok := g.pending[token]
+	if !ok || time.Now().After(p.expires) {
+		delete(g.pending, token)
+		return http.StatusForbidden, "Invalid or expired confirmation token"
+	}
+	if p.action != action || p.target != target {
+		return http.StatusForbidden, "Confirmation token does not match this action"
+	}
+	if last, ok := g.lastRuns[action]; ok && time.Since(last) < actionCooldown {
+		return http.StatusTooManyRequests, "Action was executed recently, try again later"
+	}
+	delete(g.pending, token)
+	g.lastRuns[action] = time.Now()
+	return http.StatusOK, ""
+}
+
+// ResetStats zeroes all counters, including the per-device breakdowns, and
+// restarts the measurement period, returning its new start. Packets
+// captured before but not yet accounted are dropped.
+func (bm *BandwidthMonitor) ResetStats() time.Time {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	bm.resets.all = bm.resets.next()
+	bm.resets.devices = nil
+	bm.devices.clear()
+	bm.vlanMu.Lock()
+	bm.vlans = make(map[uint16]*VLANStats)
+	bm.vlanMu.Unlock()
+	bm.measurementStart = time.Now()
+	bm.unattributedBytes.Store(0)
+	bm.unattributedPackets.Store(0)
+	bm.services.reset()
+	bm.risk.reset()
+	bm.newDest.reset()
+	bm.domains.reset()
+	bm.asnUsage.reset()
+	bm.geoUsage.reset()
+	bm.ports.reset()
+	bm.discovery.reset()
+	bm.activity.reset()
+	bm.dnsFilter.reset()
+	return bm.measurementStart
+}
+
+// ResetDevice zeroes the counters and per-device breakdowns of one device,
+// keeping its addresses and names; its counters start over now, dropping
+// its packets captured before but not yet accounted. It returns a copy of
+// the device, or false when it is unknown.
+func (bm *BandwidthMonitor) ResetDevice(key string) (DeviceStats, bool) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	dev, ok := bm.devices.get(key)
+	if !ok {
+		return DeviceStats{}, false
+	}
+	now := time.Now()
+	dev.BytesSent, dev.BytesRecv, dev.PacketsSent, dev.PacketsRecv = 0, 0, 0, 0
+	dev.Protocols = ProtocolStats{}
+	dev.LANBytes, dev.WANBytes = 0, 0
+	dev.DNSAllowed, dev.DNSBlocked = 0, 0
+	dev.rate = &rateCounter{}
+	dev.FirstSeen = now
+	if bm.resets.devices == nil {
+		bm.resets.devices = make(map[string]uint64)
+	}
+	bm.resets.devices[key] = bm.resets.next()
+	bm.forgetDevice(key)
+	bm.activity.drop(key)
+	reset := *dev
+	reset.fillWindow(now)
+	return reset, true
+}
+
+// PurgeDevice removes a device and its counters; it reports whether the device existed
+func (bm *BandwidthMonitor) PurgeDevice(key string) bool {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	if !bm.devices.remove(key) {
+		return false
+	}
+	bm.forgetDevice(key)
+	return true
+}
+
+// RestartCapture asks every capture loop to close and reopen its handle
+func (bm *BandwidthMonitor) RestartCapture() {
+	for _, src := range bm.captures {
+		select {
+		case src.restart <- struct{}{}:
+		default:
+			// Restart already pending
+		}
+	}
+}
+
+// REST API: Zero all counters and start a new measurement period
+func (bm *BandwidthMonitor) handleResetStats(w http.ResponseWriter, r *http.Request) {
+	start := bm.ResetStats()
+	writeEncoded(w, r, map[string]interface{}{"status": "reset", "measurementStart": start})
+}
+
+// REST API: Zero the counters of one device
+func (bm *BandwidthMonitor) handleResetDevice(w http.ResponseWriter, r *http.Request) {
+	dev, ok := bm.ResetDevice(mux.Vars(r)["mac"])
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, dev)
+}
+
+// REST API: Two-step disruptive actions.
+// The first POST returns a confirmation token; repeating the POST with that
+// token executes the action.
+func (bm *BandwidthMonitor) handleAction(w http.ResponseWriter, r *http.Request) {
+	action := mux.Vars(r)["action"]
+
+	var req actionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch action {
+	case "reset-stats", "restart-capture":
+	case "purge-device":
+		if req.Target == "" {
+			http.Error(w, "purge-device requires a target", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	// Step one: hand out a confirmation token
+	if req.Token == "" {
+		confirmation, err := bm.actions.issue(action, req.Target)
+		if err != nil {
+			http.Error(w, "Could not issue confirmation token", http.StatusInternalServerError)
+			return
+		}
+		writeEncodedStatus(w, r, http.StatusAccepted, confirmation)
+		return
+	}
+
+	// Step two: execute with a valid token
+	if status, msg := bm.actions.redeem(req.Token, action, req.Target); status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+
+	switch action {
+	case "reset-stats":
+		bm.ResetStats()
+	case "purge-device":
+		if !bm.PurgeDevice(req.Target) {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+	case "restart-capture":
+		bm.RestartCapture()
+	}
+
+	writeEncoded(w, r, map[string]string{"status": "ok", "action": action})
+}
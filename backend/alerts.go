@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAlerts is how many alerts are kept in memory (see resourceProfile)
+var maxAlerts = 1000
+
+// Alert severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert workflow states
+const (
+	AlertOpen         = "open"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// maxAlertComments caps the comments kept per alert
+const maxAlertComments = 100
+
+// AlertComment is a note left on an alert by an operator
+type AlertComment struct {
+	Author string    `json:"author,omitempty"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+// Alert is a notable condition raised by one of the detectors
+type Alert struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"` // e.g. "heartbeat-silence"
+	Severity string    `json:"severity"`
+	Device   string    `json:"device,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+
+	// Triage workflow
+	State          string         `json:"state"`
+	Assignee       string         `json:"assignee,omitempty"`
+	AcknowledgedAt *time.Time     `json:"acknowledgedAt,omitempty"`
+	ResolvedAt     *time.Time     `json:"resolvedAt,omitempty"`
+	Comments       []AlertComment `json:"comments,omitempty"`
+}
+
+// alertManager stores raised alerts and fans them out to notifiers
+type alertManager struct {
+	mu        sync.RWMutex
+	alerts    []Alert // oldest first, capped at maxAlerts
+	nextID    uint64
+	notifiers []func(Alert)
+}
+
+// newAlertManager creates an empty alertManager
+func newAlertManager() *alertManager {
+	return &alertManager{}
+}
+
+// subscribe registers fn to be called for every new alert
+func (am *alertManager) subscribe(fn func(Alert)) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	am.notifiers = append(am.notifiers, fn)
+}
+
+// raise records a new alert and notifies subscribers
+func (am *alertManager) raise(alertType, severity, device, format string, args ...interface{}) Alert {
+	am.mu.Lock()
+	am.nextID++
+	alert := Alert{
+		ID:       am.nextID,
+		Type:     alertType,
+		Severity: severity,
+		Device:   device,
+		Message:  fmt.Sprintf(format, args...),
+		Time:     time.Now(),
+		State:    AlertOpen,
+	}
+	am.alerts = append(am.alerts, alert)
+	if len(am.alerts) > maxAlerts {
+		am.alerts = am.alerts[len(am.alerts)-maxAlerts:]
+	}
+	notifiers := am.notifiers
+	am.mu.Unlock()
+
+	log.Printf("Alert [%s] %s: %s", alert.Severity, alert.Type, alert.Message)
+	for _, notify := range notifiers {
+		notify(alert)
+	}
+	return alert
+}
+
+// list returns alerts with an id greater than since, oldest first,
+// optionally only those in state
+func (am *alertManager) list(since uint64, state string) []Alert {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	result := make([]Alert, 0)
+	for _, a := range am.alerts {
+		if a.ID > since && (state == "" || a.State == state) {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// find returns the index of alert id; caller holds am.mu
+func (am *alertManager) find(id uint64) int {
+	for i := range am.alerts {
+		if am.alerts[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// AlertUpdate changes the workflow fields of an alert; nil fields are kept
+type AlertUpdate struct {
+	State    *string `json:"state"`
+	Assignee *string `json:"assignee"`
+}
+
+// update applies a workflow change to alert id
+func (am *alertManager) update(id uint64, u AlertUpdate) (Alert, bool, error) {
+	if u.State != nil {
+		switch *u.State {
+		case AlertOpen, AlertAcknowledged, AlertResolved:
+		default:
+			return Alert{}, false, fmt.Errorf("invalid state %q", *u.State)
+		}
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	i := am.find(id)
+	if i < 0 {
+		return Alert{}, false, nil
+	}
+	a := &am.alerts[i]
+	if u.Assignee != nil {
+		a.Assignee = *u.Assignee
+	}
+	if u.State != nil && *u.State != a.State {
+		now := time.Now()
+		switch *u.State {
+		case AlertOpen:
+			a.AcknowledgedAt, a.ResolvedAt = nil, nil
+		case AlertAcknowledged:
+			a.AcknowledgedAt, a.ResolvedAt = &now, nil
+		case AlertResolved:
+			if a.AcknowledgedAt == nil {
+				a.AcknowledgedAt = &now
+			}
+			a.ResolvedAt = &now
+		}
+		a.State = *u.State
+	}
+	return *a, true, nil
+}
+
+// acknowledge marks an alert as acknowledged; resolved alerts stay resolved
+func (am *alertManager) acknowledge(id uint64) (Alert, bool) {
+	am.mu.RLock()
+	i := am.find(id)
+	resolved := i >= 0 && am.alerts[i].State == AlertResolved
+	am.mu.RUnlock()
+	state := AlertAcknowledged
+	if resolved {
+		state = AlertResolved
+	}
+	alert, found, _ := am.update(id, AlertUpdate{State: &state})
+	return alert, found
+}
+
+// comment adds an operator note to alert id
+func (am *alertManager) comment(id uint64, c AlertComment) (Alert, bool) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	i := am.find(id)
+	if i < 0 {
+		return Alert{}, false
+	}
+	a := &am.alerts[i]
+	c.Time = time.Now()
+	a.Comments = append(a.Comments, c)
+	if len(a.Comments) > maxAlertComments {
+		a.Comments = a.Comments[len(a.Comments)-maxAlertComments:]
+	}
+	return *a, true
+}
+
+// get returns alert id
+func (am *alertManager) get(id uint64) (Alert, bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	i := am.find(id)
+	if i < 0 {
+		return Alert{}, false
+	}
+	return am.alerts[i], true
+}
+
+// isAcknowledged reports whether an alert has left the open state. Alerts
+// that have aged out of memory count as acknowledged.
+func (am *alertManager) isAcknowledged(id uint64) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	i := am.find(id)
+	return i < 0 || am.alerts[i].State != AlertOpen
+}
+
+// parseAlertID reads the {id} route variable, answering 400 when invalid
+func parseAlertID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid alert id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// REST API: List alerts, optionally only those after ?since=<id> and in ?state=
+func (bm *BandwidthMonitor) handleGetAlerts(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeEncoded(w, r, bm.alerts.list(since, r.URL.Query().Get("state")))
+}
+
+// REST API: Get one alert
+func (bm *BandwidthMonitor) handleGetAlert(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseAlertID(w, r)
+	if !ok {
+		return
+	}
+	alert, found := bm.alerts.get(id)
+	if !found {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, alert)
+}
+
+// REST API: Change the state and/or assignee of an alert
+func (bm *BandwidthMonitor) handleUpdateAlert(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseAlertID(w, r)
+	if !ok {
+		return
+	}
+	var u AlertUpdate
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	alert, found, err := bm.alerts.update(id, u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !found {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, alert)
+}
+
+// REST API: Add a comment to an alert, by the signed-in user or API key
+func (bm *BandwidthMonitor) handleCommentAlert(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseAlertID(w, r)
+	if !ok {
+		return
+	}
+	var c AlertComment
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if c.Text == "" {
+		http.Error(w, "Comment text is required", http.StatusBadRequest)
+		return
+	}
+	// The author is whoever the request authenticated as, not what the
+	// body claims
+	p := principalOf(r)
+	c.Author = p.Name
+	if c.Author == "" {
+		c.Author = p.APIKey
+	}
+	alert, found := bm.alerts.comment(id, c)
+	if !found {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	writeEncodedStatus(w, r, http.StatusCreated, alert)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// authExempt are the paths under /api that take no credentials: the health
+// check for load balancers and container probes, the login, and the event
+// stream, which checks credentials itself since EventSource cannot send
+// headers
+var authExempt = map[string]bool{
+	"/api/health": true,
+	"/api/login":  true,
+	"/api/stream": true,
+}
+
+// apiKey is one -api-key; the name tells integrations apart in usage
+// metering
+type apiKey struct {
+	name string
+	key  string
+}
+
+// defaultAPIKeyName names a key given without one
+const defaultAPIKeyName = "default"
+
+// loadAPIKeys parses the -api-key value, comma-separated, or the lines of
+// -api-key-file so the keys stay out of the process list. Each entry is
+// "name:key" or a bare key.
+func loadAPIKeys(keys, file string) ([]apiKey, error) {
+	entries := strings.Split(keys, ",")
+	if file != "" {
+		if keys != "" {
+			return nil, fmt.Errorf("-api-key and -api-key-file are exclusive")
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		entries = strings.Split(string(data), "\n")
+	}
+	var result []apiKey
+	unnamed := 0
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" || strings.HasPrefix(e, "#") {
+			continue
+		}
+		name, key, ok := strings.Cut(e, ":")
+		if !ok {
+			unnamed++
+			name, key = defaultAPIKeyName, e
+			if unnamed > 1 {
+				name = fmt.Sprintf("%s-%d", defaultAPIKeyName, unnamed)
+			}
+		}
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if name == "" || key == "" {
+			return nil, fmt.Errorf("invalid API key entry %q", e)
+		}
+		for _, k := range result {
+			if k.name == name {
+				return nil, fmt.Errorf("API key name %q used twice", name)
+			}
+		}
+		result = append(result, apiKey{name: name, key: key})
+	}
+	if file != "" && len(result) == 0 {
+		return nil, fmt.Errorf("%s holds no key", file)
+	}
+	return result, nil
+}
+
+// matchAPIKey returns the name of the API key token is, or ""
+func (bm *BandwidthMonitor) matchAPIKey(token string) string {
+	for _, k := range bm.apiKeys {
+		if tokenMatches(token, k.key) {
+			return k.name
+		}
+	}
+	return ""
+}
+
+// tokenMatches compares a presented token with a configured one in constant
+// time; an unset token matches nothing
+func tokenMatches(token, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return auth[7:]
+	}
+	return ""
+}
+
+// requireAuth rejects /api and /metrics requests without the -api-key as
+// bearer token or a user session, once either is configured, and tells the
+// handlers who made the request. The WebSocket and event stream take their
+// credentials as ?token= instead (see authorized).
+func (bm *BandwidthMonitor) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bm.authRequired() {
+			next.ServeHTTP(w, withPrincipal(r, principal{Role: RoleAdmin}))
+			return
+		}
+		if p, ok := bm.identify(r); ok {
+			if p.APIKey != "" {
+				bm.apiUsage.request(p.APIKey, time.Now())
+			}
+			next.ServeHTTP(w, withPrincipal(r, p))
+			return
+		}
+		path := r.URL.Path
+		if authExempt[path] || (!strings.HasPrefix(path, "/api/") && path != "/metrics") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="lantt"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// APIKeyUsage is what one API key was used for since startup
+type APIKeyUsage struct {
+	Name        string    `json:"name"`
+	Requests    uint64    `json:"requests"` // REST API calls
+	LastUsed    time.Time `json:"lastUsed,omitempty"`
+	WSOpen      int       `json:"wsOpen"`  // WebSocket connections now open
+	WSTotal     uint64    `json:"wsTotal"` // WebSocket connections ever opened
+	WSMessages  uint64    `json:"wsMessages"`
+	WSBytesSent uint64    `json:"wsBytesSent"`
+}
+
+// apiUsage meters REST calls and WebSocket traffic per API key, so
+// operators can see which integration is hammering the monitor
+type apiUsage struct {
+	mu   sync.Mutex
+	keys map[string]*APIKeyUsage
+}
+
+// newAPIUsage creates a meter listing every configured key
+func newAPIUsage(keys []apiKey) *apiUsage {
+	u := &apiUsage{keys: make(map[string]*APIKeyUsage, len(keys))}
+	for _, k := range keys {
+		u.keys[k.name] = &APIKeyUsage{Name: k.name}
+	}
+	return u
+}
+
+// get returns the usage of key; caller holds u.mu
+func (u *apiUsage) get(key string) *APIKeyUsage {
+	ku, ok := u.keys[key]
+	if !ok {
+		ku = &APIKeyUsage{Name: key}
+		u.keys[key] = ku
+	}
+	return ku
+}
+
+// request counts a REST call made with key
+func (u *apiUsage) request(key string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ku := u.get(key)
+	ku.Requests++
+	ku.LastUsed = now
+}
+
+// wsOpened counts a WebSocket connection made with key
+func (u *apiUsage) wsOpened(key string, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ku := u.get(key)
+	ku.WSOpen++
+	ku.WSTotal++
+	ku.LastUsed = now
+}
+
+// wsClosed notes the end of a WebSocket connection made with key
+func (u *apiUsage) wsClosed(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.get(key).WSOpen--
+}
+
+// wsSent counts a message of n bytes sent to a WebSocket opened with key
+func (u *apiUsage) wsSent(key string, n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	ku := u.get(key)
+	ku.WSMessages++
+	ku.WSBytesSent += uint64(n)
+}
+
+// list returns the usage of every key, by name
+func (u *apiUsage) list() []APIKeyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	list := make([]APIKeyUsage, 0, len(u.keys))
+	for _, ku := range u.keys {
+		list = append(list, *ku)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// REST API: Calls and WebSocket traffic per API key since startup
+func (bm *BandwidthMonitor) handleGetAPIKeyUsage(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.apiUsage.list())
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -10,30 +9,100 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"sort"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
+	"google.golang.org/grpc"
 )
 
+// maxIPsPerDevice caps the addresses listed per device; IPv6 privacy
+// extensions rotate addresses, so a long-lived device accumulates many.
+var maxIPsPerDevice = 16
+
 // DeviceStats holds bandwidth statistics for a network device
 type DeviceStats struct {
 	MAC         string    `json:"mac"`
-	IP          string    `json:"ip"`
+	IP          string    `json:"ip"`  // primary address, IPv4 when known
+	IPs         []string  `json:"ips"` // every address seen, IPv4 and IPv6
 	BytesSent   uint64    `json:"bytesSent"`
 	BytesRecv   uint64    `json:"bytesRecv"`
+	RateSentBps float64   `json:"rateSentBps"` // bytes/s averaged over -rate-window
+	RateRecvBps float64   `json:"rateRecvBps"`
+	RecentBytes uint64    `json:"recentBytes"` // sent and received in the last minute
 	PacketsSent uint64    `json:"packetsSent"`
 	PacketsRecv uint64    `json:"packetsRecv"`
 	LastSeen    time.Time `json:"lastSeen"`
+	FirstSeen   time.Time `json:"firstSeen"` // start of this device's counters
+	Duration    float64   `json:"duration"`  // seconds the counters cover
 	Hostname    string    `json:"hostname"`
+	Label       string    `json:"label,omitempty"` // custom name (PUT /api/devices/{mac}/name)
+	// Make and model from the DHCP fingerprint (-fingerbank-key)
+	Classification *DeviceClass `json:"classification,omitempty"`
+	// Capture interfaces the device was seen on, and its 802.1Q VLAN (0 if untagged)
+	Interfaces []string `json:"interfaces,omitempty"`
+	VLAN       uint16   `json:"vlan,omitempty"`
+	// Tethering / connection-sharing detection
+	NATSuspected bool     `json:"natSuspected"`
+	NATSignals   []string `json:"natSignals,omitempty"`
+	// Traffic split by protocol (sent and received together)
+	Protocols ProtocolStats `json:"protocols"`
+	// Traffic that stayed on the LAN and that crossed to the internet
+	// (-lan-subnets; sent and received together)
+	LANBytes uint64 `json:"lanBytes"`
+	WANBytes uint64 `json:"wanBytes"`
+	// Composite risk score (0-100) and the contribution of each signal
+	RiskScore   float64            `json:"riskScore"`
+	RiskFactors map[string]float64 `json:"riskFactors,omitempty"`
+	// Queries the LAN's Pi-hole/AdGuard allowed and blocked (-dns-filter)
+	DNSAllowed uint64 `json:"dnsAllowed,omitempty"`
+	DNSBlocked uint64 `json:"dnsBlocked,omitempty"`
+	// Queries the resolver answered for the device over its last day
+	DNSQueriesToday uint64 `json:"dnsQueriesToday,omitempty"`
+
+	nat  *natTracker  // detector state, not serialized
+	rate *rateCounter // traffic per second, for RateSentBps/RateRecvBps
+}
+
+// ProtocolCounter counts the traffic of one protocol
+type ProtocolCounter struct {
+	Bytes   uint64 `json:"bytes"`
+	Packets uint64 `json:"packets"`
+}
+
+// ProtocolStats breaks a device's traffic down by protocol
+type ProtocolStats struct {
+	TCP   ProtocolCounter `json:"tcp"`
+	UDP   ProtocolCounter `json:"udp"`
+	ICMP  ProtocolCounter `json:"icmp"`
+	ARP   ProtocolCounter `json:"arp"`
+	Other ProtocolCounter `json:"other"`
+}
+
+// add counts traffic for the named protocol; unknown names count as other
+func (ps *ProtocolStats) add(protocol string, bytes, packets uint64) {
+	c := &ps.Other
+	switch protocol {
+	case "tcp":
+		c = &ps.TCP
+	case "udp":
+		c = &ps.UDP
+	case "icmp":
+		c = &ps.ICMP
+	case "arp":
+		c = &ps.ARP
+	}
+	c.Bytes += bytes
+	c.Packets += packets
 }
 
 // NetworkStats holds overall network statistics
@@ -43,96 +112,398 @@ type NetworkStats struct {
 	TotalRecv       uint64         `json:"totalRecv"`
 	TotalPackets    uint64         `json:"totalPackets"`
 	ActiveDevices   int            `json:"activeDevices"`
-	MonitorDuration float64        `json:"monitorDuration"` // seconds
+	MonitorDuration float64        `json:"monitorDuration"` // seconds since MeasurementStart
 	Timestamp       time.Time      `json:"timestamp"`
+	// Start of the measurement window the counters cover (startup or the
+	// last stats reset), and seconds since the monitor started
+	MeasurementStart time.Time `json:"measurementStart"`
+	Uptime           float64   `json:"uptime"`
+	// Traffic that could not be attributed to any device
+	UnattributedBytes   uint64 `json:"unattributedBytes"`
+	UnattributedPackets uint64 `json:"unattributedPackets"`
+	// Traffic per 802.1Q VLAN, when tagged frames were seen
+	VLANs []VLANStats `json:"vlans,omitempty"`
+	// Packets accounted 1 in SampleRate, with counters scaled up: above 1
+	// the numbers are estimates
+	SampleRate int `json:"sampleRate"`
+	// A newer release than the running one (-update-check)
+	NewVersion string `json:"newVersion,omitempty"`
+	// Devices left out of a top-N or paged update (counted in the totals),
+	// and the position of the first device listed in a page
+	DevicesOmitted int `json:"devicesOmitted,omitempty"`
+	Offset         int `json:"offset,omitempty"`
+	// Delta-mode WebSocket updates: "full" or "delta", and in a delta the
+	// keys of the devices no longer listed
+	Update  string   `json:"update,omitempty"`
+	Removed []string `json:"removed,omitempty"`
 }
 
 // BandwidthMonitor manages bandwidth statistics for multiple devices
 type BandwidthMonitor struct {
-	devices   map[string]*DeviceStats
+	devices   *deviceTable // lock-striped; see deviceTable for the locking
 	mutex     sync.RWMutex
 	localIP   string
-	startTime time.Time
+	startTime time.Time // process start
+	// Start of the current measurement window, moved by ResetStats
+	measurementStart time.Time
 	// WebSocket clients
-	clients   map[*websocket.Conn]bool
+	clients   map[*websocket.Conn]*wsClient
 	clientsMu sync.RWMutex
-	// Channel for broadcasting updates
+	// Channels for broadcasting updates and events (alerts, flows)
 	broadcast chan *NetworkStats
-}
-
-// WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins in development
-	},
+	events    chan *WSEvent
+	// Server-Sent Events streams of the broadcast stats
+	streams *sseHub
+	// Confirmation tokens for disruptive actions
+	actions *actionGuard
+	// Capture interfaces, fixed once capture starts
+	captures []captureSource
+	// Live capture handles by interface and the BPF filter they share
+	captureMu      sync.Mutex
+	captureHandles map[string]*pcap.Handle
+	captureFilter  string
+	// Paused packet accounting (POST /api/capture/pause)
+	pause *capturePause
+	// Per-device service level objectives
+	slo *sloTracker
+	// Raised alerts and their escalation policies (nil without -escalation-file)
+	alerts      *alertManager
+	escalations *escalator
+	// Alert-triggered traffic shaping (nil without -shaping-file)
+	shaping *shaper
+	// Payload signature rules (nil without -signatures-file)
+	signatures *signatureMatcher
+	// Blocked versus allowed queries from Pi-hole/AdGuard (nil without -dns-filter)
+	dnsFilter *dnsFilterStats
+	// Expected-traffic rules for always-on devices
+	heartbeats *heartbeatMonitor
+	// Per-device daily/weekly traffic quotas
+	quotas *quotaMonitor
+	// NetFlow/sFlow ingestion (nil without -netflow-listen or -sflow-listen)
+	collector *flowCollector
+	// Build features of this instance (GET /api/version)
+	features Features
+	// Upload/download asymmetry alerts (nil without -asymmetry-ratio)
+	asymmetry *asymmetryMonitor
+	// Release checks (nil without -update-check or in development builds)
+	updates *updateChecker
+	// Device keying: AccountingMAC or AccountingIP
+	accounting string
+	// Scheduled capture profiles and the packet counter used for sampling
+	profiles      *profileManager
+	sampleCounter atomic.Uint64
+	// Report and notification templates
+	templates *templateRenderer
+	// Per-device destination sets for new-destination alerts
+	newDest *newDestTracker
+	// Recent DNS queries and TLS server names per device (see CaptureProfile)
+	domains *domainLog
+	// Optional AS database and per-device traffic by AS
+	asnDB    *asnDB
+	asnUsage *asnUsage
+	geoDB    *geoDB
+	geoUsage *geoUsage
+	// Subnets whose traffic counts as local (LANBytes) rather than internet
+	lan *lanNetworks
+	// Per-device risk signals
+	risk *riskTracker
+	// Per-device traffic by service port
+	ports *portUsage
+	// WebSocket upgrader, its origin allowlist and the optional auth token
+	upgrader  websocket.Upgrader
+	wsOrigins []string
+	authToken string
+	// Optional keys required on the REST API, /metrics and the WebSocket,
+	// and what each was used for
+	apiKeys  []apiKey
+	apiUsage *apiUsage
+	// User accounts and sessions; without accounts the API needs no login
+	users *userStore
+	// Memory bounds and eviction policy (-profile)
+	resources resourceProfile
+	// Devices evicted for inactivity (GET /api/devices/archived)
+	archive *deviceArchive
+	// Devices evicted by -device-ttl and -max-devices since startup
+	devicesEvicted uint64
+	// Device order of stats and broadcasts (-sort), kept from one snapshot
+	// to the next
+	sortKeys []string
+	order    *deviceOrder
+	// Per-address REST API rate limit (nil when off) and WebSocket caps
+	limiter      *rateLimiter
+	maxWSClients int
+	maxWSPerIP   int
+	// Hot standby: the replication role and how often followers are updated
+	replication         *replication
+	replicationInterval time.Duration
+	// Runtime configuration reload (SIGHUP, POST /api/admin/reload)
+	reloader *reloader
+	// Optional persistence backend (nil without -store)
+	store Store
+	// Custom device names
+	labels *labelStore
+	// Devices merged into others (POST /api/devices/merge)
+	merges *mergeStore
+	// Logical devices grouping several device identities
+	logical *logicalStore
+	// Optional Web Push delivery of alerts (nil when not configured)
+	push *pushNotifier
+	// Saved dashboard views
+	views *viewStore
+	// Device names learned from mDNS, LLMNR and NetBIOS
+	names *nameDiscovery
+	// Optional per-minute traffic history in SQLite (nil without -history-db)
+	series *seriesDB
+	// Per-device traffic history in historyStep buckets
+	history *deviceHistory
+	// Passive TCP handshake RTTs in historyStep buckets
+	latency *latencyTracker
+	// File and print service usage per client-server pair
+	services *serviceUsage
+	// Open flows and recently closed flow records
+	flows *flowTable
+	// Packets captured but not yet accounted (see runAccounting)
+	statsQueue *statsQueue
+	// Counter resets, against which queued packets are checked
+	resets resetLog
+	// Per-VLAN totals
+	vlans  map[uint16]*VLANStats
+	vlanMu sync.Mutex
+	// Per-device traffic of the last hour, for top talkers
+	activity *recentActivity
+	// Per-device service-discovery chatter
+	discovery *discoveryUsage
+	// MACs that forward internet traffic onto the LAN, excluded from
+	// tethering detection (see ObserveHostSignals)
+	gateways sync.Map
+	// Senders of IPv6 router advertisements
+	routerAdverts *routerAdvertTracker
+	// Optional DHCP fingerprint classification (nil without -fingerbank-key)
+	fingerbank *fingerbankClassifier
+	// Hourly self-metrics for long-running stability checks
+	soak *soakRecorder
+	// Packets without any usable address
+	unattributedBytes   atomic.Uint64
+	unattributedPackets atomic.Uint64
 }
 
 // NewBandwidthMonitor creates a new BandwidthMonitor instance
 func NewBandwidthMonitor(localIP string) *BandwidthMonitor {
+	// Built-in profiles only; cannot fail
+	profiles, _ := newProfileManager("")
+
 	// Initialize the BandwidthMonitor
-	return &BandwidthMonitor{
-		devices:   make(map[string]*DeviceStats),
-		localIP:   localIP,
-		startTime: time.Now(),
-		clients:   make(map[*websocket.Conn]bool),
-		broadcast: make(chan *NetworkStats, 256),
+	bm := &BandwidthMonitor{
+		devices:        newDeviceTable(),
+		localIP:        localIP,
+		startTime:      time.Now(),
+		clients:        make(map[*websocket.Conn]*wsClient),
+		broadcast:      make(chan *NetworkStats, 256),
+		events:         make(chan *WSEvent, 256),
+		streams:        newSSEHub(),
+		actions:        newActionGuard(),
+		captureHandles: make(map[string]*pcap.Handle),
+		pause:          newCapturePause(),
+		resources:      resourceProfiles["default"],
+		archive:        newDeviceArchive(defaultDeviceArchive),
+		sortKeys:       []string{SortBytes},
+		order:          newDeviceOrder(),
+		vlans:          make(map[uint16]*VLANStats),
+		slo:            newSLOTracker(nil),
+		alerts:         newAlertManager(),
+		heartbeats:     newHeartbeatMonitor(nil),
+		quotas:         newQuotaMonitor(nil),
+		profiles:       profiles,
+		accounting:     AccountingMAC,
+		templates:      newTemplateRenderer("", ""),
+		newDest:        newNewDestTracker(24 * time.Hour),
+		domains:        newDomainLog(),
+		asnUsage:       newASNUsage(),
+		geoUsage:       newGeoUsage(),
+		risk:           newRiskTracker(),
+		ports:          newPortUsage(),
+		discovery:      newDiscoveryUsage(),
+		labels:         newLabelStore(nil),
+		merges:         newMergeStore(nil),
+		logical:        newLogicalStore(nil),
+		users:          newUserStore(nil),
+		apiUsage:       newAPIUsage(nil),
+		replication:    newReplication("", 0),
+		views:          newViewStore(nil),
+		names:          newNameDiscovery(),
+		history:        newDeviceHistory(),
+		latency:        newLatencyTracker(),
+		services:       newServiceUsage(),
+		activity:       newRecentActivity(),
+		flows:          newFlowTable(30*time.Minute, time.Minute),
+		routerAdverts:  newRouterAdvertTracker(nil, 10*time.Minute, time.Now()),
+		soak:           newSoakRecorder(nil),
 	}
+	bm.measurementStart = bm.startTime
+	bm.statsQueue = newStatsQueue(&bm.resets)
+	bm.upgrader = websocket.Upgrader{
+		HandshakeTimeout: wsHandshakeTimeout,
+		CheckOrigin:      bm.checkOrigin,
+	}
+	return bm
 }
 
 // UpdateStats updates the statistics for a device based on a captured packet
 // Keying strategy: prefer MAC; if MAC empty use IP so we don't lose devices that only show IP.
 func (bm *BandwidthMonitor) UpdateStats(srcMAC, dstMAC, srcIP, dstIP string, packetSize uint64) {
-	// Lock for writing
-	bm.mutex.Lock()
-	defer bm.mutex.Unlock()
+	bm.UpdateStatsWeighted("", srcMAC, dstMAC, srcIP, dstIP, "other", packetSize, 1)
+}
+
+// UpdateStatsWeighted is UpdateStats for a packet of the given protocol,
+// seen on capture interface iface (empty if unknown), that stands for
+// `packets` packets totalling packetSize bytes, as used by sampling.
+func (bm *BandwidthMonitor) UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, protocol string, packetSize, packets uint64) {
 	// Current timestamp
 	now := time.Now()
+	bm.makeRoomIfFull(now)
+	// Lock the table shared; each device is updated under its shard's lock
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	bm.account(now, statsKey{iface, srcMAC, dstMAC, srcIP, dstIP, protocol}, packetSize, packets, nil)
+}
+
+// makeRoomIfFull evicts devices when the table is at the device cap.
+// Eviction needs the whole table, so room is made before taking the shared
+// lock.
+func (bm *BandwidthMonitor) makeRoomIfFull(now time.Time) {
+	if limit := bm.resources.maxDevices; limit > 0 && bm.devices.len() >= limit {
+		bm.mutex.Lock()
+		bm.makeRoomForDevice(now)
+		bm.mutex.Unlock()
+	}
+}
+
+// account adds packets to the devices at both ends, skipping the devices
+// stale reports (when set); caller holds bm.mutex shared
+func (bm *BandwidthMonitor) account(now time.Time, k statsKey, packetSize, packets uint64, stale func(key string) bool) {
+	iface, srcMAC, dstMAC, srcIP, dstIP, protocol := k.iface, k.srcMAC, k.dstMAC, k.srcIP, k.dstIP, k.protocol
+	local := bm.lan.isLocalTraffic(srcIP, dstIP)
 
 	// Helper to update a device by key
 	update := func(key, mac, ip string, sent bool, size uint64) {
 		if key == "" {
 			return
 		}
-		if _, exists := bm.devices[key]; !exists {
-			bm.devices[key] = &DeviceStats{
-				MAC: mac,
-				IP:  ip,
+		key = bm.merges.resolve(key)
+		if stale != nil && stale(key) {
+			return
+		}
+		shard := bm.devices.shard(key)
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+		dev, exists := bm.devices.get(key)
+		if !exists {
+			dev = &DeviceStats{
+				MAC:       mac,
+				IP:        ip,
+				Label:     bm.labels.get(key),
+				FirstSeen: now,
+				rate:      &rateCounter{},
 			}
+			bm.devices.set(key, dev)
 		}
-		dev := bm.devices[key]
 		if sent {
 			dev.BytesSent += size
-			dev.PacketsSent++
+			dev.PacketsSent += packets
 		} else {
 			dev.BytesRecv += size
-			dev.PacketsRecv++
+			dev.PacketsRecv += packets
+		}
+		dev.Protocols.add(protocol, size, packets)
+		if local {
+			dev.LANBytes += size
+		} else {
+			dev.WANBytes += size
 		}
+		dev.rate.add(now, size, sent)
 		dev.LastSeen = now
-		// prefer storing IP if not present
-		if dev.IP == "" && ip != "" {
+		// prefer storing IP if not present; an IPv4 address replaces an
+		// IPv6 one since IPv4 is what the device filter and clients expect
+		if ip != "" && (dev.IP == "" || (strings.Contains(dev.IP, ":") && !strings.Contains(ip, ":"))) {
 			dev.IP = ip
 		}
+		if ip != "" && len(dev.IPs) < maxIPsPerDevice && bm.deviceAddress(ip, sent) && !containsString(dev.IPs, ip) {
+			dev.IPs = append(dev.IPs, ip)
+		}
+		if iface != "" && !containsString(dev.Interfaces, iface) {
+			dev.Interfaces = append(dev.Interfaces, iface)
+		}
 		// prefer storing MAC if not present
 		if dev.MAC == "" && mac != "" {
 			dev.MAC = mac
 		}
 	}
 
+	// Loopback and some tunnels carry all-zero MACs; treat them as absent
+	// so every endpoint isn't merged into one "00:00:00:00:00:00" device.
+	if srcMAC == zeroMAC {
+		srcMAC = ""
+	}
+	if dstMAC == zeroMAC {
+		dstMAC = ""
+	}
+	byIP := bm.accounting == AccountingIP
+
 	// Update source device: prefer MAC key else IP key
-	if srcMAC != "" && srcMAC != "ff:ff:ff:ff:ff:ff" {
+	if !byIP && srcMAC != "" && srcMAC != "ff:ff:ff:ff:ff:ff" {
 		update(srcMAC, srcMAC, srcIP, true, packetSize)
 	} else if srcIP != "" {
 		update(srcIP, srcMAC, srcIP, true, packetSize)
 	}
 
 	// Update destination device
-	if dstMAC != "" && dstMAC != "ff:ff:ff:ff:ff:ff" {
+	if !byIP && dstMAC != "" && dstMAC != "ff:ff:ff:ff:ff:ff" {
 		update(dstMAC, dstMAC, dstIP, false, packetSize)
 	} else if dstIP != "" {
 		update(dstIP, dstMAC, dstIP, false, packetSize)
 	}
 }
 
+// deviceAddress reports whether ip, seen on the sent or received side of a
+// MAC-keyed device, is one of its own addresses. Gateways also carry
+// internet traffic, so public IPv4 is never listed and global IPv6 only
+// when the device sent from it.
+func (bm *BandwidthMonitor) deviceAddress(ip string, sent bool) bool {
+	if bm.accounting == AccountingIP {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLoopback() {
+		return true
+	}
+	return sent && addr.To4() == nil && addr.IsGlobalUnicast()
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceKey returns the key a device with these addresses is stored under,
+// following the same rules as UpdateStats.
+func (bm *BandwidthMonitor) deviceKey(mac, ip string) string {
+	if mac == zeroMAC {
+		mac = ""
+	}
+	if bm.accounting != AccountingIP && mac != "" && mac != "ff:ff:ff:ff:ff:ff" {
+		return bm.merges.resolve(mac)
+	}
+	return bm.merges.resolve(ip)
+}
+
 // Replace the existing GetNetworkStats with this filtered version.
 // Also make sure "strings" is present in the import list at the top: "strings"
 func (bm *BandwidthMonitor) GetNetworkStats() *NetworkStats {
@@ -140,31 +511,34 @@ func (bm *BandwidthMonitor) GetNetworkStats() *NetworkStats {
 	bm.mutex.RLock()
 	defer bm.mutex.RUnlock()
 
-	// Prepare device stats slice
-	devices := make([]*DeviceStats, 0, len(bm.devices))
+	// Copies are made into one slab rather than one allocation per device
+	copies := make([]DeviceStats, 0, bm.devices.len())
+	keys := make([]string, 0, bm.devices.len())
 	// Aggregate totals
 	var totalSent, totalRecv, totalPackets uint64
 
 	// Copy device stats to avoid race conditions and FILTER to internal 192.168.* IPs
-	for _, dev := range bm.devices {
-		// Only include devices that have an IP starting with 192.168.
-		// Devices without an IP (or with IPs outside 192.168.*) are ignored.
-		if dev.IP == "" || !strings.HasPrefix(dev.IP, "192.168.") {
-			continue
+	now := time.Now()
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		// Only include internal devices (see includeDevice)
+		if !bm.includeDevice(dev) {
+			return
 		}
-		devCopy := *dev
-		devices = append(devices, &devCopy)
+		copies = append(copies, *dev)
+		copies[len(copies)-1].fillWindow(now)
+		keys = append(keys, key)
 		totalSent += dev.BytesSent
 		totalRecv += dev.BytesRecv
 		totalPackets += dev.PacketsSent + dev.PacketsRecv
+	})
+	devices := make([]*DeviceStats, len(copies))
+	for i := range copies {
+		devices[i] = &copies[i]
 	}
 
-	// Sort by total bandwidth (descending)
-	sort.Slice(devices, func(i, j int) bool {
-		totalI := devices[i].BytesSent + devices[i].BytesRecv
-		totalJ := devices[j].BytesSent + devices[j].BytesRecv
-		return totalI > totalJ
-	})
+	// Sort by the configured keys (-sort, busiest first by default),
+	// starting from the previous snapshot's order
+	bm.order.sort(devices, keys, bm.sortKeys)
 
 	// Return filtered network stats
 	return &NetworkStats{
@@ -173,15 +547,42 @@ func (bm *BandwidthMonitor) GetNetworkStats() *NetworkStats {
 		TotalRecv:       totalRecv,
 		TotalPackets:    totalPackets,
 		ActiveDevices:   len(devices),
-		MonitorDuration: time.Since(bm.startTime).Seconds(),
-		Timestamp:       time.Now(),
+		MonitorDuration: now.Sub(bm.measurementStart).Seconds(),
+		Timestamp:       now,
+
+		MeasurementStart: bm.measurementStart,
+		Uptime:           now.Sub(bm.startTime).Seconds(),
+
+		UnattributedBytes:   bm.unattributedBytes.Load(),
+		UnattributedPackets: bm.unattributedPackets.Load(),
+		VLANs:               bm.vlanTotals(devices),
+
+		SampleRate: bm.profiles.current().SampleRate,
+		NewVersion: bm.updates.available(),
 	}
 }
 
 // WebSocket handler
 func (bm *BandwidthMonitor) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Upgrade HTTP connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Refuse the upgrade without the auth token
+	if !bm.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Rates as the client asked for them (?smoothing=, see rateSmoothing)
+	smoothing, err := parseSmoothing(r.URL.Query().Get("smoothing"))
+	if err != nil {
+		http.Error(w, "Invalid smoothing parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Refuse clients beyond the connection caps
+	if !bm.wsAdmit(r.RemoteAddr) {
+		log.Printf("WebSocket connection from %s refused: too many clients", r.RemoteAddr)
+		http.Error(w, "Too many WebSocket connections", http.StatusServiceUnavailable)
+		return
+	}
+	// Upgrade HTTP connection to WebSocket; the upgrader checks the Origin
+	conn, err := bm.upgrader.Upgrade(w, r, nil)
 	// Handle upgrade error
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -190,9 +591,22 @@ func (bm *BandwidthMonitor) handleWebSocket(w http.ResponseWriter, r *http.Reque
 	// Ensure connection is closed on exit
 	defer conn.Close()
 
-	// Register client
+	// Register client with the encoding it asked for; its write pump does
+	// all writes, so a stalled client cannot block the broadcaster
+	codec := negotiateCodec(r)
+	client := newWSClient(conn, r.RemoteAddr, codec)
+	client.delta = r.URL.Query().Get("mode") == "delta"
+	client.smoothing = smoothing
+	if client.apiKey = bm.matchAPIKey(requestToken(r)); client.apiKey != "" {
+		client.usage = bm.apiUsage
+		bm.apiUsage.wsOpened(client.apiKey, time.Now())
+		defer bm.apiUsage.wsClosed(client.apiKey)
+	}
+	client.keepAlive()
+	go client.writePump()
+	defer close(client.done)
 	bm.clientsMu.Lock()
-	bm.clients[conn] = true
+	bm.clients[conn] = client
 	bm.clientsMu.Unlock()
 
 	// Log connection
@@ -200,47 +614,148 @@ func (bm *BandwidthMonitor) handleWebSocket(w http.ResponseWriter, r *http.Reque
 
 	// Send initial data
 	stats := bm.GetNetworkStats()
-	if err := conn.WriteJSON(stats); err != nil {
+	if err := client.send(client.statsFor(bm, stats, bm.topStats(stats))); err != nil {
 		log.Printf("Error sending initial data: %v", err)
 	}
 
-	// Keep connection alive and handle disconnection
+	// Handle subscription requests until disconnection; the read fails once
+	// pongs stop coming in (see keepAlive)
 	for {
-		if _, _, err := conn.ReadMessage(); err != nil {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
 			bm.clientsMu.Lock()
 			delete(bm.clients, conn)
 			bm.clientsMu.Unlock()
 			log.Printf("WebSocket client disconnected from %s. Total clients: %d", r.RemoteAddr, len(bm.clients))
 			break
 		}
+		reply := client.handleRequest(data)
+		if err := client.send(reply); err != nil {
+			log.Printf("Error replying to client: %v", err)
+			continue
+		}
+		// Catch the client up with its new subscription or smoothing
+		if reply.Type == EventSubscribed || reply.Type == EventSmoothing || reply.Type == EventPage {
+			stats := bm.GetNetworkStats()
+			if update := client.statsFor(bm, stats, bm.topStats(stats)); update != nil {
+				if err := client.send(update); err != nil {
+					log.Printf("Error sending subscribed data: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// topStats limits stats to the busiest devices under the resource profile's
+// broadcastTopN, and at most maxBroadcastDevices; devices are sorted in the
+// -sort order, so top N is a prefix
+func (bm *BandwidthMonitor) topStats(stats *NetworkStats) *NetworkStats {
+	n := bm.resources.broadcastTopN
+	if n <= 0 || n > maxBroadcastDevices {
+		n = maxBroadcastDevices
+	}
+	return stats.page(0, n)
+}
+
+// page returns stats listing limit devices from offset, stats itself when
+// that is all of them
+func (s *NetworkStats) page(offset, limit int) *NetworkStats {
+	if offset == 0 && len(s.Devices) <= limit {
+		return s
 	}
+	page := *s
+	offset = min(offset, len(s.Devices))
+	page.Devices = s.Devices[offset:min(offset+limit, len(s.Devices))]
+	page.Offset = offset
+	page.DevicesOmitted = len(s.Devices) - len(page.Devices)
+	return &page
 }
 
-// Broadcast stats to all WebSocket clients
+// Broadcast stats and events to WebSocket clients
 func (bm *BandwidthMonitor) broadcastStats() {
-	// Listen for stats to broadcast
-	for stats := range bm.broadcast {
-		bm.clientsMu.RLock()
-		for client := range bm.clients {
-			if err := client.WriteJSON(stats); err != nil {
-				log.Printf("Error broadcasting to client: %v", err)
-				client.Close()
-				bm.clientsMu.RUnlock()
-				bm.clientsMu.Lock()
-				delete(bm.clients, client)
-				bm.clientsMu.Unlock()
-				bm.clientsMu.RLock()
+	for {
+		select {
+		case stats := <-bm.broadcast:
+			bm.broadcastUpdate(stats)
+		case e := <-bm.events:
+			bm.broadcastEvent(e)
+		}
+	}
+}
+
+// broadcastUpdate sends each client its subscribed part of stats
+func (bm *BandwidthMonitor) broadcastUpdate(stats *NetworkStats) {
+	top := bm.topStats(stats)
+	// Encode the shared top-N update once per codec rather than once per
+	// client; other subscriptions and delta-mode clients get their own
+	encoded := make(map[string][]byte)
+	for _, meta := range bm.clientList() {
+		update := meta.statsFor(bm, stats, top)
+		if update == nil {
+			continue
+		}
+		data, ok := encoded[meta.codec.Name()]
+		if !ok || update != top {
+			var err error
+			if data, err = meta.codec.Marshal(update); err != nil {
+				log.Printf("Error encoding stats as %s: %v", meta.codec.Name(), err)
+				continue
+			}
+			if update == top {
+				encoded[meta.codec.Name()] = data
 			}
 		}
-		bm.clientsMu.RUnlock()
+		meta.queue(data, stats.Timestamp)
 	}
+	bm.publishStream(top)
 }
 
-// REST API: Get current stats
+// clientList returns the connected clients. Broadcasts encode outside
+// clientsMu, so a panicking encoder cannot leave it locked.
+func (bm *BandwidthMonitor) clientList() []*wsClient {
+	bm.clientsMu.RLock()
+	defer bm.clientsMu.RUnlock()
+	clients := make([]*wsClient, 0, len(bm.clients))
+	for _, meta := range bm.clients {
+		clients = append(clients, meta)
+	}
+	return clients
+}
+
+// REST API: Get current stats (?sort=rate,name overrides the -sort order;
+// ?offset= and ?limit= page through the devices)
 func (bm *BandwidthMonitor) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	offset, limit := 0, 0
+	if s := r.URL.Query().Get("offset"); s != "" {
+		var err error
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			http.Error(w, "Invalid offset parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
 	stats := bm.GetNetworkStats()
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	if by := r.URL.Query().Get("sort"); by != "" {
+		keys, err := parseSortKeys(by)
+		if err != nil {
+			http.Error(w, "Invalid sort parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sortDevices(stats.Devices, keys)
+	}
+	if offset > 0 || limit > 0 {
+		if limit == 0 {
+			limit = len(stats.Devices)
+		}
+		stats = stats.page(offset, limit)
+	}
+	writeEncoded(w, r, stats)
 }
 
 // REST API: Get specific device stats
@@ -249,7 +764,7 @@ func (bm *BandwidthMonitor) handleGetDevice(w http.ResponseWriter, r *http.Reque
 	mac := vars["mac"]
 
 	bm.mutex.RLock()
-	device, exists := bm.devices[mac]
+	devCopy, exists := bm.devices.load(mac, time.Now())
 	bm.mutex.RUnlock()
 
 	if !exists {
@@ -257,14 +772,37 @@ func (bm *BandwidthMonitor) handleGetDevice(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(device)
+	writeEncoded(w, r, devCopy)
+}
+
+// HealthStatus is the /api/health response
+type HealthStatus struct {
+	Status string        `json:"status"`
+	Update *UpdateStatus `json:"update,omitempty"` // with -update-check
 }
 
 // REST API: Health check
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+func (bm *BandwidthMonitor) handleHealth(w http.ResponseWriter, r *http.Request) {
+	health := HealthStatus{Status: "ok"}
+	if bm.updates != nil {
+		update := bm.updates.current()
+		health.Update = &update
+	}
+	writeEncoded(w, r, health)
+}
+
+// stringList is a flag that may be repeated or given comma-separated values
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" && !containsString(*l, item) {
+			*l = append(*l, item)
+		}
+	}
+	return nil
 }
 
 // getLocalIP retrieves the local IP address of the machine
@@ -281,57 +819,186 @@ func getLocalIP(deviceName string, devices []pcap.Interface) string {
 	return ""
 }
 
-// resolveHostnamesPeriodically resolves hostnames for known device IPs and fills DeviceStats.Hostname.
-// It will attempt reverse DNS lookup (LookupAddr) and set Hostname when available.
-func (bm *BandwidthMonitor) resolveHostnamesPeriodically(interval time.Duration, stop <-chan struct{}) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-stop:
-			return
-		case <-ticker.C:
-			// Copy keys to avoid holding lock during network calls
-			bm.mutex.RLock()
-			ips := make(map[string]string) // key -> ip
-			for key, dev := range bm.devices {
-				if dev.IP != "" && dev.Hostname == "" {
-					ips[key] = dev.IP
-				}
+// selectDevices returns the capture interfaces, the first one with an
+// address when none are named, and the local IP. "-device none" captures
+// nothing, for a pure flow collector.
+func selectDevices(names stringList, devices []pcap.Interface) (stringList, string) {
+	var localIP string
+	if len(names) == 1 && names[0] == "none" {
+		for _, dev := range devices {
+			if dev.Name != "lo" && len(dev.Addresses) > 0 {
+				return nil, dev.Addresses[0].IP.String()
 			}
-			bm.mutex.RUnlock()
-
-			for key, ip := range ips {
-				names, err := net.LookupAddr(ip)
-				if err != nil || len(names) == 0 {
-					// no reverse DNS found; skip
-					continue
-				}
-				// Use first name, trim trailing dot
-				name := names[0]
-				if len(name) > 0 && name[len(name)-1] == '.' {
-					name = name[:len(name)-1]
-				}
-				// update device
-				bm.mutex.Lock()
-				if dev, ok := bm.devices[key]; ok {
-					dev.Hostname = name
-				}
-				bm.mutex.Unlock()
+		}
+		return nil, ""
+	}
+	if len(names) == 0 {
+		for _, dev := range devices {
+			if dev.Name != "lo" && len(dev.Addresses) > 0 {
+				names = append(names, dev.Name)
+				localIP = dev.Addresses[0].IP.String()
+				break
 			}
 		}
+		if len(names) == 0 {
+			names = append(names, devices[0].Name)
+		}
+	}
+
+	// Get local IP if not set
+	if localIP == "" {
+		localIP = getLocalIP(names[0], devices)
 	}
+	return names, localIP
 }
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		os.Exit(runTop(os.Args[2:]))
+	}
+
 	// Command-line flags
-	devicePtr := flag.String("device", "", "Network device to monitor")
+	var deviceNames stringList
+	flag.Var(&deviceNames, "device", "Network device to monitor; comma-separated or repeated for several (e.g. eth0,wlan0); none with -netflow-listen or -sflow-listen only collects flows")
+	var lanSubnets stringList
+	flag.Var(&lanSubnets, "lan-subnets", "Subnets whose traffic counts as LAN rather than internet; comma-separated or repeated CIDRs (default: the networks of the capture interfaces)")
 	hostPtr := flag.String("host", "0.0.0.0", "Host address to bind (0.0.0.0 for all interfaces)")
 	portPtr := flag.String("port", "8080", "HTTP server port")
 	intervalPtr := flag.Int("interval", 2, "Broadcast interval in seconds")
 	listPtr := flag.Bool("list", false, "List available devices and exit")
+	versionPtr := flag.Bool("version", false, "Print the version and exit")
+	filterPtr := flag.String("filter", "", "BPF capture filter, e.g. \"net 192.168.1.0/24\" or \"not port 22\"")
+	sloFilePtr := flag.String("slo-file", "", "JSON file holding per-device SLO objectives (created on first change)")
+	asymmetryRatioPtr := flag.Float64("asymmetry-ratio", 0, "Alert when a device uploads more than this multiple of what it downloads over -asymmetry-window, e.g. 10 (0 disables)")
+	asymmetryWindowPtr := flag.Duration("asymmetry-window", time.Hour, "Sliding window of the -asymmetry-ratio check")
+	asymmetryMinPtr := flag.Int64("asymmetry-min-upload", 100, "Upload in MB within -asymmetry-window below which a device is never asymmetric")
+	heartbeatFilePtr := flag.String("heartbeat-file", "", "JSON file holding heartbeat-silence rules (created on first change)")
+	quotaFilePtr := flag.String("quota-file", "", "JSON file holding per-device daily/weekly traffic quotas raising quota alerts (created on first change)")
+	labelsFilePtr := flag.String("labels-file", "", "JSON file holding custom device names (created on first change)")
+	mergesFilePtr := flag.String("merges-file", "", "JSON file holding device merges (created on first merge)")
+	logicalFilePtr := flag.String("logical-file", "", "JSON file holding logical devices (created on first change)")
+	viewsFilePtr := flag.String("views-file", "", "JSON file holding saved dashboard views (created on first change)")
+	accountingPtr := flag.String("accounting", "auto", "Device keying: mac, ip, or auto (ip on loopback/tunnel interfaces)")
+	dataDirPtr := flag.String("data-dir", "", "Directory for user data such as template and locale overrides (templates/*.tmpl, locales/<locale>.json)")
+	localePtr := flag.String("locale", os.Getenv("LANG"), "Locale for number and date formatting in reports (e.g. de-DE)")
+	newDestLearningPtr := flag.Duration("new-dest-learning", 24*time.Hour, "How long a device's destinations are learned before new ones raise alerts")
+	asnDBPtr := flag.String("asn-db", "", "AS database in iptoasn.com TSV format (optionally .gz) for labeling internet peers")
+	geoIPDBPtr := flag.String("geoip-db", "", "MaxMind GeoLite2/GeoIP2 Country or City database (.mmdb) for locating internet peers")
+	blocklistPtr := flag.String("blocklist", "", "File of blocklisted IPs/CIDRs (one per line) used in device risk scoring")
+	profilesFilePtr := flag.String("profiles-file", "", "JSON file defining capture profiles and their cron schedule")
+	sampleRatePtr := flag.Int("sample-rate", 0, "Account only 1 in N packets, scaling counters by N, to save CPU on busy links (0 = the capture profile's; 1 = every packet)")
+	wsOriginsPtr := flag.String("ws-origins", "", "Comma-separated origins allowed to open the WebSocket, e.g. \"https://lan.example\" (default: same host; * allows any)")
+	authTokenPtr := flag.String("auth-token", "", "Token required on the WebSocket upgrade (?token= or Authorization: Bearer)")
+	writePcapPtr := flag.String("write-pcap", "", "Also write captured packets to this pcap file, rotated to .1, .2, ...")
+	pcapMaxSizePtr := flag.Int64("pcap-max-size", 100, "Size in MB at which the -write-pcap file is rotated")
+	pcapMaxFilesPtr := flag.Int("pcap-max-files", 10, "Number of -write-pcap files kept, including the current one")
+	fanoutPtr := flag.Int("fanout", 1, "Capture workers per interface (Linux AF_PACKET fanout by flow hash; 1 = single pcap handle)")
+	snaplenPtr := flag.Int("snaplen", defaultSnaplen, "Bytes captured per packet (headers plus the start of the payload)")
+	promiscPtr := flag.Bool("promisc", true, "Put capture interfaces in promiscuous mode (-promisc=false sees only the host's own and broadcast traffic)")
+	pcapBufferPtr := flag.Int("pcap-buffer", 0, "Kernel capture buffer per interface in MB, raised against drops on busy links (0 = libpcap default, 2 MB on Linux)")
+	pcapTimeoutPtr := flag.Duration("pcap-timeout", captureReadTimeout, "How long a capture read waits to batch packets before returning; also how quickly capture notices stop and restart")
+	captureEnginePtr := flag.String("capture-engine", CaptureEnginePcap, "Packet capture engine: pcap (libpcap) or afpacket (Linux TPACKETv3 rings, for multi-gigabit mirror ports; implied by -fanout > 1)")
+	ebpfPtr := flag.String("ebpf", "", "Count bytes in the kernel with eBPF on Linux: xdp (received traffic, e.g. a mirror port) or tc (both directions, Linux 6.6+); only -ebpf-sample packets reach userspace")
+	ebpfSamplePtr := flag.Int("ebpf-sample", 100, "With -ebpf, pass 1 in N packets to userspace for addresses, protocols and detectors")
+	resourcePtr := flag.String("profile", "default", "Resource profile: default, low-memory for Raspberry Pi class hardware (sampling, short retention, top-N updates, device eviction), or campus for 100k+ devices (small per-device breakdowns, top-N updates, idle eviction)")
+	encryptionKeyPtr := flag.String("encryption-key", "", "256-bit key (64 hex digits or base64) encrypting persisted state at rest: the -store, -*-file documents, the -history-db minutes and the -journal (default $LANTT_ENCRYPTION_KEY)")
+	encryptionKeyFilePtr := flag.String("encryption-key-file", "", "File holding the -encryption-key, e.g. created with: openssl rand -hex 32 > key")
+	storePtr := flag.String("store", "", "Persistence backend for runtime state: json, bolt or sqlite (default: only the -*-file flags persist)")
+	storePathPtr := flag.String("store-path", "", "Location of the -store database (default: under -data-dir)")
+	rdnsRatePtr := flag.Float64("rdns-rate", 5, "Reverse DNS lookups per second for device hostnames (0 disables)")
+	flowActivePtr := flag.Duration("flow-active-timeout", 30*time.Minute, "Close and report flows open longer than this")
+	flowIdlePtr := flag.Duration("flow-idle-timeout", time.Minute, "Close and report flows without packets for this long")
+	flowExportPtr := flag.String("flow-export", "", "Export closed flows to this NetFlow/IPFIX collector (host:port over UDP, e.g. ntopng or ElastiFlow on :2055); lower -flow-active-timeout to report long flows sooner")
+	netflowListenPtr := flag.String("netflow-listen", "", "Receive NetFlow v5/v9 and IPFIX from routers on this UDP address (e.g. :2055) and account it like captured traffic")
+	var collectorAllow stringList
+	flag.Var(&collectorAllow, "collector-allow", "Routers and switches -netflow-listen and -sflow-listen accept datagrams from; comma-separated or repeated addresses or CIDRs (default: senders on -lan-subnets)")
+	sflowListenPtr := flag.String("sflow-listen", "", "Receive sFlow v5 packet samples from switches on this UDP address (e.g. :6343) and account them like captured traffic")
+	flowExportFormatPtr := flag.String("flow-export-format", FlowExportIPFIX, "Format of -flow-export: ipfix or netflow9")
+	updateCheckPtr := flag.Bool("update-check", false, "Check -update-url for newer releases and report them in /api/health and the UI (never installs; skipped for development builds)")
+	updateURLPtr := flag.String("update-url", defaultUpdateURL, "Release endpoint answering like the GitHub latest-release API")
+	updateIntervalPtr := flag.Duration("update-interval", 24*time.Hour, "How often -update-check looks for a newer release")
+	nameProbePtr := flag.Bool("name-probe", false, "Actively query unnamed devices for their NetBIOS name (names are also learned passively from mDNS, LLMNR and NetBIOS)")
+	pushFilePtr := flag.String("push-file", "", "JSON file holding the Web Push VAPID keys and browser subscriptions (enables push; created on first run)")
+	pushContactPtr := flag.String("push-contact", "mailto:admin@localhost", "Contact (mailto: or https: URL) sent to push services with Web Push notifications")
+	pushMinSeverityPtr := flag.String("push-min-severity", SeverityWarning, "Lowest alert severity pushed to browsers: info, warning or critical")
+	historyDBPtr := flag.String("history-db", "", "SQLite database receiving per-device traffic per minute, so history survives restarts")
+	historyRetentionPtr := flag.Duration("history-retention", 30*24*time.Hour, "How long -history-db keeps per-minute traffic (0 = forever)")
+	raRoutersPtr := flag.String("ra-routers", "", "Comma-separated MACs allowed to send IPv6 router advertisements; others raise rogue-router alerts")
+	raLearningPtr := flag.Duration("ra-learning", 10*time.Minute, "Without -ra-routers, trust routers advertising within this long after startup")
+	influxURLPtr := flag.String("influx-url", "", "InfluxDB server to push per-device bandwidth samples to, e.g. http://influxdb:8086 (enables the exporter)")
+	influxOrgPtr := flag.String("influx-org", "", "InfluxDB 2.x organization")
+	influxBucketPtr := flag.String("influx-bucket", "lantt", "InfluxDB bucket (or database/retention-policy on 1.8)")
+	influxTokenPtr := flag.String("influx-token", os.Getenv("INFLUX_TOKEN"), "InfluxDB API token (default $INFLUX_TOKEN)")
+	influxIntervalPtr := flag.Duration("influx-interval", 10*time.Second, "How often samples are pushed to InfluxDB")
+	rateWindowPtr := flag.Duration("rate-window", 5*time.Second, "Window the per-device rateSentBps/rateRecvBps are averaged over (1s to 60s)")
+	deterministicPtr := flag.Bool("deterministic", false, "Reproducible API output for golden-file tests: timestamps truncated to whole seconds in UTC")
+	soakFilePtr := flag.String("soak-file", "", "JSON file keeping the hourly self-metrics of /api/debug/soak across restarts")
+	fingerbankKeyPtr := flag.String("fingerbank-key", os.Getenv("FINGERBANK_API_KEY"), "Fingerbank API key for classifying devices by DHCP fingerprint (default $FINGERBANK_API_KEY; enables classification)")
+	fingerbankURLPtr := flag.String("fingerbank-url", defaultFingerbankURL, "Fingerbank-compatible interrogate endpoint")
+	fingerbankCachePtr := flag.String("fingerbank-cache", "", "JSON file caching Fingerbank classifications across restarts (created on first lookup)")
+	snmpTrapPtr := flag.String("snmp-trap", os.Getenv("SNMP_TRAP"), "SNMP trap receiver for alerts: snmp://community@host[:162] (v2c) or snmpv3://user@host?auth=SHA&authpass=..&priv=AES&privpass=.. (default $SNMP_TRAP)")
+	snmpTrapMinSeverityPtr := flag.String("snmp-trap-min-severity", SeverityCritical, "Lowest alert severity sent as SNMP trap: info, warning or critical")
+	apiKeyPtr := flag.String("api-key", "", "Keys required as \"Authorization: Bearer\" on /api/* and /metrics, and as ?token= on /ws and /api/stream; comma-separated, each \"name:key\" or a bare key")
+	apiKeyFilePtr := flag.String("api-key-file", "", "File holding the -api-key entries, one per line, so they do not show in the process list")
+	usersFilePtr := flag.String("users-file", "", "JSON file holding user accounts (viewer or admin role, bcrypt passwords); with accounts the API requires a login")
+	adminPasswordPtr := flag.String("admin-password", os.Getenv("ADMIN_PASSWORD"), "Create the account \"admin\" with this password when there are no accounts yet (default $ADMIN_PASSWORD)")
+	tlsCertPtr := flag.String("tls-cert", "", "PEM certificate (chain) to serve HTTPS and WSS with; needs -tls-key")
+	tlsKeyPtr := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsSelfSignedPtr := flag.Bool("tls-self-signed", false, "Serve HTTPS and WSS with a generated self-signed certificate (kept under -data-dir) when no -tls-cert is given")
+	httpRedirectPortPtr := flag.String("http-redirect-port", "", "With TLS, also listen for plain HTTP on this port and redirect it to HTTPS on -port (e.g. 80)")
+	sortPtr := flag.String("sort", SortBytes, "Device order of stats and broadcasts: comma-separated keys of bytes, rate, recent, lastSeen, name or risk, each breaking ties of the one before")
+	apiRatePtr := flag.Float64("api-rate", 20, "REST API requests per second allowed per client address (0 disables limiting)")
+	apiBurstPtr := flag.Int("api-burst", 40, "REST API requests a client address may send in a burst above -api-rate")
+	maxWSClientsPtr := flag.Int("max-ws-clients", 100, "Maximum concurrent WebSocket connections (0 = unlimited)")
+	maxWSPerIPPtr := flag.Int("max-ws-per-ip", 10, "Maximum concurrent WebSocket connections per client address (0 = unlimited)")
+	replicationListenPtr := flag.String("replication-listen", "", "Stream state to hot standby followers over gRPC at this address, e.g. :7070 (TLS when HTTPS is on)")
+	replicationIntervalPtr := flag.Duration("replication-interval", 2*time.Second, "How often followers receive the state")
+	followPtr := flag.String("follow", "", "Run as hot standby of the primary at this replication address (host:port): mirror its state without capturing until promoted")
+	followKeyPtr := flag.String("follow-key", os.Getenv("FOLLOW_KEY"), "API key presented to the primary with -follow (default $FOLLOW_KEY)")
+	followCAPtr := flag.String("follow-ca", "", "PEM certificate(s) to verify the primary's replication TLS with; without it -follow connects in plaintext")
+	followLeasePtr := flag.Duration("follow-lease", 0, "Promote to primary when the primary sends nothing for this long after its first update (0: only via POST /api/replication/promote)")
+	journalPtr := flag.String("journal", "", "Append-only file journaling the traffic not yet written to -history-db, replayed after an unclean shutdown")
+	journalIntervalPtr := flag.Duration("journal-interval", 5*time.Second, "How often traffic is journaled (and synced to disk) with -journal")
+	proxyFrontendPtr := flag.String("proxy-frontend", "", "Proxy every non-API path to this frontend dev server, e.g. http://localhost:5173 (development only)")
+	summaryFilePtr := flag.String("summary-file", "", "Also write the run summary printed at shutdown (and on SIGUSR1) to this file; JSON when it ends in .json")
+	deviceTTLPtr := flag.Duration("device-ttl", 0, "Evict devices not seen for this long from the live device list (0 = never; default: the -profile's, 30m for low-memory)")
+	maxDevicesPtr := flag.Int("max-devices", 0, "Devices tracked at most, evicting the least recently seen (0 = no cap; default: the -profile's, 256 for low-memory)")
+	maxFlowsPtr := flag.Int("max-flows", 0, "Open flows tracked at most, evicting the least recently active (default: the -profile's, 65536 or 4096 for low-memory)")
+	deviceArchivePtr := flag.Int("device-archive", defaultDeviceArchive, "Evicted devices kept for /api/devices/archived (0 = none)")
+	signaturesFilePtr := flag.String("signatures-file", "", "JSON file of payload signature rules (protocol, ports, text/hex/regex) raising alerts, e.g. for telnet logins or SMBv1")
+	shapingFilePtr := flag.String("shaping-file", "", "JSON file of rules running tc/nftables commands to limit a device when its alerts fire (opt-in enforcement)")
+	dnsFilterPtr := flag.String("dns-filter", "", "Filtering DNS resolver to report blocked vs allowed queries per device from: pihole or adguard")
+	dnsFilterURLPtr := flag.String("dns-filter-url", "", "Base URL of the -dns-filter server, e.g. http://pi.hole or http://adguard.lan:3000")
+	dnsFilterUserPtr := flag.String("dns-filter-user", "", "AdGuard Home user name")
+	dnsFilterPasswordPtr := flag.String("dns-filter-password", os.Getenv("DNS_FILTER_PASSWORD"), "Pi-hole app password or AdGuard Home password (default $DNS_FILTER_PASSWORD)")
+	dnsFilterIntervalPtr := flag.Duration("dns-filter-interval", time.Minute, "How often the -dns-filter query log is read")
+	configPtr := flag.String("config", "", "YAML or JSON file setting any of these flags by name, optionally grouped in sections (storage:, alerting:, ...); flags given on the command line or as LANTT_* variables win")
+	escalationFilePtr := flag.String("escalation-file", "", "JSON file defining alert notifiers and escalation policies")
+	reportNotifiersPtr := flag.String("report-notifiers", "", "Comma-separated -escalation-file notifiers the weekly report is sent through on -report-schedule")
+	reportSchedulePtr := flag.String("report-schedule", "0 8 * * 1", "When -report-notifiers receive the weekly report, as a cron expression (default Monday 08:00)")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nEvery flag can also be set with an environment variable: -history-db as %s.\n", envName("history-db"))
+	}
 	flag.Parse()
+	cmdline := make(map[string]bool) // flags that env, -config and reloads leave alone
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
+	if err := applyEnvironment(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+	if *configPtr != "" {
+		if err := applyConfigFile(flag.CommandLine, *configPtr); err != nil {
+			log.Fatalf("Error reading -config %s: %v", *configPtr, err)
+		}
+	}
+
+	if *versionPtr {
+		fmt.Println(buildInfo().versionString())
+		os.Exit(0)
+	}
 
 	// Find all devices
 	devices, err := pcap.FindAllDevs()
@@ -355,91 +1022,690 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(devices) == 0 {
+	collectorOnly := len(deviceNames) == 1 && deviceNames[0] == "none"
+	if collectorOnly && *netflowListenPtr == "" && *sflowListenPtr == "" {
+		log.Fatal("-device none needs -netflow-listen or -sflow-listen")
+	}
+	if len(devices) == 0 && !collectorOnly {
 		log.Fatal("No devices found")
 	}
 
-	// Select device
-	var deviceName string
-	var localIP string
+	// Select devices
+	deviceNames, localIP := selectDevices(deviceNames, devices)
 
-	if *devicePtr != "" {
-		deviceName = *devicePtr
+	fmt.Println(buildInfo().versionString())
+	if collectorOnly {
+		fmt.Println("Starting bandwidth monitor without local capture (flow collector only)")
 	} else {
-		for _, dev := range devices {
-			if dev.Name != "lo" && len(dev.Addresses) > 0 {
-				deviceName = dev.Name
-				if len(dev.Addresses) > 0 {
-					localIP = dev.Addresses[0].IP.String()
-				}
-				break
-			}
+		fmt.Printf("Starting bandwidth monitor on device: %s\n", strings.Join(deviceNames, ", "))
+	}
+	lan := detectLANSubnets(deviceNames, devices)
+	if len(lanSubnets) > 0 {
+		if lan, err = parseLANSubnets(lanSubnets); err != nil {
+			log.Fatalf("Invalid -lan-subnets: %v", err)
 		}
-		if deviceName == "" {
-			deviceName = devices[0].Name
+	}
+	fmt.Printf("LAN subnets: %s\n", lan)
+	if localIP != "" {
+		fmt.Printf("Local IP: %s\n", localIP)
+		scheme := "http"
+		if *tlsCertPtr != "" || *tlsSelfSignedPtr {
+			scheme = "https"
 		}
+		fmt.Printf("Access from other devices: %s://%s:%s\n", scheme, localIP, *portPtr)
 	}
+	fmt.Printf("HTTP server binding to: %s:%s\n", *hostPtr, *portPtr)
 
-	// Get local IP if not set
-	if localIP == "" {
-		localIP = getLocalIP(deviceName, devices)
+	switch *captureEnginePtr {
+	case CaptureEnginePcap, CaptureEngineAFPacket:
+	default:
+		log.Fatalf("Invalid -capture-engine %q (want pcap or afpacket)", *captureEnginePtr)
+	}
+	if *snaplenPtr < 64 || *snaplenPtr > 262144 {
+		log.Fatalf("Invalid -snaplen %d (want 64 to 262144)", *snaplenPtr)
+	}
+	if *pcapBufferPtr < 0 {
+		log.Fatalf("Invalid -pcap-buffer %d", *pcapBufferPtr)
+	}
+	if *pcapTimeoutPtr <= 0 {
+		log.Fatalf("Invalid -pcap-timeout %v", *pcapTimeoutPtr)
+	}
+	switch *ebpfPtr {
+	case "", EBPFModeXDP, EBPFModeTC:
+	default:
+		log.Fatalf("Invalid -ebpf %q (want xdp or tc)", *ebpfPtr)
+	}
+	if *ebpfSamplePtr < 1 {
+		log.Fatalf("Invalid -ebpf-sample %d", *ebpfSamplePtr)
+	}
+	if *ebpfPtr != "" && !ebpfSupported {
+		log.Fatal("-ebpf needs Linux")
 	}
 
-	fmt.Printf("Starting bandwidth monitor on device: %s\n", deviceName)
-	if localIP != "" {
-		fmt.Printf("Local IP: %s\n", localIP)
-		fmt.Printf("Access from other devices: http://%s:%s\n", localIP, *portPtr)
+	// Open devices, one capture per interface
+	var sources []captureSource
+	handles := make(map[string]*pcap.Handle)
+	modes := make(map[string]bool)
+	for _, name := range deviceNames {
+		source := captureSource{
+			device:     name,
+			snaplen:    int32(*snaplenPtr),
+			promisc:    *promiscPtr,
+			timeout:    *pcapTimeoutPtr,
+			bufferSize: *pcapBufferPtr << 20,
+			restart:    make(chan struct{}, 1),
+			engine:     *captureEnginePtr,
+			fanout:     *fanoutPtr,
+			ebpf:       *ebpfPtr,
+		}
+		handle, err := source.open()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening device %s: %v\n\n", name, err)
+			fmt.Fprintf(os.Stderr, "Hint: You may need root/sudo or capabilities\n")
+			os.Exit(1)
+		}
+
+		// Apply BPF filter
+		if *filterPtr != "" {
+			if err := handle.SetBPFFilter(*filterPtr); err != nil {
+				handle.Close()
+				log.Fatalf("Invalid -filter %q on %s: %v", *filterPtr, name, err)
+			}
+		}
+		if source.afpacket() && (!fanoutSupported || handle.LinkType() != layers.LinkTypeEthernet) {
+			log.Printf("AF_PACKET capture needs an Ethernet interface on Linux; capturing %s with a single pcap handle", name)
+			source.engine, source.fanout = CaptureEnginePcap, 1
+		}
+		if source.ebpf != "" {
+			if handle.LinkType() != layers.LinkTypeEthernet {
+				log.Printf("The eBPF fast path needs an Ethernet interface; capturing %s with pcap", name)
+				source.ebpf = ""
+			} else {
+				// Counting in the kernel replaces the AF_PACKET workers
+				source.engine, source.fanout = CaptureEnginePcap, 1
+				source.ebpfSample = uint64(*ebpfSamplePtr)
+			}
+		}
+		modes[autoAccountingMode(name, devices, handle.LinkType())] = true
+		sources = append(sources, source)
+		handles[name] = handle
+	}
+	if *filterPtr != "" {
+		fmt.Printf("Capture filter: %s\n", *filterPtr)
+		if *ebpfPtr != "" {
+			log.Printf("Warning: -filter does not apply to traffic counted with -ebpf")
+		}
 	}
-	fmt.Printf("HTTP server binding to: %s:%s\n", *hostPtr, *portPtr)
 
-	// Open device
-	handle, err := pcap.OpenLive(deviceName, 1600, true, pcap.BlockForever)
+	// Pick how devices are keyed. With interfaces of both kinds MAC keying
+	// wins; it falls back to IP for packets without a MAC anyway. A pure
+	// flow collector keys by IP, as flow records rarely carry MACs.
+	accounting := *accountingPtr
+	switch accounting {
+	case AccountingMAC, AccountingIP:
+	case "auto":
+		accounting = AccountingMAC
+		if len(modes) == 0 || len(modes) == 1 && modes[AccountingIP] {
+			accounting = AccountingIP
+		}
+	default:
+		log.Fatalf("Invalid -accounting %q (want mac, ip or auto)", accounting)
+	}
+	fmt.Printf("Accounting mode: %s\n", accounting)
+
+	// Retention limits must be in place before anything is tracked
+	resources, err := lookupResourceProfile(*resourcePtr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening device: %v\n\n", err)
-		fmt.Fprintf(os.Stderr, "Hint: You may need root/sudo or capabilities\n")
-		os.Exit(1)
+		log.Fatalf("Invalid -profile: %v", err)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "device-ttl":
+			resources.deviceIdleTTL = *deviceTTLPtr
+		case "max-devices":
+			resources.maxDevices = *maxDevicesPtr
+		case "max-flows":
+			resources.maxFlows = *maxFlowsPtr
+		}
+	})
+	if resources.deviceIdleTTL < 0 {
+		log.Fatalf("Invalid -device-ttl: %v", resources.deviceIdleTTL)
 	}
-	defer handle.Close()
+	if resources.maxDevices < 0 {
+		log.Fatalf("Invalid -max-devices: %d", resources.maxDevices)
+	}
+	if resources.maxFlows <= 0 {
+		log.Fatalf("Invalid -max-flows: %d", resources.maxFlows)
+	}
+	resources.apply()
+	fmt.Printf("Resource profile: %s\n", resources.name)
+	if resources.deviceIdleTTL > 0 {
+		fmt.Printf("Evicting devices idle for %v\n", resources.deviceIdleTTL)
+	}
+	if resources.maxDevices > 0 {
+		fmt.Printf("Tracking at most %d devices\n", resources.maxDevices)
+	}
+	if *rateWindowPtr < time.Second || *rateWindowPtr > maxRateWindow {
+		log.Fatalf("Invalid -rate-window: %v (want 1s to %v)", *rateWindowPtr, maxRateWindow)
+	}
+	rateWindow = *rateWindowPtr
+	deterministicOutput = *deterministicPtr
 
 	// Create bandwidth monitor
 	monitor := NewBandwidthMonitor(localIP)
+	monitor.lan = lan
+	monitor.resources = resources
+	monitor.archive = newDeviceArchive(*deviceArchivePtr)
+	monitor.accounting = accounting
+	monitor.captureFilter = *filterPtr
+	monitor.wsOrigins = parseOriginList(*wsOriginsPtr)
+	monitor.authToken = *authTokenPtr
+	monitor.sortKeys, err = parseSortKeys(*sortPtr)
+	if err != nil {
+		log.Fatalf("Invalid -sort: %v", err)
+	}
+	monitor.limiter = newRateLimiter(*apiRatePtr, *apiBurstPtr)
+	monitor.maxWSClients = *maxWSClientsPtr
+	monitor.maxWSPerIP = *maxWSPerIPPtr
+	monitor.apiKeys, err = loadAPIKeys(*apiKeyPtr, *apiKeyFilePtr)
+	if err != nil {
+		log.Fatalf("Error reading API keys: %v", err)
+	}
+	monitor.apiUsage = newAPIUsage(monitor.apiKeys)
+	monitor.replication = newReplication(*followPtr, *followLeasePtr)
+	monitor.replicationInterval = *replicationIntervalPtr
+	monitor.templates = newTemplateRenderer(*dataDirPtr, *localePtr)
+	monitor.newDest = newNewDestTracker(*newDestLearningPtr)
+	raRouters, err := parseMACList(*raRoutersPtr)
+	if err != nil {
+		log.Fatalf("Invalid -ra-routers: %v", err)
+	}
+	monitor.routerAdverts = newRouterAdvertTracker(raRouters, *raLearningPtr, time.Now())
+	if *blocklistPtr != "" {
+		bl, err := loadBlocklist(*blocklistPtr)
+		if err != nil {
+			log.Fatalf("Error loading blocklist: %v", err)
+		}
+		monitor.risk.blocklist = bl
+	}
+	if *asnDBPtr != "" {
+		db, err := loadASNDB(*asnDBPtr)
+		if err != nil {
+			log.Fatalf("Error loading AS database: %v", err)
+		}
+		log.Printf("Loaded %d AS ranges from %s", len(db.ranges), *asnDBPtr)
+		monitor.asnDB = db
+		// Learn destinations per AS rather than per prefix
+		monitor.newDest.classify = func(ip net.IP) string {
+			if as, ok := db.lookup(ip); ok {
+				return as.Label()
+			}
+			return prefixDestination(ip)
+		}
+	}
+	if *geoIPDBPtr != "" {
+		db, err := loadGeoDB(*geoIPDBPtr)
+		if err != nil {
+			log.Fatalf("Error loading GeoIP database: %v", err)
+		}
+		log.Printf("Loaded %s database from %s", db.reader.Metadata.DatabaseType, *geoIPDBPtr)
+		monitor.geoDB = db
+	}
+	// Encryption at rest must be set up before any state is loaded
+	if atRest, err = loadEncryptionKey(*encryptionKeyPtr, *encryptionKeyFilePtr); err != nil {
+		log.Fatalf("Error loading encryption key: %v", err)
+	}
+	if atRest != nil {
+		fmt.Println("Encryption at rest: persisted state is encrypted (AES-256-GCM)")
+	}
+	if *storePtr != "" {
+		store, err := openStore(*storePtr, *storePathPtr, *dataDirPtr)
+		if err != nil {
+			log.Fatalf("Error opening %s store: %v", *storePtr, err)
+		}
+		defer store.Close()
+		monitor.store = store
+		if atRest != nil {
+			monitor.store = encryptedStore{Store: store, c: atRest}
+		}
+	}
+	// An explicit file flag wins over the store
+	if doc := persistedDocument(*sloFilePtr, monitor.store, "slo", "objectives"); doc != nil {
+		monitor.slo = newSLOTracker(doc)
+	}
+	if doc := persistedDocument(*heartbeatFilePtr, monitor.store, "heartbeats", "rules"); doc != nil {
+		monitor.heartbeats = newHeartbeatMonitor(doc)
+	}
+	if doc := persistedDocument(*quotaFilePtr, monitor.store, "quotas", "rules"); doc != nil {
+		monitor.quotas = newQuotaMonitor(doc)
+	}
+	if *asymmetryRatioPtr != 0 {
+		if *asymmetryRatioPtr < 1 || *asymmetryWindowPtr < time.Minute || *asymmetryMinPtr < 0 {
+			log.Fatalf("Invalid -asymmetry-ratio %v, -asymmetry-window %v or -asymmetry-min-upload %d (want a ratio of at least 1 over at least 1m)",
+				*asymmetryRatioPtr, *asymmetryWindowPtr, *asymmetryMinPtr)
+		}
+		monitor.asymmetry = newAsymmetryMonitor(*asymmetryRatioPtr, *asymmetryWindowPtr, uint64(*asymmetryMinPtr)<<20)
+		fmt.Printf("Upload asymmetry alerts: above %.1fx over %v\n", *asymmetryRatioPtr, *asymmetryWindowPtr)
+	}
+	if doc := persistedDocument(*labelsFilePtr, monitor.store, "labels", "devices"); doc != nil {
+		monitor.labels = newLabelStore(doc)
+	}
+	if doc := persistedDocument(*mergesFilePtr, monitor.store, "merges", "devices"); doc != nil {
+		monitor.merges = newMergeStore(doc)
+	}
+	if doc := persistedDocument(*logicalFilePtr, monitor.store, "logical", "devices"); doc != nil {
+		monitor.logical = newLogicalStore(doc)
+	}
+	if doc := persistedDocument(*usersFilePtr, monitor.store, "users", "accounts"); doc != nil {
+		monitor.users = newUserStore(doc)
+	}
+	if *adminPasswordPtr != "" && !monitor.users.configured() {
+		if err := monitor.users.set("admin", RoleAdmin, *adminPasswordPtr); err != nil {
+			log.Fatalf("Error creating admin account: %v", err)
+		}
+		log.Printf("Created account admin")
+	}
+	if doc := persistedDocument(*viewsFilePtr, monitor.store, "views", "all"); doc != nil {
+		monitor.views = newViewStore(doc)
+	}
+	if doc := persistedDocument(*soakFilePtr, monitor.store, "soak", "samples"); doc != nil {
+		monitor.soak = newSoakRecorder(doc)
+	}
+	if *profilesFilePtr != "" {
+		profiles, err := newProfileManager(*profilesFilePtr)
+		if err != nil {
+			log.Fatalf("Error loading capture profiles: %v", err)
+		}
+		monitor.profiles = profiles
+	} else if resources.captureProfile != "" {
+		if err := monitor.profiles.setDefault(resources.captureProfile); err != nil {
+			log.Fatalf("Error selecting capture profile: %v", err)
+		}
+	}
+	if *sampleRatePtr != 0 {
+		if err := monitor.profiles.setSampleRate(*sampleRatePtr); err != nil {
+			log.Fatalf("Invalid -sample-rate: %v", err)
+		}
+		fmt.Printf("Sampling: 1 in %d packets\n", *sampleRatePtr)
+	}
+	if *writePcapPtr != "" {
+		for i := range sources {
+			// One file set per interface, as a pcap file has one link type
+			path := *writePcapPtr
+			if len(sources) > 1 {
+				ext := filepath.Ext(path)
+				path = strings.TrimSuffix(path, ext) + "-" + sources[i].device + ext
+			}
+			pw, err := newRollingPcapWriter(path, *pcapMaxSizePtr<<20, *pcapMaxFilesPtr)
+			if err != nil {
+				log.Fatalf("Error setting up pcap output: %v", err)
+			}
+			sources[i].pcapOut = pw
+			log.Printf("Writing %s packets to %s (rotating at %d MB, keeping %d files)", sources[i].device, path, *pcapMaxSizePtr, *pcapMaxFilesPtr)
+		}
+	}
+	monitor.captures = sources
+	monitor.flows = newFlowTable(*flowActivePtr, *flowIdlePtr)
+	monitor.flows.geo = monitor.geoDB
+	monitor.flows.subscribe(monitor.publishFlows)
+	monitor.alerts.subscribe(monitor.publishAlert)
+	if monitor.store != nil {
+		monitor.flows.subscribe(persistFlows(monitor.store))
+	}
+	var netflowConn, sflowConn net.PacketConn
+	if *netflowListenPtr != "" || *sflowListenPtr != "" {
+		allow, err := parseCollectorAllow(collectorAllow)
+		if err != nil {
+			log.Fatalf("Invalid -collector-allow: %v", err)
+		}
+		monitor.collector = newFlowCollector(monitor, allow)
+		if len(allow) > 0 {
+			fmt.Printf("Flow exporters allowed: %s\n", strings.Join(collectorAllow, ", "))
+		} else {
+			fmt.Printf("Flow exporters allowed: %s\n", lan)
+		}
+	}
+	if *netflowListenPtr != "" {
+		if netflowConn, err = net.ListenPacket("udp", *netflowListenPtr); err != nil {
+			log.Fatalf("Error listening for NetFlow: %v", err)
+		}
+		defer netflowConn.Close()
+		fmt.Printf("NetFlow/IPFIX collector: %s\n", netflowConn.LocalAddr())
+	}
+	if *sflowListenPtr != "" {
+		if sflowConn, err = net.ListenPacket("udp", *sflowListenPtr); err != nil {
+			log.Fatalf("Error listening for sFlow: %v", err)
+		}
+		defer sflowConn.Close()
+		fmt.Printf("sFlow collector: %s\n", sflowConn.LocalAddr())
+	}
+	if *flowExportPtr != "" {
+		exporter, err := newFlowExporter(*flowExportPtr, *flowExportFormatPtr)
+		if err != nil {
+			log.Fatalf("Error setting up flow export: %v", err)
+		}
+		defer exporter.Close()
+		monitor.flows.subscribe(exporter.export)
+		fmt.Printf("Flow export: %s to %s\n", *flowExportFormatPtr, *flowExportPtr)
+	}
+	if *historyDBPtr != "" {
+		series, err := openSeriesDB(*historyDBPtr, *historyRetentionPtr)
+		if err != nil {
+			log.Fatalf("Error opening history database: %v", err)
+		}
+		defer series.Close()
+		monitor.series = series
+		if *journalPtr != "" {
+			if *journalIntervalPtr <= 0 {
+				log.Fatalf("-journal-interval must be positive")
+			}
+			if err := series.attachJournal(*journalPtr); err != nil {
+				log.Fatalf("Error opening history journal: %v", err)
+			}
+		}
+	} else if *journalPtr != "" {
+		log.Fatalf("-journal needs -history-db")
+	}
+	if *updateCheckPtr && version == "dev" {
+		// A development build has no release to compare against
+		fmt.Println("Update check: skipped for development build")
+	} else if *updateCheckPtr {
+		if *updateIntervalPtr < time.Hour {
+			log.Fatalf("Error setting up update check: -update-interval must be at least 1h")
+		}
+		if monitor.updates, err = newUpdateChecker(*updateURLPtr); err != nil {
+			log.Fatalf("Error setting up update check: %v", err)
+		}
+		fmt.Printf("Update check: %s every %s\n", *updateURLPtr, *updateIntervalPtr)
+	}
+	if *fingerbankKeyPtr != "" {
+		doc := persistedDocument(*fingerbankCachePtr, monitor.store, "fingerbank", "cache")
+		fingerbank, err := newFingerbankClassifier(*fingerbankURLPtr, *fingerbankKeyPtr, doc)
+		if err != nil {
+			log.Fatalf("Error setting up Fingerbank: %v", err)
+		}
+		monitor.fingerbank = fingerbank
+	}
+	var influx *influxExporter
+	if *influxURLPtr != "" {
+		if *influxIntervalPtr <= 0 {
+			log.Fatalf("Invalid -influx-interval: %v", *influxIntervalPtr)
+		}
+		influx, err = newInfluxExporter(*influxURLPtr, *influxOrgPtr, *influxBucketPtr, *influxTokenPtr)
+		if err != nil {
+			log.Fatalf("Error setting up InfluxDB export: %v", err)
+		}
+	}
+	if *dnsFilterPtr != "" {
+		if *dnsFilterIntervalPtr <= 0 {
+			log.Fatalf("Invalid -dns-filter-interval: %v", *dnsFilterIntervalPtr)
+		}
+		source, err := newDNSFilterSource(*dnsFilterPtr, *dnsFilterURLPtr, *dnsFilterUserPtr, *dnsFilterPasswordPtr)
+		if err != nil {
+			log.Fatalf("Error setting up -dns-filter: %v", err)
+		}
+		monitor.dnsFilter = newDNSFilterStats(source)
+		fmt.Printf("DNS filter: %s at %s\n", *dnsFilterPtr, *dnsFilterURLPtr)
+	}
+	if doc := persistedDocument(*pushFilePtr, monitor.store, "push", "state"); doc != nil {
+		push, err := newPushNotifier(doc, *pushContactPtr, *pushMinSeverityPtr)
+		if err != nil {
+			log.Fatalf("Error setting up Web Push: %v", err)
+		}
+		monitor.push = push
+		monitor.alerts.subscribe(push.notifyAlert)
+	}
+	if *snmpTrapPtr != "" {
+		traps, err := newSNMPTrapSender(*snmpTrapPtr, *snmpTrapMinSeverityPtr)
+		if err != nil {
+			log.Fatalf("Error setting up SNMP traps: %v", err)
+		}
+		monitor.alerts.subscribe(traps.notifyAlert)
+	}
+	if *escalationFilePtr != "" {
+		esc, err := loadEscalator(*escalationFilePtr)
+		if err != nil {
+			log.Fatalf("Error loading escalation policies: %v", err)
+		}
+		monitor.escalations = esc
+		monitor.alerts.subscribe(esc.start)
+	}
+	var reportSchedule *cronSchedule
+	var reportNotifiers []string
+	if *reportNotifiersPtr != "" {
+		if monitor.escalations == nil {
+			log.Fatalf("-report-notifiers needs -escalation-file")
+		}
+		for _, name := range strings.Split(*reportNotifiersPtr, ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := monitor.escalations.notifier(name); !ok {
+				log.Fatalf("Invalid -report-notifiers: no notifier %q in %s", name, *escalationFilePtr)
+			}
+			reportNotifiers = append(reportNotifiers, name)
+		}
+		if reportSchedule, err = parseCron(*reportSchedulePtr); err != nil {
+			log.Fatalf("Invalid -report-schedule: %v", err)
+		}
+		fmt.Printf("Weekly report: %s via %s\n", *reportSchedulePtr, strings.Join(reportNotifiers, ", "))
+	}
+	if *shapingFilePtr != "" {
+		sh, err := loadShaper(*shapingFilePtr)
+		if err != nil {
+			log.Fatalf("Error loading shaping rules: %v", err)
+		}
+		monitor.shaping = sh
+		monitor.alerts.subscribe(monitor.shapeAlert)
+		fmt.Printf("Traffic shaping: %d rules from %s\n", len(sh.rules), *shapingFilePtr)
+	}
+	if *signaturesFilePtr != "" {
+		sig, err := loadSignatures(*signaturesFilePtr)
+		if err != nil {
+			log.Fatalf("Error loading signature rules: %v", err)
+		}
+		monitor.signatures = sig
+		fmt.Printf("Signature rules: %d from %s\n", len(sig.rules), *signaturesFilePtr)
+	}
+
+	// Background workers run under supervision: a panic is reported and the
+	// worker restarted. stopWorkers is closed on shutdown to stop them all.
+	stopWorkers := make(chan struct{})
 
 	// Start WebSocket broadcaster
-	go monitor.broadcastStats()
+	go monitor.supervise("broadcaster", stopWorkers, monitor.broadcastStats)
+	go monitor.supervise("accounting", stopWorkers, func() {
+		monitor.runAccounting(stopWorkers)
+	})
+
+	// Start flow collector listeners
+	if netflowConn != nil {
+		go monitor.supervise("netflow", stopWorkers, func() {
+			monitor.collector.listen(netflowConn, stopWorkers, monitor.collector.handleNetFlow)
+		})
+	}
+	if sflowConn != nil {
+		go monitor.supervise("sflow", stopWorkers, func() {
+			decoders := newSFlowDecoders()
+			monitor.collector.listen(sflowConn, stopWorkers, func(data []byte, addr string) {
+				monitor.collector.handleSFlow(decoders, data, addr)
+			})
+		})
+	}
 
 	// Start hostname resolver goroutine
-	stopResolve := make(chan struct{})
-	go monitor.resolveHostnamesPeriodically(10*time.Second, stopResolve)
+	if *rdnsRatePtr > 0 {
+		resolver := newHostnameResolver(*rdnsRatePtr)
+		go monitor.supervise("resolver", stopWorkers, func() {
+			monitor.resolveHostnamesPeriodically(resolver, stopWorkers)
+		})
+	}
 
-	// Start packet capture
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packets := packetSource.Packets()
+	// Start release checks
+	if monitor.updates != nil {
+		go monitor.supervise("update-check", stopWorkers, func() {
+			monitor.updates.checkPeriodically(*updateIntervalPtr, stopWorkers)
+		})
+	}
 
-	go func() {
-		for packet := range packets {
-			var srcMAC, dstMAC, srcIP, dstIP string
+	// Start DHCP fingerprint classification
+	if monitor.fingerbank != nil {
+		go monitor.supervise("fingerbank", stopWorkers, func() {
+			monitor.classifyDevicesPeriodically(monitor.fingerbank, stopWorkers)
+		})
+	}
 
-			if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
-				eth := ethLayer.(*layers.Ethernet)
-				srcMAC = eth.SrcMAC.String()
-				dstMAC = eth.DstMAC.String()
-			}
+	// Start active name probing
+	if *nameProbePtr {
+		go monitor.supervise("name-probe", stopWorkers, func() {
+			monitor.probeNamesPeriodically(stopWorkers)
+		})
+	}
 
-			if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
-				ip := ipLayer.(*layers.IPv4)
-				srcIP = ip.SrcIP.String()
-				dstIP = ip.DstIP.String()
-			}
+	// Start per-device history sampling
+	go monitor.supervise("history", stopWorkers, func() {
+		monitor.recordHistoryPeriodically(stopWorkers)
+	})
+
+	// Start recent-activity sampling for top talkers
+	go monitor.supervise("activity", stopWorkers, func() {
+		monitor.recordActivityPeriodically(stopWorkers)
+	})
 
-			packetSize := uint64(len(packet.Data()))
-			monitor.UpdateStats(srcMAC, dstMAC, srcIP, dstIP, packetSize)
+	// Start per-minute history persistence
+	if monitor.series != nil {
+		go monitor.supervise("history-db", stopWorkers, func() {
+			monitor.flushSeriesPeriodically(stopWorkers)
+		})
+		if *journalPtr != "" {
+			go monitor.supervise("journal", stopWorkers, func() {
+				monitor.journalSeriesPeriodically(*journalIntervalPtr, stopWorkers)
+			})
 		}
-	}()
+	}
+
+	// Start InfluxDB export
+	if influx != nil {
+		go monitor.supervise("influx", stopWorkers, func() {
+			monitor.exportInfluxPeriodically(influx, *influxIntervalPtr, stopWorkers)
+		})
+	}
+
+	// Start flow expiry
+	go monitor.supervise("flows", stopWorkers, func() {
+		monitor.expireFlowsPeriodically(stopWorkers)
+	})
+
+	// Start SLO tracking
+	go monitor.supervise("slo", stopWorkers, func() {
+		monitor.trackSLOsPeriodically(stopWorkers)
+	})
+
+	// Start heartbeat-silence watcher
+	go monitor.supervise("heartbeat", stopWorkers, func() {
+		monitor.watchHeartbeatsPeriodically(stopWorkers)
+	})
+
+	// Start quota watcher
+	go monitor.supervise("quota", stopWorkers, func() {
+		monitor.watchQuotasPeriodically(stopWorkers)
+	})
+
+	// Start upload asymmetry watcher
+	if monitor.asymmetry != nil {
+		go monitor.supervise("asymmetry", stopWorkers, func() {
+			monitor.watchAsymmetryPeriodically(stopWorkers)
+		})
+	}
+
+	// Start risk score updates
+	go monitor.supervise("risk", stopWorkers, func() {
+		monitor.updateRiskScoresPeriodically(stopWorkers)
+	})
+
+	// Start capture profile scheduler
+	go monitor.supervise("profiles", stopWorkers, func() {
+		monitor.runProfileSchedule(stopWorkers)
+	})
+
+	// Start scheduled weekly reports
+	if reportSchedule != nil {
+		go monitor.supervise("reports", stopWorkers, func() {
+			monitor.runReportSchedule(reportSchedule, reportNotifiers, stopWorkers)
+		})
+	}
+
+	// Start idle device eviction
+	go monitor.supervise("eviction", stopWorkers, func() {
+		monitor.evictDevicesPeriodically(stopWorkers)
+	})
+
+	// Start soak telemetry
+	go monitor.supervise("soak", stopWorkers, func() {
+		monitor.recordSoakPeriodically(stopWorkers)
+	})
+
+	// Start alert escalation
+	if monitor.escalations != nil {
+		go monitor.supervise("escalation", stopWorkers, func() {
+			monitor.runEscalations(stopWorkers)
+		})
+	}
+
+	// Start DNS filter polling
+	if monitor.dnsFilter != nil {
+		go monitor.supervise("dns-filter", stopWorkers, func() {
+			monitor.pollDNSFilterPeriodically(*dnsFilterIntervalPtr, stopWorkers)
+		})
+	}
+
+	// Start traffic shaping
+	if monitor.shaping != nil {
+		go monitor.supervise("shaping", stopWorkers, func() {
+			monitor.runShaping(stopWorkers)
+		})
+	}
+
+	// Start packet capture, one worker per interface; after a panic the
+	// handle is reopened. A follower starts capturing once promoted.
+	stopCapture := make(chan struct{})
+	startCapture := func() {
+		for _, source := range monitor.captures {
+			source := source
+			handle := handles[source.device]
+			go monitor.supervise("capture "+source.device, stopCapture, func() {
+				h := handle
+				handle = nil
+				monitor.runCapture(source, h, stopCapture)
+			})
+		}
+	}
+	if *followPtr != "" {
+		conn, err := dialPrimary(*followPtr, *followCAPtr)
+		if err != nil {
+			log.Fatalf("Error setting up replication from %s: %v", *followPtr, err)
+		}
+		defer conn.Close()
+		log.Printf("Following primary %s", *followPtr)
+		go monitor.supervise("follower", stopWorkers, func() {
+			monitor.followPrimary(conn, *followKeyPtr, stopWorkers)
+		})
+		go func() {
+			select {
+			case <-monitor.replication.promoted:
+				startCapture()
+			case <-stopWorkers:
+			}
+		}()
+	} else {
+		startCapture()
+	}
 
 	// Periodic broadcast to WebSocket clients
 	ticker := time.NewTicker(time.Duration(*intervalPtr) * time.Second)
-	go func() {
+	monitor.reloader = &reloader{flags: flag.CommandLine, given: cmdline, configFile: *configPtr, ticker: ticker,
+		filter: *filterPtr, interval: *intervalPtr, escalationFile: *escalationFilePtr}
+	go monitor.supervise("ticker", stopWorkers, func() {
 		for range ticker.C {
+			// The broadcaster narrows stats to what each client subscribed to
 			stats := monitor.GetNetworkStats()
 			select {
 			case monitor.broadcast <- stats:
@@ -447,55 +1713,305 @@ func main() {
 				// Channel full, skip this update
 			}
 		}
-	}()
+	})
+
+	// What this instance runs with, for /api/version
+	monitor.features = Features{
+		Libpcap:    pcap.Version(),
+		AFPacket:   fanoutSupported,
+		TLS:        *tlsCertPtr != "" || *tlsSelfSignedPtr,
+		Store:      *storePtr,
+		HistoryDB:  monitor.series != nil,
+		Encryption: atRest != nil,
+		Auth:       monitor.authToken != "" || monitor.authRequired(),
+	}
+	if monitor.geoDB != nil {
+		monitor.features.GeoIP = monitor.geoDB.reader.Metadata.DatabaseType
+	}
+	if *flowExportPtr != "" {
+		monitor.features.FlowExport = *flowExportFormatPtr
+	}
+	if *netflowListenPtr != "" {
+		monitor.features.Collector = append(monitor.features.Collector, "netflow")
+	}
+	if *sflowListenPtr != "" {
+		monitor.features.Collector = append(monitor.features.Collector, "sflow")
+	}
+	for _, src := range sources {
+		engine := CaptureEnginePcap
+		if src.ebpf != "" {
+			engine = "ebpf-" + src.ebpf
+		} else if src.afpacket() {
+			engine = CaptureEngineAFPacket
+		}
+		if !containsString(monitor.features.CaptureEngines, engine) {
+			monitor.features.CaptureEngines = append(monitor.features.CaptureEngines, engine)
+		}
+	}
 
 	// Setup HTTP server with CORS
 	router := mux.NewRouter()
 
 	// REST API routes
-	router.HandleFunc("/api/health", handleHealth).Methods("GET")
+	router.HandleFunc("/api/health", monitor.handleHealth).Methods("GET")
+	router.HandleFunc("/api/version", monitor.handleGetVersion).Methods("GET")
 	router.HandleFunc("/api/stats", monitor.handleGetStats).Methods("GET")
+	router.HandleFunc("/api/stats/reset", monitor.adminOnly(monitor.handleResetStats)).Methods("POST")
+	router.HandleFunc("/api/tethering", monitor.handleGetTethering).Methods("GET")
+	router.HandleFunc("/api/devices/merge", monitor.adminOnly(monitor.handleMergeDevices)).Methods("POST")
+	router.HandleFunc("/api/devices/merges", monitor.handleGetMerges).Methods("GET")
+	router.HandleFunc("/api/devices/archived", monitor.handleGetArchivedDevices).Methods("GET")
+	router.HandleFunc("/api/devices/merges/{mac}", monitor.adminOnly(monitor.handleDeleteMerge)).Methods("DELETE")
 	router.HandleFunc("/api/devices/{mac}", monitor.handleGetDevice).Methods("GET")
+	router.HandleFunc("/api/devices/{mac}/name", monitor.adminOnly(monitor.handlePutDeviceName)).Methods("PUT")
+	router.HandleFunc("/api/devices/{mac}/reset", monitor.adminOnly(monitor.handleResetDevice)).Methods("POST")
+	router.HandleFunc("/api/devices/{mac}/destinations", monitor.handleGetDestinations).Methods("GET")
+	router.HandleFunc("/api/devices/{mac}/domains", monitor.handleGetDeviceDomains).Methods("GET")
+	router.HandleFunc("/api/devices/{mac}/asns", monitor.handleGetDeviceASNs).Methods("GET")
+	router.HandleFunc("/api/devices/{mac}/countries", monitor.handleGetDeviceCountries).Methods("GET")
+	router.HandleFunc("/api/devices/{mac}/ports", monitor.handleGetDevicePorts).Methods("GET")
+	router.HandleFunc("/api/top", monitor.handleGetTopTalkers).Methods("GET")
+	router.HandleFunc("/api/leaderboard", monitor.handleGetLeaderboard).Methods("GET")
+	router.HandleFunc("/api/history", monitor.handleGetHistory).Methods("GET")
+	router.HandleFunc("/api/history/latency", monitor.handleGetLatencyHistory).Methods("GET")
+	router.HandleFunc("/api/services/usage", monitor.handleGetServiceUsage).Methods("GET")
+	router.HandleFunc("/api/compare/devices", monitor.handleCompareDevices).Methods("GET")
+	router.HandleFunc("/api/flows/top", monitor.handleGetTopFlows).Methods("GET")
+	router.HandleFunc("/api/flows/closed", monitor.handleGetClosedFlows).Methods("GET")
+	router.HandleFunc("/api/collector", monitor.handleGetCollector).Methods("GET")
+	router.HandleFunc("/api/routers", monitor.handleGetRouters).Methods("GET")
+	router.HandleFunc("/api/asn/{ip}", monitor.handleGetASN).Methods("GET")
+	router.HandleFunc("/api/geoip/{ip}", monitor.handleGetGeoIP).Methods("GET")
+
+	// Logical devices over several MACs/IPs
+	router.HandleFunc("/api/logical-devices", monitor.handleGetLogicalDevices).Methods("GET")
+	router.HandleFunc("/api/logical-devices/suggestions", monitor.handleGetLogicalSuggestions).Methods("GET")
+	router.HandleFunc("/api/logical-devices/{id}", monitor.handleGetLogicalDevice).Methods("GET")
+	router.HandleFunc("/api/logical-devices/{id}", monitor.adminOnly(monitor.handlePutLogicalDevice)).Methods("PUT")
+	router.HandleFunc("/api/logical-devices/{id}", monitor.adminOnly(monitor.handleDeleteLogicalDevice)).Methods("DELETE")
+
+	// Login sessions and user accounts
+	router.HandleFunc("/api/login", monitor.handleLogin).Methods("POST")
+	router.HandleFunc("/api/logout", monitor.handleLogout).Methods("POST")
+	router.HandleFunc("/api/me", monitor.handleGetMe).Methods("GET")
+	router.HandleFunc("/api/users", monitor.adminOnly(monitor.handleGetUsers)).Methods("GET")
+	router.HandleFunc("/api/users/{name}", monitor.adminOnly(monitor.handlePutUser)).Methods("PUT")
+	router.HandleFunc("/api/users/{name}", monitor.adminOnly(monitor.handleDeleteUser)).Methods("DELETE")
+
+	// Disruptive actions (two-step confirmation)
+	router.HandleFunc("/api/actions/{action}", monitor.adminOnly(monitor.handleAction)).Methods("POST")
+
+	// Per-device SLOs and reports
+	router.HandleFunc("/api/slo", monitor.handleGetSLOs).Methods("GET")
+	router.HandleFunc("/api/slo/{mac}", monitor.adminOnly(monitor.handlePutSLO)).Methods("PUT")
+	router.HandleFunc("/api/slo/{mac}", monitor.adminOnly(monitor.handleDeleteSLO)).Methods("DELETE")
+	router.HandleFunc("/api/reports/weekly", monitor.handleGetWeeklyReport).Methods("GET")
+	router.HandleFunc("/api/reports/weekly/text", monitor.handleGetWeeklyReportText).Methods("GET")
+	router.HandleFunc("/api/reports/discovery", monitor.handleGetDiscoveryReport).Methods("GET")
+
+	// Capture filter and profiles
+	router.HandleFunc("/api/capture/filter", monitor.handleGetFilter).Methods("GET")
+	router.HandleFunc("/api/capture/filter", monitor.adminOnly(monitor.handlePutFilter)).Methods("PUT")
+	router.HandleFunc("/api/capture/pause", monitor.handleGetCapturePause).Methods("GET")
+	router.HandleFunc("/api/capture/pause", monitor.adminOnly(monitor.handlePauseCapture)).Methods("POST")
+	router.HandleFunc("/api/capture/resume", monitor.adminOnly(monitor.handleResumeCapture)).Methods("POST")
+	router.HandleFunc("/api/capture/profile", monitor.handleGetProfile).Methods("GET")
+	router.HandleFunc("/api/capture/profile", monitor.adminOnly(monitor.handlePutProfile)).Methods("PUT")
+
+	// Alerts, heartbeat-silence rules and quotas
+	router.HandleFunc("/api/alerts", monitor.handleGetAlerts).Methods("GET")
+	router.HandleFunc("/api/alerts/{id}", monitor.handleGetAlert).Methods("GET")
+	router.HandleFunc("/api/alerts/{id}", monitor.adminOnly(monitor.handleUpdateAlert)).Methods("PATCH")
+	router.HandleFunc("/api/alerts/{id}/ack", monitor.adminOnly(monitor.handleAckAlert)).Methods("POST")
+	router.HandleFunc("/api/alerts/{id}/comments", monitor.handleCommentAlert).Methods("POST")
+	router.HandleFunc("/api/dns-filter", monitor.handleGetDNSFilter).Methods("GET")
+	router.HandleFunc("/api/signatures", monitor.handleGetSignatures).Methods("GET")
+	router.HandleFunc("/api/shaping", monitor.handleGetShaping).Methods("GET")
+	router.HandleFunc("/api/shaping/{mac}", monitor.adminOnly(monitor.handleLiftShaping)).Methods("DELETE")
+	router.HandleFunc("/api/heartbeats", monitor.handleGetHeartbeats).Methods("GET")
+	router.HandleFunc("/api/asymmetry", monitor.handleGetAsymmetry).Methods("GET")
+	router.HandleFunc("/api/heartbeats/{mac}", monitor.adminOnly(monitor.handlePutHeartbeat)).Methods("PUT")
+	router.HandleFunc("/api/heartbeats/{mac}", monitor.adminOnly(monitor.handleDeleteHeartbeat)).Methods("DELETE")
+	router.HandleFunc("/api/quotas", monitor.handleGetQuotas).Methods("GET")
+	router.HandleFunc("/api/quotas/{mac}", monitor.adminOnly(monitor.handlePutQuota)).Methods("PUT")
+	router.HandleFunc("/api/quotas/{mac}", monitor.adminOnly(monitor.handleDeleteQuota)).Methods("DELETE")
+
+	// Web Push subscriptions for alert notifications
+	router.HandleFunc("/api/push/key", monitor.handleGetPushKey).Methods("GET")
+	router.HandleFunc("/api/push/subscriptions", monitor.handlePostPushSubscription).Methods("POST")
+	router.HandleFunc("/api/push/subscriptions", monitor.handleDeletePushSubscription).Methods("DELETE")
+
+	// Saved dashboard views of the requesting user
+	router.HandleFunc("/api/views", monitor.handleGetViews).Methods("GET")
+	router.HandleFunc("/api/views/{name}", monitor.handleGetView).Methods("GET")
+	router.HandleFunc("/api/views/{name}", monitor.handlePutView).Methods("PUT")
+	router.HandleFunc("/api/views/{name}", monitor.handleDeleteView).Methods("DELETE")
+
+	// WebSocket client administration and API key metering
+	router.HandleFunc("/api/clients", monitor.handleGetClients).Methods("GET")
+	router.HandleFunc("/api/usage/api-keys", monitor.adminOnly(monitor.handleGetAPIKeyUsage)).Methods("GET")
+	router.HandleFunc("/api/clients/{id}", monitor.adminOnly(monitor.handleDisconnectClient)).Methods("DELETE")
+
+	// Configuration reload
+	router.HandleFunc("/api/admin/reload", monitor.adminOnly(monitor.handleReload)).Methods("POST")
+
+	// Hot standby replication
+	router.HandleFunc("/api/replication", monitor.handleGetReplication).Methods("GET")
+	router.HandleFunc("/api/replication/promote", monitor.adminOnly(monitor.handlePromote)).Methods("POST")
+
+	// Soak telemetry and Prometheus metrics
+	router.HandleFunc("/api/debug/soak", monitor.handleGetSoak).Methods("GET")
+	router.HandleFunc("/api/resources", monitor.handleGetResources).Methods("GET")
+	router.Handle("/metrics", monitor.metricsHandler()).Methods("GET")
+
+	// Server-Sent Events alternative to the WebSocket
+	router.HandleFunc("/api/stream", monitor.handleStream).Methods("GET")
 
 	// WebSocket route
 	router.HandleFunc("/ws", monitor.handleWebSocket)
 
+	// Frontend dev server for everything else
+	if *proxyFrontendPtr != "" {
+		proxy, err := frontendProxy(*proxyFrontendPtr)
+		if err != nil {
+			log.Fatalf("Invalid -proxy-frontend: %v", err)
+		}
+		router.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return !strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/metrics"
+		}).Handler(proxy)
+		log.Printf("Proxying the frontend to %s", *proxyFrontendPtr)
+	}
+
 	// CORS configuration
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 	})
 
-	handler := c.Handler(router)
+	handler := securityHeaders(c.Handler(monitor.rateLimit(monitor.requireAuth(router))))
 
 	// Start HTTP server
 	addr := *hostPtr + ":" + *portPtr
 	server := &http.Server{
-		Addr:         addr,
-		Handler:      handler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
+	server.TLSConfig, err = tlsConfig(*tlsCertPtr, *tlsKeyPtr, *tlsSelfSignedPtr, *dataDirPtr, certificateHosts(*hostPtr, localIP))
+	if err != nil {
+		log.Fatalf("Error setting up TLS: %v", err)
+	}
+	var redirectServer *http.Server
+	if *httpRedirectPortPtr != "" {
+		if server.TLSConfig == nil {
+			log.Fatalf("-http-redirect-port needs TLS (-tls-cert or -tls-self-signed)")
+		}
+		redirectServer = &http.Server{
+			Addr:              *hostPtr + ":" + *httpRedirectPortPtr,
+			Handler:           httpsRedirect(*portPtr),
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: readHeaderTimeout,
+			WriteTimeout:      15 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			MaxHeaderBytes:    maxHeaderBytes,
+		}
+		go func() {
+			log.Printf("Redirecting HTTP on %s to HTTPS", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("HTTP redirect server error: %v", err)
+			}
+		}()
+	}
+
+	// Replication server for followers
+	var replicationServer *grpc.Server
+	if *replicationListenPtr != "" {
+		lis, err := net.Listen("tcp", *replicationListenPtr)
+		if err != nil {
+			log.Fatalf("Error listening for followers: %v", err)
+		}
+		replicationServer = monitor.newReplicationServer(server.TLSConfig)
+		go func() {
+			log.Printf("Replication server starting on %s", *replicationListenPtr)
+			if err := replicationServer.Serve(lis); err != nil {
+				log.Printf("Replication server error: %v", err)
+			}
+		}()
 	}
 
 	// Graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// SIGHUP reloads the configuration
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			monitor.reloadLogged("SIGHUP")
+		}
+	}()
+
+	// SIGUSR1 prints the run summary
+	if len(summarySignals) > 0 {
+		usrChan := make(chan os.Signal, 1)
+		signal.Notify(usrChan, summarySignals...)
+		go func() {
+			for range usrChan {
+				monitor.reportSummary(*summaryFilePtr)
+			}
+		}()
+	}
+
 	go func() {
-		log.Printf("Server starting on %s", addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			log.Printf("Server starting on %s (HTTPS)", addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Server starting on %s", addr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
 
 	<-sigChan
 	log.Println("\nShutting down server...")
-	// stop resolver
-	close(stopResolve)
+	// Summarize while the capture handles still hold their counters
+	monitor.reportSummary(*summaryFilePtr)
+	// stop background workers and capture
+	close(stopWorkers)
+	close(stopCapture)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	server.Shutdown(ctx)
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	if replicationServer != nil {
+		replicationServer.Stop()
+	}
+	// Lift device limits nothing would remove after exit
+	if monitor.shaping != nil {
+		monitor.shaping.liftAll()
+	}
+	// Report flows still open so the flow history is complete
+	monitor.flows.expire(time.Now(), true)
+	// Keep the minute in progress
+	if monitor.series != nil {
+		monitor.flushSeries()
+	}
+	for _, src := range monitor.captures {
+		if src.pcapOut != nil {
+			src.pcapOut.Close()
+		}
+	}
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultDeviceArchive is how many evicted devices are kept by default
+const defaultDeviceArchive = 1000
+
+// ArchivedDevice is the last state of a device evicted for inactivity
+type ArchivedDevice struct {
+	DeviceStats
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+// deviceArchive keeps the devices evicted from the live map, newest
+// eviction per device, up to limit. Networks with MAC randomization evict
+// a steady stream of one-off devices, so the archive is bounded too.
+type deviceArchive struct {
+	mu      sync.Mutex
+	limit   int // 0 disables the archive
+	devices map[string]ArchivedDevice
+}
+
+// newDeviceArchive creates an archive holding up to limit devices
+func newDeviceArchive(limit int) *deviceArchive {
+	return &deviceArchive{limit: limit, devices: make(map[string]ArchivedDevice)}
+}
+
+// add archives evicted devices, dropping the longest archived over the limit
+func (a *deviceArchive) add(devices []DeviceStats, now time.Time) {
+	if a.limit <= 0 || len(devices) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, d := range devices {
+		d.RateSentBps, d.RateRecvBps, d.RecentBytes = 0, 0, 0
+		d.nat, d.rate = nil, nil
+		key := d.MAC
+		if key == "" {
+			key = d.IP
+		}
+		a.devices[key] = ArchivedDevice{DeviceStats: d, ArchivedAt: now}
+	}
+	if len(a.devices) <= a.limit {
+		return
+	}
+	for _, d := range a.sorted()[a.limit:] {
+		key := d.MAC
+		if key == "" {
+			key = d.IP
+		}
+		delete(a.devices, key)
+	}
+}
+
+// sorted returns the archive newest eviction first; caller holds a.mu
+func (a *deviceArchive) sorted() []ArchivedDevice {
+	list := make([]ArchivedDevice, 0, len(a.devices))
+	for _, d := range a.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].ArchivedAt.Equal(list[j].ArchivedAt) {
+			return list[i].ArchivedAt.After(list[j].ArchivedAt)
+		}
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list
+}
+
+// list returns the archive newest eviction first
+func (a *deviceArchive) list() []ArchivedDevice {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sorted()
+}
+
+// REST API: Devices evicted for inactivity (-device-ttl), newest first
+func (bm *BandwidthMonitor) handleGetArchivedDevices(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.archive.list())
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// maxASNsPerDevice caps the per-device AS breakdown (see resourceProfile)
+var maxASNsPerDevice = 500
+
+// asnRange is one row of the AS database
+type asnRange struct {
+	start, end [16]byte // IPv4 stored as IPv4-in-IPv6
+	asn        uint32
+	name       string
+}
+
+// ASNInfo identifies an autonomous system
+type ASNInfo struct {
+	Number uint32 `json:"asn"`
+	Name   string `json:"name"`
+}
+
+// Label formats the AS as e.g. "AS15169 Google"
+func (a ASNInfo) Label() string {
+	if a.Name == "" {
+		return fmt.Sprintf("AS%d", a.Number)
+	}
+	return fmt.Sprintf("AS%d %s", a.Number, a.Name)
+}
+
+// asnDB looks up the AS of an IP address. It reads the tab-separated
+// iptoasn.com format (range_start, range_end, AS_number, country, AS_name),
+// optionally gzip-compressed, covering IPv4 and IPv6.
+type asnDB struct {
+	ranges []asnRange // sorted by start
+}
+
+// loadASNDB reads an AS database file
+func loadASNDB(path string) (*asnDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	db := &asnDB{}
+	names := make(map[string]string) // interned AS names
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		asn, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil || asn == 0 {
+			// AS 0 marks unrouted space
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("%s:%d: invalid address range", path, line)
+		}
+		name, ok := names[fields[4]]
+		if !ok {
+			name = fields[4]
+			names[name] = name
+		}
+		var rng asnRange
+		copy(rng.start[:], start.To16())
+		copy(rng.end[:], end.To16())
+		rng.asn = uint32(asn)
+		rng.name = name
+		db.ranges = append(db.ranges, rng)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return bytes.Compare(db.ranges[i].start[:], db.ranges[j].start[:]) < 0
+	})
+	return db, nil
+}
+
+// lookup returns the AS announcing ip
+func (db *asnDB) lookup(ip net.IP) (ASNInfo, bool) {
+	if db == nil {
+		return ASNInfo{}, false
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ASNInfo{}, false
+	}
+	// Last range starting at or before ip
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return bytes.Compare(db.ranges[i].start[:], ip16) > 0
+	}) - 1
+	if i < 0 || bytes.Compare(ip16, db.ranges[i].end[:]) > 0 {
+		return ASNInfo{}, false
+	}
+	return ASNInfo{Number: db.ranges[i].asn, Name: db.ranges[i].name}, true
+}
+
+// ASNUsage is a device's traffic with one AS
+type ASNUsage struct {
+	ASNInfo
+	Label     string `json:"label"`
+	BytesSent uint64 `json:"bytesSent"`
+	BytesRecv uint64 `json:"bytesRecv"`
+}
+
+// asnUsage accumulates per-device traffic by AS
+type asnUsage struct {
+	mu      sync.Mutex
+	devices map[string]map[uint32]*ASNUsage
+}
+
+// newASNUsage creates an empty per-device AS accumulator
+func newASNUsage() *asnUsage {
+	return &asnUsage{devices: make(map[string]map[uint32]*ASNUsage)}
+}
+
+// add records size bytes between device and the AS
+func (u *asnUsage) add(device string, as ASNInfo, size uint64, sent bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	byAS, ok := u.devices[device]
+	if !ok {
+		byAS = make(map[uint32]*ASNUsage)
+		u.devices[device] = byAS
+	}
+	entry, ok := byAS[as.Number]
+	if !ok {
+		if len(byAS) >= maxASNsPerDevice {
+			return
+		}
+		entry = &ASNUsage{ASNInfo: as, Label: as.Label()}
+		byAS[as.Number] = entry
+	}
+	if sent {
+		entry.BytesSent += size
+	} else {
+		entry.BytesRecv += size
+	}
+}
+
+// forget drops the AS breakdown of device
+func (u *asnUsage) forget(device string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.devices, device)
+}
+
+// reset drops the AS breakdown of every device
+func (u *asnUsage) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.devices = make(map[string]map[uint32]*ASNUsage)
+}
+
+// top returns the n ASes the device exchanged most bytes with
+func (u *asnUsage) top(device string, n int) []ASNUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make([]ASNUsage, 0, len(u.devices[device]))
+	for _, entry := range u.devices[device] {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti, tj := result[i].BytesSent+result[i].BytesRecv, result[j].BytesSent+result[j].BytesRecv
+		if ti != tj {
+			return ti > tj
+		}
+		return result[i].Label < result[j].Label
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// externalPeer works out which side of a packet is the local device and
+// which the internet peer. ok is false unless exactly one side is private.
+func (bm *BandwidthMonitor) externalPeer(srcMAC, dstMAC, srcIP, dstIP string) (device string, peer net.IP, sent, ok bool) {
+	src, dst := net.ParseIP(srcIP), net.ParseIP(dstIP)
+	if src == nil || dst == nil {
+		return "", nil, false, false
+	}
+	switch {
+	case src.IsPrivate() && isPublicIP(dst):
+		device, peer, sent = bm.deviceKey(srcMAC, srcIP), dst, true
+	case dst.IsPrivate() && isPublicIP(src):
+		device, peer, sent = bm.deviceKey(dstMAC, dstIP), src, false
+	default:
+		return "", nil, false, false
+	}
+	return device, peer, sent, device != ""
+}
+
+// ObserveASN accounts a packet to the AS of its internet peer
+func (bm *BandwidthMonitor) ObserveASN(srcMAC, dstMAC, srcIP, dstIP string, size uint64) {
+	if bm.asnDB == nil {
+		return
+	}
+	device, peer, sent, ok := bm.externalPeer(srcMAC, dstMAC, srcIP, dstIP)
+	if !ok {
+		return
+	}
+	if as, found := bm.asnDB.lookup(peer); found {
+		bm.asnUsage.add(device, as, size, sent)
+	}
+}
+
+// REST API: Top ASes a device talks to (?n=, default 10)
+func (bm *BandwidthMonitor) handleGetDeviceASNs(w http.ResponseWriter, r *http.Request) {
+	if bm.asnDB == nil {
+		http.Error(w, "No AS database loaded (start with -asn-db)", http.StatusNotFound)
+		return
+	}
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeEncoded(w, r, bm.asnUsage.top(mux.Vars(r)["mac"], n))
+}
+
+// REST API: Look up the AS of an IP address
+func (bm *BandwidthMonitor) handleGetASN(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(mux.Vars(r)["ip"])
+	if ip == nil {
+		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+		return
+	}
+	as, ok := bm.asnDB.lookup(ip)
+	if !ok {
+		http.Error(w, "AS not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, ASNUsage{ASNInfo: as, Label: as.Label()})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AsymmetryStatus is a device's upload and download over the asymmetry window
+type AsymmetryStatus struct {
+	Device     string  `json:"device"`
+	Name       string  `json:"name,omitempty"`
+	Uploaded   uint64  `json:"uploaded"` // bytes
+	Downloaded uint64  `json:"downloaded"`
+	Ratio      float64 `json:"ratio"`    // upload per downloaded byte; upload itself without downloads
+	Alerting   bool    `json:"alerting"` // alert raised and the ratio still exceeded
+	WindowSec  int     `json:"windowSec"`
+}
+
+// asymmetrySample is a device's counters at one evaluation
+type asymmetrySample struct {
+	at         time.Time
+	sent, recv uint64
+}
+
+// asymmetryState tracks one device between evaluations
+type asymmetryState struct {
+	samples []asymmetrySample // oldest first, spanning the window
+	alerted bool
+}
+
+// asymmetryMonitor raises "upload-asymmetry" alerts for devices uploading
+// more than ratio times what they download over a sliding window, the
+// signature of exfiltration or a cloud backup gone wrong. Devices uploading
+// less than minBytes in the window are ignored, so an idle device sending a
+// few keepalives is no alarm.
+type asymmetryMonitor struct {
+	mu       sync.Mutex
+	ratio    float64
+	window   time.Duration
+	minBytes uint64
+	state    map[string]*asymmetryState
+	names    map[string]string
+}
+
+// newAsymmetryMonitor creates a monitor alerting above ratio over window
+func newAsymmetryMonitor(ratio float64, window time.Duration, minBytes uint64) *asymmetryMonitor {
+	return &asymmetryMonitor{
+		ratio:    ratio,
+		window:   window,
+		minBytes: minBytes,
+		state:    make(map[string]*asymmetryState),
+		names:    make(map[string]string),
+	}
+}
+
+// asymmetryRatio is upload per downloaded byte, the upload itself when
+// nothing was downloaded
+func asymmetryRatio(sent, recv uint64) float64 {
+	return float64(sent) / float64(max(recv, 1))
+}
+
+// window returns the upload and download over the samples of st
+func (st *asymmetryState) window() (sent, recv uint64) {
+	if len(st.samples) < 2 {
+		return 0, 0
+	}
+	first, last := st.samples[0], st.samples[len(st.samples)-1]
+	return last.sent - first.sent, last.recv - first.recv
+}
+
+// evaluate samples every device's counters and alerts on the ones whose
+// upload over the window exceeds the ratio
+func (a *asymmetryMonitor) evaluate(bm *BandwidthMonitor, now time.Time) {
+	totals := make(map[string]asymmetrySample)
+	names := make(map[string]string)
+	bm.mutex.RLock()
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		if !bm.includeDevice(dev) {
+			return
+		}
+		totals[key] = asymmetrySample{at: now, sent: dev.BytesSent, recv: dev.BytesRecv}
+		names[key] = dev.friendlyName()
+	})
+	bm.mutex.RUnlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.names = names
+	for key := range a.state {
+		if _, ok := totals[key]; !ok {
+			delete(a.state, key)
+		}
+	}
+	for key, sample := range totals {
+		st, ok := a.state[key]
+		if !ok {
+			st = &asymmetryState{}
+			a.state[key] = st
+		}
+		// Counters reset: start the window over
+		if n := len(st.samples); n > 0 && (sample.sent < st.samples[n-1].sent || sample.recv < st.samples[n-1].recv) {
+			st.samples = st.samples[:0]
+		}
+		st.samples = append(st.samples, sample)
+		// Keep one sample at or before the window start, so the window is whole
+		for len(st.samples) > 2 && now.Sub(st.samples[1].at) >= a.window {
+			st.samples = st.samples[1:]
+		}
+		// Not alerting until a whole window was seen
+		if now.Sub(st.samples[0].at) < a.window {
+			continue
+		}
+
+		sent, recv := st.window()
+		ratio := asymmetryRatio(sent, recv)
+		if sent < a.minBytes || ratio <= a.ratio {
+			st.alerted = false
+			continue
+		}
+		if st.alerted {
+			continue
+		}
+		st.alerted = true
+		label := key
+		if names[key] != "" {
+			label = names[key] + " (" + key + ")"
+		}
+		if recv == 0 {
+			bm.alerts.raise("upload-asymmetry", SeverityWarning, key,
+				"%s uploaded %.1f MB and downloaded nothing in the last %v", label, float64(sent)/(1<<20), a.window)
+			continue
+		}
+		bm.alerts.raise("upload-asymmetry", SeverityWarning, key,
+			"%s uploaded %.1f MB but downloaded %.1f MB in the last %v (%.1fx, limit %.1fx)",
+			label, float64(sent)/(1<<20), float64(recv)/(1<<20), a.window, ratio, a.ratio)
+	}
+}
+
+// statuses returns the devices with a whole window, most asymmetric first
+func (a *asymmetryMonitor) statuses() []AsymmetryStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make([]AsymmetryStatus, 0, len(a.state))
+	for key, st := range a.state {
+		if len(st.samples) < 2 {
+			continue
+		}
+		sent, recv := st.window()
+		result = append(result, AsymmetryStatus{
+			Device:     key,
+			Name:       a.names[key],
+			Uploaded:   sent,
+			Downloaded: recv,
+			Ratio:      asymmetryRatio(sent, recv),
+			Alerting:   st.alerted,
+			WindowSec:  int(st.samples[len(st.samples)-1].at.Sub(st.samples[0].at) / time.Second),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Ratio != result[j].Ratio {
+			return result[i].Ratio > result[j].Ratio
+		}
+		return result[i].Device < result[j].Device
+	})
+	return result
+}
+
+// watchAsymmetryPeriodically evaluates upload asymmetry once per minute until stop is closed
+func (bm *BandwidthMonitor) watchAsymmetryPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.asymmetry.evaluate(bm, now)
+		}
+	}
+}
+
+// REST API: Per-device upload and download over the asymmetry window
+func (bm *BandwidthMonitor) handleGetAsymmetry(w http.ResponseWriter, r *http.Request) {
+	if bm.asymmetry == nil {
+		http.Error(w, "Asymmetry alerts not configured (-asymmetry-ratio)", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, bm.asymmetry.statuses())
+}
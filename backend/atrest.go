@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Encrypted data is marked so plaintext written before encryption was
+// enabled still loads (and is encrypted on its next save)
+const (
+	// encryptedFileMagic starts an encrypted document file, followed by
+	// the nonce and the AES-256-GCM sealed JSON
+	encryptedFileMagic = "LANTT-ENC1\n"
+	// encryptedValuePrefix starts the base64 of a sealed value in a store
+	// or a journal line, kept as a JSON string so every backend accepts it
+	encryptedValuePrefix = "enc1:"
+)
+
+// atRest encrypts persisted runtime state (stores, -*-file documents, the
+// history journal) when a key is configured; nil stores plaintext
+var atRest *atRestCipher
+
+// atRestCipher seals persisted data with AES-256-GCM
+type atRestCipher struct {
+	aead cipher.AEAD
+}
+
+// parseEncryptionKey decodes a 256-bit key given as 64 hex digits or base64,
+// e.g. from "openssl rand -hex 32"
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("want a 256-bit key as 64 hex digits or base64 (openssl rand -hex 32)")
+}
+
+// loadEncryptionKey returns the key given directly or, when key is empty,
+// read from the file at path; nil when neither is set
+func loadEncryptionKey(key, path string) (*atRestCipher, error) {
+	if key == "" && path == "" {
+		return nil, nil
+	}
+	if key == "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key = string(data)
+	}
+	raw, err := parseEncryptionKey(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &atRestCipher{aead: aead}, nil
+}
+
+// seal encrypts data under a fresh nonce, which it prepends
+func (c *atRestCipher) seal(data []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // the system's randomness source failed
+	}
+	return c.aead.Seal(nonce, nonce, data, nil)
+}
+
+// open decrypts data sealed by seal
+func (c *atRestCipher) open(sealed []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("encrypted data truncated")
+	}
+	data, err := c.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt (wrong encryption key?)")
+	}
+	return data, nil
+}
+
+// sealFile returns the contents of an encrypted document file
+func (c *atRestCipher) sealFile(data []byte) []byte {
+	return append([]byte(encryptedFileMagic), c.seal(data)...)
+}
+
+// openFile returns the JSON of a document file, decrypting it when it is
+// encrypted
+func (c *atRestCipher) openFile(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encryptedFileMagic)) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, errors.New("file is encrypted; set -encryption-key or -encryption-key-file")
+	}
+	return c.open(data[len(encryptedFileMagic):])
+}
+
+// sealValue returns data sealed into a JSON string
+func (c *atRestCipher) sealValue(data []byte) []byte {
+	value, _ := json.Marshal(encryptedValuePrefix + base64.StdEncoding.EncodeToString(c.seal(data)))
+	return value
+}
+
+// openValue returns the JSON of a value sealed by sealValue, or value
+// itself when it is plaintext
+func (c *atRestCipher) openValue(value []byte) ([]byte, error) {
+	var s string
+	if !bytes.HasPrefix(value, []byte(`"`+encryptedValuePrefix)) || json.Unmarshal(value, &s) != nil {
+		return value, nil
+	}
+	if c == nil {
+		return nil, errors.New("value is encrypted; set -encryption-key or -encryption-key-file")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedValuePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted value: %v", err)
+	}
+	return c.open(sealed)
+}
+
+// loadDocumentFile is loadJSONFile for runtime state, which may be
+// encrypted
+func loadDocumentFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if data, err = atRest.openFile(data); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveDocumentFile is saveJSONFile for runtime state, encrypting it when a
+// key is configured
+func saveDocumentFile(path string, v interface{}) error {
+	if atRest == nil {
+		return saveJSONFile(path, v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, atRest.sealFile(data))
+}
+
+// encryptedStore encrypts the values of a Store; plaintext values written
+// before encryption was enabled are still read
+type encryptedStore struct {
+	Store
+	c *atRestCipher
+}
+
+func (s encryptedStore) Get(bucket, key string) ([]byte, error) {
+	value, err := s.Store.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.c.openValue(value)
+}
+
+func (s encryptedStore) Put(bucket, key string, value []byte) error {
+	return s.Store.Put(bucket, key, s.c.sealValue(value))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Batching limits for per-worker accounting
+const (
+	batchFlushInterval = 250 * time.Millisecond
+	batchMaxEntries    = 4096
+	statsQueueSize     = 65536 // packets buffered between capture and accounting
+)
+
+// statsAccounter receives per-packet device accounting. BandwidthMonitor
+// applies it directly; statsBatch accumulates it for a capture worker.
+type statsAccounter interface {
+	UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, protocol string, packetSize, packets uint64)
+}
+
+// statsKey identifies packets that account identically
+type statsKey struct {
+	iface, srcMAC, dstMAC, srcIP, dstIP, protocol string
+}
+
+// statsDelta is the traffic accumulated for one statsKey
+type statsDelta struct {
+	bytes, packets uint64
+}
+
+// statsBatch collects a capture worker's device accounting and merges it
+// into the monitor periodically, so parallel workers do not contend for
+// bm.mutex on every packet. Packets of one conversation share a key, so a
+// batch stays small even at high packet rates. All packets of a batch were
+// captured in the same reset epoch.
+type statsBatch struct {
+	bm        *BandwidthMonitor
+	pending   map[statsKey]*statsDelta
+	epoch     uint64
+	lastFlush time.Time
+}
+
+// resetLog numbers the counter resets, so that packets captured before one
+// but accounted after it are dropped rather than bringing back the counts
+// it cleared. Every packet carries the epoch it was captured in.
+type resetLog struct {
+	epoch atomic.Uint64
+	// Epochs of the last ResetStats and of each device's last ResetDevice;
+	// guarded by bm.mutex
+	all     uint64
+	devices map[string]uint64
+}
+
+// next starts a new epoch and returns it; caller holds bm.mutex
+func (l *resetLog) next() uint64 {
+	return l.epoch.Add(1)
+}
+
+// newStatsBatch creates an empty batch merging into bm
+func newStatsBatch(bm *BandwidthMonitor) *statsBatch {
+	return &statsBatch{bm: bm, pending: make(map[statsKey]*statsDelta), lastFlush: time.Now()}
+}
+
+// UpdateStatsWeighted accumulates one packet
+func (b *statsBatch) UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, protocol string, packetSize, packets uint64) {
+	b.add(statsRecord{statsKey{iface, srcMAC, dstMAC, srcIP, dstIP, protocol}, packetSize, packets, b.bm.resets.epoch.Load()})
+}
+
+// add accumulates one queued packet. A packet from a new epoch first
+// flushes the packets of the previous one.
+func (b *statsBatch) add(rec statsRecord) {
+	if len(b.pending) > 0 && rec.epoch != b.epoch {
+		b.flush(time.Now())
+	}
+	b.epoch = rec.epoch
+	d, ok := b.pending[rec.key]
+	if !ok {
+		d = &statsDelta{}
+		b.pending[rec.key] = d
+	}
+	d.bytes += rec.bytes
+	d.packets += rec.packets
+}
+
+// flushIfDue merges the batch when it is old or large enough
+func (b *statsBatch) flushIfDue(now time.Time) {
+	if len(b.pending) >= batchMaxEntries || now.Sub(b.lastFlush) >= batchFlushInterval {
+		b.flush(now)
+	}
+}
+
+// flush merges everything accumulated into the monitor
+func (b *statsBatch) flush(now time.Time) {
+	if len(b.pending) > 0 {
+		b.bm.applyBatch(b.pending, b.epoch)
+	}
+	clear(b.pending)
+	b.lastFlush = now
+}
+
+// applyBatch accounts the packets of a batch captured in epoch, except for
+// the devices reset since
+func (bm *BandwidthMonitor) applyBatch(pending map[statsKey]*statsDelta, epoch uint64) {
+	now := time.Now()
+	bm.makeRoomIfFull(now)
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	if epoch < bm.resets.all {
+		return
+	}
+	stale := func(key string) bool { return bm.resets.devices[key] > epoch }
+	for k, d := range pending {
+		bm.account(now, k, d.bytes, d.packets, stale)
+	}
+}
+
+// statsRecord is one packet handed from capture to the accounting worker
+type statsRecord struct {
+	key            statsKey
+	bytes, packets uint64
+	epoch          uint64 // reset epoch the packet was captured in
+}
+
+// statsQueue decouples a capture loop from accounting: packets are queued
+// and a single worker (runAccounting) batches them into the monitor, so the
+// capture loop never waits for bm.mutex and reads the next packet before
+// the kernel buffer fills.
+type statsQueue struct {
+	records chan statsRecord
+	stalls  atomic.Uint64  // packets that waited for room in a full queue
+	epoch   *atomic.Uint64 // the monitor's reset epoch
+}
+
+// newStatsQueue creates an empty queue tagging packets with the reset
+// epoch of resets
+func newStatsQueue(resets *resetLog) *statsQueue {
+	return &statsQueue{records: make(chan statsRecord, statsQueueSize), epoch: &resets.epoch}
+}
+
+// UpdateStatsWeighted queues one packet, waiting if the worker has fallen
+// a whole queue behind
+func (q *statsQueue) UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, protocol string, packetSize, packets uint64) {
+	rec := statsRecord{statsKey{iface, srcMAC, dstMAC, srcIP, dstIP, protocol}, packetSize, packets, q.epoch.Load()}
+	select {
+	case q.records <- rec:
+	default:
+		q.stalls.Add(1)
+		q.records <- rec
+	}
+}
+
+// QueueUsage is how full the accounting queue is
+type QueueUsage struct {
+	Length   int    `json:"length"`
+	Capacity int    `json:"capacity"`
+	Stalls   uint64 `json:"stalls"` // packets capture had to wait to queue
+}
+
+// usage reports the queue's fill level
+func (q *statsQueue) usage() QueueUsage {
+	return QueueUsage{Length: len(q.records), Capacity: cap(q.records), Stalls: q.stalls.Load()}
+}
+
+// runAccounting merges queued packets into the monitor in batches until
+// stop is closed. Whatever is queued at a time is taken in one go, so the
+// batch absorbs bursts and bm.mutex is taken once per conversation and
+// flush rather than once per packet.
+func (bm *BandwidthMonitor) runAccounting(stop <-chan struct{}) {
+	batch := newStatsBatch(bm)
+	defer func() { batch.flush(time.Now()) }()
+	ticker := time.NewTicker(batchFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			// Account everything captured so far, a full batch at a time
+			for {
+				bm.statsQueue.drainInto(batch)
+				if len(batch.pending) < batchMaxEntries {
+					return
+				}
+				batch.flush(time.Now())
+			}
+		case now := <-ticker.C:
+			if len(batch.pending) > 0 {
+				batch.flush(now)
+			}
+		case rec := <-bm.statsQueue.records:
+			batch.add(rec)
+			bm.statsQueue.drainInto(batch)
+			batch.flushIfDue(time.Now())
+		}
+	}
+}
+
+// withAccounting runs capture, which feeds bm.statsQueue, with an
+// accounting worker behind it. Once capture returns the worker accounts
+// what is still queued, so the device table is complete on return.
+func (bm *BandwidthMonitor) withAccounting(capture func()) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		bm.runAccounting(stop)
+		close(done)
+	}()
+	capture()
+	close(stop)
+	<-done
+}
+
+// drainInto moves the queued packets into batch without waiting for more,
+// stopping early once the batch is full
+func (q *statsQueue) drainInto(batch *statsBatch) {
+	for len(batch.pending) < batchMaxEntries {
+		select {
+		case rec := <-q.records:
+			batch.add(rec)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// Build identification, set with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) \
+//	  -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them the commit and date come from the VCS stamp Go embeds when
+// building from a checkout.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// Features is what this instance was built and started with
+type Features struct {
+	Libpcap        string   `json:"libpcap"`        // libpcap version string
+	CaptureEngines []string `json:"captureEngines"` // engines in use, e.g. pcap, afpacket, ebpf-xdp
+	AFPacket       bool     `json:"afpacket"`       // AF_PACKET capture available on this platform
+	TLS            bool     `json:"tls"`
+	Store          string   `json:"store,omitempty"` // json, bolt or sqlite
+	HistoryDB      bool     `json:"historyDb"`
+	GeoIP          string   `json:"geoip,omitempty"` // GeoIP database type, e.g. GeoLite2-City
+	Encryption     bool     `json:"encryption"`      // persisted state encrypted at rest
+	Auth           bool     `json:"auth"`            // WebSocket token, API keys or accounts
+	FlowExport     string   `json:"flowExport,omitempty"`
+	Collector      []string `json:"collector,omitempty"` // netflow, sflow
+}
+
+// BuildInfo identifies the running build for bug reports and upgrade
+// automation
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	Modified  bool     `json:"modified,omitempty"` // built from a checkout with local changes
+	BuildDate string   `json:"buildDate,omitempty"`
+	GoVersion string   `json:"goVersion"`
+	Platform  string   `json:"platform"` // GOOS/GOARCH
+	Features  Features `json:"features"`
+}
+
+// buildInfo returns the build identification, filling what ldflags left
+// unset from the embedded VCS stamp
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+				if len(info.Commit) > 12 {
+					info.Commit = info.Commit[:12]
+				}
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			case s.Key == "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+// versionString is the one-line form printed by -version
+func (b BuildInfo) versionString() string {
+	s := "lantt " + b.Version
+	if b.Commit != "" {
+		s += " (" + b.Commit
+		if b.Modified {
+			s += "-dirty"
+		}
+		s += ")"
+	}
+	if b.BuildDate != "" {
+		s += " built " + b.BuildDate
+	}
+	return fmt.Sprintf("%s, %s %s, %s", s, b.GoVersion, b.Platform, pcap.Version())
+}
+
+// REST API: Version, build and enabled features
+func (bm *BandwidthMonitor) handleGetVersion(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo()
+	info.Features = bm.features
+	writeEncoded(w, r, info)
+}
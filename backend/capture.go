@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureReadTimeout is how long a capture read waits for packets before
+// the loop checks for stop and restart requests (-pcap-timeout)
+const captureReadTimeout = 100 * time.Millisecond
+
+// defaultSnaplen captures all headers plus the start of the payload for
+// name services and signature rules (-snaplen)
+const defaultSnaplen = 1600
+
+// captureSource describes how to open the live capture handle of one
+// interface, so the capture can be reopened on restart with the same settings.
+type captureSource struct {
+	device  string
+	snaplen int32
+	promisc bool
+	timeout time.Duration
+	// bufferSize is the kernel capture buffer in bytes; 0 keeps the
+	// libpcap default (2 MB on Linux)
+	bufferSize int
+	// restart signals the capture loop to reopen its handle
+	restart chan struct{}
+	// optional rolling pcap copy of this interface's packets
+	pcapOut *rollingPcapWriter
+	// engine is CaptureEnginePcap or CaptureEngineAFPacket
+	engine string
+	// fanout > 1 spreads the capture over that many AF_PACKET workers
+	fanout int
+	// ebpf counts the traffic in the kernel (EBPFModeXDP or EBPFModeTC)
+	// and passes 1 in ebpfSample packets up; empty captures with pcap
+	ebpf       string
+	ebpfSample uint64
+}
+
+// Capture engines (-capture-engine)
+const (
+	CaptureEnginePcap     = "pcap"     // libpcap handle
+	CaptureEngineAFPacket = "afpacket" // Linux TPACKETv3 rings, as fanout uses
+)
+
+// afpacket reports whether the source captures with AF_PACKET sockets
+// rather than its pcap handle; fanout always does
+func (cs captureSource) afpacket() bool {
+	return cs.engine == CaptureEngineAFPacket || cs.fanout > 1
+}
+
+// open opens a live pcap handle for the source
+func (cs captureSource) open() (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(cs.device)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+	if err := inactive.SetSnapLen(int(cs.snaplen)); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(cs.promisc); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(cs.timeout); err != nil {
+		return nil, err
+	}
+	if cs.bufferSize > 0 {
+		if err := inactive.SetBufferSize(cs.bufferSize); err != nil {
+			return nil, err
+		}
+	}
+	return inactive.Activate()
+}
+
+// runCapture feeds packets from handle into the monitor until stop is closed.
+// A signal on src.restart closes the handle and reopens it from src.
+// A nil handle is opened from src first, which is how the supervisor resumes
+// capture after a panic.
+func (bm *BandwidthMonitor) runCapture(src captureSource, handle *pcap.Handle, stop <-chan struct{}) {
+	if src.afpacket() {
+		// The pcap handle only served to validate the device and filter
+		if handle != nil {
+			handle.Close()
+		}
+		bm.runFanoutCapture(src, stop)
+		return
+	}
+	if src.ebpf != "" && bm.runEBPFCapture(src, handle, stop) {
+		return
+	}
+	for {
+		if handle == nil {
+			if !bm.pause.wait(stop) {
+				return
+			}
+			if handle = bm.reopenCapture(src, stop); handle == nil {
+				return
+			}
+		}
+
+		restart, stopped := bm.readPackets(src, handle, stop)
+		handle = nil
+		if stopped {
+			return
+		}
+		if !restart {
+			log.Printf("Capture on %s ended", src.device)
+			return
+		}
+		log.Printf("Restarting capture on %s", src.device)
+	}
+}
+
+// reopenCapture opens src, retrying until it succeeds; it returns nil if
+// stop is closed first.
+func (bm *BandwidthMonitor) reopenCapture(src captureSource, stop <-chan struct{}) *pcap.Handle {
+	for {
+		handle, err := src.open()
+		if err == nil {
+			if err = bm.applyCaptureFilter(handle); err == nil {
+				return handle
+			}
+			handle.Close()
+		}
+		log.Printf("Error reopening device %s: %v", src.device, err)
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// readPackets processes packets from handle until the source ends, a restart
+// is requested or stop is closed. The handle is always closed on return,
+// including when a packet panics.
+func (bm *BandwidthMonitor) readPackets(src captureSource, handle *pcap.Handle, stop <-chan struct{}) (restart, stopped bool) {
+	bm.setCaptureHandle(src.device, handle)
+	defer func() {
+		bm.setCaptureHandle(src.device, nil)
+		handle.Close()
+	}()
+
+	dec := newPacketDecoder(handle.LinkType())
+	if dec.strategy == linkUnknown {
+		log.Printf("Link type %v on %s has no MAC handling; attributing by IP only", handle.LinkType(), src.device)
+	}
+
+	if src.pcapOut != nil {
+		// Files take LINKTYPE values; raw IP is the one DLT that differs
+		linkType := handle.LinkType()
+		if linkType == 12 || linkType == 14 {
+			linkType = layers.LinkTypeRaw
+		}
+		if err := src.pcapOut.start(linkType, uint32(handle.SnapLen())); err != nil {
+			log.Printf("Error starting pcap file: %v", err)
+		}
+	}
+
+	// Reads return every captureReadTimeout without packets, so stop and
+	// restart are noticed on an idle link
+	for {
+		select {
+		case <-stop:
+			return false, true
+		case <-src.restart:
+			return true, false
+		default:
+		}
+		data, ci, err := handle.ZeroCopyReadPacketData()
+		switch {
+		case err == pcap.NextErrorTimeoutExpired:
+			continue
+		case err == io.EOF:
+			return false, false
+		case err != nil:
+			log.Printf("Error reading packets on %s: %v", src.device, err)
+			time.Sleep(captureReadTimeout)
+			continue
+		}
+		if bm.pause.paused.Load() {
+			continue
+		}
+		if src.pcapOut != nil {
+			src.pcapOut.write(ci, data)
+		}
+		bm.processPacket(bm.statsQueue, dec, data, src.device)
+	}
+}
+
+// linkStrategy says where device addresses come from for a link type
+type linkStrategy int
+
+const (
+	linkEthernet linkStrategy = iota // MACs from the Ethernet header
+	linkSLL                          // Linux "any" device: sender MAC from the SLL header
+	linkIP                           // raw IP (tun, wg): no MACs, attribute by IP
+	linkUnknown                      // unsupported link layer: attribute by IP if it decodes
+)
+
+// strategyFor returns the address strategy for a capture link type
+func strategyFor(lt layers.LinkType) linkStrategy {
+	switch lt {
+	case layers.LinkTypeEthernet:
+		return linkEthernet
+	case layers.LinkTypeLinuxSLL:
+		return linkSLL
+	case 12, 14, layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6,
+		layers.LinkTypeNull, layers.LinkTypeLoop:
+		return linkIP
+	}
+	return linkUnknown
+}
+
+// packetInfo carries the decoded fields of a packet to the detectors
+type packetInfo struct {
+	srcMAC, dstMAC   string
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+	transport        string // "tcp", "udp" or ""
+	protocol         string // breakdown bucket: "tcp", "udp", "icmp", "arp" or "other"
+	tcpSYN           bool   // connection attempt (SYN without ACK)
+	tcpSYNACK        bool   // connection accepted (SYN with ACK)
+	tcpACK           bool   // ACK without SYN, FIN or RST
+	tcpEnd           bool   // connection teardown (FIN or RST)
+	payload          []byte // TCP or UDP payload, for name services and signature rules
+	unreachable      string // "ip:port" of a UDP target an ICMP port unreachable reports closed
+	vlan             uint16 // 802.1Q VLAN ID, 0 if untagged
+	size             uint64 // bytes, already scaled by sampling
+}
+
+// processPacket decodes a frame captured on iface with dec and accounts it
+// to the devices involved, through acct (the monitor itself, the accounting
+// queue or a worker's batch). data is only used until it returns, so it may
+// be a zero-copy buffer of the capture handle.
+func (bm *BandwidthMonitor) processPacket(acct statsAccounter, dec *packetDecoder, data []byte, iface string) {
+	// Sampling: only every Nth packet is decoded, standing in for all N
+	profile := bm.profiles.current()
+	weight := uint64(1)
+	if s, ok := acct.(ebpfSampled); ok {
+		// The kernel already sampled and counted the bytes
+		weight = s.rate
+	} else if profile.SampleRate > 1 {
+		weight = uint64(profile.SampleRate)
+		if bm.sampleCounter.Add(1)%weight != 0 {
+			return
+		}
+	}
+	bm.processFrame(acct, dec, data, uint64(len(data)), weight, iface, profile)
+}
+
+// processFrame decodes data and accounts it, standing in for weight frames
+// of frameLen bytes each. frameLen exceeds len(data) for the truncated
+// headers sFlow agents sample. profile selects the optional per-packet
+// inspection; nil skips it.
+func (bm *BandwidthMonitor) processFrame(acct statsAccounter, dec *packetDecoder, data []byte, frameLen, weight uint64, iface string, profile *CaptureProfile) {
+	hostSignals := profile != nil && profile.HostSignals
+	dec.decode(data)
+	var srcMAC, dstMAC, srcIP, dstIP string
+	var ttl uint8
+	var tsval uint32
+
+	switch dec.strategy {
+	case linkEthernet:
+		if dec.hasEth {
+			srcMAC = dec.eth.SrcMAC.String()
+			dstMAC = dec.eth.DstMAC.String()
+		}
+	case linkSLL:
+		// Only the sender's address is known
+		if dec.hasSLL && dec.sll.AddrLen == 6 {
+			srcMAC = dec.sll.Addr.String()
+		}
+	}
+
+	if dec.hasIP4 {
+		srcIP = dec.ip4.SrcIP.String()
+		dstIP = dec.ip4.DstIP.String()
+		ttl = dec.ip4.TTL
+	} else if dec.hasIP6 {
+		// Covers ICMPv6 as well; ICMPv4 rides on the IPv4 branch above
+		srcIP = dec.ip6.SrcIP.String()
+		dstIP = dec.ip6.DstIP.String()
+	} else if dec.hasARP {
+		// ARP carries the IPv4 addresses of both ends in its payload
+		arp := &dec.arp
+		if arp.Protocol == layers.EthernetTypeIPv4 && len(arp.SourceProtAddress) == 4 {
+			if sender := net.IP(arp.SourceProtAddress); !sender.IsUnspecified() {
+				srcIP = sender.String()
+			}
+			// Requests are broadcast; only replies identify the target's MAC
+			if arp.Operation == layers.ARPReply && len(arp.DstProtAddress) == 4 {
+				dstIP = net.IP(arp.DstProtAddress).String()
+			}
+		}
+	}
+
+	pi := packetInfo{srcMAC: srcMAC, dstMAC: dstMAC, srcIP: srcIP, dstIP: dstIP, vlan: dec.vlan()}
+	if dec.hasTCP {
+		tcp := &dec.tcp
+		pi.transport = "tcp"
+		pi.srcPort, pi.dstPort = uint16(tcp.SrcPort), uint16(tcp.DstPort)
+		pi.tcpSYN = tcp.SYN && !tcp.ACK
+		pi.tcpSYNACK = tcp.SYN && tcp.ACK
+		pi.tcpACK = tcp.ACK && !tcp.SYN && !tcp.FIN && !tcp.RST
+		pi.tcpEnd = tcp.FIN || tcp.RST
+		pi.payload = tcp.Payload
+		if hostSignals {
+			for _, opt := range tcp.Options {
+				if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) >= 8 {
+					tsval = binary.BigEndian.Uint32(opt.OptionData[:4])
+				}
+			}
+		}
+	} else if dec.hasUDP {
+		udp := &dec.udp
+		pi.transport = "udp"
+		pi.srcPort, pi.dstPort = uint16(udp.SrcPort), uint16(udp.DstPort)
+		pi.payload = udp.Payload
+	}
+
+	switch {
+	case pi.transport != "":
+		pi.protocol = pi.transport
+	case dec.hasICMP:
+		pi.protocol = "icmp"
+		pi.unreachable = dec.portUnreachable()
+	case dec.hasARP:
+		pi.protocol = "arp"
+	default:
+		pi.protocol = "other"
+	}
+
+	packetSize := frameLen
+	pi.size = packetSize * weight
+
+	// Nothing to attribute the packet to (undecodable frame, non-IP payload
+	// on a MAC-less link): count it instead of dropping it silently
+	if srcMAC == "" && dstMAC == "" && srcIP == "" && dstIP == "" {
+		bm.unattributedBytes.Add(packetSize * weight)
+		bm.unattributedPackets.Add(weight)
+		return
+	}
+
+	acct.UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, pi.protocol, packetSize*weight, weight)
+	bm.ObserveDestination(srcMAC, srcIP, dstIP)
+	bm.ObserveASN(srcMAC, dstMAC, srcIP, dstIP, packetSize*weight)
+	bm.ObserveGeo(srcMAC, dstMAC, srcIP, dstIP, packetSize*weight)
+	bm.ObserveRisk(&pi, weight)
+	bm.ObservePorts(&pi, weight)
+	bm.ObserveServices(&pi, weight)
+	bm.ObserveDiscovery(&pi, weight)
+	bm.ObserveVLAN(&pi, weight)
+	bm.flows.observe(&pi, weight, iface, time.Now())
+	bm.ObserveLatency(&pi)
+	bm.ObserveNames(&pi)
+	bm.ObserveDHCP(&pi)
+	bm.ObserveSignatures(&pi)
+	if profile != nil {
+		bm.ObserveDomains(&pi, profile)
+	}
+	if dec.hasRA {
+		bm.ObserveRouterAdvert(srcMAC, srcIP, &dec.ra)
+	}
+	if hostSignals {
+		bm.ObserveHostSignals(&pi, ttl, tsval)
+	}
+}
+
+// Device accounting modes
+const (
+	AccountingMAC = "mac" // key devices by MAC, falling back to IP
+	AccountingIP  = "ip"  // key devices by IP, for interfaces without real MACs
+)
+
+// zeroMAC is the placeholder address loopback and some tunnels put in frames
+const zeroMAC = "00:00:00:00:00:00"
+
+// pcapIfLoopback mirrors PCAP_IF_LOOPBACK in pcap.Interface.Flags
+const pcapIfLoopback = 0x1
+
+// autoAccountingMode chooses IP accounting for loopback interfaces and
+// interfaces without an Ethernet link layer (wg0, tun), MAC accounting otherwise.
+// TAP devices carry real Ethernet frames and stay in MAC mode.
+func autoAccountingMode(name string, ifaces []pcap.Interface, lt layers.LinkType) string {
+	if lt != layers.LinkTypeEthernet {
+		return AccountingIP
+	}
+	for _, iface := range ifaces {
+		if iface.Name == name && iface.Flags&pcapIfLoopback != 0 {
+			return AccountingIP
+		}
+	}
+	return AccountingMAC
+}
+
+// includeDevice reports whether a device belongs in the device list.
+// In MAC mode only 192.168.* LAN hosts and IPv6-only hosts with a ULA or
+// link-local address are shown; in IP mode (loopback and
+// tunnels) any private, loopback or link-local address is an endpoint of interest.
+func (bm *BandwidthMonitor) includeDevice(dev *DeviceStats) bool {
+	if dev.IP == "" {
+		return false
+	}
+	if bm.accounting != AccountingIP && strings.HasPrefix(dev.IP, "192.168.") {
+		return true
+	}
+	// netip parses without allocating, which counts once per device per tick
+	ip, err := netip.ParseAddr(dev.IP)
+	if err != nil || ip.Zone() != "" {
+		return false
+	}
+	ip = ip.Unmap()
+	if bm.accounting != AccountingIP {
+		return !ip.Is4() && (ip.IsPrivate() || ip.IsLinkLocalUnicast())
+	}
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// setCaptureHandle records the handle currently capturing on device, or nil
+func (bm *BandwidthMonitor) setCaptureHandle(device string, handle *pcap.Handle) {
+	bm.captureMu.Lock()
+	defer bm.captureMu.Unlock()
+	if handle == nil {
+		delete(bm.captureHandles, device)
+		return
+	}
+	bm.captureHandles[device] = handle
+}
+
+// currentCaptureFilter returns the configured BPF filter
+func (bm *BandwidthMonitor) currentCaptureFilter() string {
+	bm.captureMu.Lock()
+	defer bm.captureMu.Unlock()
+	return bm.captureFilter
+}
+
+// applyCaptureFilter applies the configured BPF filter to a fresh handle
+func (bm *BandwidthMonitor) applyCaptureFilter(handle *pcap.Handle) error {
+	filter := bm.currentCaptureFilter()
+	if filter == "" {
+		return nil
+	}
+	return handle.SetBPFFilter(filter)
+}
+
+// SetCaptureFilter replaces the BPF filter of every running capture. The
+// filter is kept and reapplied whenever a capture is reopened; an empty
+// expression captures everything. If an interface rejects the filter, the
+// ones already changed get the previous filter back. AF_PACKET captures
+// pick the filter up by reopening their sockets.
+func (bm *BandwidthMonitor) SetCaptureFilter(filter string) error {
+	for _, src := range bm.captures {
+		if src.afpacket() && filter != "" {
+			if err := validateFanoutFilter(filter, int(src.snaplen)); err != nil {
+				return fmt.Errorf("%s: %v", src.device, err)
+			}
+		}
+	}
+	bm.captureMu.Lock()
+	defer bm.captureMu.Unlock()
+	var applied []*pcap.Handle
+	for device, handle := range bm.captureHandles {
+		if err := handle.SetBPFFilter(filter); err != nil {
+			for _, h := range applied {
+				h.SetBPFFilter(bm.captureFilter)
+			}
+			return fmt.Errorf("%s: %v", device, err)
+		}
+		applied = append(applied, handle)
+	}
+	bm.captureFilter = filter
+	for _, src := range bm.captures {
+		if src.afpacket() {
+			select {
+			case src.restart <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// REST API: Show the BPF capture filter
+func (bm *BandwidthMonitor) handleGetFilter(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, map[string]string{"filter": bm.currentCaptureFilter()})
+}
+
+// REST API: Replace the BPF capture filter
+func (bm *BandwidthMonitor) handlePutFilter(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Filter string `json:"filter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := bm.SetCaptureFilter(req.Filter); err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Capture filter set to %q", req.Filter)
+	writeEncoded(w, r, map[string]string{"filter": req.Filter})
+}
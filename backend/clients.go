@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// nextClientID hands out ids for WebSocket clients
+var nextClientID uint64
+
+// wsClient tracks metadata about a connected WebSocket client
+type wsClient struct {
+	id          uint64
+	conn        *websocket.Conn
+	remoteAddr  string
+	connectedAt time.Time
+	codec       Codec
+	delta       bool      // ?mode=delta: only changed devices, see deltaUpdate
+	apiKey      string    // name of the API key the client connected with, if any
+	usage       *apiUsage // meters apiKey's traffic
+
+	// Send queue drained by writePump, and closed when the connection ends
+	out  chan wsOutgoing
+	done chan struct{}
+
+	mu            sync.Mutex
+	subscriptions map[string]bool // topics and devices, see TopicAll
+	smoothing     rateSmoothing   // how its device rates are computed
+	page          wsPage          // devices of its "all" updates; zero for top N
+	lastSent      time.Time       // last successful push
+	lag           time.Duration   // snapshot age when it reached the client
+	messages      uint64
+	bytes         uint64
+	// Delta mode: what the client last received, per device key, and the
+	// updates since the last full snapshot
+	sent      map[string]deviceSnapshot
+	sinceFull int
+}
+
+// ClientInfo is the JSON view of a WebSocket client
+type ClientInfo struct {
+	ID           uint64    `json:"id"`
+	RemoteAddr   string    `json:"remoteAddr"`
+	Subscription string    `json:"subscription"`
+	Format       string    `json:"format"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+	LastSent     time.Time `json:"lastSent"`
+	LagMs        float64   `json:"lagMs"`
+	Messages     uint64    `json:"messages"`
+	Bytes        uint64    `json:"bytes"`
+	Delta        bool      `json:"delta,omitempty"`
+	Smoothing    string    `json:"smoothing,omitempty"`
+	APIKey       string    `json:"apiKey,omitempty"`
+}
+
+// newWSClient registers metadata for a freshly upgraded connection
+func newWSClient(conn *websocket.Conn, remoteAddr string, codec Codec) *wsClient {
+	return &wsClient{
+		id:            atomic.AddUint64(&nextClientID, 1),
+		conn:          conn,
+		remoteAddr:    remoteAddr,
+		connectedAt:   time.Now(),
+		subscriptions: map[string]bool{TopicAll: true},
+		codec:         codec,
+		out:           make(chan wsOutgoing, wsSendQueue),
+		done:          make(chan struct{}),
+	}
+}
+
+// recordSend notes a successful push of n bytes from a snapshot taken at
+// snapshotTime
+func (c *wsClient) recordSend(snapshotTime time.Time, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSent = time.Now()
+	c.lag = c.lastSent.Sub(snapshotTime)
+	c.messages++
+	c.bytes += uint64(n)
+}
+
+// info returns a JSON-friendly copy of the client metadata
+func (c *wsClient) info() ClientInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := ClientInfo{
+		ID:           c.id,
+		RemoteAddr:   c.remoteAddr,
+		Subscription: strings.Join(c.subscriptionList(), ","),
+		Format:       c.codec.Name(),
+		ConnectedAt:  c.connectedAt,
+		LastSent:     c.lastSent,
+		LagMs:        float64(c.lag) / float64(time.Millisecond),
+		Messages:     c.messages,
+		Bytes:        c.bytes,
+		Delta:        c.delta,
+		APIKey:       c.apiKey,
+	}
+	if !c.smoothing.isDefault() {
+		info.Smoothing = c.smoothing.String()
+	}
+	return info
+}
+
+// REST API: List connected WebSocket clients
+func (bm *BandwidthMonitor) handleGetClients(w http.ResponseWriter, r *http.Request) {
+	bm.clientsMu.RLock()
+	clients := make([]ClientInfo, 0, len(bm.clients))
+	for _, client := range bm.clients {
+		clients = append(clients, client.info())
+	}
+	bm.clientsMu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+
+	writeEncoded(w, r, clients)
+}
+
+// REST API: Disconnect a WebSocket client by id
+func (bm *BandwidthMonitor) handleDisconnectClient(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid client id", http.StatusBadRequest)
+		return
+	}
+
+	var target *wsClient
+	bm.clientsMu.RLock()
+	for _, client := range bm.clients {
+		if client.id == id {
+			target = client
+			break
+		}
+	}
+	bm.clientsMu.RUnlock()
+
+	if target == nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	// Closing the connection makes the read loop in handleWebSocket
+	// unregister the client.
+	log.Printf("Disconnecting WebSocket client %d (%s) on admin request", target.id, target.remoteAddr)
+	target.conn.Close()
+
+	writeEncoded(w, r, map[string]string{"status": "disconnected"})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec serializes API payloads for REST responses and WebSocket messages
+type Codec interface {
+	// Name is the short name used in ?format= (e.g. "json")
+	Name() string
+	// ContentType is the MIME type sent in responses
+	ContentType() string
+	// MessageType is the WebSocket frame type used for this encoding
+	MessageType() int
+	// Marshal encodes v
+	Marshal(v interface{}) ([]byte, error)
+}
+
+// jsonCodec is the default encoding
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "json" }
+func (jsonCodec) ContentType() string { return "application/json" }
+func (jsonCodec) MessageType() int    { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if deterministicOutput {
+		generic, err := deterministic(v)
+		if err != nil {
+			return nil, err
+		}
+		v = generic
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Match json.Encoder output so REST responses are unchanged
+	return append(b, '\n'), nil
+}
+
+// cborCodec encodes payloads as CBOR (RFC 8949). Values go through their JSON
+// representation first so field names, omitempty and time formatting are
+// identical to the JSON API.
+type cborCodec struct{}
+
+func (cborCodec) Name() string        { return "cbor" }
+func (cborCodec) ContentType() string { return "application/cbor" }
+func (cborCodec) MessageType() int    { return websocket.BinaryMessage }
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	if deterministicOutput {
+		generic = truncateTimestamps(generic)
+	}
+	var buf bytes.Buffer
+	if err := cborEncode(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// codecs lists the available encodings; the first one is the default
+var codecs = []Codec{jsonCodec{}, cborCodec{}}
+
+// negotiateCodec picks a codec from ?format= or the Accept header, falling
+// back to JSON. Of the media types in Accept, the supported one with the
+// highest q-value wins, the first listed on a tie; q=0 rules a type out.
+func negotiateCodec(r *http.Request) Codec {
+	if format := r.URL.Query().Get("format"); format != "" {
+		for _, c := range codecs {
+			if c.Name() == format {
+				return c
+			}
+		}
+	}
+	var best Codec
+	bestQ := 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && f >= 0 && f <= 1 {
+					q = f
+				}
+			}
+		}
+		for _, c := range codecs {
+			if c.ContentType() == mediaType && q > bestQ {
+				best, bestQ = c, q
+			}
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return codecs[0]
+}
+
+// writeEncoded writes v to the response using the negotiated codec
+func writeEncoded(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeEncodedStatus(w, r, http.StatusOK, v)
+}
+
+// writeEncodedStatus is writeEncoded with an explicit status code. A
+// ?fields= projection, e.g. "totalSent,devices.mac", trims the payload.
+func writeEncodedStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		projected, err := projectFields(v, fields)
+		if err != nil {
+			http.Error(w, "Encoding error", http.StatusInternalServerError)
+			return
+		}
+		v = projected
+	}
+	codec := negotiateCodec(r)
+	data, err := codec.Marshal(v)
+	if err != nil {
+		http.Error(w, "Encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// CBOR major types
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+)
+
+// cborHead writes a CBOR item header with the given major type and argument
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// cborEncode encodes a value produced by a json.Decoder with UseNumber
+func cborEncode(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if val {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case string:
+		cborHead(buf, cborText, uint64(len(val)))
+		buf.WriteString(val)
+	case json.Number:
+		return cborEncodeNumber(buf, val)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(val)))
+		for _, item := range val {
+			if err := cborEncode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// Sorted keys keep the output deterministic
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cborHead(buf, cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			cborHead(buf, cborText, uint64(len(k)))
+			buf.WriteString(k)
+			if err := cborEncode(buf, val[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+// cborEncodeNumber encodes integers from -2^64 to 2^64-1 compactly and
+// everything else as the shortest float that holds the value exactly
+func cborEncodeNumber(buf *bytes.Buffer, n json.Number) error {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if strings.HasPrefix(s, "-") {
+			// -1-m is encoded as m
+			if m, err := strconv.ParseUint(s[1:], 10, 64); err == nil {
+				if m == 0 {
+					cborHead(buf, cborUint, 0)
+				} else {
+					cborHead(buf, cborNegInt, m-1)
+				}
+				return nil
+			} else if s[1:] == "18446744073709551616" {
+				cborHead(buf, cborNegInt, math.MaxUint64)
+				return nil
+			}
+		} else if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			cborHead(buf, cborUint, u)
+			return nil
+		}
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	cborEncodeFloat(buf, f)
+	return nil
+}
+
+// cborEncodeFloat writes f as a half, single or double precision float,
+// whichever is shortest without losing precision (RFC 8949 section 4.2.2)
+func cborEncodeFloat(buf *bytes.Buffer, f float64) {
+	if f32 := float32(f); float64(f32) == f || math.IsNaN(f) {
+		if half, ok := cborHalf(f32); ok {
+			buf.WriteByte(0xf9)
+			binary.Write(buf, binary.BigEndian, half)
+			return
+		}
+		buf.WriteByte(0xfa)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(f32))
+		return
+	}
+	buf.WriteByte(0xfb)
+	binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+}
+
+// cborHalf converts f to IEEE 754 half precision when that is exact
+func cborHalf(f float32) (uint16, bool) {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127
+	mant := bits & 0x7fffff
+	switch {
+	case exp == 128:
+		// Infinity or NaN
+		if mant != 0 {
+			return sign | 0x7e00, true
+		}
+		return sign | 0x7c00, true
+	case bits&0x7fffffff == 0:
+		return sign, true
+	case exp >= -14 && exp <= 15:
+		if mant&0x1fff != 0 {
+			return 0, false
+		}
+		return sign | uint16(exp+15)<<10 | uint16(mant>>13), true
+	case exp >= -24 && exp < -14:
+		// Subnormal: the mantissa with its implicit bit, in units of 2^-24
+		m, shift := mant|0x800000, uint(-exp-1)
+		if m&(1<<shift-1) != 0 {
+			return 0, false
+		}
+		return sign | uint16(m>>shift), true
+	}
+	return 0, false
+}
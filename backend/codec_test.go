@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCBORVectors checks the encoder against the examples of RFC 8949
+// Appendix A that JSON can express
+func TestCBORVectors(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		cbor string
+	}{
+		// Integers
+		{"0", "00"},
+		{"1", "01"},
+		{"10", "0a"},
+		{"23", "17"},
+		{"24", "1818"},
+		{"25", "1819"},
+		{"100", "1864"},
+		{"1000", "1903e8"},
+		{"1000000", "1a000f4240"},
+		{"1000000000000", "1b000000e8d4a51000"},
+		{"18446744073709551615", "1bffffffffffffffff"},
+		{"-18446744073709551616", "3bffffffffffffffff"},
+		{"-1", "20"},
+		{"-10", "29"},
+		{"-100", "3863"},
+		{"-1000", "3903e7"},
+		// Floats, in the shortest exact precision
+		{"0.0", "f90000"},
+		{"-0.0", "f98000"},
+		{"1.0", "f93c00"},
+		{"1.1", "fb3ff199999999999a"},
+		{"1.5", "f93e00"},
+		{"65504.0", "f97bff"},
+		{"100000.0", "fa47c35000"},
+		{"3.4028234663852886e+38", "fa7f7fffff"},
+		{"1.0e+300", "fb7e37e43c8800759c"},
+		{"5.960464477539063e-8", "f90001"},
+		{"0.00006103515625", "f90400"},
+		{"-4.0", "f9c400"},
+		{"-4.1", "fbc010666666666666"},
+		// Simple values
+		{"false", "f4"},
+		{"true", "f5"},
+		{"null", "f6"},
+		// Strings
+		{`""`, "60"},
+		{`"a"`, "6161"},
+		{`"IETF"`, "6449455446"},
+		{`"\"\\"`, "62225c"},
+		{`"ü"`, "62c3bc"},
+		{`"水"`, "63e6b0b4"},
+		// Arrays and maps
+		{"[]", "80"},
+		{"[1, 2, 3]", "83010203"},
+		{"[1, [2, 3], [4, 5]]", "8301820203820405"},
+		{"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25]",
+			"98190102030405060708090a0b0c0d0e0f101112131415161718181819"},
+		{"{}", "a0"},
+		{`{"a": 1, "b": [2, 3]}`, "a26161016162820203"},
+		{`["a", {"b": "c"}]`, "826161a161626163"},
+		{`{"a": "A", "b": "B", "c": "C", "d": "D", "e": "E"}`, "a56161614161626142616361436164614461656145"},
+	} {
+		dec := json.NewDecoder(strings.NewReader(tc.json))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("%s: %v", tc.json, err)
+		}
+		var buf bytes.Buffer
+		if err := cborEncode(&buf, v); err != nil {
+			t.Errorf("cborEncode(%s): %v", tc.json, err)
+			continue
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != tc.cbor {
+			t.Errorf("cborEncode(%s) = %s, want %s", tc.json, got, tc.cbor)
+		}
+	}
+}
+
+func TestCBOREncodeNumberOutOfRange(t *testing.T) {
+	// Integers beyond 64 bits fall back to a float rather than wrapping
+	for n, want := range map[string]string{
+		"18446744073709551616":  "fa5f800000",
+		"-18446744073709551617": "fadf800000",
+	} {
+		var buf bytes.Buffer
+		if err := cborEncodeNumber(&buf, json.Number(n)); err != nil {
+			t.Errorf("cborEncodeNumber(%s): %v", n, err)
+			continue
+		}
+		if got := hex.EncodeToString(buf.Bytes()); got != want {
+			t.Errorf("cborEncodeNumber(%s) = %s, want %s", n, got, want)
+		}
+	}
+	var buf bytes.Buffer
+	if err := cborEncodeNumber(&buf, json.Number("12abc")); err == nil {
+		t.Error("cborEncodeNumber accepted 12abc")
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	for _, tc := range []struct {
+		url    string
+		accept string
+		want   string
+	}{
+		{"/api/devices", "", "json"},
+		{"/api/devices", "application/cbor", "cbor"},
+		{"/api/devices", "text/html, application/cbor", "cbor"},
+		{"/api/devices", "application/json, application/cbor", "json"},
+		{"/api/devices", "application/json;q=0.5, application/cbor", "cbor"},
+		{"/api/devices", "application/json; q=0.9, application/cbor; q=0.8", "json"},
+		{"/api/devices", "application/cbor;q=0.5, application/json;q=0.5", "cbor"},
+		{"/api/devices", "application/cbor;q=0", "json"},
+		{"/api/devices", "application/CBOR;Q=1", "cbor"},
+		{"/api/devices", "application/cbor;q=abc", "cbor"},
+		{"/api/devices", "*/*;q=0.1, application/cbor;q=0.2", "cbor"},
+		{"/api/devices?format=json", "application/cbor", "json"},
+		{"/api/devices?format=cbor", "", "cbor"},
+		{"/api/devices?format=xml", "application/cbor", "cbor"},
+	} {
+		r := httptest.NewRequest("GET", tc.url, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		if got := negotiateCodec(r).Name(); got != tc.want {
+			t.Errorf("negotiateCodec(%s, Accept: %q) = %s, want %s", tc.url, tc.accept, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector limits
+const (
+	// collectorReadTimeout bounds a socket read, so the listener notices stop
+	collectorReadTimeout = time.Second
+	// maxCollectorTemplates caps the NetFlow v9/IPFIX templates learned per
+	// exporter, against exporters (or spoofed datagrams) churning IDs
+	maxCollectorTemplates = 256
+	// maxExporters caps the exporters tracked
+	maxExporters = 256
+)
+
+// Collected datagram protocols, as reported per exporter
+const (
+	CollectorNetFlow5 = "netflow5"
+	CollectorNetFlow9 = "netflow9"
+	CollectorIPFIX    = "ipfix"
+	CollectorSFlow    = "sflow"
+)
+
+// Additional information elements read from exported records (see
+// netflow.go for the ones the exporter writes)
+const (
+	ieSamplingInterval       = 34
+	iePostSourceMacAddress   = 81 // NetFlow v9 OUT_SRC_MAC
+	iePostDestMacAddress     = 57 // NetFlow v9 OUT_DST_MAC
+	ieOctetTotalCount        = 85
+	iePacketTotalCount       = 86
+	ieSamplingPacketInterval = 305
+	// variableLength marks an IPFIX field whose length precedes its value
+	variableLength = 0xffff
+)
+
+// ExporterStatus is what the collector received from one router or switch
+type ExporterStatus struct {
+	Address   string    `json:"address"`
+	Protocol  string    `json:"protocol"` // netflow5, netflow9, ipfix or sflow
+	Datagrams uint64    `json:"datagrams"`
+	Records   uint64    `json:"records"` // flow records or packet samples accounted
+	Bytes     uint64    `json:"bytes"`   // traffic they stand for, scaled by sampling
+	Dropped   uint64    `json:"dropped"` // records without a known template or addresses
+	Errors    uint64    `json:"errors"`  // malformed datagrams
+	LastError string    `json:"lastError,omitempty"`
+	Templates int       `json:"templates,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// templateKey identifies a NetFlow v9/IPFIX template: templates are scoped
+// to the exporter and its source ID (observation domain)
+type templateKey struct {
+	exporter string
+	domain   uint32
+	id       uint16
+}
+
+// collectorField is one field of a learned template
+type collectorField struct {
+	id, length uint16
+	enterprise bool // vendor field; skipped
+}
+
+// collectedFlow is a flow record decoded from NetFlow or IPFIX
+type collectedFlow struct {
+	srcIP, dstIP     net.IP
+	srcMAC, dstMAC   net.HardwareAddr
+	srcPort, dstPort uint16
+	protocol         uint8
+	bytes, packets   uint64
+	sampling         uint64
+}
+
+// flowCollector receives NetFlow v5/v9, IPFIX and sFlow datagrams from
+// routers and switches and accounts the traffic they describe to the same
+// device stats as local capture, for traffic that never crosses the
+// monitor's NIC. Records are accounted when they arrive, so a long flow
+// reported at its end shows as a burst; a router exporting both ingress
+// and egress records counts transit traffic twice.
+type flowCollector struct {
+	bm        *BandwidthMonitor
+	mu        sync.Mutex
+	templates map[templateKey][]collectorField
+	exporters map[string]*ExporterStatus // by protocol and address
+	// allow lists the exporters accepted (-collector-allow); none: senders
+	// on the LAN subnets
+	allow []netip.Prefix
+	// rejected remembers senders refused, to log each once
+	rejected map[string]bool
+}
+
+// newFlowCollector creates a collector accounting into bm the datagrams of
+// the exporters in allow
+func newFlowCollector(bm *BandwidthMonitor, allow []netip.Prefix) *flowCollector {
+	return &flowCollector{
+		bm:        bm,
+		templates: make(map[templateKey][]collectorField),
+		exporters: make(map[string]*ExporterStatus),
+		allow:     allow,
+		rejected:  make(map[string]bool),
+	}
+}
+
+// parseCollectorAllow parses -collector-allow addresses and CIDRs
+func parseCollectorAllow(list []string) ([]netip.Prefix, error) {
+	var allow []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if addr, err := netip.ParseAddr(s); err == nil {
+			allow = append(allow, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exporter %q: want an address or CIDR, e.g. 192.168.1.1", s)
+		}
+		allow = append(allow, p.Masked())
+	}
+	return allow, nil
+}
+
+// allowed reports whether datagrams from addr are accepted: from an
+// address in -collector-allow or, without it, on the LAN subnets. Refused
+// senders are logged once each.
+func (c *flowCollector) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	ok := false
+	if len(c.allow) == 0 {
+		ok = c.bm.lan.isLocal(addr.String())
+	}
+	for _, p := range c.allow {
+		if p.Contains(addr) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		c.mu.Lock()
+		if !c.rejected[addr.String()] && len(c.rejected) < maxExporters {
+			c.rejected[addr.String()] = true
+			log.Printf("Ignoring flow datagrams from %s: not an allowed exporter (-collector-allow)", addr)
+		}
+		c.mu.Unlock()
+	}
+	return ok
+}
+
+// exporter returns the status of an exporter, nil once maxExporters are
+// tracked; caller holds c.mu
+func (c *flowCollector) exporter(protocol, addr string) *ExporterStatus {
+	key := protocol + "|" + addr
+	st, ok := c.exporters[key]
+	if !ok {
+		if len(c.exporters) >= maxExporters {
+			return nil
+		}
+		st = &ExporterStatus{Address: addr, Protocol: protocol}
+		c.exporters[key] = st
+	}
+	return st
+}
+
+// record updates an exporter's counters after a datagram
+func (c *flowCollector) record(protocol, addr string, records, bytes, dropped uint64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.exporter(protocol, addr)
+	if st == nil {
+		return
+	}
+	st.Datagrams++
+	st.Records += records
+	st.Bytes += bytes
+	st.Dropped += dropped
+	st.LastSeen = time.Now()
+	if err != nil {
+		if st.Errors == 0 {
+			log.Printf("Malformed %s datagram from %s: %v", protocol, addr, err)
+		}
+		st.Errors++
+		st.LastError = err.Error()
+	}
+}
+
+// statuses lists the exporters heard from
+func (c *flowCollector) statuses() []ExporterStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	templates := make(map[string]int)
+	for key := range c.templates {
+		templates[key.exporter]++
+	}
+	list := make([]ExporterStatus, 0, len(c.exporters))
+	for _, st := range c.exporters {
+		s := *st
+		if s.Protocol == CollectorNetFlow9 || s.Protocol == CollectorIPFIX {
+			s.Templates = templates[s.Address]
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Address != list[j].Address {
+			return list[i].Address < list[j].Address
+		}
+		return list[i].Protocol < list[j].Protocol
+	})
+	return list
+}
+
+// listen reads datagrams from conn until stop is closed, handing each from
+// an allowed exporter to handle with the sender's address
+func (c *flowCollector) listen(conn net.PacketConn, stop <-chan struct{}, handle func(data []byte, addr string)) {
+	buf := make([]byte, 65535)
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		conn.SetReadDeadline(time.Now().Add(collectorReadTimeout))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading flow collector socket %s: %v", conn.LocalAddr(), err)
+			time.Sleep(collectorReadTimeout)
+			continue
+		}
+		if c.bm.pause.paused.Load() {
+			continue
+		}
+		udp, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(udp.IP)
+		if !c.allowed(ip) {
+			continue
+		}
+		handle(buf[:n], ip.Unmap().String())
+	}
+}
+
+// handleNetFlow dispatches a NetFlow or IPFIX datagram by its version
+func (c *flowCollector) handleNetFlow(data []byte, addr string) {
+	if len(data) < 2 {
+		c.record(CollectorNetFlow9, addr, 0, 0, 0, errors.New("datagram too short"))
+		return
+	}
+	switch v := binary.BigEndian.Uint16(data); v {
+	case 5:
+		c.handleNetFlow5(data, addr)
+	case 9, 10:
+		c.handleTemplated(data, addr, v == 10)
+	default:
+		c.record(CollectorNetFlow9, addr, 0, 0, 0, fmt.Errorf("unsupported version %d", v))
+	}
+}
+
+// handleNetFlow5 accounts a NetFlow v5 datagram: a 24-byte header and up
+// to 30 fixed 48-byte IPv4 records
+func (c *flowCollector) handleNetFlow5(data []byte, addr string) {
+	const headerLen, recordLen = 24, 48
+	if len(data) < headerLen {
+		c.record(CollectorNetFlow5, addr, 0, 0, 0, errors.New("header truncated"))
+		return
+	}
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	// The top two bits are the sampling mode, the rest the interval
+	sampling := uint64(binary.BigEndian.Uint16(data[22:]) & 0x3fff)
+	if len(data) < headerLen+count*recordLen {
+		c.record(CollectorNetFlow5, addr, 0, 0, 0, fmt.Errorf("%d records announced, %d bytes received", count, len(data)))
+		return
+	}
+	var records, bytes uint64
+	for i := 0; i < count; i++ {
+		r := data[headerLen+i*recordLen:]
+		f := collectedFlow{
+			srcIP:    net.IP(r[0:4]),
+			dstIP:    net.IP(r[4:8]),
+			packets:  uint64(binary.BigEndian.Uint32(r[16:])),
+			bytes:    uint64(binary.BigEndian.Uint32(r[20:])),
+			srcPort:  binary.BigEndian.Uint16(r[32:]),
+			dstPort:  binary.BigEndian.Uint16(r[34:]),
+			protocol: r[38],
+			sampling: sampling,
+		}
+		bytes += c.account(&f, CollectorNetFlow5+":"+addr)
+		records++
+	}
+	c.record(CollectorNetFlow5, addr, records, bytes, 0, nil)
+}
+
+// handleTemplated accounts a NetFlow v9 or IPFIX datagram, learning the
+// templates it carries
+func (c *flowCollector) handleTemplated(data []byte, addr string, ipfix bool) {
+	protocol, headerLen := CollectorNetFlow9, 20
+	templateSet, optionsSet := uint16(0), uint16(1)
+	if ipfix {
+		protocol, headerLen = CollectorIPFIX, 16
+		templateSet, optionsSet = 2, 3
+	}
+	if len(data) < headerLen {
+		c.record(protocol, addr, 0, 0, 0, errors.New("header truncated"))
+		return
+	}
+	domain := binary.BigEndian.Uint32(data[headerLen-4:])
+	if ipfix {
+		// The message length excludes anything trailing the datagram
+		if n := int(binary.BigEndian.Uint16(data[2:])); n >= headerLen && n <= len(data) {
+			data = data[:n]
+		}
+	}
+	iface := protocol + ":" + addr
+	var records, bytes, dropped uint64
+	var err error
+	for rest := data[headerLen:]; len(rest) >= 4; {
+		id, n := binary.BigEndian.Uint16(rest), int(binary.BigEndian.Uint16(rest[2:]))
+		if n < 4 || n > len(rest) {
+			err = fmt.Errorf("set %d: invalid length %d", id, n)
+			break
+		}
+		body := rest[4:n]
+		rest = rest[n:]
+		switch {
+		case id == templateSet:
+			err = c.learnTemplates(body, addr, domain, ipfix)
+		case id == optionsSet, id < 256:
+			// Options templates (exporter metadata) are not needed
+		default:
+			c.mu.Lock()
+			fields, ok := c.templates[templateKey{addr, domain, id}]
+			c.mu.Unlock()
+			if !ok {
+				dropped++
+				continue
+			}
+			for len(body) > 0 {
+				var f collectedFlow
+				used, ok := decodeTemplated(body, fields, &f)
+				if !ok {
+					break // padding
+				}
+				body = body[used:]
+				if f.srcIP == nil || f.dstIP == nil {
+					dropped++
+					continue
+				}
+				bytes += c.account(&f, iface)
+				records++
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	c.record(protocol, addr, records, bytes, dropped, err)
+}
+
+// learnTemplates stores the templates of a template set
+func (c *flowCollector) learnTemplates(body []byte, addr string, domain uint32, ipfix bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(body) >= 4 {
+		id, count := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+		body = body[4:]
+		key := templateKey{addr, domain, id}
+		if count == 0 {
+			// IPFIX template withdrawal
+			delete(c.templates, key)
+			continue
+		}
+		fields := make([]collectorField, 0, count)
+		for i := 0; i < count; i++ {
+			if len(body) < 4 {
+				return fmt.Errorf("template %d truncated", id)
+			}
+			f := collectorField{id: binary.BigEndian.Uint16(body), length: binary.BigEndian.Uint16(body[2:])}
+			body = body[4:]
+			if ipfix && f.id&0x8000 != 0 {
+				if len(body) < 4 {
+					return fmt.Errorf("template %d truncated", id)
+				}
+				f.id &= 0x7fff
+				f.enterprise = true
+				body = body[4:]
+			}
+			if !ipfix && f.length == variableLength {
+				return fmt.Errorf("template %d: variable-length field in NetFlow v9", id)
+			}
+			fields = append(fields, f)
+		}
+		if _, known := c.templates[key]; !known && c.countTemplates(addr) >= maxCollectorTemplates {
+			return fmt.Errorf("more than %d templates", maxCollectorTemplates)
+		}
+		c.templates[key] = fields
+	}
+	return nil
+}
+
+// countTemplates is the number of templates learned from addr; caller
+// holds c.mu
+func (c *flowCollector) countTemplates(addr string) int {
+	n := 0
+	for key := range c.templates {
+		if key.exporter == addr {
+			n++
+		}
+	}
+	return n
+}
+
+// decodeTemplated decodes one data record laid out by fields into f. It
+// returns the bytes used, or false when data is too short (set padding).
+func decodeTemplated(data []byte, fields []collectorField, f *collectedFlow) (int, bool) {
+	off := 0
+	var totalBytes, totalPackets uint64
+	var postSrcMAC, postDstMAC net.HardwareAddr
+	for _, field := range fields {
+		n := int(field.length)
+		if field.length == variableLength {
+			if off >= len(data) {
+				return 0, false
+			}
+			n, off = int(data[off]), off+1
+			if n == 255 {
+				if off+2 > len(data) {
+					return 0, false
+				}
+				n, off = int(binary.BigEndian.Uint16(data[off:])), off+2
+			}
+		}
+		if off+n > len(data) {
+			return 0, false
+		}
+		v := data[off : off+n]
+		off += n
+		if field.enterprise {
+			continue
+		}
+		switch field.id {
+		case ieSourceIPv4Address, ieSourceIPv6Address:
+			if n == 4 || n == 16 {
+				f.srcIP = net.IP(v)
+			}
+		case ieDestIPv4Address, ieDestIPv6Address:
+			if n == 4 || n == 16 {
+				f.dstIP = net.IP(v)
+			}
+		case ieSourceMacAddress:
+			if n == 6 {
+				f.srcMAC = net.HardwareAddr(v)
+			}
+		case ieDestMacAddress:
+			if n == 6 {
+				f.dstMAC = net.HardwareAddr(v)
+			}
+		case iePostSourceMacAddress:
+			if n == 6 {
+				postSrcMAC = net.HardwareAddr(v)
+			}
+		case iePostDestMacAddress:
+			if n == 6 {
+				postDstMAC = net.HardwareAddr(v)
+			}
+		case ieSourceTransportPort:
+			f.srcPort = uint16(readUint(v))
+		case ieDestTransportPort:
+			f.dstPort = uint16(readUint(v))
+		case ieProtocolIdentifier:
+			f.protocol = uint8(readUint(v))
+		case ieOctetDeltaCount:
+			f.bytes = readUint(v)
+		case iePacketDeltaCount:
+			f.packets = readUint(v)
+		case ieOctetTotalCount:
+			totalBytes = readUint(v)
+		case iePacketTotalCount:
+			totalPackets = readUint(v)
+		case ieSamplingInterval, ieSamplingPacketInterval:
+			f.sampling = readUint(v)
+		}
+	}
+	// Exporters sending only totals or only post-NAT/egress MACs
+	if f.bytes == 0 && f.packets == 0 {
+		f.bytes, f.packets = totalBytes, totalPackets
+	}
+	if f.srcMAC == nil {
+		f.srcMAC = postSrcMAC
+	}
+	if f.dstMAC == nil {
+		f.dstMAC = postDstMAC
+	}
+	// A record of zero-length fields only would loop forever
+	return off, off > 0
+}
+
+// readUint reads a big-endian unsigned integer of up to 8 bytes, as
+// IPFIX reduced-size encoding sends them
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b[:min(len(b), 8)] {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// collectedProtocol names an IP protocol number as packet capture does
+func collectedProtocol(number uint8) (protocol, transport string) {
+	switch number {
+	case 6:
+		return "tcp", "tcp"
+	case 17:
+		return "udp", "udp"
+	case 1, 58:
+		return "icmp", ""
+	}
+	return "other", ""
+}
+
+// account adds a flow record to the device stats, scaled by its sampling
+// interval, and returns the bytes it stands for
+func (c *flowCollector) account(f *collectedFlow, iface string) uint64 {
+	weight := max(f.sampling, 1)
+	protocol, transport := collectedProtocol(f.protocol)
+	pi := packetInfo{
+		srcIP:     f.srcIP.String(),
+		dstIP:     f.dstIP.String(),
+		srcPort:   f.srcPort,
+		dstPort:   f.dstPort,
+		transport: transport,
+		protocol:  protocol,
+		size:      f.bytes * weight,
+	}
+	if f.srcMAC != nil {
+		pi.srcMAC = f.srcMAC.String()
+	}
+	if f.dstMAC != nil {
+		pi.dstMAC = f.dstMAC.String()
+	}
+	packets := max(f.packets*weight, 1)
+	bm := c.bm
+	bm.statsQueue.UpdateStatsWeighted(iface, pi.srcMAC, pi.dstMAC, pi.srcIP, pi.dstIP, pi.protocol, pi.size, packets)
+	bm.ObserveDestination(pi.srcMAC, pi.srcIP, pi.dstIP)
+	bm.ObserveASN(pi.srcMAC, pi.dstMAC, pi.srcIP, pi.dstIP, pi.size)
+	bm.ObserveGeo(pi.srcMAC, pi.dstMAC, pi.srcIP, pi.dstIP, pi.size)
+	bm.ObservePorts(&pi, packets)
+	bm.ObserveServices(&pi, packets)
+	return pi.size
+}
+
+// REST API: Routers and switches the flow collector receives from
+func (bm *BandwidthMonitor) handleGetCollector(w http.ResponseWriter, r *http.Request) {
+	if bm.collector == nil {
+		http.Error(w, "Flow collector not configured (-netflow-listen or -sflow-listen)", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, bm.collector.statuses())
+}
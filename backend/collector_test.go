@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// testCollector returns a collector accounting into a fresh monitor
+func testCollector() *flowCollector {
+	return newFlowCollector(NewBandwidthMonitor(""), nil)
+}
+
+// exporterStatus returns the status the collector keeps for an exporter
+func exporterStatus(t *testing.T, c *flowCollector, protocol, addr string) ExporterStatus {
+	t.Helper()
+	for _, st := range c.statuses() {
+		if st.Protocol == protocol && st.Address == addr {
+			return st
+		}
+	}
+	t.Fatalf("no %s status for %s", protocol, addr)
+	return ExporterStatus{}
+}
+
+// templatedFields is the record layout the decoder tests use: IPv4
+// addresses, ports, protocol and 4-byte counters
+var templatedFields = []collectorField{
+	{id: ieSourceIPv4Address, length: 4},
+	{id: ieDestIPv4Address, length: 4},
+	{id: ieSourceTransportPort, length: 2},
+	{id: ieDestTransportPort, length: 2},
+	{id: ieProtocolIdentifier, length: 1},
+	{id: ieOctetDeltaCount, length: 4},
+	{id: iePacketDeltaCount, length: 4},
+}
+
+// templatedRecord encodes one record of templatedFields
+func templatedRecord(src, dst string, sport, dport uint16, proto uint8, bytes, packets uint32) []byte {
+	b := append([]byte(nil), net.ParseIP(src).To4()...)
+	b = append(b, net.ParseIP(dst).To4()...)
+	b = binary.BigEndian.AppendUint16(b, sport)
+	b = binary.BigEndian.AppendUint16(b, dport)
+	b = append(b, proto)
+	b = binary.BigEndian.AppendUint32(b, bytes)
+	return binary.BigEndian.AppendUint32(b, packets)
+}
+
+func TestDecodeTemplated(t *testing.T) {
+	rec := templatedRecord("192.168.1.10", "8.8.8.8", 40000, 53, 17, 1500, 3)
+	var f collectedFlow
+	used, ok := decodeTemplated(rec, templatedFields, &f)
+	if !ok || used != len(rec) {
+		t.Fatalf("decodeTemplated = %d, %v; want %d, true", used, ok, len(rec))
+	}
+	if f.srcIP.String() != "192.168.1.10" || f.dstIP.String() != "8.8.8.8" || f.srcPort != 40000 || f.dstPort != 53 ||
+		f.protocol != 17 || f.bytes != 1500 || f.packets != 3 {
+		t.Errorf("decoded %+v", f)
+	}
+
+	// Every truncation is padding, not a record
+	for n := 0; n < len(rec); n++ {
+		var f collectedFlow
+		if used, ok := decodeTemplated(rec[:n], templatedFields, &f); ok {
+			t.Errorf("record truncated to %d bytes decoded (%d bytes used)", n, used)
+		}
+	}
+}
+
+func TestDecodeTemplatedMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields []collectorField
+		data   []byte
+		used   int
+		ok     bool
+	}{
+		{"only zero-length fields", []collectorField{{id: ieOctetDeltaCount}, {id: iePacketDeltaCount}}, []byte{1, 2, 3, 4}, 0, false},
+		{"variable length, short form", []collectorField{{id: 999, length: variableLength}}, []byte{3, 'a', 'b', 'c'}, 4, true},
+		{"variable length, long form", []collectorField{{id: 999, length: variableLength}}, []byte{255, 0, 2, 'a', 'b'}, 5, true},
+		{"variable length beyond the data", []collectorField{{id: 999, length: variableLength}}, []byte{200, 'a'}, 0, false},
+		{"variable length prefix truncated", []collectorField{{id: 999, length: variableLength}}, []byte{255, 0}, 0, false},
+		{"variable length without data", []collectorField{{id: 999, length: variableLength}}, nil, 0, false},
+		{"field longer than the data", []collectorField{{id: ieOctetDeltaCount, length: 0xfffe}}, make([]byte, 64), 0, false},
+		{"oversized counter", []collectorField{{id: ieOctetDeltaCount, length: 16}}, make([]byte, 16), 16, true},
+		{"wrongly sized address", []collectorField{{id: ieSourceIPv4Address, length: 3}}, []byte{10, 0, 0}, 3, true},
+		{"enterprise field", []collectorField{{id: ieSourceIPv4Address, length: 4, enterprise: true}}, []byte{10, 0, 0, 1}, 4, true},
+	} {
+		var f collectedFlow
+		used, ok := decodeTemplated(tc.data, tc.fields, &f)
+		if used != tc.used || ok != tc.ok {
+			t.Errorf("%s: decodeTemplated = %d, %v; want %d, %v", tc.name, used, ok, tc.used, tc.ok)
+		}
+		if f.srcIP != nil {
+			t.Errorf("%s: decoded source address %v", tc.name, f.srcIP)
+		}
+	}
+}
+
+// netflow5Datagram encodes a NetFlow v5 datagram announcing count records
+// with the given sampling interval
+func netflow5Datagram(count int, sampling uint16, records ...[]byte) []byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint16(b, 5)
+	binary.BigEndian.PutUint16(b[2:], uint16(count))
+	binary.BigEndian.PutUint16(b[22:], sampling)
+	for _, r := range records {
+		b = append(b, r...)
+	}
+	return b
+}
+
+// netflow5Record encodes one 48-byte NetFlow v5 record
+func netflow5Record(src, dst string, packets, bytes uint32, sport, dport uint16, proto uint8) []byte {
+	r := make([]byte, 48)
+	copy(r[0:], net.ParseIP(src).To4())
+	copy(r[4:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint32(r[16:], packets)
+	binary.BigEndian.PutUint32(r[20:], bytes)
+	binary.BigEndian.PutUint16(r[32:], sport)
+	binary.BigEndian.PutUint16(r[34:], dport)
+	r[38] = proto
+	return r
+}
+
+func TestHandleNetFlow5(t *testing.T) {
+	c := testCollector()
+	data := netflow5Datagram(2, 0x4000|10, // sampling mode bits, interval 10
+		netflow5Record("192.168.1.10", "8.8.8.8", 2, 1000, 40000, 443, 6),
+		netflow5Record("8.8.8.8", "192.168.1.10", 3, 500, 443, 40000, 6))
+	c.handleNetFlow(data, "192.168.1.1")
+	st := exporterStatus(t, c, CollectorNetFlow5, "192.168.1.1")
+	if st.Records != 2 || st.Bytes != 15000 || st.Errors != 0 {
+		t.Errorf("status = %+v, want 2 records of 15000 bytes", st)
+	}
+}
+
+func TestHandleNetFlow5Malformed(t *testing.T) {
+	rec := netflow5Record("192.168.1.10", "8.8.8.8", 1, 100, 1, 2, 17)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"header truncated", netflow5Datagram(0, 0)[:23]},
+		{"more records announced than sent", netflow5Datagram(30, 0, rec)},
+		{"record truncated", netflow5Datagram(1, 0, rec[:47])},
+		{"count overflowing the datagram", netflow5Datagram(0xffff, 0, rec, rec)},
+	} {
+		c := testCollector()
+		c.handleNetFlow5(tc.data, "192.168.1.1")
+		st := exporterStatus(t, c, CollectorNetFlow5, "192.168.1.1")
+		if st.Errors != 1 || st.Records != 0 || st.Bytes != 0 {
+			t.Errorf("%s: status = %+v, want one error and nothing accounted", tc.name, st)
+		}
+	}
+}
+
+// ipfixDatagram encodes an IPFIX message of the given sets
+func ipfixDatagram(sets ...[]byte) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b, 10)
+	for _, s := range sets {
+		b = append(b, s...)
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+// ipfixSet encodes a set of the given ID around body
+func ipfixSet(id uint16, body []byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(body)))
+	return append(b, body...)
+}
+
+// ipfixTemplate encodes a template record of fields
+func ipfixTemplate(id uint16, fields []collectorField) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+	for _, f := range fields {
+		b = binary.BigEndian.AppendUint16(b, f.id)
+		b = binary.BigEndian.AppendUint16(b, f.length)
+	}
+	return b
+}
+
+func TestHandleTemplatedMalformed(t *testing.T) {
+	template := ipfixSet(2, ipfixTemplate(256, templatedFields))
+	data := ipfixSet(256, templatedRecord("192.168.1.10", "8.8.8.8", 40000, 443, 6, 1000, 2))
+	valid := ipfixDatagram(template, data)
+
+	c := testCollector()
+	c.handleNetFlow(valid, "192.168.1.1")
+	if st := exporterStatus(t, c, CollectorIPFIX, "192.168.1.1"); st.Records != 1 || st.Bytes != 1000 || st.Errors != 0 {
+		t.Errorf("valid message: status = %+v, want 1 record of 1000 bytes", st)
+	}
+
+	// No truncation may panic or account a partial record
+	for n := 0; n < len(valid); n++ {
+		c := testCollector()
+		c.handleNetFlow(valid[:n], "192.168.1.1")
+		for _, st := range c.statuses() {
+			if st.Records != 0 {
+				t.Errorf("message truncated to %d bytes accounted %d records", n, st.Records)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"set length below its header", ipfixDatagram(append([]byte{0, 2, 0, 2}, template...))},
+		{"set length beyond the message", ipfixDatagram([]byte{0, 2, 0xff, 0xff, 1, 0, 0, 1})},
+		{"template longer than its set", ipfixDatagram(ipfixSet(2, []byte{1, 0, 0xff, 0xff, 0, 8, 0, 4}))},
+		{"enterprise field truncated", ipfixDatagram(ipfixSet(2, []byte{1, 0, 0, 1, 0x80, 8, 0, 4}))},
+	} {
+		c := testCollector()
+		c.handleNetFlow(tc.data, "192.168.1.1")
+		st := exporterStatus(t, c, CollectorIPFIX, "192.168.1.1")
+		if st.Errors != 1 || st.Records != 0 {
+			t.Errorf("%s: status = %+v, want one error and nothing accounted", tc.name, st)
+		}
+	}
+
+	// Template churn is capped per exporter
+	c = testCollector()
+	var body []byte
+	for id := 256; id < 256+maxCollectorTemplates+10; id++ {
+		body = append(body, ipfixTemplate(uint16(id), templatedFields[:1])...)
+	}
+	c.handleNetFlow(ipfixDatagram(ipfixSet(2, body)), "192.168.1.1")
+	if st := exporterStatus(t, c, CollectorIPFIX, "192.168.1.1"); st.Templates != maxCollectorTemplates || st.Errors != 1 {
+		t.Errorf("template flood: status = %+v, want %d templates and an error", st, maxCollectorTemplates)
+	}
+}
+
+// sflowDatagram encodes an sFlow v5 datagram from agent with one flow
+// sample of the given sampling rate carrying an Ethernet header
+func sflowDatagram(agent string, rate uint32, frameLength uint32, header []byte) []byte {
+	u32 := binary.BigEndian.AppendUint32
+	padded := append([]byte(nil), header...)
+	for len(padded)%4 != 0 {
+		padded = append(padded, 0)
+	}
+	// Raw packet header record
+	rec := u32(nil, sflowHeaderEthernet)
+	rec = u32(rec, frameLength)
+	rec = u32(rec, 4) // FCS stripped
+	rec = u32(rec, uint32(len(header)))
+	rec = append(rec, padded...)
+	// Flow sample
+	sample := u32(nil, 1)      // sequence number
+	sample = u32(sample, 1)    // source ID
+	sample = u32(sample, rate) // sampling rate
+	sample = u32(sample, 1000) // sample pool
+	sample = u32(sample, 0)    // drops
+	sample = u32(sample, 1)    // input interface
+	sample = u32(sample, 2)    // output interface
+	sample = u32(sample, 1)    // flow records
+	sample = u32(sample, sflowRawPacketHeader)
+	sample = u32(sample, uint32(len(rec)))
+	sample = append(sample, rec...)
+	// Datagram
+	b := u32(nil, 5)
+	b = u32(b, 1) // IPv4 agent
+	b = append(b, net.ParseIP(agent).To4()...)
+	b = u32(b, 0) // sub-agent ID
+	b = u32(b, 1) // sequence number
+	b = u32(b, 0) // uptime
+	b = u32(b, 1) // samples
+	b = u32(b, sflowFlowSample)
+	b = u32(b, uint32(len(sample)))
+	return append(b, sample...)
+}
+
+// sampledFrame is an Ethernet/IPv4/UDP header as a switch samples it
+func sampledFrame() []byte {
+	b := []byte{0x02, 0, 0, 0, 0, 0x02, 0x02, 0, 0, 0, 0, 0x01, 0x08, 0x00}
+	ip := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 192, 168, 1, 10, 192, 168, 1, 20}
+	udp := []byte{0x9c, 0x40, 0x00, 0x35, 0, 8, 0, 0}
+	return append(append(b, ip...), udp...)
+}
+
+func TestHandleSFlow(t *testing.T) {
+	c := testCollector()
+	c.handleSFlow(newSFlowDecoders(), sflowDatagram("192.168.1.2", 100, 68, sampledFrame()), "192.168.1.3")
+	st := exporterStatus(t, c, CollectorSFlow, "192.168.1.2")
+	if st.Records != 1 || st.Bytes != 6400 || st.Errors != 0 {
+		t.Errorf("status = %+v, want 1 sample of 64 bytes at 1 in 100", st)
+	}
+}
+
+func TestHandleSFlowMalformed(t *testing.T) {
+	valid := sflowDatagram("192.168.1.2", 100, 68, sampledFrame())
+
+	// No truncation may panic or account a partial sample
+	for n := 0; n < len(valid); n++ {
+		c := testCollector()
+		c.handleSFlow(newSFlowDecoders(), valid[:n], "192.168.1.3")
+		for _, st := range c.statuses() {
+			if st.Records != 0 {
+				t.Errorf("datagram truncated to %d bytes accounted %d samples", n, st.Records)
+			}
+		}
+	}
+
+	u32 := binary.BigEndian.AppendUint32
+	header := func(samples uint32) []byte {
+		b := u32(nil, 5)
+		b = u32(b, 1)
+		b = append(b, 192, 168, 1, 2)
+		b = u32(u32(u32(b, 0), 0), 0)
+		return u32(b, samples)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"huge sample count", header(0xffffffff)},
+		{"sample longer than the datagram", u32(u32(header(1), sflowFlowSample), 0xfffffff0)},
+		{"sample length overflowing int32", u32(u32(header(1), sflowFlowSample), 0xffffffff)},
+		{"unknown address type", append(u32(u32(nil, 5), 7), make([]byte, 64)...)},
+	} {
+		c := testCollector()
+		c.handleSFlow(newSFlowDecoders(), tc.data, "192.168.1.3")
+		for _, st := range c.statuses() {
+			if st.Records != 0 {
+				t.Errorf("%s: accounted %d samples", tc.name, st.Records)
+			}
+		}
+	}
+
+	c := testCollector()
+	c.handleSFlow(newSFlowDecoders(), u32(nil, 4), "192.168.1.3")
+	if st := exporterStatus(t, c, CollectorSFlow, "192.168.1.3"); st.Errors != 1 {
+		t.Errorf("sFlow v4: status = %+v, want an error", st)
+	}
+}
+
+func TestCollectorAllow(t *testing.T) {
+	allow, err := parseCollectorAllow([]string{"192.168.1.1", " 10.0.0.0/8", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFlowCollector(NewBandwidthMonitor(""), allow)
+	for addr, want := range map[string]bool{
+		"192.168.1.1":        true,
+		"192.168.1.2":        false,
+		"10.20.30.40":        true,
+		"::ffff:192.168.1.1": true,
+		"fd00::1":            true,
+		"fd00::2":            false,
+		"203.0.113.5":        false,
+	} {
+		if got := c.allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	// Without -collector-allow, LAN senders only
+	c = testCollector()
+	if !c.allowed(netip.MustParseAddr("192.168.1.1")) || c.allowed(netip.MustParseAddr("203.0.113.5")) {
+		t.Error("default allowlist should accept private and refuse public senders")
+	}
+
+	if _, err := parseCollectorAllow([]string{"router.lan"}); err == nil {
+		t.Error("parseCollectorAllow accepted a host name")
+	}
+}
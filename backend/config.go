@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// loadConfigFile reads a -config file into flag values by flag name. The
+// file is YAML, or JSON when it ends in .json. Top-level keys are flag
+// names; a section such as
+//
+//	storage:
+//	  store: sqlite
+//	  history-db: /var/lib/lantt/history.db
+//	influx:
+//	  url: http://influx:8086
+//
+// sets, for each key, the flag named by the joined path ("influx-url") or,
+// when there is none, by the path without its leading sections
+// ("history-db"). Lists become comma-separated values. Unknown keys are an
+// error, so a typo does not silently leave a default in place.
+func loadConfigFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	if err := flattenConfig(fs, nil, doc, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// flattenConfig adds the flag values of section (found at path) to values
+func flattenConfig(fs *flag.FlagSet, path []string, section map[string]interface{}, values map[string]string) error {
+	keys := make([]string, 0, len(section))
+	for key := range section {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // report the first bad key deterministically
+	for _, key := range keys {
+		p := append(path[:len(path):len(path)], key)
+		if sub, ok := section[key].(map[string]interface{}); ok {
+			if err := flattenConfig(fs, p, sub, values); err != nil {
+				return err
+			}
+			continue
+		}
+		name := configFlagName(fs, p)
+		if name == "" {
+			return fmt.Errorf("unknown setting %q", strings.Join(p, "."))
+		}
+		value, err := configValue(section[key])
+		if err != nil {
+			return fmt.Errorf("%s: %v", strings.Join(p, "."), err)
+		}
+		values[name] = value
+	}
+	return nil
+}
+
+// configFlagName returns the flag a config path sets, or ""
+func configFlagName(fs *flag.FlagSet, path []string) string {
+	for i := range path {
+		if name := strings.Join(path[i:], "-"); fs.Lookup(name) != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// configValue formats a config value the way it is given on the command line
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// applyConfigFile sets the flags of a -config file that were not given on
+// the command line, so flags override the file
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	values, err := loadConfigFile(fs, path)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range values {
+		if given[name] || name == "config" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// envPrefix starts the environment variables that set flags
+const envPrefix = "LANTT_"
+
+// envName is the environment variable of a flag: -history-db is
+// LANTT_HISTORY_DB
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvironment sets the flags that were not given on the command line
+// from their LANTT_* variables, so containers and systemd units need no
+// wrapper scripts. Flags win over the environment, which wins over -config.
+func applyEnvironment(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookup(envName(f.Name))
+		if !ok || given[f.Name] || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), e)
+		}
+	})
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// cronTime returns the given minute of October 2026; the 16th is a Friday
+func cronTime(day, hour, minute int) time.Time {
+	return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronFields(t *testing.T) {
+	for _, tc := range []struct {
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"5", 0, 59, []int{5}},
+		{"1,3,5", 0, 59, []int{1, 3, 5}},
+		{"10-13", 0, 59, []int{10, 11, 12, 13}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"10-20/5", 0, 59, []int{10, 15, 20}},
+		{"22-23,0-2", 0, 23, []int{0, 1, 2, 22, 23}},
+		{"*/10", 1, 31, []int{1, 11, 21, 31}},
+		{"7", 0, 6, []int{7}},
+	} {
+		set, err := parseCronField(tc.field, tc.min, tc.max)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tc.field, err)
+			continue
+		}
+		var want uint64
+		for _, v := range tc.want {
+			want |= 1 << uint(v)
+		}
+		if set != want {
+			t.Errorf("parseCronField(%q) = %b, want %b", tc.field, set, want)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"* * * * *", cronTime(16, 3, 17), true},
+		{"0 9 * * 1-5", cronTime(16, 9, 0), true},
+		{"0 9 * * 1-5", cronTime(16, 9, 1), false},
+		{"0 9 * * 1-5", cronTime(17, 9, 0), false}, // Saturday
+		{"*/15 22-23,0-6 * * *", cronTime(16, 23, 45), true},
+		{"*/15 22-23,0-6 * * *", cronTime(16, 5, 30), true},
+		{"*/15 22-23,0-6 * * *", cronTime(16, 7, 0), false},
+		{"*/15 22-23,0-6 * * *", cronTime(16, 22, 10), false},
+		{"0 0 * 10 *", cronTime(1, 0, 0), true},
+		{"0 0 * 11 *", cronTime(1, 0, 0), false},
+		// 0 and 7 both mean Sunday
+		{"0 12 * * 0", cronTime(18, 12, 0), true},
+		{"0 12 * * 7", cronTime(18, 12, 0), true},
+		{"0 12 * * 7", cronTime(17, 12, 0), false},
+		// Only day of month restricted
+		{"0 0 13 * *", cronTime(13, 0, 0), true},
+		{"0 0 13 * *", cronTime(16, 0, 0), false},
+		// Only day of week restricted
+		{"0 0 * * 5", cronTime(16, 0, 0), true},
+		{"0 0 * * 5", cronTime(13, 0, 0), false},
+		// Both restricted: either matches
+		{"0 0 13 * 5", cronTime(13, 0, 0), true},
+		{"0 0 13 * 5", cronTime(16, 0, 0), true},
+		{"0 0 13 * 5", cronTime(15, 0, 0), false},
+		// A stepped star still counts as restricted
+		{"0 0 */10 * 5", cronTime(16, 0, 0), true},
+		{"0 0 */10 * 5", cronTime(21, 0, 0), true},
+		{"0 0 */10 * 5", cronTime(20, 0, 0), false},
+	} {
+		sched, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tc.expr, err)
+			continue
+		}
+		if got := sched.matches(tc.at); got != tc.want {
+			t.Errorf("%q matches %s = %v, want %v", tc.expr, tc.at.Format("Mon Jan 2 15:04"), got, tc.want)
+		}
+	}
+}
+
+// TestProfileScheduleTick checks that an entry matching a range of minutes
+// switches once, so a profile chosen through the API stays until the next
+// scheduled switch
+func TestProfileScheduleTick(t *testing.T) {
+	pm, err := newProfileManager("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []ProfileSchedule{
+		{Cron: "* 9-17 * * 1-5", Profile: "full"},
+		{Cron: "* 0-8,18-23 * * *", Profile: "sampled"},
+	} {
+		if entry.schedule, err = parseCron(entry.Cron); err != nil {
+			t.Fatal(err)
+		}
+		pm.schedule = append(pm.schedule, entry)
+	}
+	pm.scheduled = -1
+
+	pm.tick(cronTime(16, 8, 59))
+	if got := pm.current().Name; got != "sampled" {
+		t.Fatalf("at 08:59 profile = %q, want sampled", got)
+	}
+	pm.tick(cronTime(16, 9, 0))
+	if got := pm.current().Name; got != "full" {
+		t.Fatalf("at 09:00 profile = %q, want full", got)
+	}
+
+	pm.activate("sampled", "api")
+	for m := 1; m < 60; m++ {
+		pm.tick(cronTime(16, 9, m))
+	}
+	if st := pm.state(); st.Active.Name != "sampled" || st.Source != "api" {
+		t.Fatalf("override after an hour = %q (%s), want sampled (api)", st.Active.Name, st.Source)
+	}
+
+	pm.activate("full", "api")
+	pm.tick(cronTime(16, 18, 0))
+	if st := pm.state(); st.Active.Name != "sampled" || st.Source != "schedule" {
+		t.Fatalf("at 18:00 profile = %q (%s), want sampled (schedule)", st.Active.Name, st.Source)
+	}
+}
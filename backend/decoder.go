@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetDecoder decodes the frames of one capture loop into layers it
+// reuses for every packet, so decoding allocates nothing per packet (the
+// gopacket.Packet API allocates each layer and lets GC pressure drop
+// packets under load). It is not safe for concurrent use; every capture
+// loop or fanout worker has its own.
+type packetDecoder struct {
+	strategy linkStrategy
+	linkType layers.LinkType
+
+	eth     layers.Ethernet
+	sll     layers.LinuxSLL
+	loop    layers.Loopback
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	arp     layers.ARP
+	tcp     layers.TCP
+	udp     layers.UDP
+	icmp4   layers.ICMPv4
+	icmp6   layers.ICMPv6
+	ra      layers.ICMPv6RouterAdvertisement
+	payload gopacket.Payload
+
+	// One parser per first layer, all sharing the layers above
+	parsers map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	decoded []gopacket.LayerType
+	// Layers found in the last packet
+	hasEth, hasSLL, hasDot1Q, hasIP4, hasIP6, hasARP bool
+	hasTCP, hasUDP, hasICMP, hasRA                   bool
+}
+
+// newPacketDecoder creates a decoder for frames of link type lt
+func newPacketDecoder(lt layers.LinkType) *packetDecoder {
+	d := &packetDecoder{strategy: strategyFor(lt), linkType: lt, decoded: make([]gopacket.LayerType, 0, 8)}
+	d.parsers = make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)
+	for _, first := range []gopacket.LayerType{layers.LayerTypeEthernet, layers.LayerTypeLinuxSLL,
+		layers.LayerTypeLoopback, layers.LayerTypeIPv4, layers.LayerTypeIPv6} {
+		p := gopacket.NewDecodingLayerParser(first, &d.eth, &d.sll, &d.loop, &d.dot1q, &d.ip4, &d.ip6,
+			&d.arp, &d.tcp, &d.udp, &d.icmp4, &d.icmp6, &d.ra, &d.payload)
+		// Layers without a decoder here (ICMP echo, NDP, ...) end decoding
+		p.IgnoreUnsupported = true
+		d.parsers[first] = p
+	}
+	return d
+}
+
+// firstLayer returns the layer a frame starts with, or 0 when the link
+// type has no decoding layer and decodeFallback must be used
+func (d *packetDecoder) firstLayer(data []byte) gopacket.LayerType {
+	switch d.linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6
+	case 12, 14, layers.LinkTypeRaw:
+		// Raw IP, as on tun and VPN interfaces. libpcap reports DLT values,
+		// which for raw IP differ from the LINKTYPE numbers gopacket
+		// registers (DLT_RAW is 12 on most platforms and 14 on OpenBSD);
+		// the version nibble tells IPv4 from IPv6.
+		if len(data) > 0 && data[0]>>4 == 6 {
+			return layers.LayerTypeIPv6
+		}
+		return layers.LayerTypeIPv4
+	}
+	return 0
+}
+
+// decode decodes data, a frame of the decoder's link type. Truncated or
+// partly unsupported frames keep the layers decoded before the problem.
+func (d *packetDecoder) decode(data []byte) {
+	d.decoded = d.decoded[:0]
+	if first := d.firstLayer(data); first != 0 {
+		d.parsers[first].DecodeLayers(data, &d.decoded)
+	} else {
+		d.decodeFallback(data)
+	}
+	d.hasEth, d.hasSLL, d.hasDot1Q, d.hasIP4, d.hasIP6, d.hasARP = false, false, false, false, false, false
+	d.hasTCP, d.hasUDP, d.hasICMP, d.hasRA = false, false, false, false
+	for _, t := range d.decoded {
+		switch t {
+		case layers.LayerTypeEthernet:
+			d.hasEth = true
+		case layers.LayerTypeLinuxSLL:
+			d.hasSLL = true
+		case layers.LayerTypeDot1Q:
+			d.hasDot1Q = true
+		case layers.LayerTypeIPv4:
+			d.hasIP4 = true
+		case layers.LayerTypeIPv6:
+			d.hasIP6 = true
+		case layers.LayerTypeARP:
+			d.hasARP = true
+		case layers.LayerTypeTCP:
+			d.hasTCP = true
+		case layers.LayerTypeUDP:
+			d.hasUDP = true
+		case layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
+			d.hasICMP = true
+		case layers.LayerTypeICMPv6RouterAdvertisement:
+			d.hasRA = true
+		}
+	}
+}
+
+// decodeFallback decodes a frame of a link type without a decoding layer
+// through gopacket's full decoder, continuing from its network layer
+func (d *packetDecoder) decodeFallback(data []byte) {
+	packet := gopacket.NewPacket(data, d.linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	network := packet.NetworkLayer()
+	if network == nil {
+		return
+	}
+	first := network.LayerType()
+	p, ok := d.parsers[first]
+	if !ok {
+		return
+	}
+	contents := network.LayerContents()
+	p.DecodeLayers(append(contents[:len(contents):len(contents)], network.LayerPayload()...), &d.decoded)
+}
+
+// vlan returns the VLAN ID of the last packet, 0 if untagged. For QinQ the
+// outer (service) tag is used, as that is what a switch mirror port
+// separates on; the parser reuses one Dot1Q layer for both tags, so the
+// outer one is read from the Ethernet payload.
+func (d *packetDecoder) vlan() uint16 {
+	if !d.hasDot1Q {
+		return 0
+	}
+	if d.hasEth && len(d.eth.Payload) >= 2 &&
+		(d.eth.EthernetType == layers.EthernetTypeDot1Q || d.eth.EthernetType == layers.EthernetTypeQinQ) {
+		return binary.BigEndian.Uint16(d.eth.Payload[:2]) & 0x0fff
+	}
+	return d.dot1q.VLANIdentifier
+}
+
+// portUnreachable returns the "ip:port" of the UDP target an ICMP port
+// unreachable in the last packet reports closed, from the header of the
+// datagram it quotes; empty for any other ICMP message
+func (d *packetDecoder) portUnreachable() string {
+	var dst net.IP
+	var udp []byte
+	switch {
+	case d.hasIP4 && d.icmp4.TypeCode == layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort):
+		quoted := d.icmp4.Payload
+		if len(quoted) < 20 || quoted[9] != byte(layers.IPProtocolUDP) {
+			return ""
+		}
+		ihl := int(quoted[0]&0x0f) * 4
+		if ihl < 20 || len(quoted) < ihl {
+			return ""
+		}
+		dst, udp = net.IP(quoted[16:20]), quoted[ihl:]
+	case d.hasIP6 && d.icmp6.TypeCode == layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable):
+		// The quoted packet follows 4 unused bytes
+		quoted := d.icmp6.Payload
+		if len(quoted) < 44 || quoted[10] != byte(layers.IPProtocolUDP) {
+			return ""
+		}
+		dst, udp = net.IP(quoted[28:44]), quoted[44:]
+	default:
+		return ""
+	}
+	if len(udp) < 4 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", dst, binary.BigEndian.Uint16(udp[2:4]))
+}
@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// deterministicOutput makes API output reproducible for golden-file tests
+// (-deterministic): timestamps are truncated to whole seconds in UTC. JSON
+// object keys are always sorted and lists always have a total order.
+var deterministicOutput bool
+
+// deterministic returns the JSON form of v with timestamps truncated
+func deterministic(v interface{}) (interface{}, error) {
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return truncateTimestamps(generic), nil
+}
+
+// truncateTimestamps rewrites every RFC 3339 string in a JSON value to whole
+// seconds in UTC
+func truncateTimestamps(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, field := range val {
+			val[k] = truncateTimestamps(field)
+		}
+	case []interface{}:
+		for i, elem := range val {
+			val[i] = truncateTimestamps(elem)
+		}
+	case string:
+		// Cheap shape check before parsing: "2006-01-02T..."
+		if len(val) >= 20 && val[4] == '-' && val[10] == 'T' {
+			if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+				return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+			}
+		}
+	}
+	return v
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deviceShardCount is how many independently locked parts the device map
+// is split into
+const deviceShardCount = 64
+
+// deviceShard is one lock-striped part of the device map
+type deviceShard struct {
+	mu      sync.RWMutex
+	devices map[string]*DeviceStats
+}
+
+// deviceTable is the device map, striped so that capture workers updating
+// different devices do not contend, and a reader such as GetNetworkStats
+// only holds up the packets of the shard it is copying.
+//
+// bm.mutex guards the table as a whole. Holding it exclusively gives access
+// to every device without shard locks (resets, merges, eviction). The packet
+// path and readers hold it shared and lock the shard of each device they
+// touch: for writing to update it, for reading to copy it.
+type deviceTable struct {
+	shards [deviceShardCount]deviceShard
+	count  atomic.Int64
+}
+
+// newDeviceTable creates an empty table
+func newDeviceTable() *deviceTable {
+	t := &deviceTable{}
+	for i := range t.shards {
+		t.shards[i].devices = make(map[string]*DeviceStats)
+	}
+	return t
+}
+
+// shard returns the shard holding key (FNV-1a)
+func (t *deviceTable) shard(key string) *deviceShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &t.shards[h%deviceShardCount]
+}
+
+// get returns a device; caller holds bm.mutex exclusively or the shard lock
+func (t *deviceTable) get(key string) (*DeviceStats, bool) {
+	dev, ok := t.shard(key).devices[key]
+	return dev, ok
+}
+
+// set stores a device; caller holds bm.mutex exclusively or the shard's
+// write lock
+func (t *deviceTable) set(key string, dev *DeviceStats) {
+	s := t.shard(key)
+	if _, ok := s.devices[key]; !ok {
+		t.count.Add(1)
+	}
+	s.devices[key] = dev
+}
+
+// remove deletes a device and reports whether it existed; caller holds
+// bm.mutex exclusively
+func (t *deviceTable) remove(key string) bool {
+	s := t.shard(key)
+	if _, ok := s.devices[key]; !ok {
+		return false
+	}
+	delete(s.devices, key)
+	t.count.Add(-1)
+	return true
+}
+
+// clear removes every device; caller holds bm.mutex exclusively
+func (t *deviceTable) clear() {
+	for i := range t.shards {
+		t.shards[i].devices = make(map[string]*DeviceStats)
+	}
+	t.count.Store(0)
+}
+
+// len is the number of devices
+func (t *deviceTable) len() int {
+	return int(t.count.Load())
+}
+
+// all calls fn for every device; caller holds bm.mutex exclusively
+func (t *deviceTable) all(fn func(key string, dev *DeviceStats)) {
+	for i := range t.shards {
+		for key, dev := range t.shards[i].devices {
+			fn(key, dev)
+		}
+	}
+}
+
+// each calls fn for every device with its shard read-locked, one shard at a
+// time; caller holds bm.mutex shared
+func (t *deviceTable) each(fn func(key string, dev *DeviceStats)) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for key, dev := range s.devices {
+			fn(key, dev)
+		}
+		s.mu.RUnlock()
+	}
+}
+
+// load returns a copy of a device with its rates as of now. The copy is
+// detached from the live rate and NAT state, which only the shard lock
+// guards. Caller holds bm.mutex shared.
+func (t *deviceTable) load(key string, now time.Time) (DeviceStats, bool) {
+	s := t.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dev, ok := s.devices[key]
+	if !ok {
+		return DeviceStats{}, false
+	}
+	c := *dev
+	c.fillWindow(now)
+	c.rate, c.nat = nil, nil
+	return c, true
+}
+
+// view calls fn with a device under its shard's read lock and reports
+// whether the device exists; caller holds bm.mutex shared
+func (t *deviceTable) view(key string, fn func(dev *DeviceStats)) bool {
+	s := t.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dev, ok := s.devices[key]
+	if ok {
+		fn(dev)
+	}
+	return ok
+}
+
+// update calls fn with a device under its shard's write lock and reports
+// whether the device exists; caller holds bm.mutex shared
+func (t *deviceTable) update(key string, fn func(dev *DeviceStats)) bool {
+	s := t.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dev, ok := s.devices[key]
+	if ok {
+		fn(dev)
+	}
+	return ok
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// frontendProxy forwards requests to the frontend dev server at target
+// (-proxy-frontend), including its hot-reload WebSocket, so the dashboard
+// can be developed against live capture data on one origin
+func frontendProxy(target string) (http.Handler, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http(s) URL", target)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(u) // the dev server sees its own host name
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Frontend proxy: %v", err)
+			http.Error(w, "Frontend dev server unavailable at "+target, http.StatusBadGateway)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Pages and scripts need what securityHeaders forbids for the API
+		w.Header().Del("Content-Security-Policy")
+		w.Header().Del("X-Frame-Options")
+		if r.Header.Get("Upgrade") != "" {
+			// The hot-reload socket outlives the server's write timeout
+			rc := http.NewResponseController(w)
+			rc.SetReadDeadline(time.Time{})
+			rc.SetWriteDeadline(time.Time{})
+		}
+		proxy.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// discoveryPorts maps the UDP ports of service-discovery protocols to their
+// names. Their chatter is mostly multicast, which WiFi sends at the lowest
+// basic rate, so a few noisy devices can eat a lot of airtime.
+var discoveryPorts = map[uint16]string{
+	1900: "ssdp",
+	3702: "ws-discovery",
+	5353: "mdns",
+	5355: "llmnr",
+}
+
+// DiscoveryChatter is the service-discovery traffic a device sent
+type DiscoveryChatter struct {
+	Device           string                     `json:"device"`
+	Name             string                     `json:"name,omitempty"`
+	Bytes            uint64                     `json:"bytes"`
+	Packets          uint64                     `json:"packets"`
+	PacketsPerMinute float64                    `json:"packetsPerMinute"` // since first seen
+	Share            float64                    `json:"share"`            // of all bytes the device sent
+	Protocols        map[string]ProtocolCounter `json:"protocols"`
+	FirstSeen        time.Time                  `json:"firstSeen"`
+}
+
+// DiscoveryReport ranks devices by service-discovery chatter
+type DiscoveryReport struct {
+	Since     time.Time                  `json:"since"`
+	Bytes     uint64                     `json:"bytes"` // all devices
+	Packets   uint64                     `json:"packets"`
+	Protocols map[string]ProtocolCounter `json:"protocols"`
+	Devices   []DiscoveryChatter         `json:"devices"` // noisiest first
+}
+
+// discoveryUsage accumulates per-device service-discovery chatter
+type discoveryUsage struct {
+	mu      sync.Mutex
+	devices map[string]*DiscoveryChatter
+}
+
+// newDiscoveryUsage creates an empty accumulator
+func newDiscoveryUsage() *discoveryUsage {
+	return &discoveryUsage{devices: make(map[string]*DiscoveryChatter)}
+}
+
+// add records a discovery packet sent by device
+func (u *discoveryUsage) add(device, protocol string, size, packets uint64, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, ok := u.devices[device]
+	if !ok {
+		c = &DiscoveryChatter{Device: device, Protocols: make(map[string]ProtocolCounter), FirstSeen: now}
+		u.devices[device] = c
+	}
+	c.Bytes += size
+	c.Packets += packets
+	p := c.Protocols[protocol]
+	p.Bytes += size
+	p.Packets += packets
+	c.Protocols[protocol] = p
+}
+
+// forget drops the chatter of device
+func (u *discoveryUsage) forget(device string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.devices, device)
+}
+
+// reset drops the chatter of every device
+func (u *discoveryUsage) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.devices = make(map[string]*DiscoveryChatter)
+}
+
+// snapshot copies the chatter of every device
+func (u *discoveryUsage) snapshot() []DiscoveryChatter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make([]DiscoveryChatter, 0, len(u.devices))
+	for _, c := range u.devices {
+		cp := *c
+		cp.Protocols = make(map[string]ProtocolCounter, len(c.Protocols))
+		for k, v := range c.Protocols {
+			cp.Protocols[k] = v
+		}
+		result = append(result, cp)
+	}
+	return result
+}
+
+// discoveryProtocol names the discovery protocol of a packet, or ""
+func discoveryProtocol(pi *packetInfo) string {
+	if pi.transport != "udp" {
+		return ""
+	}
+	if name, ok := discoveryPorts[pi.dstPort]; ok {
+		return name
+	}
+	// Unicast replies, e.g. SSDP responses to an M-SEARCH
+	return discoveryPorts[pi.srcPort]
+}
+
+// ObserveDiscovery accounts a service-discovery packet to its sender
+func (bm *BandwidthMonitor) ObserveDiscovery(pi *packetInfo, packets uint64) {
+	protocol := discoveryProtocol(pi)
+	if protocol == "" {
+		return
+	}
+	if src := bm.deviceKey(pi.srcMAC, pi.srcIP); src != "" {
+		bm.discovery.add(src, protocol, pi.size, packets, time.Now())
+	}
+}
+
+// buildDiscoveryReport ranks the n devices sending the most discovery packets
+func (bm *BandwidthMonitor) buildDiscoveryReport(n int, now time.Time) *DiscoveryReport {
+	report := &DiscoveryReport{Since: bm.startTime, Protocols: make(map[string]ProtocolCounter)}
+	devices := bm.discovery.snapshot()
+	for _, c := range devices {
+		report.Bytes += c.Bytes
+		report.Packets += c.Packets
+		for k, v := range c.Protocols {
+			p := report.Protocols[k]
+			p.Bytes += v.Bytes
+			p.Packets += v.Packets
+			report.Protocols[k] = p
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Packets != devices[j].Packets {
+			return devices[i].Packets > devices[j].Packets
+		}
+		return devices[i].Device < devices[j].Device
+	})
+	if n > 0 && len(devices) > n {
+		devices = devices[:n]
+	}
+
+	bm.mutex.RLock()
+	for i := range devices {
+		c := &devices[i]
+		if minutes := now.Sub(c.FirstSeen).Minutes(); minutes >= 1 {
+			c.PacketsPerMinute = float64(c.Packets) / minutes
+		} else {
+			c.PacketsPerMinute = float64(c.Packets)
+		}
+		if dev, ok := bm.devices.load(c.Device, now); ok {
+			c.Name = dev.friendlyName()
+			if dev.BytesSent > 0 {
+				c.Share = float64(c.Bytes) / float64(dev.BytesSent)
+			}
+		}
+	}
+	bm.mutex.RUnlock()
+	report.Devices = devices
+	return report
+}
+
+// REST API: Noisiest devices by service-discovery chatter (mDNS, SSDP,
+// WS-Discovery, LLMNR), top ?n= (default 10)
+func (bm *BandwidthMonitor) handleGetDiscoveryReport(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeEncoded(w, r, bm.buildDiscoveryReport(n, time.Now()))
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS filter limits
+const (
+	dnsFilterPageSize          = 1000
+	dnsFilterMaxPages          = 50 // per poll; older queries are skipped after an outage
+	maxBlockedDomainsPerDevice = 100
+	dnsFilterTopDomains        = 10
+)
+
+// dnsQuery is one query answered by the LAN's filtering resolver
+type dnsQuery struct {
+	Time    time.Time
+	Client  string // IP address
+	Domain  string
+	Blocked bool
+}
+
+// dnsClient is a client the filtering resolver knows, by IP address
+type dnsClient struct {
+	IP           string
+	Name         string
+	QueriesToday uint64
+}
+
+// dnsFilterSource reads the query log and clients of a filtering resolver
+type dnsFilterSource interface {
+	// queries returns the queries answered after since
+	queries(since time.Time) ([]dnsQuery, error)
+	// clients returns the named clients and the query counts of the last day
+	clients() ([]dnsClient, error)
+	name() string
+}
+
+// newDNSFilterSource creates a client for a Pi-hole (v6 API) or AdGuard Home
+// server at baseURL
+func newDNSFilterSource(kind, baseURL, user, password string) (dnsFilterSource, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", baseURL)
+	}
+	base := strings.TrimSuffix(u.String(), "/")
+	client := &http.Client{Timeout: notifyTimeout}
+	switch kind {
+	case "pihole":
+		return &piholeSource{base: base, password: password, client: client}, nil
+	case "adguard":
+		return &adguardSource{base: base, user: user, password: password, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown type %q (want pihole or adguard)", kind)
+}
+
+// getJSON decodes the JSON response of req into v
+func getJSON(client *http.Client, req *http.Request, v interface{}) (int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// piholeBlocked are the Pi-hole query statuses of blocked queries
+var piholeBlocked = map[string]bool{
+	"GRAVITY": true, "REGEX": true, "DENYLIST": true, "GRAVITY_CNAME": true, "REGEX_CNAME": true,
+	"DENYLIST_CNAME": true, "EXTERNAL_BLOCKED_IP": true, "EXTERNAL_BLOCKED_NULL": true,
+	"EXTERNAL_BLOCKED_NXRA": true, "EXTERNAL_BLOCKED_EDE15": true, "SPECIAL_DOMAIN": true,
+}
+
+// piholeSource reads the Pi-hole v6 API, logging in with an app password
+// when the server has one set
+type piholeSource struct {
+	base     string
+	password string
+	client   *http.Client
+
+	mu  sync.Mutex
+	sid string // session id of the last login
+}
+
+func (p *piholeSource) name() string { return "pihole" }
+
+// login starts an API session
+func (p *piholeSource) login() (string, error) {
+	body, _ := json.Marshal(map[string]string{"password": p.password})
+	req, err := http.NewRequest(http.MethodPost, p.base+"/api/auth", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Session struct {
+			Valid   bool   `json:"valid"`
+			SID     string `json:"sid"`
+			Message string `json:"message"`
+		} `json:"session"`
+	}
+	if _, err := getJSON(p.client, req, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Session.Valid {
+		return "", fmt.Errorf("Pi-hole login failed: %s", resp.Session.Message)
+	}
+	return resp.Session.SID, nil
+}
+
+// get fetches an API path, logging in again once when the session expired
+func (p *piholeSource) get(path string, v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		p.mu.Lock()
+		sid := p.sid
+		p.mu.Unlock()
+		req, err := http.NewRequest(http.MethodGet, p.base+path, nil)
+		if err != nil {
+			return err
+		}
+		if sid != "" {
+			req.Header.Set("X-FTL-SID", sid)
+		}
+		status, err := getJSON(p.client, req, v)
+		if status != http.StatusUnauthorized || attempt > 0 {
+			return err
+		}
+		if sid, err = p.login(); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.sid = sid
+		p.mu.Unlock()
+	}
+}
+
+func (p *piholeSource) queries(since time.Time) ([]dnsQuery, error) {
+	var queries []dnsQuery
+	until := time.Now()
+	for page := 0; page < dnsFilterMaxPages; page++ {
+		q := url.Values{
+			"from":   {strconv.FormatInt(since.Unix(), 10)},
+			"until":  {strconv.FormatInt(until.Unix(), 10)},
+			"start":  {strconv.Itoa(page * dnsFilterPageSize)},
+			"length": {strconv.Itoa(dnsFilterPageSize)},
+		}
+		var resp struct {
+			Queries []struct {
+				Time   float64 `json:"time"`
+				Domain string  `json:"domain"`
+				Status string  `json:"status"`
+				Client struct {
+					IP string `json:"ip"`
+				} `json:"client"`
+			} `json:"queries"`
+		}
+		if err := p.get("/api/queries?"+q.Encode(), &resp); err != nil {
+			return queries, err
+		}
+		for _, e := range resp.Queries {
+			t := time.Unix(0, int64(e.Time*float64(time.Second)))
+			if !t.After(since) {
+				continue
+			}
+			queries = append(queries, dnsQuery{Time: t, Client: e.Client.IP, Domain: e.Domain, Blocked: piholeBlocked[e.Status]})
+		}
+		if len(resp.Queries) < dnsFilterPageSize {
+			break
+		}
+	}
+	return queries, nil
+}
+
+// clients merges the names of the network table, which Pi-hole learns from
+// DHCP and PTR records, with the query counts of its last 24 hours
+func (p *piholeSource) clients() ([]dnsClient, error) {
+	var network struct {
+		Devices []struct {
+			IPs []struct {
+				IP   string `json:"ip"`
+				Name string `json:"name"`
+			} `json:"ips"`
+		} `json:"devices"`
+	}
+	if err := p.get("/api/network/devices?max_devices=1000&max_addresses=8", &network); err != nil {
+		return nil, err
+	}
+	var top struct {
+		Clients []struct {
+			IP    string `json:"ip"`
+			Name  string `json:"name"`
+			Count uint64 `json:"count"`
+		} `json:"clients"`
+	}
+	if err := p.get("/api/stats/top_clients?count=1000", &top); err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, d := range network.Devices {
+		for _, a := range d.IPs {
+			if names[a.IP] == "" {
+				names[a.IP] = a.Name
+			}
+		}
+	}
+	counts := make(map[string]uint64, len(top.Clients))
+	for _, c := range top.Clients {
+		counts[c.IP] = c.Count
+		if names[c.IP] == "" {
+			names[c.IP] = c.Name
+		}
+	}
+	clients := make([]dnsClient, 0, len(names))
+	for ip, name := range names {
+		clients = append(clients, dnsClient{IP: ip, Name: name, QueriesToday: counts[ip]})
+	}
+	return clients, nil
+}
+
+// adguardBlocked are the AdGuard Home filtering reasons of blocked queries
+var adguardBlocked = map[string]bool{
+	"FilteredBlackList": true, "FilteredBlockedService": true, "FilteredSafeBrowsing": true,
+	"FilteredParental": true, "FilteredInvalid": true,
+}
+
+// adguardSource reads the AdGuard Home query log with basic auth
+type adguardSource struct {
+	base           string
+	user, password string
+	client         *http.Client
+}
+
+func (a *adguardSource) name() string { return "adguard" }
+
+// get fetches an API path with basic auth
+func (a *adguardSource) get(path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, a.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if a.user != "" || a.password != "" {
+		req.SetBasicAuth(a.user, a.password)
+	}
+	_, err = getJSON(a.client, req, v)
+	return err
+}
+
+// clients merges the persistent clients, named by an administrator, with
+// the automatically found ones and the query counts of the stats period
+// (a day by default)
+func (a *adguardSource) clients() ([]dnsClient, error) {
+	var list struct {
+		Clients []struct {
+			Name string   `json:"name"`
+			IDs  []string `json:"ids"`
+		} `json:"clients"`
+		AutoClients []struct {
+			IP   string `json:"ip"`
+			Name string `json:"name"`
+		} `json:"auto_clients"`
+	}
+	if err := a.get("/control/clients", &list); err != nil {
+		return nil, err
+	}
+	var stats struct {
+		TopClients []map[string]uint64 `json:"top_clients"`
+	}
+	if err := a.get("/control/stats", &stats); err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, c := range list.AutoClients {
+		names[c.IP] = c.Name
+	}
+	for _, c := range list.Clients {
+		for _, id := range c.IDs {
+			if net.ParseIP(id) != nil {
+				names[id] = c.Name
+			}
+		}
+	}
+	counts := make(map[string]uint64)
+	for _, entry := range stats.TopClients {
+		for ip, n := range entry {
+			counts[ip] = n
+			if _, ok := names[ip]; !ok {
+				names[ip] = ""
+			}
+		}
+	}
+	clients := make([]dnsClient, 0, len(names))
+	for ip, name := range names {
+		clients = append(clients, dnsClient{IP: ip, Name: name, QueriesToday: counts[ip]})
+	}
+	return clients, nil
+}
+
+// queries pages back through the log, which is newest first, until since
+func (a *adguardSource) queries(since time.Time) ([]dnsQuery, error) {
+	var queries []dnsQuery
+	olderThan := ""
+	for page := 0; page < dnsFilterMaxPages; page++ {
+		q := url.Values{"limit": {strconv.Itoa(dnsFilterPageSize)}}
+		if olderThan != "" {
+			q.Set("older_than", olderThan)
+		}
+		var resp struct {
+			Data []struct {
+				Time     time.Time `json:"time"`
+				Client   string    `json:"client"`
+				Reason   string    `json:"reason"`
+				Question struct {
+					Name string `json:"name"`
+				} `json:"question"`
+			} `json:"data"`
+			Oldest string `json:"oldest"`
+		}
+		if err := a.get("/control/querylog?"+q.Encode(), &resp); err != nil {
+			return queries, err
+		}
+		for _, e := range resp.Data {
+			if !e.Time.After(since) {
+				return queries, nil
+			}
+			queries = append(queries, dnsQuery{Time: e.Time, Client: e.Client, Domain: e.Question.Name, Blocked: adguardBlocked[e.Reason]})
+		}
+		if len(resp.Data) < dnsFilterPageSize || resp.Oldest == "" {
+			break
+		}
+		olderThan = resp.Oldest
+	}
+	return queries, nil
+}
+
+// DomainCount is how often a domain was queried
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+}
+
+// DNSFilterDevice is the blocked versus allowed queries of one device
+type DNSFilterDevice struct {
+	Device     string        `json:"device"`
+	Allowed    uint64        `json:"allowed"`
+	Blocked    uint64        `json:"blocked"`
+	BytesTotal uint64        `json:"bytesTotal"` // sent and received, for comparison
+	TopBlocked []DomainCount `json:"topBlocked,omitempty"`
+}
+
+// DNSFilterReport is the state of the filtering resolver integration
+type DNSFilterReport struct {
+	Source    string            `json:"source"`
+	LastPoll  time.Time         `json:"lastPoll,omitempty"`
+	LastError string            `json:"lastError,omitempty"`
+	Devices   []DNSFilterDevice `json:"devices"`
+}
+
+// dnsFilterStats keeps the blocked domains of every device, capped per device
+type dnsFilterStats struct {
+	mu        sync.Mutex
+	source    dnsFilterSource
+	since     time.Time // newest query seen
+	lastPoll  time.Time
+	lastError string
+	blocked   map[string]map[string]uint64 // device -> domain -> queries
+}
+
+// newDNSFilterStats starts reading source from now on
+func newDNSFilterStats(source dnsFilterSource) *dnsFilterStats {
+	return &dnsFilterStats{source: source, since: time.Now(), blocked: make(map[string]map[string]uint64)}
+}
+
+// forget drops the blocked domains of device
+func (s *dnsFilterStats) forget(device string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blocked, device)
+}
+
+// reset drops the blocked domains of every device
+func (s *dnsFilterStats) reset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked = make(map[string]map[string]uint64)
+}
+
+// pollDNSFilter reads the queries answered since the last poll and counts
+// them against the devices with their client addresses
+func (bm *BandwidthMonitor) pollDNSFilter(now time.Time) error {
+	s := bm.dnsFilter
+	s.mu.Lock()
+	since := s.since
+	s.mu.Unlock()
+	queries, err := s.source.queries(since)
+
+	bm.mutex.Lock()
+	byIP := make(map[string]*DeviceStats, bm.devices.len())
+	keys := make(map[*DeviceStats]string, bm.devices.len())
+	bm.devices.all(func(key string, dev *DeviceStats) {
+		keys[dev] = key
+		for _, ip := range dev.IPs {
+			byIP[ip] = dev
+		}
+		if dev.IP != "" {
+			byIP[dev.IP] = dev
+		}
+	})
+	var blocked [][2]string // device, domain
+	newest := since
+	for _, q := range queries {
+		if q.Time.After(newest) {
+			newest = q.Time
+		}
+		dev, ok := byIP[q.Client]
+		if !ok {
+			continue
+		}
+		if q.Blocked {
+			dev.DNSBlocked++
+			blocked = append(blocked, [2]string{keys[dev], q.Domain})
+		} else {
+			dev.DNSAllowed++
+		}
+	}
+	bm.mutex.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since, s.lastPoll = newest, now
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	for _, b := range blocked {
+		domains := s.blocked[b[0]]
+		if domains == nil {
+			domains = make(map[string]uint64)
+			s.blocked[b[0]] = domains
+		}
+		if _, ok := domains[b[1]]; ok || len(domains) < maxBlockedDomainsPerDevice {
+			domains[b[1]]++
+		}
+	}
+	return err
+}
+
+// syncDNSFilterClients names devices after the resolver's clients and sets
+// their query counts of the last day
+func (bm *BandwidthMonitor) syncDNSFilterClients() error {
+	clients, err := bm.dnsFilter.source.clients()
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]uint64, len(clients))
+	now := time.Now()
+	for _, c := range clients {
+		counts[c.IP] = c.QueriesToday
+		if name := strings.TrimSpace(c.Name); name != "" && name != c.IP && bm.names.learn(c.IP, name, NameSourceDNSFilter, now) {
+			bm.applyHostname(c.IP, name)
+		}
+	}
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	bm.devices.all(func(_ string, dev *DeviceStats) {
+		dev.DNSQueriesToday = counts[dev.IP]
+		for _, ip := range dev.IPs {
+			if ip != dev.IP {
+				dev.DNSQueriesToday += counts[ip]
+			}
+		}
+	})
+	return nil
+}
+
+// pollDNSFilterPeriodically polls the resolver every interval until stop is
+// closed
+func (bm *BandwidthMonitor) pollDNSFilterPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := bm.pollDNSFilter(now); err != nil {
+				log.Printf("Error reading %s query log: %v", bm.dnsFilter.source.name(), err)
+			}
+			if err := bm.syncDNSFilterClients(); err != nil {
+				log.Printf("Error reading %s clients: %v", bm.dnsFilter.source.name(), err)
+			}
+		}
+	}
+}
+
+// dnsFilterReport lists the devices with filtered queries, most blocked first
+func (bm *BandwidthMonitor) dnsFilterReport() DNSFilterReport {
+	s := bm.dnsFilter
+	bm.mutex.RLock()
+	devices := make([]DNSFilterDevice, 0)
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		if dev.DNSAllowed+dev.DNSBlocked == 0 {
+			return
+		}
+		devices = append(devices, DNSFilterDevice{Device: key, Allowed: dev.DNSAllowed, Blocked: dev.DNSBlocked,
+			BytesTotal: dev.BytesSent + dev.BytesRecv})
+	})
+	bm.mutex.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range devices {
+		domains := s.blocked[devices[i].Device]
+		top := make([]DomainCount, 0, len(domains))
+		for domain, n := range domains {
+			top = append(top, DomainCount{Domain: domain, Count: n})
+		}
+		sort.Slice(top, func(a, b int) bool {
+			if top[a].Count != top[b].Count {
+				return top[a].Count > top[b].Count
+			}
+			return top[a].Domain < top[b].Domain
+		})
+		if len(top) > dnsFilterTopDomains {
+			top = top[:dnsFilterTopDomains]
+		}
+		devices[i].TopBlocked = top
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Blocked != devices[j].Blocked {
+			return devices[i].Blocked > devices[j].Blocked
+		}
+		return devices[i].Device < devices[j].Device
+	})
+	return DNSFilterReport{Source: s.source.name(), LastPoll: s.lastPoll, LastError: s.lastError, Devices: devices}
+}
+
+// REST API: Blocked versus allowed DNS queries per device
+func (bm *BandwidthMonitor) handleGetDNSFilter(w http.ResponseWriter, r *http.Request) {
+	if bm.dnsFilter == nil {
+		http.Error(w, "DNS filter not configured (-dns-filter)", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, bm.dnsFilterReport())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/gorilla/mux"
+)
+
+// maxDomainLookups is how many recent lookups are kept per device
+const maxDomainLookups = 200
+
+// portDNS is the port of plain DNS queries
+const portDNS = 53
+
+// Where a domain lookup was seen
+const (
+	DomainSourceDNS = "dns" // query to a DNS server
+	DomainSourceSNI = "sni" // server name of a TLS ClientHello
+)
+
+// DomainLookup is one domain a device looked up or connected to
+type DomainLookup struct {
+	Domain string    `json:"domain"`
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+// domainLog keeps the most recent DNS queries and TLS server names of each
+// device, when the active capture profile enables them
+type domainLog struct {
+	mu      sync.Mutex
+	devices map[string][]DomainLookup
+}
+
+// newDomainLog creates an empty log
+func newDomainLog() *domainLog {
+	return &domainLog{devices: make(map[string][]DomainLookup)}
+}
+
+// add records a lookup, dropping the device's oldest beyond maxDomainLookups
+func (l *domainLog) add(device string, lookup DomainLookup) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := append(l.devices[device], lookup)
+	if len(list) > maxDomainLookups {
+		list = append(list[:0:0], list[len(list)-maxDomainLookups:]...)
+	}
+	l.devices[device] = list
+}
+
+// forget drops the lookups of device
+func (l *domainLog) forget(device string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.devices, device)
+}
+
+// reset drops the lookups of every device
+func (l *domainLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.devices = make(map[string][]DomainLookup)
+}
+
+// list returns the lookups of a device, newest first
+func (l *domainLog) list(device string) ([]DomainLookup, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list, ok := l.devices[device]
+	if !ok {
+		return nil, false
+	}
+	result := make([]DomainLookup, len(list))
+	for i, lookup := range list {
+		result[len(list)-1-i] = lookup
+	}
+	return result, true
+}
+
+// ObserveDomains logs the DNS queries and TLS server names sent by a device,
+// as far as profile enables them
+func (bm *BandwidthMonitor) ObserveDomains(pi *packetInfo, profile *CaptureProfile) {
+	if len(pi.payload) == 0 {
+		return
+	}
+	var domains []string
+	var source string
+	switch {
+	case profile.DNSLog && pi.transport == "udp" && pi.dstPort == portDNS:
+		domains, source = dnsQueryNames(pi.payload), DomainSourceDNS
+	case profile.SNILog && pi.transport == "tcp":
+		if name := tlsServerName(pi.payload); name != "" {
+			domains, source = []string{name}, DomainSourceSNI
+		}
+	}
+	if len(domains) == 0 {
+		return
+	}
+	device := bm.deviceKey(pi.srcMAC, pi.srcIP)
+	if device == "" {
+		return
+	}
+	now := time.Now()
+	for _, domain := range domains {
+		bm.domains.add(device, DomainLookup{Domain: domain, Source: source, Time: now})
+	}
+}
+
+// dnsQueryNames returns the question names of a DNS query
+func dnsQueryNames(payload []byte) []string {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil || msg.QR {
+		return nil
+	}
+	var names []string
+	for _, q := range msg.Questions {
+		if name := strings.TrimSuffix(string(q.Name), "."); name != "" {
+			names = append(names, strings.ToLower(name))
+		}
+	}
+	return names
+}
+
+// tlsServerName returns the server_name extension of a TLS ClientHello at the
+// start of payload, or "" when there is none. Only a ClientHello that fits in
+// the segment is parsed.
+func tlsServerName(p []byte) string {
+	// Record header: handshake (22), version, length; then the handshake
+	// header: ClientHello (1) and a 3-byte length
+	if len(p) < 9 || p[0] != 22 || p[5] != 1 {
+		return ""
+	}
+	p = p[9:]
+	// Client version and random, then the session ID
+	if len(p) < 35 {
+		return ""
+	}
+	p = p[34:]
+	n := int(p[0])
+	if len(p) < 1+n+2 {
+		return ""
+	}
+	p = p[1+n:]
+	// Cipher suites
+	n = int(binary.BigEndian.Uint16(p))
+	if len(p) < 2+n+1 {
+		return ""
+	}
+	p = p[2+n:]
+	// Compression methods
+	n = int(p[0])
+	if len(p) < 1+n+2 {
+		return ""
+	}
+	p = p[1+n:]
+	// Extensions
+	n = int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) > n {
+		p = p[:n]
+	}
+	for len(p) >= 4 {
+		typ, size := binary.BigEndian.Uint16(p), int(binary.BigEndian.Uint16(p[2:]))
+		p = p[4:]
+		if len(p) < size {
+			return ""
+		}
+		if typ == 0 {
+			return sniHostName(p[:size])
+		}
+		p = p[size:]
+	}
+	return ""
+}
+
+// sniHostName returns the host name entry of a server_name extension body
+func sniHostName(p []byte) string {
+	if len(p) < 2 {
+		return ""
+	}
+	p = p[2:] // list length
+	for len(p) >= 3 {
+		typ, size := p[0], int(binary.BigEndian.Uint16(p[1:]))
+		p = p[3:]
+		if len(p) < size {
+			return ""
+		}
+		if typ == 0 {
+			return strings.ToLower(string(p[:size]))
+		}
+		p = p[size:]
+	}
+	return ""
+}
+
+// REST API: Recent DNS queries and TLS server names of a device
+func (bm *BandwidthMonitor) handleGetDeviceDomains(w http.ResponseWriter, r *http.Request) {
+	list, ok := bm.domains.list(mux.Vars(r)["mac"])
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, list)
+}
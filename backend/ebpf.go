@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+// eBPF fast path modes (-ebpf)
+const (
+	EBPFModeXDP = "xdp" // count at the driver hook; sees what the interface receives
+	EBPFModeTC  = "tc"  // count at the traffic-control hook, in both directions
+)
+
+// Address families of the kernel counter keys
+const (
+	ebpfFamilyMAC  = 0
+	ebpfFamilyIPv4 = 4
+	ebpfFamilyIPv6 = 6
+)
+
+// ebpfProtocols names the protocol buckets of the kernel counters, indexed
+// by the number the eBPF program stores in the key
+var ebpfProtocols = [...]string{"other", "tcp", "udp", "icmp", "arp"}
+
+// ebpfKey is the key of the kernel counters: the MAC address of a device,
+// or its IP address in IP accounting mode, and a protocol bucket
+type ebpfKey struct {
+	Addr     [16]byte
+	Protocol uint8
+	Family   uint8 // ebpfFamilyMAC, ebpfFamilyIPv4 or ebpfFamilyIPv6
+	_        [6]byte
+}
+
+// ebpfCounts are the counters of one key; the kernel keeps a copy per CPU
+type ebpfCounts struct {
+	TxBytes, TxPackets uint64
+	RxBytes, RxPackets uint64
+}
+
+// address returns the MAC or IP address of the key as UpdateStats takes it
+func (k ebpfKey) address() string {
+	switch k.Family {
+	case ebpfFamilyIPv4:
+		return netip.AddrFrom4([4]byte(k.Addr[:4])).String()
+	case ebpfFamilyIPv6:
+		return netip.AddrFrom16(k.Addr).String()
+	}
+	return net.HardwareAddr(k.Addr[:6]).String()
+}
+
+// protocol returns the breakdown bucket of the key
+func (k ebpfKey) protocol() string {
+	if int(k.Protocol) < len(ebpfProtocols) {
+		return ebpfProtocols[k.Protocol]
+	}
+	return "other"
+}
+
+// ebpfSampled accounts the packets the eBPF program passes up. The kernel
+// already counted their bytes, so only the addresses are taken from them;
+// for the detectors each sample stands in for rate packets.
+type ebpfSampled struct {
+	acct statsAccounter
+	rate uint64
+}
+
+// UpdateStatsWeighted learns the addresses of a sampled packet
+func (s ebpfSampled) UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, protocol string, packetSize, packets uint64) {
+	s.acct.UpdateStatsWeighted(iface, srcMAC, dstMAC, srcIP, dstIP, protocol, 0, 0)
+}
+
+// accountKernelCounts adds the traffic the kernel counted for key on iface
+// since the previous poll
+func (bm *BandwidthMonitor) accountKernelCounts(iface string, key ebpfKey, delta ebpfCounts) {
+	var mac, ip string
+	if key.Family == ebpfFamilyMAC {
+		mac = key.address()
+	} else {
+		ip = key.address()
+	}
+	if delta.TxPackets > 0 {
+		bm.UpdateStatsWeighted(iface, mac, "", ip, "", key.protocol(), delta.TxBytes, delta.TxPackets)
+	}
+	if delta.RxPackets > 0 {
+		bm.UpdateStatsWeighted(iface, "", mac, "", ip, key.protocol(), delta.RxBytes, delta.RxPackets)
+	}
+}
@@ -0,0 +1,545 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/perf"
+	"github.com/cilium/ebpf/rlimit"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
+)
+
+// eBPF fast path tuning
+const (
+	// ebpfPollInterval is how often the kernel counters are read into the
+	// device table
+	ebpfPollInterval = time.Second
+	// ebpfMaxEntries bounds the counter map; there is one entry per device
+	// and protocol bucket
+	ebpfMaxEntries = 1 << 16
+	// ebpfIdleExpiry is how long a counter may stay unchanged before it is
+	// deleted from the kernel map to make room
+	ebpfIdleExpiry = 10 * time.Minute
+	// ebpfPerfBuffer is the per-CPU size of the sample ring in bytes
+	ebpfPerfBuffer = 256 << 10
+)
+
+// ebpfSupported reports whether this platform has the eBPF fast path
+const ebpfSupported = true
+
+// ebpfFastPath is the eBPF program counting one interface, its maps and
+// the reader of the packets it samples
+type ebpfFastPath struct {
+	counts  *ebpf.Map // per-CPU hash of ebpfKey to ebpfCounts
+	samples *ebpf.Map // perf event array of sampled packets
+	prog    *ebpf.Program
+	links   []link.Link
+	reader  *perf.Reader
+	// last is what each key had counted at the previous poll
+	last map[ebpfKey]ebpfSeen
+}
+
+// ebpfSeen is a key's counters at the last poll and when they last changed
+type ebpfSeen struct {
+	counts  ebpfCounts
+	changed time.Time
+}
+
+// openEBPF loads the counting program for src, keyed by IP address when
+// byIP is set, and attaches it to the interface
+func openEBPF(src captureSource, byIP bool) (fp *ebpfFastPath, err error) {
+	iface, err := net.InterfaceByName(src.device)
+	if err != nil {
+		return nil, err
+	}
+	// Kernels before 5.11 charge BPF memory to RLIMIT_MEMLOCK
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, err
+	}
+	fp = &ebpfFastPath{last: make(map[ebpfKey]ebpfSeen)}
+	defer func() {
+		if err != nil {
+			fp.Close()
+		}
+	}()
+	if fp.counts, err = ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.PerCPUHash,
+		KeySize:    uint32(binary.Size(ebpfKey{})),
+		ValueSize:  uint32(binary.Size(ebpfCounts{})),
+		MaxEntries: ebpfMaxEntries,
+		Flags:      unix.BPF_F_NO_PREALLOC,
+	}); err != nil {
+		return nil, fmt.Errorf("creating counter map: %w", err)
+	}
+	if fp.samples, err = ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.PerfEventArray}); err != nil {
+		return nil, fmt.Errorf("creating sample map: %w", err)
+	}
+
+	spec := &ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		Instructions: ebpfProgram(src.ebpf, fp.counts, fp.samples, byIP, uint32(src.ebpfSample), uint32(src.snaplen)),
+		// bpf_perf_event_output is only available to GPL-compatible programs
+		License: "GPL",
+	}
+	if src.ebpf == EBPFModeTC {
+		spec.Type = ebpf.SchedCLS
+	}
+	if fp.prog, err = ebpf.NewProgram(spec); err != nil {
+		return nil, fmt.Errorf("loading program: %w", err)
+	}
+
+	if src.ebpf == EBPFModeTC {
+		for _, attach := range []ebpf.AttachType{ebpf.AttachTCXIngress, ebpf.AttachTCXEgress} {
+			l, err := link.AttachTCX(link.TCXOptions{Interface: iface.Index, Program: fp.prog, Attach: attach})
+			if err != nil {
+				return nil, fmt.Errorf("attaching to tc (needs Linux 6.6 or later): %w", err)
+			}
+			fp.links = append(fp.links, l)
+		}
+	} else {
+		// Without flags the kernel uses native XDP where the driver has it
+		// and generic XDP otherwise
+		l, err := link.AttachXDP(link.XDPOptions{Interface: iface.Index, Program: fp.prog})
+		if err != nil {
+			return nil, fmt.Errorf("attaching to XDP: %w", err)
+		}
+		fp.links = append(fp.links, l)
+	}
+
+	if fp.reader, err = perf.NewReader(fp.samples, ebpfPerfBuffer); err != nil {
+		return nil, fmt.Errorf("opening sample reader: %w", err)
+	}
+	return fp, nil
+}
+
+// Close detaches the program and releases its maps
+func (fp *ebpfFastPath) Close() {
+	if fp.reader != nil {
+		fp.reader.Close()
+	}
+	for _, l := range fp.links {
+		l.Close()
+	}
+	if fp.prog != nil {
+		fp.prog.Close()
+	}
+	if fp.counts != nil {
+		fp.counts.Close()
+	}
+	if fp.samples != nil {
+		fp.samples.Close()
+	}
+}
+
+// be16 returns a 16-bit network-order value as a load from the packet sees it
+func be16(v uint16) int32 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return int32(binary.NativeEndian.Uint16(b[:]))
+}
+
+// ebpfProgram assembles the counting program. For every Ethernet frame it
+// adds the length to the transmit counters of the source and the receive
+// counters of the destination, keyed by MAC address (or IP address when
+// byIP is set) and protocol bucket, then passes the frame on unchanged. One
+// frame in rate, cut to snaplen bytes, also goes to the samples perf array
+// behind an 8-byte header: the frame length and the bytes that follow.
+func ebpfProgram(mode string, counts, samples *ebpf.Map, byIP bool, rate, snaplen uint32) asm.Instructions {
+	// Context fields and the verdict letting the frame through
+	ctxData, ctxDataEnd, pass := int16(0), int16(4), int32(2) // xdp_md, XDP_PASS
+	if mode == EBPFModeTC {
+		ctxData, ctxDataEnd, pass = 76, 80, -1 // __sk_buff, TCX_NEXT
+	}
+	// Stack layout below the frame pointer
+	const (
+		keyOff   = -24 // ebpfKey
+		dstOff   = -40 // destination address, copied into the key after the source is counted
+		valueOff = -72 // ebpfCounts of a new entry
+		metaOff  = -80 // sample header
+	)
+
+	// R6 context, R7 packet start, R8 packet end, R9 frame length
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.LoadMem(asm.R7, asm.R6, ctxData, asm.Word),
+		asm.LoadMem(asm.R8, asm.R6, ctxDataEnd, asm.Word),
+	}
+	if mode == EBPFModeTC {
+		insns = append(insns, asm.LoadMem(asm.R9, asm.R6, 0, asm.Word)) // skb->len
+	} else {
+		insns = append(insns, asm.Mov.Reg(asm.R9, asm.R8), asm.Sub.Reg(asm.R9, asm.R7))
+	}
+	insns = append(insns,
+		// Ethernet header, with one optional VLAN tag: R2 EtherType, R3
+		// offset of the network header
+		asm.Mov.Reg(asm.R1, asm.R7),
+		asm.Add.Imm(asm.R1, 14),
+		asm.JGT.Reg(asm.R1, asm.R8, "out"),
+		asm.LoadMem(asm.R2, asm.R7, 12, asm.Half),
+		asm.Mov.Imm(asm.R3, 14),
+		asm.JEq.Imm(asm.R2, be16(0x8100), "vlan"),
+		asm.JEq.Imm(asm.R2, be16(0x88a8), "vlan"),
+		asm.Ja.Label("key"),
+		asm.Mov.Reg(asm.R1, asm.R7).WithSymbol("vlan"),
+		asm.Add.Imm(asm.R1, 18),
+		asm.JGT.Reg(asm.R1, asm.R8, "out"),
+		asm.LoadMem(asm.R2, asm.R7, 16, asm.Half),
+		asm.Mov.Imm(asm.R3, 18),
+
+		asm.StoreImm(asm.RFP, keyOff, 0, asm.DWord).WithSymbol("key"),
+		asm.StoreImm(asm.RFP, keyOff+8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, keyOff+16, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, dstOff, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, dstOff+8, 0, asm.DWord),
+		asm.Mov.Reg(asm.R1, asm.R7),
+		asm.Add.Reg(asm.R1, asm.R3), // R1 network header
+		asm.JEq.Imm(asm.R2, be16(0x0800), "ipv4"),
+		asm.JEq.Imm(asm.R2, be16(0x86dd), "ipv6"),
+		asm.JEq.Imm(asm.R2, be16(0x0806), "arp"),
+		asm.Ja.Label("other"),
+	)
+
+	// Protocol bucket (R5) of an IP protocol number (R2), then on to label
+	bucket := func(prefix string, icmp int32, next string) asm.Instructions {
+		return asm.Instructions{
+			asm.Mov.Imm(asm.R5, 0),
+			asm.JNE.Imm(asm.R2, 6, prefix+"-udp"),
+			asm.Mov.Imm(asm.R5, 1),
+			asm.Ja.Label(next),
+			asm.JNE.Imm(asm.R2, 17, prefix+"-icmp").WithSymbol(prefix + "-udp"),
+			asm.Mov.Imm(asm.R5, 2),
+			asm.Ja.Label(next),
+			asm.JNE.Imm(asm.R2, icmp, next).WithSymbol(prefix + "-icmp"),
+			asm.Mov.Imm(asm.R5, 3),
+		}
+	}
+	// copyAddr copies n bytes at off in the network header (R1) to the
+	// stack at dst
+	copyAddr := func(off int16, dst int16, n int16) asm.Instructions {
+		var out asm.Instructions
+		for i := int16(0); i < n; i += 4 {
+			out = append(out,
+				asm.LoadMem(asm.R2, asm.R1, off+i, asm.Word),
+				asm.StoreMem(asm.RFP, dst+i, asm.R2, asm.Word),
+			)
+		}
+		return out
+	}
+
+	next := "mac"
+	if byIP {
+		next = "ip"
+	}
+	// IPv4: protocol at 9, addresses at 12 and 16
+	insns = append(insns,
+		asm.Mov.Reg(asm.R4, asm.R1).WithSymbol("ipv4"),
+		asm.Add.Imm(asm.R4, 20),
+		asm.JGT.Reg(asm.R4, asm.R8, "other"),
+		asm.LoadMem(asm.R2, asm.R1, 9, asm.Byte),
+	)
+	insns = append(insns, bucket("ipv4", 1, "ipv4-"+next)...)
+	if byIP {
+		insns = append(insns, asm.StoreImm(asm.RFP, keyOff+17, ebpfFamilyIPv4, asm.Byte).WithSymbol("ipv4-ip"))
+		insns = append(insns, copyAddr(12, keyOff, 4)...)
+		insns = append(insns, copyAddr(16, dstOff, 4)...)
+		insns = append(insns, asm.Ja.Label("count"))
+	} else {
+		insns = append(insns, asm.Ja.Label("mac").WithSymbol("ipv4-mac"))
+	}
+	// IPv6: next header at 6, addresses at 8 and 24; extension headers
+	// count as other
+	insns = append(insns,
+		asm.Mov.Reg(asm.R4, asm.R1).WithSymbol("ipv6"),
+		asm.Add.Imm(asm.R4, 40),
+		asm.JGT.Reg(asm.R4, asm.R8, "other"),
+		asm.LoadMem(asm.R2, asm.R1, 6, asm.Byte),
+	)
+	insns = append(insns, bucket("ipv6", 58, "ipv6-"+next)...)
+	if byIP {
+		insns = append(insns, asm.StoreImm(asm.RFP, keyOff+17, ebpfFamilyIPv6, asm.Byte).WithSymbol("ipv6-ip"))
+		insns = append(insns, copyAddr(8, keyOff, 16)...)
+		insns = append(insns, copyAddr(24, dstOff, 16)...)
+		insns = append(insns, asm.Ja.Label("count"))
+	} else {
+		insns = append(insns, asm.Ja.Label("mac").WithSymbol("ipv6-mac"))
+	}
+	// Without IP addresses there is nothing to key by in IP mode
+	if byIP {
+		insns = append(insns,
+			asm.Ja.Label("sample").WithSymbol("arp"),
+			asm.Ja.Label("sample").WithSymbol("other"),
+		)
+	} else {
+		insns = append(insns,
+			asm.Mov.Imm(asm.R5, 4).WithSymbol("arp"),
+			asm.Ja.Label("mac"),
+			asm.Mov.Imm(asm.R5, 0).WithSymbol("other"),
+			// Source MAC at 6, destination at 0
+			asm.LoadMem(asm.R2, asm.R7, 6, asm.Word).WithSymbol("mac"),
+			asm.StoreMem(asm.RFP, keyOff, asm.R2, asm.Word),
+			asm.LoadMem(asm.R2, asm.R7, 10, asm.Half),
+			asm.StoreMem(asm.RFP, keyOff+4, asm.R2, asm.Half),
+			asm.LoadMem(asm.R2, asm.R7, 0, asm.Word),
+			asm.StoreMem(asm.RFP, dstOff, asm.R2, asm.Word),
+			asm.LoadMem(asm.R2, asm.R7, 4, asm.Half),
+			asm.StoreMem(asm.RFP, dstOff+4, asm.R2, asm.Half),
+			asm.Ja.Label("count"),
+		)
+	}
+
+	// add adds the frame to the counters at bytesOff and packetsOff of the
+	// key's entry, creating it if needed
+	add := func(prefix string, bytesOff, packetsOff int16) asm.Instructions {
+		return asm.Instructions{
+			asm.LoadMapPtr(asm.R1, counts.FD()),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, keyOff),
+			asm.FnMapLookupElem.Call(),
+			asm.JEq.Imm(asm.R0, 0, prefix+"-new"),
+			asm.LoadMem(asm.R1, asm.R0, bytesOff, asm.DWord),
+			asm.Add.Reg(asm.R1, asm.R9),
+			asm.StoreMem(asm.R0, bytesOff, asm.R1, asm.DWord),
+			asm.LoadMem(asm.R1, asm.R0, packetsOff, asm.DWord),
+			asm.Add.Imm(asm.R1, 1),
+			asm.StoreMem(asm.R0, packetsOff, asm.R1, asm.DWord),
+			asm.Ja.Label(prefix + "-done"),
+			asm.StoreImm(asm.RFP, valueOff, 0, asm.DWord).WithSymbol(prefix + "-new"),
+			asm.StoreImm(asm.RFP, valueOff+8, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, valueOff+16, 0, asm.DWord),
+			asm.StoreImm(asm.RFP, valueOff+24, 0, asm.DWord),
+			asm.StoreMem(asm.RFP, valueOff+bytesOff, asm.R9, asm.DWord),
+			asm.StoreImm(asm.RFP, valueOff+packetsOff, 1, asm.DWord),
+			asm.LoadMapPtr(asm.R1, counts.FD()),
+			asm.Mov.Reg(asm.R2, asm.RFP),
+			asm.Add.Imm(asm.R2, keyOff),
+			asm.Mov.Reg(asm.R3, asm.RFP),
+			asm.Add.Imm(asm.R3, valueOff),
+			asm.Mov.Imm(asm.R4, 0), // BPF_ANY: only this CPU's copy is written
+			asm.FnMapUpdateElem.Call(),
+			asm.Mov.Imm(asm.R0, 0).WithSymbol(prefix + "-done"),
+		}
+	}
+	insns = append(insns, asm.StoreMem(asm.RFP, keyOff+16, asm.R5, asm.Byte).WithSymbol("count"))
+	insns = append(insns, add("tx", 0, 8)...)
+	insns = append(insns,
+		asm.LoadMem(asm.R2, asm.RFP, dstOff, asm.DWord),
+		asm.StoreMem(asm.RFP, keyOff, asm.R2, asm.DWord),
+		asm.LoadMem(asm.R2, asm.RFP, dstOff+8, asm.DWord),
+		asm.StoreMem(asm.RFP, keyOff+8, asm.R2, asm.DWord),
+	)
+	insns = append(insns, add("rx", 16, 24)...)
+
+	// Sampling: one frame in rate goes up for enrichment
+	insns = append(insns, asm.Mov.Imm(asm.R0, 0).WithSymbol("sample"))
+	if rate > 1 {
+		insns = append(insns,
+			asm.FnGetPrandomU32.Call(),
+			asm.Mod.Imm(asm.R0, int32(rate)),
+			asm.JNE.Imm(asm.R0, 0, "out"),
+		)
+	}
+	insns = append(insns,
+		asm.Mov.Reg(asm.R5, asm.R9),
+		asm.JLE.Imm(asm.R5, int32(snaplen), "emit"),
+		asm.Mov.Imm(asm.R5, int32(snaplen)),
+		asm.StoreMem(asm.RFP, metaOff, asm.R9, asm.Word).WithSymbol("emit"),
+		asm.StoreMem(asm.RFP, metaOff+4, asm.R5, asm.Word),
+		// Flags: BPF_F_CURRENT_CPU, and the bytes of the frame to append
+		// in the upper half
+		asm.Mov.Reg(asm.R3, asm.R5),
+		asm.LSh.Imm(asm.R3, 32),
+		asm.LoadImm(asm.R4, 0xffffffff, asm.DWord),
+		asm.Or.Reg(asm.R3, asm.R4),
+		asm.Mov.Reg(asm.R1, asm.R6),
+		asm.LoadMapPtr(asm.R2, samples.FD()),
+		asm.Mov.Reg(asm.R4, asm.RFP),
+		asm.Add.Imm(asm.R4, metaOff),
+		asm.Mov.Imm(asm.R5, 8),
+		asm.FnPerfEventOutput.Call(),
+
+		asm.Mov.Imm(asm.R0, pass).WithSymbol("out"),
+		asm.Return(),
+	)
+	return insns
+}
+
+// runEBPFCapture counts src in the kernel until stop is closed, accounting
+// the counters every ebpfPollInterval and the sampled packets as they come.
+// A released pause detaches the program until resume. It reports false,
+// leaving handle open, when the program cannot be loaded or attached, so
+// the caller captures with pcap instead.
+func (bm *BandwidthMonitor) runEBPFCapture(src captureSource, handle *pcap.Handle, stop <-chan struct{}) bool {
+	fp, err := openEBPF(src, bm.accounting == AccountingIP)
+	if err != nil {
+		log.Printf("eBPF fast path unavailable on %s: %v; capturing with pcap", src.device, err)
+		return false
+	}
+	// The pcap handle only served to validate the device
+	if handle != nil {
+		handle.Close()
+	}
+	if src.pcapOut != nil {
+		if err := src.pcapOut.start(layers.LinkTypeEthernet, uint32(src.snaplen)); err != nil {
+			log.Printf("Error starting pcap file: %v", err)
+		}
+	}
+	for {
+		if fp == nil {
+			if !bm.pause.wait(stop) {
+				return true
+			}
+			if fp, err = openEBPF(src, bm.accounting == AccountingIP); err != nil {
+				log.Printf("Error attaching eBPF program on %s: %v", src.device, err)
+				select {
+				case <-stop:
+					return true
+				case <-time.After(5 * time.Second):
+					continue
+				}
+			}
+		}
+		log.Printf("Counting %s in the kernel (%s), passing 1 in %d packets up", src.device, src.ebpf, src.ebpfSample)
+		stopped := bm.countEBPF(src, fp, stop)
+		fp.Close()
+		fp = nil
+		if stopped {
+			return true
+		}
+		log.Printf("Detached eBPF program from %s until resume", src.device)
+	}
+}
+
+// countEBPF runs one attachment of fp until stop is closed, which it
+// reports, or a released pause
+func (bm *BandwidthMonitor) countEBPF(src captureSource, fp *ebpfFastPath, stop <-chan struct{}) bool {
+	done := make(chan struct{})
+	defer close(done)
+	go bm.supervise("samples "+src.device, done, func() {
+		bm.readEBPFSamples(src, fp.reader, done)
+	})
+
+	ticker := time.NewTicker(ebpfPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			fp.poll(bm, src.device, time.Now())
+			return true
+		case <-src.restart:
+			// Filters do not apply to the kernel counters
+			if bm.pause.status().Released {
+				return false
+			}
+		case now := <-ticker.C:
+			fp.poll(bm, src.device, now)
+		}
+	}
+}
+
+// poll accounts what every key counted since the previous poll, and
+// deletes keys idle for ebpfIdleExpiry so the map does not fill up
+func (fp *ebpfFastPath) poll(bm *BandwidthMonitor, iface string, now time.Time) {
+	var key ebpfKey
+	var perCPU []ebpfCounts
+	seen := make(map[ebpfKey]bool, len(fp.last))
+	var idle []ebpfKey
+	iter := fp.counts.Iterate()
+	for iter.Next(&key, &perCPU) {
+		var total ebpfCounts
+		for _, c := range perCPU {
+			total.TxBytes += c.TxBytes
+			total.TxPackets += c.TxPackets
+			total.RxBytes += c.RxBytes
+			total.RxPackets += c.RxPackets
+		}
+		seen[key] = true
+		prev, ok := fp.last[key]
+		if ok && total == prev.counts {
+			if now.Sub(prev.changed) >= ebpfIdleExpiry {
+				idle = append(idle, key)
+			}
+			continue
+		}
+		// Traffic counted while paused is dropped, not accounted on resume
+		if !bm.pause.paused.Load() {
+			bm.accountKernelCounts(iface, key, ebpfCounts{
+				TxBytes:   total.TxBytes - prev.counts.TxBytes,
+				TxPackets: total.TxPackets - prev.counts.TxPackets,
+				RxBytes:   total.RxBytes - prev.counts.RxBytes,
+				RxPackets: total.RxPackets - prev.counts.RxPackets,
+			})
+		}
+		fp.last[key] = ebpfSeen{counts: total, changed: now}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf("Error reading eBPF counters: %v", err)
+	}
+	// A packet counted between the read above and the delete is lost;
+	// the key has been idle for minutes, so that is rare
+	for _, k := range idle {
+		if err := fp.counts.Delete(k); err == nil || errors.Is(err, ebpf.ErrKeyNotExist) {
+			delete(fp.last, k)
+		}
+	}
+	for k := range fp.last {
+		if !seen[k] {
+			delete(fp.last, k)
+		}
+	}
+}
+
+// readEBPFSamples decodes and accounts the packets the program samples
+// until done is closed
+func (bm *BandwidthMonitor) readEBPFSamples(src captureSource, reader *perf.Reader, done <-chan struct{}) {
+	acct := ebpfSampled{acct: bm, rate: src.ebpfSample}
+	dec := newPacketDecoder(layers.LinkTypeEthernet)
+	var rec perf.Record
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		reader.SetDeadline(time.Now().Add(src.timeout))
+		err := reader.ReadInto(&rec)
+		switch {
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			continue
+		case errors.Is(err, perf.ErrClosed):
+			return
+		case err != nil:
+			log.Printf("Error reading eBPF samples on %s: %v", src.device, err)
+			time.Sleep(src.timeout)
+			continue
+		}
+		if rec.LostSamples > 0 || len(rec.RawSample) < 8 || bm.pause.paused.Load() {
+			continue
+		}
+		// The header gives the frame and captured lengths; the sample may
+		// carry trailing padding
+		wireLen := binary.NativeEndian.Uint32(rec.RawSample[0:4])
+		capLen := binary.NativeEndian.Uint32(rec.RawSample[4:8])
+		data := rec.RawSample[8:]
+		if int(capLen) > len(data) {
+			continue
+		}
+		data = data[:capLen]
+		if src.pcapOut != nil {
+			src.pcapOut.write(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: int(capLen), Length: int(wireLen)}, data)
+		}
+		bm.processPacket(acct, dec, data, src.device)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"log"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// ebpfSupported reports whether this platform has the eBPF fast path
+const ebpfSupported = false
+
+// runEBPFCapture needs Linux; main rejects -ebpf elsewhere
+func (bm *BandwidthMonitor) runEBPFCapture(src captureSource, handle *pcap.Handle, stop <-chan struct{}) bool {
+	log.Printf("The eBPF fast path is only supported on Linux; capturing %s with pcap", src.device)
+	return false
+}
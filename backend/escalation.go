@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// escalationTick is how often pending escalations are checked
+const escalationTick = 10 * time.Second
+
+// severityRank orders severities for policy matching
+var severityRank = map[string]int{SeverityInfo: 0, SeverityWarning: 1, SeverityCritical: 2}
+
+// EscalationStep notifies a channel once the alert has been unacknowledged for After
+type EscalationStep struct {
+	After    string `json:"after"` // duration, e.g. "0s", "15m"
+	Notifier string `json:"notifier"`
+
+	after time.Duration
+}
+
+// EscalationPolicy applies to alerts matching Types (any when empty) with at
+// least MinSeverity, and walks Steps until the alert is acknowledged.
+type EscalationPolicy struct {
+	Name        string           `json:"name"`
+	Types       []string         `json:"types,omitempty"`
+	MinSeverity string           `json:"minSeverity,omitempty"`
+	Steps       []EscalationStep `json:"steps"`
+}
+
+// matches reports whether the policy applies to alert
+func (p *EscalationPolicy) matches(alert Alert) bool {
+	if p.MinSeverity != "" && severityRank[alert.Severity] < severityRank[p.MinSeverity] {
+		return false
+	}
+	if len(p.Types) == 0 {
+		return true
+	}
+	for _, t := range p.Types {
+		if t == alert.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// escalationConfig is the on-disk format of the -escalation-file
+type escalationConfig struct {
+	Notifiers map[string]NotifierConfig `json:"notifiers"`
+	Policies  []EscalationPolicy        `json:"policies"`
+}
+
+// escalation tracks one alert moving through a policy
+type escalation struct {
+	alert    Alert
+	policy   *EscalationPolicy
+	nextStep int
+}
+
+// escalator runs escalation policies for raised alerts
+type escalator struct {
+	mu        sync.Mutex
+	notifiers map[string]Notifier
+	policies  []*EscalationPolicy
+	active    map[uint64]*escalation // alert id -> escalation
+	wake      chan struct{}
+}
+
+// loadEscalator reads the escalation file at path
+func loadEscalator(path string) (*escalator, error) {
+	var cfg escalationConfig
+	if err := loadJSONFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	e := &escalator{
+		notifiers: make(map[string]Notifier),
+		active:    make(map[uint64]*escalation),
+		wake:      make(chan struct{}, 1),
+	}
+	for name, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %q: %v", name, err)
+		}
+		e.notifiers[name] = n
+	}
+	for i := range cfg.Policies {
+		p := &cfg.Policies[i]
+		for j := range p.Steps {
+			step := &p.Steps[j]
+			d, err := time.ParseDuration(step.After)
+			if err != nil {
+				return nil, fmt.Errorf("policy %q step %d: invalid after %q", p.Name, j, step.After)
+			}
+			if _, ok := e.notifiers[step.Notifier]; !ok {
+				return nil, fmt.Errorf("policy %q step %d: unknown notifier %q", p.Name, j, step.Notifier)
+			}
+			step.after = d
+		}
+		e.policies = append(e.policies, p)
+	}
+	return e, nil
+}
+
+// notifier returns the notifier configured under name
+func (e *escalator) notifier(name string) (Notifier, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	n, ok := e.notifiers[name]
+	return n, ok
+}
+
+// replace takes the notifiers and policies of o (a reloaded escalation
+// file); escalations under way finish with their old policy
+func (e *escalator) replace(o *escalator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, esc := range e.active {
+		for _, step := range esc.policy.Steps[esc.nextStep:] {
+			if n, ok := e.notifiers[step.Notifier]; ok {
+				if _, kept := o.notifiers[step.Notifier]; !kept {
+					o.notifiers[step.Notifier] = n
+				}
+			}
+		}
+	}
+	e.notifiers, e.policies = o.notifiers, o.policies
+}
+
+// start registers a new alert with the first matching policy
+func (e *escalator) start(alert Alert) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, p := range e.policies {
+		if p.matches(alert) && len(p.Steps) > 0 {
+			e.active[alert.ID] = &escalation{alert: alert, policy: p}
+			select {
+			case e.wake <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// due collects the notifications that are due now and drops finished or
+// acknowledged escalations.
+func (e *escalator) due(bm *BandwidthMonitor, now time.Time) []func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var sends []func()
+	for id, esc := range e.active {
+		if bm.alerts.isAcknowledged(id) {
+			delete(e.active, id)
+			continue
+		}
+		for esc.nextStep < len(esc.policy.Steps) {
+			step := esc.policy.Steps[esc.nextStep]
+			if now.Sub(esc.alert.Time) < step.after {
+				break
+			}
+			esc.nextStep++
+			alert, notifier, name := esc.alert, e.notifiers[step.Notifier], step.Notifier
+			sends = append(sends, func() {
+				text, err := bm.templates.RenderAlert(alert)
+				if err != nil {
+					text = alert.Message
+				}
+				if err := notifier.Notify(alert, text); err != nil {
+					log.Printf("Error notifying %s about alert %d: %v", name, alert.ID, err)
+				}
+			})
+		}
+		if esc.nextStep >= len(esc.policy.Steps) {
+			delete(e.active, id)
+		}
+	}
+	return sends
+}
+
+// runEscalations delivers escalation steps as they fall due until stop is closed
+func (bm *BandwidthMonitor) runEscalations(stop <-chan struct{}) {
+	ticker := time.NewTicker(escalationTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-bm.escalations.wake:
+		}
+		// Notifications go out without holding the escalator lock
+		for _, send := range bm.escalations.due(bm, time.Now()) {
+			send()
+		}
+	}
+}
+
+// REST API: Acknowledge an alert, stopping its escalation
+func (bm *BandwidthMonitor) handleAckAlert(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseAlertID(w, r)
+	if !ok {
+		return
+	}
+	alert, found := bm.alerts.acknowledge(id)
+	if !found {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, alert)
+}
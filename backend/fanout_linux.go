@@ -0,0 +1,208 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// fanoutNumBlocks sizes each worker's ring without -pcap-buffer: 32 blocks
+// of 512 KiB. Workers wait for packets up to the source's timeout, so they
+// notice stop and restart requests and flush their batch when idle.
+const fanoutNumBlocks = 32
+
+// fanoutSupported reports whether this platform can capture with AF_PACKET
+// (-fanout, -capture-engine afpacket)
+const fanoutSupported = true
+
+// runFanoutCapture captures src with AF_PACKET TPACKETv3 rings, which the
+// kernel fills without libpcap's per-packet copy. With src.fanout > 1 the
+// sockets join one PACKET_FANOUT_HASH group: the kernel hashes each flow to
+// one socket, so every worker sees whole conversations and accounts them
+// into its own batch, merged into the monitor periodically. It runs until
+// stop is closed; a signal on src.restart reopens the sockets with the
+// current filter.
+func (bm *BandwidthMonitor) runFanoutCapture(src captureSource, stop <-chan struct{}) {
+	if src.pcapOut != nil {
+		if err := src.pcapOut.start(layers.LinkTypeEthernet, uint32(src.snaplen)); err != nil {
+			log.Printf("Error starting pcap file: %v", err)
+		}
+	}
+	for {
+		if !bm.pause.wait(stop) {
+			return
+		}
+		sockets, promisc, err := bm.openFanout(src)
+		if err != nil {
+			log.Printf("Error opening fanout capture on %s: %v", src.device, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Second):
+				continue
+			}
+		}
+		log.Printf("Capturing on %s with AF_PACKET (%d workers)", src.device, len(sockets))
+
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for i, tp := range sockets {
+			wg.Add(1)
+			go func(name string, tp *afpacket.TPacket) {
+				defer wg.Done()
+				bm.supervise(name, done, func() {
+					bm.runFanoutWorker(src, tp, done)
+				})
+			}(fmt.Sprintf("capture %s#%d", src.device, i), tp)
+		}
+
+		restart := false
+		select {
+		case <-stop:
+		case <-src.restart:
+			restart = true
+		}
+		close(done)
+		wg.Wait()
+		for _, tp := range sockets {
+			tp.Close()
+		}
+		if promisc >= 0 {
+			unix.Close(promisc)
+		}
+		if !restart {
+			return
+		}
+		log.Printf("Restarting capture on %s", src.device)
+	}
+}
+
+// runFanoutWorker reads one fanout socket until done is closed
+func (bm *BandwidthMonitor) runFanoutWorker(src captureSource, tp *afpacket.TPacket, done <-chan struct{}) {
+	batch := newStatsBatch(bm)
+	defer func() { batch.flush(time.Now()) }()
+	dec := newPacketDecoder(layers.LinkTypeEthernet)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		data, ci, err := tp.ZeroCopyReadPacketData()
+		now := time.Now()
+		if err == afpacket.ErrTimeout {
+			batch.flushIfDue(now)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error reading fanout socket on %s: %v", src.device, err)
+			time.Sleep(src.timeout)
+			continue
+		}
+		if bm.pause.paused.Load() {
+			continue
+		}
+		if src.pcapOut != nil {
+			src.pcapOut.write(ci, data)
+		}
+		bm.processPacket(batch, dec, data, src.device)
+		batch.flushIfDue(now)
+	}
+}
+
+// openFanout opens the AF_PACKET sockets of src with the current capture
+// filter, plus a packet-less socket holding the interface in promiscuous
+// mode for as long as it stays open (-1 if promisc is off).
+func (bm *BandwidthMonitor) openFanout(src captureSource) (sockets []*afpacket.TPacket, promisc int, err error) {
+	iface, err := net.InterfaceByName(src.device)
+	if err != nil {
+		return nil, -1, err
+	}
+	prog, err := compileFanoutFilter(bm.currentCaptureFilter(), int(src.snaplen))
+	if err != nil {
+		return nil, -1, err
+	}
+
+	promisc = -1
+	if src.promisc {
+		// Protocol 0: the socket receives nothing, it only holds the membership
+		if promisc, err = unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0); err != nil {
+			return nil, -1, err
+		}
+		mreq := unix.PacketMreq{Ifindex: int32(iface.Index), Type: unix.PACKET_MR_PROMISC}
+		if err = unix.SetsockoptPacketMreq(promisc, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+			unix.Close(promisc)
+			return nil, -1, err
+		}
+	}
+
+	// Fanout groups are global; derive an ID unique to this process and interface
+	groupID := uint16(os.Getpid()<<4 + iface.Index)
+	workers := max(src.fanout, 1)
+	// -pcap-buffer is shared by the workers of an interface
+	blocks := fanoutNumBlocks
+	if src.bufferSize > 0 {
+		blocks = max(src.bufferSize/workers/afpacket.DefaultBlockSize, 1)
+	}
+	for i := 0; i < workers; i++ {
+		tp, err := afpacket.NewTPacket(
+			afpacket.OptInterface(src.device),
+			afpacket.OptNumBlocks(blocks),
+			afpacket.OptPollTimeout(src.timeout),
+		)
+		if err == nil && prog != nil {
+			err = tp.SetBPF(prog)
+		}
+		if err == nil && workers > 1 {
+			err = tp.SetFanout(afpacket.FanoutHash, groupID)
+		}
+		if err != nil {
+			if tp != nil {
+				tp.Close()
+			}
+			for _, s := range sockets {
+				s.Close()
+			}
+			if promisc >= 0 {
+				unix.Close(promisc)
+			}
+			return nil, -1, err
+		}
+		sockets = append(sockets, tp)
+	}
+	return sockets, promisc, nil
+}
+
+// validateFanoutFilter checks that filter compiles for fanout sockets
+func validateFanoutFilter(filter string, snaplen int) error {
+	_, err := compileFanoutFilter(filter, snaplen)
+	return err
+}
+
+// compileFanoutFilter compiles a BPF expression for Ethernet fanout
+// sockets; an empty expression needs no program
+func compileFanoutFilter(filter string, snaplen int) ([]bpf.RawInstruction, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	insns, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, filter)
+	if err != nil {
+		return nil, err
+	}
+	prog := make([]bpf.RawInstruction, len(insns))
+	for i, ins := range insns {
+		prog[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return prog, nil
+}
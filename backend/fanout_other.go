@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "log"
+
+// fanoutSupported reports whether this platform can capture with AF_PACKET
+// (-fanout, -capture-engine afpacket)
+const fanoutSupported = false
+
+// runFanoutCapture needs AF_PACKET; main rejects -fanout and
+// -capture-engine afpacket elsewhere
+func (bm *BandwidthMonitor) runFanoutCapture(src captureSource, stop <-chan struct{}) {
+	log.Printf("Fanout capture is only supported on Linux; not capturing on %s", src.device)
+}
+
+// validateFanoutFilter has nothing to check without fanout support
+func validateFanoutFilter(filter string, snaplen int) error {
+	return nil
+}
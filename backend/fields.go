@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// fieldTree is a parsed ?fields= projection: each key maps to the fields
+// kept below it, an empty tree meaning the whole value.
+type fieldTree map[string]fieldTree
+
+// parseFields parses a comma-separated list of dotted paths such as
+// "totalSent,devices.mac,devices.bytesRecv"
+func parseFields(s string) fieldTree {
+	tree := fieldTree{}
+	for _, path := range strings.Split(s, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		node := tree
+		for _, name := range strings.Split(path, ".") {
+			child, ok := node[name]
+			if !ok {
+				child = fieldTree{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+// project keeps only the fields in tree. Arrays are transparent: the
+// projection applies to each element, so "mac,ip" works on a device list
+// just as on a single device.
+func (tree fieldTree) project(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(tree))
+		for name, sub := range tree {
+			if field, ok := val[name]; ok {
+				if len(sub) > 0 {
+					field = sub.project(field)
+				}
+				out[name] = field
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, elem := range val {
+			out[i] = tree.project(elem)
+		}
+		return out
+	}
+	return v
+}
+
+// projectFields applies a ?fields= projection to v through its JSON form, so
+// field names are those clients already see.
+func projectFields(v interface{}, fields string) (interface{}, error) {
+	tree := parseFields(fields)
+	if len(tree) == 0 {
+		return v, nil
+	}
+	generic, err := toGeneric(v)
+	if err != nil {
+		return nil, err
+	}
+	return tree.project(generic), nil
+}
+
+// toGeneric converts v to its JSON form as maps, slices and json.Numbers
+func toGeneric(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
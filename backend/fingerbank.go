@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DHCP ports
+const (
+	portDHCPServer = 67
+	portDHCPClient = 68
+)
+
+// Fingerbank lookup tuning
+const (
+	// defaultFingerbankURL is the interrogate endpoint of the public API
+	defaultFingerbankURL = "https://api.fingerbank.org/api/v2/combinations/interrogate"
+	// fingerbankScanInterval is how often fingerprinted devices are checked
+	fingerbankScanInterval = 10 * time.Second
+	// fingerbankSpacing keeps lookups within the free tier (300 per hour)
+	fingerbankSpacing = 12 * time.Second
+	// fingerbankTTL is how long a classification is cached; a fingerprint
+	// that could not be classified is retried after fingerbankNegativeTTL
+	fingerbankTTL         = 30 * 24 * time.Hour
+	fingerbankNegativeTTL = time.Hour
+	// maxFingerprints caps the devices fingerprints are remembered for, and
+	// the cached fingerprint combinations
+	maxFingerprints = 4096
+)
+
+// DeviceClass is what Fingerbank made of a device's DHCP fingerprint
+type DeviceClass struct {
+	Make    string `json:"make,omitempty"`    // manufacturer
+	Model   string `json:"model"`             // device name, e.g. "Apple iPhone"
+	Type    string `json:"type,omitempty"`    // category path, e.g. "Smartphones/Tablets/Wearables/Apple iOS"
+	Version string `json:"version,omitempty"` // OS version when known
+	Score   int    `json:"score"`             // Fingerbank confidence, 0-100
+}
+
+// dhcpFingerprint is the identifying part of a device's DHCP requests: the
+// parameter request list (option 55) and vendor class (option 60)
+type dhcpFingerprint struct {
+	Options string `json:"options"` // e.g. "1,3,6,15,119,252"
+	Vendor  string `json:"vendor,omitempty"`
+}
+
+// fingerbankCacheEntry is a cached lookup; Class is nil for a failed one
+type fingerbankCacheEntry struct {
+	Fingerprint dhcpFingerprint `json:"fingerprint"`
+	Class       *DeviceClass    `json:"class,omitempty"`
+	Expires     time.Time       `json:"expires"`
+}
+
+// fingerbankClassifier classifies devices by their DHCP fingerprint with a
+// Fingerbank-compatible API, caching results by fingerprint
+type fingerbankClassifier struct {
+	url    string
+	key    string
+	client *http.Client
+
+	mu      sync.Mutex
+	devices map[string]dhcpFingerprint // by MAC
+	cache   map[dhcpFingerprint]fingerbankCacheEntry
+	doc     document // optional place the cache is persisted to
+}
+
+// newFingerbankClassifier creates a classifier using the API at apiURL with
+// key, loading cached results from doc when set
+func newFingerbankClassifier(apiURL, key string, doc document) (*fingerbankClassifier, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Fingerbank URL %q", apiURL)
+	}
+	if key == "" {
+		return nil, fmt.Errorf("no Fingerbank API key")
+	}
+	fc := &fingerbankClassifier{
+		url:     apiURL,
+		key:     key,
+		client:  &http.Client{Timeout: notifyTimeout},
+		devices: make(map[string]dhcpFingerprint),
+		cache:   make(map[dhcpFingerprint]fingerbankCacheEntry),
+		doc:     doc,
+	}
+	if doc == nil {
+		return fc, nil
+	}
+	var entries []fingerbankCacheEntry
+	if err := doc.load(&entries); err != nil {
+		log.Printf("Error reading Fingerbank cache from %s: %v", doc, err)
+		return fc, nil
+	}
+	for _, e := range entries {
+		fc.cache[e.Fingerprint] = e
+	}
+	return fc, nil
+}
+
+// save writes the cache back to its document; caller holds fc.mu
+func (fc *fingerbankClassifier) save() {
+	if fc.doc == nil {
+		return
+	}
+	list := make([]fingerbankCacheEntry, 0, len(fc.cache))
+	for _, e := range fc.cache {
+		list = append(list, e)
+	}
+	if err := fc.doc.save(list); err != nil {
+		log.Printf("Error writing Fingerbank cache to %s: %v", fc.doc, err)
+	}
+}
+
+// observe records the fingerprint a device sent
+func (fc *fingerbankClassifier) observe(mac string, fp dhcpFingerprint) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if _, ok := fc.devices[mac]; !ok && len(fc.devices) >= maxFingerprints {
+		return
+	}
+	fc.devices[mac] = fp
+}
+
+// pending splits the fingerprinted devices into those with a fresh cached
+// class and the fingerprints needing a lookup
+func (fc *fingerbankClassifier) pending(now time.Time) (map[string]*DeviceClass, []dhcpFingerprint) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	classes := make(map[string]*DeviceClass)
+	var stale []dhcpFingerprint
+	seen := make(map[dhcpFingerprint]bool)
+	for mac, fp := range fc.devices {
+		e, ok := fc.cache[fp]
+		if ok && e.Class != nil {
+			classes[mac] = e.Class // a stale class is kept until replaced
+		}
+		if (!ok || now.After(e.Expires)) && !seen[fp] {
+			seen[fp] = true
+			stale = append(stale, fp)
+		}
+	}
+	return classes, stale
+}
+
+// store caches the result of a lookup, pruning expired entries when full
+func (fc *fingerbankClassifier) store(fp dhcpFingerprint, class *DeviceClass, now time.Time) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if _, ok := fc.cache[fp]; !ok && len(fc.cache) >= maxFingerprints {
+		for k, e := range fc.cache {
+			if now.After(e.Expires) {
+				delete(fc.cache, k)
+			}
+		}
+		if len(fc.cache) >= maxFingerprints {
+			return
+		}
+	}
+	ttl := fingerbankTTL
+	if class == nil {
+		ttl = fingerbankNegativeTTL
+	}
+	fc.cache[fp] = fingerbankCacheEntry{Fingerprint: fp, Class: class, Expires: now.Add(ttl)}
+	fc.save()
+}
+
+// fingerbankResponse is the part of an interrogate response used here
+type fingerbankResponse struct {
+	Device struct {
+		Name string `json:"name"`
+	} `json:"device"`
+	DeviceName   string `json:"device_name"`
+	Manufacturer struct {
+		Name string `json:"name"`
+	} `json:"manufacturer"`
+	Version string `json:"version"`
+	Score   int    `json:"score"`
+}
+
+// lookup asks the API to classify fp
+func (fc *fingerbankClassifier) lookup(fp dhcpFingerprint) (*DeviceClass, error) {
+	q := url.Values{"key": {fc.key}, "dhcp_fingerprint": {fp.Options}}
+	if fp.Vendor != "" {
+		q.Set("dhcp_vendor", fp.Vendor)
+	}
+	resp, err := fc.client.Get(fc.url + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil // unknown fingerprint
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("Fingerbank returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var r fingerbankResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&r); err != nil {
+		return nil, err
+	}
+	if r.Device.Name == "" {
+		return nil, nil
+	}
+	class := &DeviceClass{Make: r.Manufacturer.Name, Model: r.Device.Name, Version: r.Version, Score: r.Score}
+	// device_name is the category path ending in the device itself
+	if i := strings.LastIndexByte(r.DeviceName, '/'); i > 0 {
+		class.Type = r.DeviceName[:i]
+	}
+	return class, nil
+}
+
+// parseDHCPFingerprint returns the client MAC and fingerprint of a DHCP
+// request (DISCOVER, REQUEST or INFORM) in a UDP payload
+func parseDHCPFingerprint(payload []byte) (string, dhcpFingerprint, bool) {
+	var msg layers.DHCPv4
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil || msg.Operation != layers.DHCPOpRequest {
+		return "", dhcpFingerprint{}, false
+	}
+	var fp dhcpFingerprint
+	request := false
+	for _, opt := range msg.Options {
+		switch opt.Type {
+		case layers.DHCPOptMessageType:
+			if len(opt.Data) == 1 {
+				switch layers.DHCPMsgType(opt.Data[0]) {
+				case layers.DHCPMsgTypeDiscover, layers.DHCPMsgTypeRequest, layers.DHCPMsgTypeInform:
+					request = true
+				}
+			}
+		case layers.DHCPOptParamsRequest:
+			codes := make([]string, len(opt.Data))
+			for i, c := range opt.Data {
+				codes[i] = strconv.Itoa(int(c))
+			}
+			fp.Options = strings.Join(codes, ",")
+		case layers.DHCPOptClassID:
+			fp.Vendor = string(opt.Data)
+		}
+	}
+	if !request || fp.Options == "" || len(msg.ClientHWAddr) != 6 {
+		return "", dhcpFingerprint{}, false
+	}
+	return msg.ClientHWAddr.String(), fp, true
+}
+
+// ObserveDHCP records the fingerprint of DHCP requests for classification,
+// and the identity they carry for logical device suggestions
+func (bm *BandwidthMonitor) ObserveDHCP(pi *packetInfo) {
+	if pi.transport != "udp" || pi.srcPort != portDHCPClient || pi.dstPort != portDHCPServer {
+		return
+	}
+	if mac, id, ok := parseDHCPIdentity(pi.payload); ok {
+		bm.logical.observe(mac, id)
+	}
+	if bm.fingerbank == nil {
+		return
+	}
+	if mac, fp, ok := parseDHCPFingerprint(pi.payload); ok {
+		bm.fingerbank.observe(mac, fp)
+	}
+}
+
+// applyDeviceClasses sets the Classification of the devices with these MACs
+func (bm *BandwidthMonitor) applyDeviceClasses(classes map[string]*DeviceClass) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	bm.devices.all(func(_ string, dev *DeviceStats) {
+		if class, ok := classes[dev.MAC]; ok {
+			dev.Classification = class
+		}
+	})
+}
+
+// classifyDevicesPeriodically fills DeviceStats.Classification from
+// Fingerbank. Cached classes are applied directly; other fingerprints are
+// looked up one at a time, fingerbankSpacing apart, until stop is closed.
+func (bm *BandwidthMonitor) classifyDevicesPeriodically(fc *fingerbankClassifier, stop <-chan struct{}) {
+	ticker := time.NewTicker(fingerbankScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		classes, stale := fc.pending(time.Now())
+		bm.applyDeviceClasses(classes)
+		for _, fp := range stale {
+			class, err := fc.lookup(fp)
+			if err != nil {
+				log.Printf("Error classifying DHCP fingerprint %s: %v", fp.Options, err)
+			}
+			fc.store(fp, class, time.Now())
+			select {
+			case <-stop:
+				return
+			case <-time.After(fingerbankSpacing):
+			}
+		}
+	}
+}
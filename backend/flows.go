@@ -0,0 +1,409 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Flow table limits
+const (
+	// flowSweepInterval is how often the flow table is checked for expired flows
+	flowSweepInterval = 5 * time.Second
+	// maxClosedFlows is how many closed-flow records are kept in memory
+	maxClosedFlows = 1000
+	// flowStoreRetention is how long closed flows are kept in the -store
+	flowStoreRetention = 24 * time.Hour
+	// Flows keep per-slot byte counts for rates over the last
+	// flowRateSlots*flowSlotSeconds seconds (see /api/flows/top)
+	flowRateSlots   = 30
+	flowSlotSeconds = 2
+)
+
+// maxFlows caps concurrently tracked flows (see resourceProfile); a new flow
+// beyond it evicts the least recently active one
+var maxFlows = 65536
+
+// Reasons a flow was closed
+const (
+	FlowClosedIdle     = "idle"     // no packet within the idle timeout
+	FlowClosedActive   = "active"   // open longer than the active timeout
+	FlowClosedEnd      = "end"      // TCP FIN or RST seen
+	FlowClosedShutdown = "shutdown" // monitor stopped
+	FlowClosedEvicted  = "evicted"  // least recently active when the table was full
+)
+
+// FlowRecord describes one unidirectional flow; Reason is set once it closes
+type FlowRecord struct {
+	SrcMAC    string    `json:"srcMac,omitempty"`
+	DstMAC    string    `json:"dstMac,omitempty"`
+	SrcIP     string    `json:"srcIp"`
+	DstIP     string    `json:"dstIp"`
+	SrcPort   uint16    `json:"srcPort,omitempty"`
+	DstPort   uint16    `json:"dstPort,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Bytes     uint64    `json:"bytes"`
+	Packets   uint64    `json:"packets"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Duration  float64   `json:"duration"` // seconds
+	Reason    string    `json:"reason,omitempty"`
+	Interface string    `json:"interface,omitempty"`
+	// Locations of internet endpoints, with -geoip-db
+	SrcGeo *GeoLocation `json:"srcGeo,omitempty"`
+	DstGeo *GeoLocation `json:"dstGeo,omitempty"`
+}
+
+// flowEntry is an open flow with its recent byte counts
+type flowEntry struct {
+	FlowRecord
+	slots [flowRateSlots]uint64 // bytes per slot, indexed by slot number mod flowRateSlots
+	slot  int64                 // slot number of the latest packet
+	ended bool                  // TCP FIN or RST seen
+	lru   *list.Element         // position in flowTable.lru
+}
+
+// add accounts size bytes at now to the entry's rate slots
+func (e *flowEntry) add(size uint64, now time.Time) {
+	s := now.Unix() / flowSlotSeconds
+	if s != e.slot {
+		// Clear slots skipped since the last packet, at most the whole ring
+		for i := e.slot + 1; i <= s && i <= e.slot+flowRateSlots; i++ {
+			e.slots[i%flowRateSlots] = 0
+		}
+		e.slot = s
+	}
+	e.slots[s%flowRateSlots] += size
+}
+
+// bytesSince sums the bytes of the slots covering the last window before now
+func (e *flowEntry) bytesSince(now time.Time, window time.Duration) uint64 {
+	cur := now.Unix() / flowSlotSeconds
+	n := int64((window + flowSlotSeconds*time.Second - 1) / (flowSlotSeconds * time.Second))
+	var total uint64
+	for s := cur - n + 1; s <= cur; s++ {
+		if s <= e.slot && s > e.slot-flowRateSlots {
+			total += e.slots[s%flowRateSlots]
+		}
+	}
+	return total
+}
+
+// flowKey identifies a unidirectional flow
+type flowKey struct {
+	srcIP, dstIP     string
+	srcPort, dstPort uint16
+	protocol         string
+}
+
+// flowTable tracks open flows and expires them on idle and active timeouts,
+// handing the closed records to subscribers (persistence, exporters)
+type flowTable struct {
+	mu            sync.Mutex
+	flows         map[flowKey]*flowEntry
+	activeTimeout time.Duration
+	idleTimeout   time.Duration
+	closed        []FlowRecord // most recent last, capped at maxClosedFlows
+	lru           *list.List   // flow keys, least recently active first
+	evicted       []FlowRecord // evicted since the last expire, for subscribers
+	evictedTotal  uint64
+	subscribers   []func([]FlowRecord)
+	geo           *geoDB // locates internet endpoints of new flows; nil skips
+}
+
+// newFlowTable creates an empty flow table with the given timeouts
+func newFlowTable(activeTimeout, idleTimeout time.Duration) *flowTable {
+	return &flowTable{
+		flows:         make(map[flowKey]*flowEntry),
+		lru:           list.New(),
+		activeTimeout: activeTimeout,
+		idleTimeout:   idleTimeout,
+	}
+}
+
+// subscribe registers fn to be called with every batch of closed flows
+func (ft *flowTable) subscribe(fn func([]FlowRecord)) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.subscribers = append(ft.subscribers, fn)
+}
+
+// observe accounts one packet to its flow
+func (ft *flowTable) observe(pi *packetInfo, packets uint64, iface string, now time.Time) {
+	if pi.srcIP == "" || pi.dstIP == "" {
+		return
+	}
+	key := flowKey{pi.srcIP, pi.dstIP, pi.srcPort, pi.dstPort, pi.protocol}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	f, ok := ft.flows[key]
+	if !ok {
+		for len(ft.flows) >= maxFlows && ft.lru.Len() > 0 {
+			ft.evictOldest()
+		}
+		f = &flowEntry{FlowRecord: FlowRecord{
+			SrcMAC: pi.srcMAC, DstMAC: pi.dstMAC,
+			SrcIP: pi.srcIP, DstIP: pi.dstIP,
+			SrcPort: pi.srcPort, DstPort: pi.dstPort,
+			Protocol: pi.protocol, Start: now, Interface: iface,
+			SrcGeo: ft.geo.locate(pi.srcIP), DstGeo: ft.geo.locate(pi.dstIP),
+		}}
+		f.lru = ft.lru.PushBack(key)
+		ft.flows[key] = f
+	} else {
+		ft.lru.MoveToBack(f.lru)
+	}
+	f.Bytes += pi.size
+	f.Packets += packets
+	f.End = now
+	f.add(pi.size, now)
+	if pi.tcpEnd {
+		f.ended = true
+	}
+}
+
+// evictOldest closes the least recently active flow; caller holds ft.mu
+func (ft *flowTable) evictOldest() {
+	key := ft.lru.Remove(ft.lru.Front()).(flowKey)
+	f := ft.flows[key]
+	delete(ft.flows, key)
+	rec := f.FlowRecord
+	rec.Reason = FlowClosedEvicted
+	rec.Duration = rec.End.Sub(rec.Start).Seconds()
+	ft.evicted = append(ft.evicted, rec)
+	ft.evictedTotal++
+}
+
+// expire closes flows that ended, went idle or outlived the active timeout
+// (all of them when shutdown is set) and hands them to subscribers
+func (ft *flowTable) expire(now time.Time, shutdown bool) []FlowRecord {
+	ft.mu.Lock()
+	var closed []FlowRecord
+	for key, f := range ft.flows {
+		reason := ""
+		switch {
+		case f.ended:
+			reason = FlowClosedEnd
+		case now.Sub(f.End) >= ft.idleTimeout:
+			reason = FlowClosedIdle
+		case now.Sub(f.Start) >= ft.activeTimeout:
+			reason = FlowClosedActive
+		case shutdown:
+			reason = FlowClosedShutdown
+		default:
+			continue
+		}
+		rec := f.FlowRecord
+		rec.Reason = reason
+		rec.Duration = rec.End.Sub(rec.Start).Seconds()
+		closed = append(closed, rec)
+		delete(ft.flows, key)
+		ft.lru.Remove(f.lru)
+	}
+	evicted := len(ft.evicted)
+	closed = append(ft.evicted, closed...)
+	ft.evicted = nil
+	ft.closed = append(ft.closed, closed...)
+	if len(ft.closed) > maxClosedFlows {
+		ft.closed = ft.closed[len(ft.closed)-maxClosedFlows:]
+	}
+	subscribers := ft.subscribers
+	ft.mu.Unlock()
+
+	if evicted > 0 {
+		log.Printf("Flow table full (%d flows): evicted %d least recently active flows", maxFlows, evicted)
+	}
+	if len(closed) > 0 {
+		for _, fn := range subscribers {
+			fn(closed)
+		}
+	}
+	return closed
+}
+
+// recent returns closed flows that ended after since, oldest first, at most limit
+func (ft *flowTable) recent(since time.Time, limit int) []FlowRecord {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	result := make([]FlowRecord, 0)
+	for _, f := range ft.closed {
+		if f.End.After(since) {
+			result = append(result, f)
+		}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// TopFlow is an open flow with its rate over a recent window
+type TopFlow struct {
+	FlowRecord
+	SrcName     string  `json:"srcName,omitempty"`
+	DstName     string  `json:"dstName,omitempty"`
+	WindowBytes uint64  `json:"windowBytes"`
+	Rate        float64 `json:"rate"` // bytes per second over the window
+}
+
+// top returns the n open flows that moved most bytes in the window before now
+func (ft *flowTable) top(now time.Time, window time.Duration, n int) []TopFlow {
+	ft.mu.Lock()
+	result := make([]TopFlow, 0)
+	for _, f := range ft.flows {
+		b := f.bytesSince(now, window)
+		if b == 0 {
+			continue
+		}
+		// A flow younger than the window is rated over its lifetime
+		span := min(window, now.Sub(f.Start))
+		result = append(result, TopFlow{
+			FlowRecord:  f.FlowRecord,
+			WindowBytes: b,
+			Rate:        float64(b) / max(span.Seconds(), 1),
+		})
+	}
+	ft.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Rate != result[j].Rate {
+			return result[i].Rate > result[j].Rate
+		}
+		return result[i].Start.Before(result[j].Start)
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// endpointName names a flow endpoint: the device's hostname, a name it
+// announced, or the AS of an internet host
+func (bm *BandwidthMonitor) endpointName(mac, ip string) string {
+	bm.mutex.RLock()
+	dev, ok := bm.devices.load(bm.deviceKey(mac, ip), time.Now())
+	hostname := ""
+	if ok {
+		hostname = dev.friendlyName()
+	}
+	bm.mutex.RUnlock()
+	if hostname != "" {
+		return hostname
+	}
+	if name, ok := bm.names.lookup(ip); ok {
+		return name
+	}
+	if bm.asnDB != nil {
+		if addr := net.ParseIP(ip); addr != nil && !addr.IsPrivate() {
+			if as, ok := bm.asnDB.lookup(addr); ok {
+				return as.Label()
+			}
+		}
+	}
+	return ""
+}
+
+// expireFlowsPeriodically sweeps the flow table until stop is closed
+func (bm *BandwidthMonitor) expireFlowsPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(flowSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.flows.expire(now, false)
+		}
+	}
+}
+
+// flowStoreKey orders stored flow batches by time
+func flowStoreKey(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+// persistFlows writes each batch of closed flows to the store under the
+// "flows" bucket, dropping batches older than flowStoreRetention
+func persistFlows(store Store) func([]FlowRecord) {
+	return func(closed []FlowRecord) {
+		now := time.Now()
+		data, err := json.Marshal(closed)
+		if err == nil {
+			err = store.Put("flows", flowStoreKey(now), data)
+		}
+		if err != nil {
+			log.Printf("Error persisting closed flows: %v", err)
+			return
+		}
+		keys, err := store.Keys("flows")
+		if err != nil {
+			return
+		}
+		cutoff := flowStoreKey(now.Add(-flowStoreRetention))
+		for _, k := range keys {
+			if k >= cutoff {
+				break
+			}
+			if err := store.Delete("flows", k); err != nil {
+				log.Printf("Error pruning closed flows: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// REST API: Recently closed flows, optionally after ?since=<RFC 3339> and at most ?limit=
+func (bm *BandwidthMonitor) handleGetClosedFlows(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeEncoded(w, r, bm.flows.recent(since, limit))
+}
+
+// REST API: Fastest open flows over ?window= (default 30s, at most 60s), top ?n= (default 20)
+func (bm *BandwidthMonitor) handleGetTopFlows(w http.ResponseWriter, r *http.Request) {
+	window := 30 * time.Second
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		window, err = time.ParseDuration(s)
+		if err != nil || window <= 0 || window > flowRateSlots*flowSlotSeconds*time.Second {
+			http.Error(w, "Invalid window parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	n := 20
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	flows := bm.flows.top(time.Now(), window, n)
+	for i := range flows {
+		flows[i].SrcName = bm.endpointName(flows[i].SrcMAC, flows[i].SrcIP)
+		flows[i].DstName = bm.endpointName(flows[i].DstMAC, flows[i].DstIP)
+	}
+	writeEncoded(w, r, flows)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxGeoCache bounds the lookups geoDB remembers; the cache is cleared when
+// it fills, which busy peers repopulate quickly
+const maxGeoCache = 16384
+
+// GeoLocation is where an internet host is, per the GeoIP database
+type GeoLocation struct {
+	Country     string `json:"country"` // ISO 3166-1 alpha-2 code
+	CountryName string `json:"countryName,omitempty"`
+	City        string `json:"city,omitempty"` // City databases only
+}
+
+// geoRecord is the part of a GeoLite2/GeoIP2 Country or City record read
+type geoRecord struct {
+	City struct {
+		Names struct {
+			En string `maxminddb:"en"`
+		} `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country           geoCountry `maxminddb:"country"`
+	RegisteredCountry geoCountry `maxminddb:"registered_country"`
+}
+
+type geoCountry struct {
+	ISOCode string `maxminddb:"iso_code"`
+	Names   struct {
+		En string `maxminddb:"en"`
+	} `maxminddb:"names"`
+}
+
+// geoDB looks up the location of an IP address in a MaxMind GeoLite2 or
+// GeoIP2 database (.mmdb), downloaded separately under MaxMind's license
+type geoDB struct {
+	reader *maxminddb.Reader
+	mu     sync.Mutex
+	cache  map[netip.Addr]GeoLocation // zero value: not found
+}
+
+// loadGeoDB opens a GeoIP database file
+func loadGeoDB(path string) (*geoDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoDB{reader: reader, cache: make(map[netip.Addr]GeoLocation)}, nil
+}
+
+// lookup returns where ip is located
+func (db *geoDB) lookup(ip net.IP) (GeoLocation, bool) {
+	if db == nil {
+		return GeoLocation{}, false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return GeoLocation{}, false
+	}
+	addr = addr.Unmap()
+	db.mu.Lock()
+	loc, cached := db.cache[addr]
+	db.mu.Unlock()
+	if !cached {
+		var rec geoRecord
+		if _, found, err := db.reader.LookupNetwork(ip, &rec); err == nil && found {
+			// Anycast and satellite ranges often carry only the country
+			// the network is registered in
+			country := rec.Country
+			if country.ISOCode == "" {
+				country = rec.RegisteredCountry
+			}
+			loc = GeoLocation{Country: country.ISOCode, CountryName: country.Names.En, City: rec.City.Names.En}
+		}
+		db.mu.Lock()
+		if len(db.cache) >= maxGeoCache {
+			clear(db.cache)
+		}
+		db.cache[addr] = loc
+		db.mu.Unlock()
+	}
+	return loc, loc.Country != ""
+}
+
+// locate returns the location of ip when it is an internet host
+func (db *geoDB) locate(ip string) *GeoLocation {
+	addr := net.ParseIP(ip)
+	if db == nil || addr == nil || !isPublicIP(addr) {
+		return nil
+	}
+	if loc, ok := db.lookup(addr); ok {
+		return &loc
+	}
+	return nil
+}
+
+// CountryUsage is a device's traffic with hosts in one country
+type CountryUsage struct {
+	Country     string `json:"country"`
+	CountryName string `json:"countryName,omitempty"`
+	BytesSent   uint64 `json:"bytesSent"`
+	BytesRecv   uint64 `json:"bytesRecv"`
+}
+
+// geoUsage accumulates per-device traffic by country; there are few enough
+// countries that the breakdown needs no cap
+type geoUsage struct {
+	mu      sync.Mutex
+	devices map[string]map[string]*CountryUsage
+}
+
+// newGeoUsage creates an empty per-device country accumulator
+func newGeoUsage() *geoUsage {
+	return &geoUsage{devices: make(map[string]map[string]*CountryUsage)}
+}
+
+// add records size bytes between device and a host at loc
+func (u *geoUsage) add(device string, loc GeoLocation, size uint64, sent bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	byCountry, ok := u.devices[device]
+	if !ok {
+		byCountry = make(map[string]*CountryUsage)
+		u.devices[device] = byCountry
+	}
+	entry, ok := byCountry[loc.Country]
+	if !ok {
+		entry = &CountryUsage{Country: loc.Country, CountryName: loc.CountryName}
+		byCountry[loc.Country] = entry
+	}
+	if sent {
+		entry.BytesSent += size
+	} else {
+		entry.BytesRecv += size
+	}
+}
+
+// forget drops the country breakdown of device
+func (u *geoUsage) forget(device string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.devices, device)
+}
+
+// reset drops the country breakdown of every device
+func (u *geoUsage) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.devices = make(map[string]map[string]*CountryUsage)
+}
+
+// top returns the n countries the device exchanged most bytes with, all
+// of them when n is 0
+func (u *geoUsage) top(device string, n int) []CountryUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make([]CountryUsage, 0, len(u.devices[device]))
+	for _, entry := range u.devices[device] {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti, tj := result[i].BytesSent+result[i].BytesRecv, result[j].BytesSent+result[j].BytesRecv
+		if ti != tj {
+			return ti > tj
+		}
+		return result[i].Country < result[j].Country
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// ObserveGeo accounts a packet to the country of its internet peer
+func (bm *BandwidthMonitor) ObserveGeo(srcMAC, dstMAC, srcIP, dstIP string, size uint64) {
+	if bm.geoDB == nil {
+		return
+	}
+	device, peer, sent, ok := bm.externalPeer(srcMAC, dstMAC, srcIP, dstIP)
+	if !ok {
+		return
+	}
+	if loc, found := bm.geoDB.lookup(peer); found {
+		bm.geoUsage.add(device, loc, size, sent)
+	}
+}
+
+// REST API: Traffic of a device by country of its internet peers (?n= to
+// keep the top n)
+func (bm *BandwidthMonitor) handleGetDeviceCountries(w http.ResponseWriter, r *http.Request) {
+	if bm.geoDB == nil {
+		http.Error(w, "No GeoIP database loaded (start with -geoip-db)", http.StatusNotFound)
+		return
+	}
+	n := 0
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeEncoded(w, r, bm.geoUsage.top(mux.Vars(r)["mac"], n))
+}
+
+// REST API: Look up the location of an IP address
+func (bm *BandwidthMonitor) handleGetGeoIP(w http.ResponseWriter, r *http.Request) {
+	if bm.geoDB == nil {
+		http.Error(w, "No GeoIP database loaded (start with -geoip-db)", http.StatusNotFound)
+		return
+	}
+	ip := net.ParseIP(mux.Vars(r)["ip"])
+	if ip == nil {
+		http.Error(w, "Invalid IP address", http.StatusBadRequest)
+		return
+	}
+	loc, ok := bm.geoDB.lookup(ip)
+	if !ok {
+		http.Error(w, "Location not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, loc)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HeartbeatRule describes a device that is expected to transmit continuously,
+// such as a camera or sensor. When its rate stays below MinRateBps for
+// SilenceMinutes consecutive minutes a "heartbeat-silence" alert is raised.
+type HeartbeatRule struct {
+	Device         string  `json:"device"`
+	Name           string  `json:"name,omitempty"`
+	MinRateBps     float64 `json:"minRateBps"`
+	SilenceMinutes int     `json:"silenceMinutes"`
+}
+
+// HeartbeatStatus is a rule together with its current state
+type HeartbeatStatus struct {
+	HeartbeatRule
+	QuietMinutes int  `json:"quietMinutes"`
+	Silent       bool `json:"silent"` // alert raised and not yet recovered
+}
+
+// heartbeatState tracks one rule between evaluations
+type heartbeatState struct {
+	lastBytes    uint64
+	primed       bool
+	quietMinutes int
+	alerted      bool
+}
+
+// heartbeatMonitor evaluates heartbeat rules once per minute
+type heartbeatMonitor struct {
+	mu    sync.Mutex
+	rules map[string]HeartbeatRule
+	state map[string]*heartbeatState
+	doc   document // optional place the rules are persisted to
+}
+
+// newHeartbeatMonitor creates a monitor, loading rules from doc when set
+func newHeartbeatMonitor(doc document) *heartbeatMonitor {
+	h := &heartbeatMonitor{
+		rules: make(map[string]HeartbeatRule),
+		state: make(map[string]*heartbeatState),
+		doc:   doc,
+	}
+	if doc == nil {
+		return h
+	}
+	var rules []HeartbeatRule
+	if err := doc.load(&rules); err != nil {
+		log.Printf("Error reading heartbeat rules from %s: %v", doc, err)
+		return h
+	}
+	for _, rule := range rules {
+		h.rules[rule.Device] = rule
+	}
+	return h
+}
+
+// save writes the rules back to their document; caller holds h.mu
+func (h *heartbeatMonitor) save() {
+	if h.doc == nil {
+		return
+	}
+	list := make([]HeartbeatRule, 0, len(h.rules))
+	for _, rule := range h.rules {
+		list = append(list, rule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	if err := h.doc.save(list); err != nil {
+		log.Printf("Error writing heartbeat rules to %s: %v", h.doc, err)
+	}
+}
+
+// set adds or replaces a rule
+func (h *heartbeatMonitor) set(rule HeartbeatRule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rules[rule.Device] = rule
+	delete(h.state, rule.Device)
+	h.save()
+}
+
+// remove deletes a rule; it reports whether it existed
+func (h *heartbeatMonitor) remove(device string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.rules[device]; !ok {
+		return false
+	}
+	delete(h.rules, device)
+	delete(h.state, device)
+	h.save()
+	return true
+}
+
+// evaluate checks every rule against the last interval of traffic
+func (h *heartbeatMonitor) evaluate(bm *BandwidthMonitor, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	totals := make(map[string]uint64, len(h.rules))
+	bm.mutex.RLock()
+	for key := range h.rules {
+		if dev, ok := bm.devices.load(key, time.Now()); ok {
+			totals[key] = dev.BytesSent + dev.BytesRecv
+		}
+	}
+	bm.mutex.RUnlock()
+
+	for key, rule := range h.rules {
+		st, ok := h.state[key]
+		if !ok {
+			st = &heartbeatState{}
+			h.state[key] = st
+		}
+		total := totals[key]
+		// First sample or counters reset: only establish a baseline
+		if !st.primed || total < st.lastBytes {
+			st.lastBytes = total
+			st.primed = true
+			continue
+		}
+		rate := float64(total-st.lastBytes) / interval.Seconds()
+		st.lastBytes = total
+
+		if rate >= rule.MinRateBps {
+			if st.alerted {
+				bm.alerts.raise("heartbeat-restored", SeverityInfo, key,
+					"%s is transmitting again after %d quiet minutes", heartbeatLabel(rule), st.quietMinutes)
+			}
+			st.quietMinutes = 0
+			st.alerted = false
+			continue
+		}
+
+		st.quietMinutes++
+		if !st.alerted && st.quietMinutes >= rule.SilenceMinutes {
+			st.alerted = true
+			bm.alerts.raise("heartbeat-silence", SeverityWarning, key,
+				"%s has been below %.0f B/s for %d minutes", heartbeatLabel(rule), rule.MinRateBps, st.quietMinutes)
+		}
+	}
+}
+
+// statuses returns all rules with their current state, sorted by device key
+func (h *heartbeatMonitor) statuses() []HeartbeatStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make([]HeartbeatStatus, 0, len(h.rules))
+	for key, rule := range h.rules {
+		st := HeartbeatStatus{HeartbeatRule: rule}
+		if s, ok := h.state[key]; ok {
+			st.QuietMinutes = s.quietMinutes
+			st.Silent = s.alerted
+		}
+		result = append(result, st)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
+
+// heartbeatLabel returns the friendliest name of a rule's device
+func heartbeatLabel(rule HeartbeatRule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return rule.Device
+}
+
+// watchHeartbeatsPeriodically evaluates heartbeat rules once per minute until stop is closed
+func (bm *BandwidthMonitor) watchHeartbeatsPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			bm.heartbeats.evaluate(bm, time.Minute)
+		}
+	}
+}
+
+// REST API: List heartbeat rules and their state
+func (bm *BandwidthMonitor) handleGetHeartbeats(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.heartbeats.statuses())
+}
+
+// REST API: Create or replace the heartbeat rule of a device
+func (bm *BandwidthMonitor) handlePutHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var rule HeartbeatRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rule.Device = mux.Vars(r)["mac"]
+	if rule.MinRateBps <= 0 || rule.SilenceMinutes < 1 {
+		http.Error(w, "minRateBps must be positive and silenceMinutes at least 1", http.StatusBadRequest)
+		return
+	}
+	bm.heartbeats.set(rule)
+	writeEncoded(w, r, rule)
+}
+
+// REST API: Delete the heartbeat rule of a device
+func (bm *BandwidthMonitor) handleDeleteHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !bm.heartbeats.remove(mux.Vars(r)["mac"]) {
+		http.Error(w, "Heartbeat rule not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyStep is the resolution of the in-memory per-device history
+const historyStep = 5 * time.Minute
+
+// maxCompareDevices caps the devices of one comparison request
+const maxCompareDevices = 10
+
+// maxHistoryPoints caps the steps of one history query
+const maxHistoryPoints = 1440
+
+// historyResolutions are the steps picked when a history query gives none:
+// the finest that keeps the query within maxHistoryPoints
+var historyResolutions = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour}
+
+// historyRetention is how much per-device history is kept in memory (see
+// resourceProfile)
+var historyRetention = 24 * time.Hour
+
+// traffic is the bytes a device sent and received
+type traffic struct {
+	sent, recv uint64
+}
+
+// historyBucket is the traffic of every active device during one step
+type historyBucket struct {
+	start   time.Time
+	devices map[string]traffic // only devices with traffic in the step
+}
+
+// deviceHistory samples device counters every historyStep into a ring of
+// buckets shared by all devices, so series of different devices align.
+// Idle devices cost nothing.
+type deviceHistory struct {
+	mu      sync.Mutex
+	buckets []historyBucket // oldest first
+	last    map[string]traffic
+	lastAt  time.Time
+}
+
+// newDeviceHistory creates an empty history
+func newDeviceHistory() *deviceHistory {
+	return &deviceHistory{last: make(map[string]traffic)}
+}
+
+// deltas returns the traffic of each device since the previous sample; a
+// counter that went backwards (stats reset) counts from zero. Caller holds h.mu.
+func (h *deviceHistory) deltas(current map[string]traffic) map[string]traffic {
+	result := make(map[string]traffic)
+	for key, cur := range current {
+		prev := h.last[key]
+		if cur.sent < prev.sent || cur.recv < prev.recv {
+			prev = traffic{}
+		}
+		if d := (traffic{cur.sent - prev.sent, cur.recv - prev.recv}); d != (traffic{}) {
+			result[key] = d
+		}
+	}
+	return result
+}
+
+// sample closes the bucket of the step ending at now
+func (h *deviceHistory) sample(current map[string]traffic, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.lastAt.IsZero() {
+		h.buckets = append(h.buckets, historyBucket{start: now.Add(-historyStep).Truncate(historyStep), devices: h.deltas(current)})
+		if keep := int(historyRetention / historyStep); len(h.buckets) > keep {
+			h.buckets = h.buckets[len(h.buckets)-keep:]
+		}
+	}
+	h.last = current
+	h.lastAt = now
+}
+
+// forget drops the sampling baseline of device; its past buckets stay
+func (h *deviceHistory) forget(device string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.last, device)
+}
+
+// merge moves the history of device from onto device into, keeping the
+// sampling baseline in step with their summed counters
+func (h *deviceHistory) merge(from, into string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, b := range h.buckets {
+		if t, ok := b.devices[from]; ok {
+			sum := b.devices[into]
+			b.devices[into] = traffic{sum.sent + t.sent, sum.recv + t.recv}
+			delete(b.devices, from)
+		}
+	}
+	if t, ok := h.last[from]; ok {
+		sum := h.last[into]
+		h.last[into] = traffic{sum.sent + t.sent, sum.recv + t.recv}
+		delete(h.last, from)
+	}
+}
+
+// series returns per-step traffic of devices from since up to now, including
+// the step in progress (taken from current), aligned on shared step starts
+func (h *deviceHistory) series(devices []string, current map[string]traffic, since, now time.Time) ([]time.Time, map[string][]traffic) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since = since.Truncate(historyStep)
+	var times []time.Time
+	result := make(map[string][]traffic, len(devices))
+	add := func(start time.Time, b map[string]traffic) {
+		times = append(times, start)
+		for _, d := range devices {
+			result[d] = append(result[d], b[d])
+		}
+	}
+	for _, b := range h.buckets {
+		if !b.start.Before(since) {
+			add(b.start, b.devices)
+		}
+	}
+	if !h.lastAt.IsZero() {
+		add(now.Truncate(historyStep), h.deltas(current))
+	}
+	return times, result
+}
+
+// deviceTraffic snapshots the counters of every device
+func (bm *BandwidthMonitor) deviceTraffic() map[string]traffic {
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	result := make(map[string]traffic, bm.devices.len())
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		result[key] = traffic{dev.BytesSent, dev.BytesRecv}
+	})
+	return result
+}
+
+// recordHistoryPeriodically samples device counters every historyStep until stop is closed
+func (bm *BandwidthMonitor) recordHistoryPeriodically(stop <-chan struct{}) {
+	bm.history.sample(bm.deviceTraffic(), time.Now())
+	// Align samples on step boundaries so buckets cover whole steps
+	next := time.Now().Truncate(historyStep).Add(historyStep)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(next)):
+			bm.history.sample(bm.deviceTraffic(), time.Now())
+			next = next.Add(historyStep)
+		}
+	}
+}
+
+// ComparedDevice is one device's traffic in a comparison
+type ComparedDevice struct {
+	Device    string   `json:"device"`
+	Name      string   `json:"name,omitempty"`
+	BytesSent uint64   `json:"bytesSent"` // totals over the window
+	BytesRecv uint64   `json:"bytesRecv"`
+	Sent      []uint64 `json:"sent"` // per step, aligned with DeviceComparison.Times
+	Recv      []uint64 `json:"recv"`
+}
+
+// DeviceComparison holds aligned traffic series of several devices
+type DeviceComparison struct {
+	Step    int              `json:"step"` // seconds per point
+	Times   []time.Time      `json:"times"`
+	Devices []ComparedDevice `json:"devices"`
+}
+
+// REST API: Compare the traffic of ?macs=a,b,c over ?window= (default 24h)
+func (bm *BandwidthMonitor) handleCompareDevices(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for _, k := range strings.Split(r.URL.Query().Get("macs"), ",") {
+		if k = strings.TrimSpace(k); k != "" && !containsString(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 || len(keys) > maxCompareDevices {
+		http.Error(w, "macs must list 1 to 10 devices", http.StatusBadRequest)
+		return
+	}
+	window := 24 * time.Hour
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil || window < historyStep || window > historyRetention {
+			http.Error(w, "Invalid window parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	names := make(map[string]string, len(keys))
+	bm.mutex.RLock()
+	for _, k := range keys {
+		if dev, ok := bm.devices.load(k, time.Now()); ok {
+			names[k] = dev.friendlyName()
+		}
+	}
+	bm.mutex.RUnlock()
+
+	now := time.Now()
+	times, series := bm.history.series(keys, bm.deviceTraffic(), now.Add(-window), now)
+	result := DeviceComparison{Step: int(historyStep / time.Second), Times: times, Devices: make([]ComparedDevice, 0, len(keys))}
+	if result.Times == nil {
+		result.Times = []time.Time{}
+	}
+	for _, k := range keys {
+		cd := ComparedDevice{Device: k, Name: names[k], Sent: make([]uint64, 0, len(times)), Recv: make([]uint64, 0, len(times))}
+		seen := false
+		for _, t := range series[k] {
+			cd.Sent = append(cd.Sent, t.sent)
+			cd.Recv = append(cd.Recv, t.recv)
+			cd.BytesSent += t.sent
+			cd.BytesRecv += t.recv
+			seen = seen || t != (traffic{})
+		}
+		if _, known := names[k]; !known && !seen {
+			http.Error(w, "Device not found: "+k, http.StatusNotFound)
+			return
+		}
+		result.Devices = append(result.Devices, cd)
+	}
+	writeEncoded(w, r, result)
+}
+
+// HistorySeries is the traffic of one device, or of all, in a history query
+type HistorySeries struct {
+	Device    string   `json:"device,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	BytesSent uint64   `json:"bytesSent"` // totals over the query
+	BytesRecv uint64   `json:"bytesRecv"`
+	Sent      []uint64 `json:"sent"` // per step, aligned with TrafficHistory.Times
+	Recv      []uint64 `json:"recv"`
+}
+
+// TrafficHistory is downsampled traffic from the -history-db
+type TrafficHistory struct {
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Resolution int             `json:"resolution"` // seconds per step
+	Times      []time.Time     `json:"times"`      // step starts
+	Total      HistorySeries   `json:"total"`
+	Devices    []HistorySeries `json:"devices"` // busiest first
+}
+
+// newHistorySeries creates a series of n zero steps
+func newHistorySeries(device string, n int) *HistorySeries {
+	return &HistorySeries{Device: device, Sent: make([]uint64, n), Recv: make([]uint64, n)}
+}
+
+// add counts t in step i
+func (s *HistorySeries) add(i int, t traffic) {
+	s.Sent[i] += t.sent
+	s.Recv[i] += t.recv
+	s.BytesSent += t.sent
+	s.BytesRecv += t.recv
+}
+
+// queryHistory downsamples the -history-db over [from, to) into steps of
+// resolution, from rounded down to a whole step
+func (bm *BandwidthMonitor) queryHistory(from, to time.Time, resolution time.Duration) (*TrafficHistory, error) {
+	from = from.Truncate(resolution)
+	n := int((to.Sub(from) + resolution - 1) / resolution)
+	rows, err := bm.series.downsample(from, to, resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &TrafficHistory{From: from, To: to, Resolution: int(resolution / time.Second), Times: make([]time.Time, n)}
+	for i := range h.Times {
+		h.Times[i] = from.Add(time.Duration(i) * resolution)
+	}
+	total := newHistorySeries("", n)
+	devices := make(map[string]*HistorySeries)
+	totals := make(map[string]traffic)
+	for _, row := range rows {
+		if row.step < 0 || row.step >= n {
+			continue
+		}
+		s, ok := devices[row.device]
+		if !ok {
+			s = newHistorySeries(row.device, n)
+			devices[row.device] = s
+		}
+		s.add(row.step, row.traffic)
+		total.add(row.step, row.traffic)
+		totals[row.device] = traffic{s.BytesSent, s.BytesRecv}
+	}
+	h.Total = *total
+
+	h.Devices = make([]HistorySeries, 0, len(devices))
+	bm.mutex.RLock()
+	for _, k := range rankDevices(totals) {
+		s := devices[k]
+		if dev, ok := bm.devices.load(k, time.Now()); ok {
+			s.Name = dev.friendlyName()
+		} else {
+			s.Name = bm.labels.get(k)
+		}
+		h.Devices = append(h.Devices, *s)
+	}
+	bm.mutex.RUnlock()
+	return h, nil
+}
+
+// REST API: Per-device and total traffic from ?from= to ?to= (RFC 3339; default
+// the last 24h) in steps of ?resolution= (default the finest within 1440 steps)
+func (bm *BandwidthMonitor) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	if bm.series == nil {
+		http.Error(w, "Traffic history not configured (-history-db)", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	to := time.Now()
+	if s := q.Get("to"); s != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid to parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if s := q.Get("from"); s != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	var resolution time.Duration
+	if s := q.Get("resolution"); s != "" {
+		var err error
+		resolution, err = time.ParseDuration(s)
+		if err != nil || resolution < time.Minute || resolution%time.Minute != 0 {
+			http.Error(w, "Invalid resolution parameter (whole minutes)", http.StatusBadRequest)
+			return
+		}
+		if to.Sub(from.Truncate(resolution)) > maxHistoryPoints*resolution {
+			http.Error(w, "Too many steps; use a coarser resolution or a shorter range", http.StatusBadRequest)
+			return
+		}
+	} else {
+		for _, res := range historyResolutions {
+			resolution = res
+			if to.Sub(from.Truncate(res)) <= maxHistoryPoints*res {
+				break
+			}
+		}
+		if to.Sub(from.Truncate(resolution)) > maxHistoryPoints*resolution {
+			http.Error(w, "Range too long", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h, err := bm.queryHistory(from, to, resolution)
+	if err != nil {
+		log.Printf("Error querying traffic history: %v", err)
+		http.Error(w, "Error reading traffic history", http.StatusInternalServerError)
+		return
+	}
+	writeEncoded(w, r, h)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP hardening limits
+const (
+	maxRequestBody     = 1 << 20 // bytes accepted in a request body
+	maxHeaderBytes     = 64 << 10
+	readHeaderTimeout  = 5 * time.Second
+	wsHandshakeTimeout = 10 * time.Second
+)
+
+// securityHeaders sets defensive response headers and caps request bodies.
+// The API serves data, never pages, so nothing may frame or script it, and
+// live stats must not be cached by shared proxies.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		h.Set("Cache-Control", "no-store")
+		if r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirect answers plain HTTP with a permanent redirect to the same
+// URL on the HTTPS server at port (-http-redirect-port)
+func httpsRedirect(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "https://"+net.JoinHostPort(host, port)+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
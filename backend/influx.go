@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Measurements written to InfluxDB
+const (
+	influxDeviceMeasurement  = "lantt_device"
+	influxNetworkMeasurement = "lantt_network"
+)
+
+// influxExporter pushes per-device bandwidth samples to InfluxDB in line
+// protocol. It uses the /api/v2/write endpoint, which InfluxDB 2.x serves
+// natively and 1.8+ for compatibility (bucket "db/rp", token "user:password").
+type influxExporter struct {
+	writeURL string
+	token    string
+	client   *http.Client
+	last     map[string]deviceCounters // counters at the previous push, for rates
+	lastAt   time.Time
+}
+
+// newInfluxExporter creates an exporter writing to bucket (and org, for 2.x)
+// on the server at baseURL
+func newInfluxExporter(baseURL, org, bucket, token string) (*influxExporter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid InfluxDB URL %q", baseURL)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no InfluxDB bucket")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+	q := url.Values{"bucket": {bucket}, "precision": {"s"}}
+	if org != "" {
+		q.Set("org", org)
+	}
+	u.RawQuery = q.Encode()
+	return &influxExporter{
+		writeURL: u.String(),
+		token:    token,
+		client:   &http.Client{Timeout: notifyTimeout},
+		last:     make(map[string]deviceCounters),
+	}, nil
+}
+
+// influxEscaper escapes tag keys and values
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "")
+
+// influxLine appends one line-protocol point; tags with empty values are left
+// out, as line protocol does not allow them
+func influxLine(buf *bytes.Buffer, measurement string, tags [][2]string, fields string, ts time.Time) {
+	buf.WriteString(measurement)
+	for _, t := range tags {
+		if t[1] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(t[0])
+		buf.WriteByte('=')
+		buf.WriteString(influxEscaper.Replace(t[1]))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(fields)
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(ts.Unix(), 10))
+	buf.WriteByte('\n')
+}
+
+// byteRate is the bytes per second between two counter readings; a counter that
+// went backwards (stats reset) counts from zero
+func byteRate(cur, prev uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	if cur < prev {
+		prev = 0
+	}
+	return float64(cur-prev) / elapsed.Seconds()
+}
+
+// encode renders a sample of every device and the network totals. Rates are
+// only written once there is a previous sample to compare against.
+func (e *influxExporter) encode(bm *BandwidthMonitor, stats *NetworkStats) []byte {
+	var buf bytes.Buffer
+	elapsed := stats.Timestamp.Sub(e.lastAt)
+	current := make(map[string]deviceCounters, len(stats.Devices))
+	for _, dev := range stats.Devices {
+		key := bm.deviceKey(dev.MAC, dev.IP)
+		cur := deviceCounters{dev.BytesSent, dev.BytesRecv, dev.PacketsSent, dev.PacketsRecv}
+		current[key] = cur
+		fields := fmt.Sprintf("bytes_sent=%di,bytes_recv=%di,packets_sent=%di,packets_recv=%di",
+			cur.bytesSent, cur.bytesRecv, cur.packetsSent, cur.packetsRecv)
+		if prev, ok := e.last[key]; ok {
+			fields += fmt.Sprintf(",rate_sent=%g,rate_recv=%g",
+				byteRate(cur.bytesSent, prev.bytesSent, elapsed), byteRate(cur.bytesRecv, prev.bytesRecv, elapsed))
+		}
+		tags := [][2]string{{"device", key}, {"mac", dev.MAC}, {"ip", dev.IP}, {"hostname", dev.friendlyName()}}
+		influxLine(&buf, influxDeviceMeasurement, tags, fields, stats.Timestamp)
+	}
+	influxLine(&buf, influxNetworkMeasurement, nil,
+		fmt.Sprintf("bytes_sent=%di,bytes_recv=%di,packets=%di,active_devices=%di",
+			stats.TotalSent, stats.TotalRecv, stats.TotalPackets, stats.ActiveDevices),
+		stats.Timestamp)
+	e.last, e.lastAt = current, stats.Timestamp
+	return buf.Bytes()
+}
+
+// write posts line-protocol points to InfluxDB
+func (e *influxExporter) write(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Token "+e.token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// exportInfluxPeriodically pushes a sample every interval until stop is closed.
+// A failed push is logged and dropped; the counters in the next one cover it.
+func (bm *BandwidthMonitor) exportInfluxPeriodically(e *influxExporter, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := e.write(e.encode(bm, bm.GetNetworkStats())); err != nil {
+				log.Printf("Error exporting to InfluxDB: %v", err)
+			}
+		}
+	}
+}
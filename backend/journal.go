@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// journalEntry is one line of the journal: the traffic of each device
+// during the interval ending at Time
+type journalEntry struct {
+	Time    int64                `json:"t"` // Unix seconds
+	Devices map[string][4]uint64 `json:"d"` // bytes sent, received, packets sent, received
+}
+
+// journal is an append-only file of the traffic not yet flushed to the
+// history database, one JSON line per entry (sealed with -encryption-key).
+// Every entry is synced to disk, so a power loss loses at most one
+// -journal-interval; it is emptied after each flush.
+type journal struct {
+	f *os.File
+}
+
+// openJournal opens (creating) the journal at path and returns the entries
+// left by an unclean shutdown. A torn last line is dropped.
+func openJournal(path string) (*journal, []journalEntry, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []journalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		line, err := atRest.openValue(scanner.Bytes())
+		if err == nil {
+			err = json.Unmarshal(line, &e)
+		}
+		if err != nil {
+			log.Printf("Journal %s: dropping entry %d and after: %v", path, len(entries)+1, err)
+			break
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &journal{f: f}, entries, nil
+}
+
+// append writes e and syncs it to disk
+func (j *journal) append(e journalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if atRest != nil {
+		line = atRest.sealValue(line)
+	}
+	if _, err := j.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// truncate empties the journal
+func (j *journal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Close closes the journal file
+func (j *journal) Close() error { return j.f.Close() }
+
+// attachJournal journals the traffic between flushes to path. Entries left
+// by an unclean shutdown are added to their minutes first.
+func (s *seriesDB) attachJournal(path string) error {
+	j, entries, err := openJournal(path)
+	if err != nil {
+		return err
+	}
+	if err := s.replay(entries); err != nil {
+		j.Close()
+		return fmt.Errorf("replaying %s: %v", path, err)
+	}
+	if err := j.truncate(); err != nil {
+		j.Close()
+		return err
+	}
+	if len(entries) > 0 {
+		log.Printf("Recovered %d journal entries (%s to %s) into the history database", len(entries),
+			time.Unix(entries[0].Time, 0).Format(time.RFC3339), time.Unix(entries[len(entries)-1].Time, 0).Format(time.RFC3339))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.journal, s.journalLast = j, make(map[string]deviceCounters)
+	return nil
+}
+
+// replay adds journal entries to the minutes they fall in
+func (s *seriesDB) replay(entries []journalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	minutes := make(map[int64]map[string]deviceCounters)
+	for _, e := range entries {
+		// The interval ends at e.Time; its traffic belongs to the minute before
+		minute := time.Unix(e.Time, 0).Add(-time.Second).Truncate(time.Minute).Unix()
+		devices := minutes[minute]
+		if devices == nil {
+			devices = make(map[string]deviceCounters)
+			minutes[minute] = devices
+		}
+		for device, c := range e.Devices {
+			devices[device] = devices[device].plus(deviceCounters{c[0], c[1], c[2], c[3]})
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.addMinutes(tx, minutes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// resetJournal empties the journal after a flush wrote current; caller
+// holds s.mu
+func (s *seriesDB) resetJournal(current map[string]deviceCounters) error {
+	if s.journal == nil {
+		return nil
+	}
+	s.journalLast = current
+	return s.journal.truncate()
+}
+
+// writeJournal appends the traffic since the previous entry (or flush);
+// nothing is journaled before the first flush set the baseline
+func (s *seriesDB) writeJournal(current map[string]deviceCounters, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil || !s.primed {
+		return nil
+	}
+	e := journalEntry{Time: now.Unix(), Devices: make(map[string][4]uint64)}
+	for device, cur := range current {
+		if d := cur.since(s.journalLast[device]); d != (deviceCounters{}) {
+			e.Devices[device] = [4]uint64{d.bytesSent, d.bytesRecv, d.packetsSent, d.packetsRecv}
+		}
+	}
+	s.journalLast = current
+	if len(e.Devices) == 0 {
+		return nil
+	}
+	return s.journal.append(e)
+}
+
+// journalSeriesPeriodically journals device traffic every interval until
+// stop is closed
+func (bm *BandwidthMonitor) journalSeriesPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := bm.series.writeJournal(bm.deviceCounterSnapshot(), now); err != nil {
+				log.Printf("Error writing history journal: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// maxLabelLength caps custom device names
+const maxLabelLength = 64
+
+// DeviceLabel is a custom name given to a device
+type DeviceLabel struct {
+	Device string `json:"device"` // device key (MAC, or IP for MAC-less devices)
+	Name   string `json:"name"`
+}
+
+// labelStore keeps custom device names
+type labelStore struct {
+	mu     sync.RWMutex
+	labels map[string]string
+	doc    document // optional place the labels are persisted to
+}
+
+// newLabelStore creates a store, loading labels from doc when set
+func newLabelStore(doc document) *labelStore {
+	ls := &labelStore{labels: make(map[string]string), doc: doc}
+	if doc == nil {
+		return ls
+	}
+	var labels []DeviceLabel
+	if err := doc.load(&labels); err != nil {
+		log.Printf("Error reading device labels from %s: %v", doc, err)
+		return ls
+	}
+	for _, l := range labels {
+		ls.labels[l.Device] = l.Name
+	}
+	return ls
+}
+
+// save writes the labels back to their document; caller holds ls.mu
+func (ls *labelStore) save() {
+	if ls.doc == nil {
+		return
+	}
+	list := make([]DeviceLabel, 0, len(ls.labels))
+	for device, name := range ls.labels {
+		list = append(list, DeviceLabel{Device: device, Name: name})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	if err := ls.doc.save(list); err != nil {
+		log.Printf("Error writing device labels to %s: %v", ls.doc, err)
+	}
+}
+
+// get returns the label of device, or ""
+func (ls *labelStore) get(device string) string {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.labels[device]
+}
+
+// set names device; an empty name removes its label
+func (ls *labelStore) set(device, name string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if name == "" {
+		delete(ls.labels, device)
+	} else {
+		ls.labels[device] = name
+	}
+	ls.save()
+}
+
+// friendlyName is the custom label of a device, else its discovered hostname
+func (d *DeviceStats) friendlyName() string {
+	if d.Label != "" {
+		return d.Label
+	}
+	return d.Hostname
+}
+
+// REST API: Set the custom name of a device ({"name": ""} removes it)
+func (bm *BandwidthMonitor) handlePutDeviceName(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if len(name) > maxLabelLength {
+		http.Error(w, "name must be at most 64 characters", http.StatusBadRequest)
+		return
+	}
+	device := mux.Vars(r)["mac"]
+	bm.labels.set(device, name)
+
+	bm.mutex.Lock()
+	if dev, ok := bm.devices.get(device); ok {
+		dev.Label = name
+	}
+	bm.mutex.Unlock()
+	writeEncoded(w, r, DeviceLabel{Device: device, Name: name})
+}
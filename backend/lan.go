@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// lanNetworks tells local traffic from internet traffic for the lanBytes and
+// wanBytes counters. A packet is local when both ends are in a LAN subnet,
+// or are link-local, multicast or broadcast addresses that never leave the
+// segment. Frames without IP addresses (ARP and other link-layer traffic)
+// are local too.
+type lanNetworks struct {
+	prefixes []netip.Prefix // none: the private address ranges
+}
+
+// parseLANSubnets parses -lan-subnets CIDRs
+func parseLANSubnets(list []string) (*lanNetworks, error) {
+	n := &lanNetworks{}
+	for _, s := range list {
+		p, err := netip.ParsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: want CIDR notation, e.g. 192.168.1.0/24", s)
+		}
+		n.prefixes = append(n.prefixes, p.Masked())
+	}
+	return n, nil
+}
+
+// detectLANSubnets returns the networks of the named capture interfaces
+func detectLANSubnets(names []string, devices []pcap.Interface) *lanNetworks {
+	n := &lanNetworks{}
+	for _, dev := range devices {
+		if !containsString(names, dev.Name) {
+			continue
+		}
+		for _, addr := range dev.Addresses {
+			ip, ok := netip.AddrFromSlice(addr.IP)
+			if !ok || addr.Netmask == nil {
+				continue
+			}
+			ip = ip.Unmap()
+			mask := addr.Netmask
+			if ip.Is4() && len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			ones, bits := mask.Size()
+			if bits == 0 || ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+				continue // non-canonical mask, or always local anyway
+			}
+			p := netip.PrefixFrom(ip, ones).Masked()
+			if !containsPrefix(n.prefixes, p) {
+				n.prefixes = append(n.prefixes, p)
+			}
+		}
+	}
+	return n
+}
+
+// containsPrefix reports whether list contains p
+func containsPrefix(list []netip.Prefix, p netip.Prefix) bool {
+	for _, q := range list {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the subnets for the startup log
+func (n *lanNetworks) String() string {
+	if n == nil || len(n.prefixes) == 0 {
+		return "private address ranges"
+	}
+	s := make([]string, len(n.prefixes))
+	for i, p := range n.prefixes {
+		s[i] = p.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// isLocal reports whether ip is on the LAN; an empty address (no IP layer)
+// is. A nil lanNetworks uses the private address ranges.
+func (n *lanNetworks) isLocal(ip string) bool {
+	if ip == "" {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true
+	}
+	addr = addr.Unmap()
+	if addr.IsLinkLocalUnicast() || addr.IsMulticast() || addr.IsLoopback() || addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return true
+	}
+	if n == nil || len(n.prefixes) == 0 {
+		return addr.IsPrivate()
+	}
+	for _, p := range n.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalTraffic reports whether a packet between srcIP and dstIP stays on
+// the LAN
+func (n *lanNetworks) isLocalTraffic(srcIP, dstIP string) bool {
+	return n.isLocal(srcIP) && n.isLocal(dstIP)
+}
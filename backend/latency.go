@@ -0,0 +1,282 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Passive latency measurement limits
+const (
+	// handshakeTimeout is how long a SYN waits for the rest of its handshake
+	handshakeTimeout = 10 * time.Second
+	// maxPendingHandshakes caps the handshakes in progress being timed
+	maxPendingHandshakes = 65536
+	// Latency histograms have logarithmic bins from latencyMinMs growing by
+	// latencyBinGrowth, so percentiles are within 10% of the true value
+	latencyMinMs     = 0.1
+	latencyBinGrowth = 1.1
+	latencyBins      = 150 // up to about 160s
+)
+
+// latencyHistogram counts RTT samples in logarithmic bins
+type latencyHistogram struct {
+	bins  [latencyBins]uint32
+	count uint64
+}
+
+// add counts one sample
+func (h *latencyHistogram) add(rtt time.Duration) {
+	ms := float64(rtt) / float64(time.Millisecond)
+	i := 0
+	if ms > latencyMinMs {
+		i = min(int(math.Log(ms/latencyMinMs)/math.Log(latencyBinGrowth))+1, latencyBins-1)
+	}
+	h.bins[i]++
+	h.count++
+}
+
+// merge adds the samples of o
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	for i, n := range o.bins {
+		h.bins[i] += n
+	}
+	h.count += o.count
+}
+
+// percentile returns the upper bound in milliseconds of the bin holding
+// the p-th percentile (0 < p <= 1); 0 without samples
+func (h *latencyHistogram) percentile(p float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(h.count)))
+	var seen uint64
+	for i, n := range h.bins {
+		if seen += uint64(n); seen >= rank {
+			return math.Round(latencyMinMs*math.Pow(latencyBinGrowth, float64(i))*100) / 100
+		}
+	}
+	return 0
+}
+
+// latencyStep is the samples of one historyStep, network-wide and per subnet
+type latencyStep struct {
+	start   time.Time
+	all     latencyHistogram
+	subnets map[string]*latencyHistogram
+}
+
+// handshake is a TCP connection being set up, timed from its SYN
+type handshake struct {
+	syn, synAck time.Time
+}
+
+// latencyTracker estimates round-trip times from TCP handshakes: SYN to
+// SYN-ACK is the RTT between the capture point and the server, SYN-ACK to
+// ACK the RTT to the client, so the whole handshake is the RTT the client
+// sees. Samples are kept per historyStep like the device history.
+type latencyTracker struct {
+	mu      sync.Mutex
+	pending map[flowKey]*handshake // by the client-to-server direction
+	steps   []*latencyStep         // oldest first; the last is in progress
+}
+
+// newLatencyTracker creates an empty tracker
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{pending: make(map[flowKey]*handshake)}
+}
+
+// latencySubnet is the subnet a client address is reported under: its /24,
+// or /64 for IPv6
+func latencySubnet(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// observe times the handshake a TCP packet belongs to
+func (t *latencyTracker) observe(pi *packetInfo, now time.Time) {
+	if pi.transport != "tcp" || pi.srcIP == "" || pi.dstIP == "" {
+		return
+	}
+	key := flowKey{pi.srcIP, pi.dstIP, pi.srcPort, pi.dstPort, pi.transport}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case pi.tcpSYN:
+		if len(t.pending) < maxPendingHandshakes {
+			t.pending[key] = &handshake{syn: now}
+		}
+	case pi.tcpSYNACK:
+		reverse := flowKey{pi.dstIP, pi.srcIP, pi.dstPort, pi.srcPort, pi.transport}
+		if h, ok := t.pending[reverse]; ok && h.synAck.IsZero() {
+			h.synAck = now
+		}
+	case pi.tcpACK:
+		h, ok := t.pending[key]
+		if !ok || h.synAck.IsZero() {
+			return
+		}
+		delete(t.pending, key)
+		if rtt := now.Sub(h.syn); rtt > 0 && rtt <= handshakeTimeout {
+			t.record(latencySubnet(pi.srcIP), rtt, now)
+		}
+	}
+}
+
+// record adds a sample to the step in progress; caller holds t.mu
+func (t *latencyTracker) record(subnet string, rtt time.Duration, now time.Time) {
+	step := t.step(now)
+	step.all.add(rtt)
+	if subnet == "" {
+		return
+	}
+	h, ok := step.subnets[subnet]
+	if !ok {
+		h = &latencyHistogram{}
+		step.subnets[subnet] = h
+	}
+	h.add(rtt)
+}
+
+// step returns the step holding now, starting a new one when it is due;
+// caller holds t.mu
+func (t *latencyTracker) step(now time.Time) *latencyStep {
+	start := now.Truncate(historyStep)
+	if n := len(t.steps); n > 0 && !t.steps[n-1].start.Before(start) {
+		return t.steps[n-1]
+	}
+	step := &latencyStep{start: start, subnets: make(map[string]*latencyHistogram)}
+	t.steps = append(t.steps, step)
+	if keep := int(historyRetention / historyStep); len(t.steps) > keep {
+		t.steps = t.steps[len(t.steps)-keep:]
+	}
+	// Handshakes that never completed are dropped once per step
+	for key, h := range t.pending {
+		if now.Sub(h.syn) > handshakeTimeout {
+			delete(t.pending, key)
+		}
+	}
+	return step
+}
+
+// LatencySeries is the handshake RTT percentiles of the network or one
+// subnet, per step and over the whole query
+type LatencySeries struct {
+	Subnet  string    `json:"subnet,omitempty"`
+	Samples uint64    `json:"samples"`
+	P50     float64   `json:"p50"` // milliseconds, over the query
+	P90     float64   `json:"p90"`
+	P99     float64   `json:"p99"`
+	Steps   []uint64  `json:"steps"` // samples per step, aligned with LatencyHistory.Times
+	P50s    []float64 `json:"p50s"`  // per step; 0 without samples
+	P90s    []float64 `json:"p90s"`
+	P99s    []float64 `json:"p99s"`
+}
+
+// LatencyHistory is passive RTT percentiles over time
+type LatencyHistory struct {
+	Step    int             `json:"step"` // seconds
+	Times   []time.Time     `json:"times"`
+	Total   LatencySeries   `json:"total"`
+	Subnets []LatencySeries `json:"subnets"` // most samples first
+}
+
+// latencySeriesBuilder accumulates a LatencySeries step by step
+type latencySeriesBuilder struct {
+	series LatencySeries
+	total  latencyHistogram
+}
+
+// add appends one step's histogram, nil for a step without samples
+func (b *latencySeriesBuilder) add(h *latencyHistogram) {
+	if h == nil {
+		h = &latencyHistogram{}
+	}
+	b.total.merge(h)
+	b.series.Steps = append(b.series.Steps, h.count)
+	b.series.P50s = append(b.series.P50s, h.percentile(0.5))
+	b.series.P90s = append(b.series.P90s, h.percentile(0.9))
+	b.series.P99s = append(b.series.P99s, h.percentile(0.99))
+}
+
+// finish sets the totals over all steps
+func (b *latencySeriesBuilder) finish() LatencySeries {
+	b.series.Samples = b.total.count
+	b.series.P50 = b.total.percentile(0.5)
+	b.series.P90 = b.total.percentile(0.9)
+	b.series.P99 = b.total.percentile(0.99)
+	return b.series
+}
+
+// history returns the percentiles of the steps since since
+func (t *latencyTracker) history(since time.Time) LatencyHistory {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	since = since.Truncate(historyStep)
+	result := LatencyHistory{Step: int(historyStep / time.Second), Times: make([]time.Time, 0), Subnets: make([]LatencySeries, 0)}
+	var steps []*latencyStep
+	for _, s := range t.steps {
+		if !s.start.Before(since) {
+			steps = append(steps, s)
+		}
+	}
+	total := &latencySeriesBuilder{}
+	subnets := make(map[string]*latencySeriesBuilder)
+	for _, s := range steps {
+		for subnet := range s.subnets {
+			if _, ok := subnets[subnet]; !ok {
+				subnets[subnet] = &latencySeriesBuilder{series: LatencySeries{Subnet: subnet}}
+			}
+		}
+	}
+	for _, s := range steps {
+		result.Times = append(result.Times, s.start)
+		total.add(&s.all)
+		for subnet, b := range subnets {
+			b.add(s.subnets[subnet])
+		}
+	}
+	result.Total = total.finish()
+	for _, b := range subnets {
+		result.Subnets = append(result.Subnets, b.finish())
+	}
+	sort.Slice(result.Subnets, func(i, j int) bool {
+		a, b := result.Subnets[i], result.Subnets[j]
+		if a.Samples != b.Samples {
+			return a.Samples > b.Samples
+		}
+		return a.Subnet < b.Subnet
+	})
+	return result
+}
+
+// ObserveLatency times TCP handshakes for the latency history
+func (bm *BandwidthMonitor) ObserveLatency(pi *packetInfo) {
+	bm.latency.observe(pi, time.Now())
+}
+
+// REST API: Network-wide and per-subnet TCP handshake RTT percentiles per
+// history step over the last ?window= (default and at most the history
+// retention)
+func (bm *BandwidthMonitor) handleGetLatencyHistory(w http.ResponseWriter, r *http.Request) {
+	window := historyRetention
+	if s := r.URL.Query().Get("window"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid window parameter", http.StatusBadRequest)
+			return
+		}
+		window = min(d, historyRetention)
+	}
+	writeEncoded(w, r, bm.latency.history(time.Now().Add(-window)))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Leaderboard periods, calendar-aligned in local time
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week" // starting Monday
+	PeriodMonth = "month"
+)
+
+// LeaderboardEntry is a device's rank by total traffic in a period
+type LeaderboardEntry struct {
+	Rank         int    `json:"rank"`
+	PreviousRank int    `json:"previousRank,omitempty"` // 0 when absent from the previous period
+	RankChange   int    `json:"rankChange"`             // places gained since the previous period
+	New          bool   `json:"new,omitempty"`
+	Device       string `json:"device"`
+	Name         string `json:"name,omitempty"`
+	BytesSent    uint64 `json:"bytesSent"`
+	BytesRecv    uint64 `json:"bytesRecv"`
+	TotalBytes   uint64 `json:"totalBytes"`
+}
+
+// Leaderboard ranks devices by traffic in the current period so far
+type Leaderboard struct {
+	Period        string             `json:"period"`
+	Start         time.Time          `json:"start"`
+	End           time.Time          `json:"end"`
+	PreviousStart time.Time          `json:"previousStart"`
+	Entries       []LeaderboardEntry `json:"entries"`
+}
+
+// periodStart returns the start of the period containing t and of the one before
+func periodStart(period string, t time.Time) (start, previous time.Time, err error) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case PeriodDay:
+		return day, day.AddDate(0, 0, -1), nil
+	case PeriodWeek:
+		start = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, -7), nil
+	case PeriodMonth:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, -1, 0), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("unknown period %q (want day, week or month)", period)
+}
+
+// rankDevices orders devices by total traffic, busiest first
+func rankDevices(totals map[string]traffic) []string {
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := totals[keys[i]], totals[keys[j]]
+		if ti.sent+ti.recv != tj.sent+tj.recv {
+			return ti.sent+ti.recv > tj.sent+tj.recv
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// buildLeaderboard ranks the n busiest devices of the period containing now
+// from the -history-db, with their rank in the previous period
+func (bm *BandwidthMonitor) buildLeaderboard(period string, n int, now time.Time) (*Leaderboard, error) {
+	start, prevStart, err := periodStart(period, now)
+	if err != nil {
+		return nil, err
+	}
+	current, err := bm.series.totals(start, now)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := bm.series.totals(prevStart, start)
+	if err != nil {
+		return nil, err
+	}
+	prevRank := make(map[string]int, len(previous))
+	for i, k := range rankDevices(previous) {
+		prevRank[k] = i + 1
+	}
+
+	ranked := rankDevices(current)
+	if n > 0 && len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	lb := &Leaderboard{Period: period, Start: start, End: now, PreviousStart: prevStart, Entries: make([]LeaderboardEntry, 0, len(ranked))}
+	bm.mutex.RLock()
+	for i, k := range ranked {
+		t := current[k]
+		e := LeaderboardEntry{Rank: i + 1, Device: k, BytesSent: t.sent, BytesRecv: t.recv, TotalBytes: t.sent + t.recv}
+		if p, ok := prevRank[k]; ok {
+			e.PreviousRank = p
+			e.RankChange = p - e.Rank
+		} else {
+			e.New = true
+		}
+		if dev, ok := bm.devices.load(k, time.Now()); ok {
+			e.Name = dev.friendlyName()
+		} else {
+			e.Name = bm.labels.get(k)
+		}
+		lb.Entries = append(lb.Entries, e)
+	}
+	bm.mutex.RUnlock()
+	return lb, nil
+}
+
+// REST API: Devices ranked by traffic this ?period= (day, week or month; default month), top ?n= (default 10)
+func (bm *BandwidthMonitor) handleGetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if bm.series == nil {
+		http.Error(w, "Traffic history not configured (-history-db)", http.StatusNotFound)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = PeriodMonth
+	}
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, _, err := periodStart(period, time.Now()); err != nil {
+		http.Error(w, "Invalid period parameter", http.StatusBadRequest)
+		return
+	}
+	lb, err := bm.buildLeaderboard(period, n, time.Now())
+	if err != nil {
+		log.Printf("Error building leaderboard: %v", err)
+		http.Error(w, "Error reading traffic history", http.StatusInternalServerError)
+		return
+	}
+	writeEncoded(w, r, lb)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/gorilla/mux"
+)
+
+// Logical device limits
+const (
+	maxLogicalDevices  = 1024
+	maxLogicalMembers  = 64
+	maxDHCPIdentities  = 4096
+	maxLogicalIDLength = 64
+)
+
+// Grouping suggestion reasons
+const (
+	SuggestHostname = "hostname"  // members announce the same host name
+	SuggestDHCPDUID = "dhcp-duid" // members send the same DHCP client DUID
+)
+
+// LogicalDevice groups the identities (device keys: MACs, or IPs of
+// MAC-less devices) of one physical device, e.g. a laptop's ethernet and
+// WiFi MACs or a phone's randomized MACs. Unlike a merge the members keep
+// their own counters; stats are rolled up when read.
+type LogicalDevice struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// LogicalDeviceStats is a logical device with the summed traffic of its members
+type LogicalDeviceStats struct {
+	LogicalDevice
+	Active      int           `json:"active"` // members currently tracked
+	BytesSent   uint64        `json:"bytesSent"`
+	BytesRecv   uint64        `json:"bytesRecv"`
+	PacketsSent uint64        `json:"packetsSent"`
+	PacketsRecv uint64        `json:"packetsRecv"`
+	LANBytes    uint64        `json:"lanBytes"`
+	WANBytes    uint64        `json:"wanBytes"`
+	RateSentBps float64       `json:"rateSentBps"`
+	RateRecvBps float64       `json:"rateRecvBps"`
+	FirstSeen   time.Time     `json:"firstSeen,omitempty"`
+	LastSeen    time.Time     `json:"lastSeen,omitempty"`
+	Devices     []DeviceStats `json:"devices,omitempty"` // only for a single logical device
+}
+
+// LogicalSuggestion proposes grouping devices that share an identity
+type LogicalSuggestion struct {
+	Reason  string   `json:"reason"`
+	Value   string   `json:"value"` // the shared host name or DUID
+	Name    string   `json:"name"`  // proposed logical device name
+	Members []string `json:"members"`
+}
+
+// dhcpIdentity is what a device calls itself in DHCP requests: its host
+// name (option 12) and, when the client identifier (option 61) is an
+// RFC 4361 IAID+DUID, the DUID, which stays the same on every interface
+type dhcpIdentity struct {
+	Hostname string
+	DUID     string
+}
+
+// logicalStore keeps the logical devices and the DHCP identities of devices
+type logicalStore struct {
+	mu         sync.RWMutex
+	devices    map[string]LogicalDevice
+	identities map[string]dhcpIdentity // by MAC
+	doc        document                // optional place the logical devices are persisted to
+}
+
+// newLogicalStore creates a store, loading logical devices from doc when set
+func newLogicalStore(doc document) *logicalStore {
+	ls := &logicalStore{devices: make(map[string]LogicalDevice), identities: make(map[string]dhcpIdentity), doc: doc}
+	if doc == nil {
+		return ls
+	}
+	var devices []LogicalDevice
+	if err := doc.load(&devices); err != nil {
+		log.Printf("Error reading logical devices from %s: %v", doc, err)
+		return ls
+	}
+	for _, d := range devices {
+		ls.devices[d.ID] = d
+	}
+	return ls
+}
+
+// save writes the logical devices back to their document; caller holds ls.mu
+func (ls *logicalStore) save() {
+	if ls.doc == nil {
+		return
+	}
+	if err := ls.doc.save(ls.sorted()); err != nil {
+		log.Printf("Error writing logical devices to %s: %v", ls.doc, err)
+	}
+}
+
+// sorted returns the logical devices ordered by ID; caller holds ls.mu
+func (ls *logicalStore) sorted() []LogicalDevice {
+	list := make([]LogicalDevice, 0, len(ls.devices))
+	for _, d := range ls.devices {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// list returns every logical device
+func (ls *logicalStore) list() []LogicalDevice {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.sorted()
+}
+
+// get returns one logical device
+func (ls *logicalStore) get(id string) (LogicalDevice, bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	d, ok := ls.devices[id]
+	return d, ok
+}
+
+// put adds or replaces a logical device. It returns the HTTP status and
+// message to report when the device cannot be stored: a member already in
+// another logical device, or too many logical devices.
+func (ls *logicalStore) put(d LogicalDevice) (int, string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.devices[d.ID]; !ok && len(ls.devices) >= maxLogicalDevices {
+		return http.StatusConflict, "Too many logical devices"
+	}
+	for _, other := range ls.devices {
+		if other.ID == d.ID {
+			continue
+		}
+		for _, m := range d.Members {
+			if containsString(other.Members, m) {
+				return http.StatusConflict, m + " already belongs to logical device " + other.ID
+			}
+		}
+	}
+	ls.devices[d.ID] = d
+	ls.save()
+	return http.StatusOK, ""
+}
+
+// remove deletes a logical device; it reports whether it existed
+func (ls *logicalStore) remove(id string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.devices[id]; !ok {
+		return false
+	}
+	delete(ls.devices, id)
+	ls.save()
+	return true
+}
+
+// grouped returns the members of every logical device
+func (ls *logicalStore) grouped() map[string]bool {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	members := make(map[string]bool)
+	for _, d := range ls.devices {
+		for _, m := range d.Members {
+			members[m] = true
+		}
+	}
+	return members
+}
+
+// observe records the DHCP identity a device sent
+func (ls *logicalStore) observe(mac string, id dhcpIdentity) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.identities[mac]; !ok && len(ls.identities) >= maxDHCPIdentities {
+		return
+	}
+	ls.identities[mac] = id
+}
+
+// identity returns the DHCP identity recorded for mac
+func (ls *logicalStore) identity(mac string) dhcpIdentity {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	return ls.identities[mac]
+}
+
+// parseDHCPIdentity returns the client MAC and identity of a DHCP request
+// in a UDP payload
+func parseDHCPIdentity(payload []byte) (string, dhcpIdentity, bool) {
+	var msg layers.DHCPv4
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil || msg.Operation != layers.DHCPOpRequest || len(msg.ClientHWAddr) != 6 {
+		return "", dhcpIdentity{}, false
+	}
+	var id dhcpIdentity
+	for _, opt := range msg.Options {
+		switch opt.Type {
+		case layers.DHCPOptHostname:
+			id.Hostname = string(opt.Data)
+		case layers.DHCPOptClientID:
+			// Type 255, then a 4-byte IAID, then the DUID
+			if len(opt.Data) > 5 && opt.Data[0] == 255 {
+				id.DUID = hex.EncodeToString(opt.Data[5:])
+			}
+		}
+	}
+	if id == (dhcpIdentity{}) {
+		return "", dhcpIdentity{}, false
+	}
+	return msg.ClientHWAddr.String(), id, true
+}
+
+// hostIdentity normalizes a host name for comparison: lower case, without
+// domain (".local", ".lan", ...)
+func hostIdentity(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	if name == "localhost" {
+		return ""
+	}
+	return name
+}
+
+// logicalMembers returns copies of the tracked devices of d with their
+// rates as of now; members match a device by key, MAC or IP, and merged
+// members by the device they were merged into. Caller holds bm.mutex.
+func (bm *BandwidthMonitor) logicalMembers(d LogicalDevice, now time.Time) []DeviceStats {
+	want := make(map[string]bool, len(d.Members))
+	for _, m := range d.Members {
+		want[m] = true
+		want[bm.merges.resolve(m)] = true
+	}
+	var devices []DeviceStats
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		if want[key] || (dev.MAC != "" && want[dev.MAC]) || (dev.IP != "" && want[dev.IP]) {
+			devCopy := *dev
+			devCopy.fillWindow(now)
+			devices = append(devices, devCopy)
+		}
+	})
+	sort.Slice(devices, func(i, j int) bool { return devices[i].FirstSeen.Before(devices[j].FirstSeen) })
+	return devices
+}
+
+// logicalStats rolls the traffic of d's members up; withDevices also
+// returns copies of the members
+func (bm *BandwidthMonitor) logicalStats(d LogicalDevice, withDevices bool) LogicalDeviceStats {
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	now := time.Now()
+	stats := LogicalDeviceStats{LogicalDevice: d}
+	for _, devCopy := range bm.logicalMembers(d, now) {
+		dev := &devCopy
+		stats.Active++
+		stats.BytesSent += dev.BytesSent
+		stats.BytesRecv += dev.BytesRecv
+		stats.PacketsSent += dev.PacketsSent
+		stats.PacketsRecv += dev.PacketsRecv
+		stats.LANBytes += dev.LANBytes
+		stats.WANBytes += dev.WANBytes
+		stats.RateSentBps += devCopy.RateSentBps
+		stats.RateRecvBps += devCopy.RateRecvBps
+		if stats.FirstSeen.IsZero() || dev.FirstSeen.Before(stats.FirstSeen) {
+			stats.FirstSeen = dev.FirstSeen
+		}
+		if dev.LastSeen.After(stats.LastSeen) {
+			stats.LastSeen = dev.LastSeen
+		}
+		if withDevices {
+			stats.Devices = append(stats.Devices, devCopy)
+		}
+	}
+	return stats
+}
+
+// logicalSuggestions proposes logical devices for tracked devices that are
+// in none yet and share a host name or DHCP DUID
+func (bm *BandwidthMonitor) logicalSuggestions() []LogicalSuggestion {
+	grouped := bm.logical.grouped()
+	type group struct {
+		reason, value string
+	}
+	members := make(map[group][]string)
+	names := make(map[group]string)
+
+	bm.mutex.RLock()
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		if grouped[key] || (dev.MAC != "" && grouped[dev.MAC]) || !bm.includeDevice(dev) {
+			return
+		}
+		id := bm.logical.identity(dev.MAC)
+		hostname := dev.Hostname
+		if hostname == "" {
+			hostname = id.Hostname
+		}
+		name := dev.Label
+		if name == "" {
+			name = hostname
+		}
+		if h := hostIdentity(hostname); h != "" {
+			g := group{SuggestHostname, h}
+			members[g] = append(members[g], key)
+			if names[g] == "" {
+				names[g] = name
+			}
+		}
+		if id.DUID != "" {
+			g := group{SuggestDHCPDUID, id.DUID}
+			members[g] = append(members[g], key)
+			if names[g] == "" {
+				names[g] = name
+			}
+		}
+	})
+	bm.mutex.RUnlock()
+
+	suggestions := make([]LogicalSuggestion, 0)
+	for g, keys := range members {
+		if len(keys) < 2 {
+			continue
+		}
+		sort.Strings(keys)
+		if len(keys) > maxLogicalMembers {
+			keys = keys[:maxLogicalMembers]
+		}
+		suggestions = append(suggestions, LogicalSuggestion{Reason: g.reason, Value: g.value, Name: names[g], Members: keys})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Reason != suggestions[j].Reason {
+			return suggestions[i].Reason < suggestions[j].Reason
+		}
+		return suggestions[i].Value < suggestions[j].Value
+	})
+	return suggestions
+}
+
+// REST API: List logical devices with their rolled-up stats
+func (bm *BandwidthMonitor) handleGetLogicalDevices(w http.ResponseWriter, r *http.Request) {
+	devices := bm.logical.list()
+	result := make([]LogicalDeviceStats, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, bm.logicalStats(d, false))
+	}
+	writeEncoded(w, r, result)
+}
+
+// REST API: Get one logical device with its rolled-up stats and members
+func (bm *BandwidthMonitor) handleGetLogicalDevice(w http.ResponseWriter, r *http.Request) {
+	d, ok := bm.logical.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "Logical device not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, bm.logicalStats(d, true))
+}
+
+// REST API: Create or replace a logical device, e.g.
+// {"name": "Laptop", "members": ["<ethernet mac>", "<wifi mac>"]}
+func (bm *BandwidthMonitor) handlePutLogicalDevice(w http.ResponseWriter, r *http.Request) {
+	var d LogicalDevice
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	d.ID = mux.Vars(r)["id"]
+	d.Name = strings.TrimSpace(d.Name)
+	if len(d.ID) > maxLogicalIDLength || len(d.Name) > maxLabelLength {
+		http.Error(w, "id and name must be at most 64 characters", http.StatusBadRequest)
+		return
+	}
+	var members []string
+	for _, m := range d.Members {
+		if m = strings.ToLower(strings.TrimSpace(m)); m != "" && !containsString(members, m) {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 || len(members) > maxLogicalMembers {
+		http.Error(w, "members must list 1 to 64 devices", http.StatusBadRequest)
+		return
+	}
+	d.Members = members
+	if d.Name == "" {
+		d.Name = d.ID
+	}
+	if status, msg := bm.logical.put(d); status != http.StatusOK {
+		http.Error(w, msg, status)
+		return
+	}
+	writeEncoded(w, r, bm.logicalStats(d, false))
+}
+
+// REST API: Delete a logical device; its members are left as they are
+func (bm *BandwidthMonitor) handleDeleteLogicalDevice(w http.ResponseWriter, r *http.Request) {
+	if !bm.logical.remove(mux.Vars(r)["id"]) {
+		http.Error(w, "Logical device not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
+
+// REST API: Suggest logical devices from shared host names and DHCP DUIDs
+func (bm *BandwidthMonitor) handleGetLogicalSuggestions(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.logicalSuggestions())
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeviceMerge records that a device key is counted as another device, e.g.
+// the WiFi MAC of a laptop merged into its ethernet MAC
+type DeviceMerge struct {
+	Device string `json:"device"` // merged device key
+	Into   string `json:"into"`   // device key it is counted as
+}
+
+// mergeStore maps merged device keys to the device they were merged into
+type mergeStore struct {
+	mu      sync.RWMutex
+	aliases map[string]string
+	doc     document // optional place the merges are persisted to
+}
+
+// newMergeStore creates a store, loading merges from doc when set
+func newMergeStore(doc document) *mergeStore {
+	ms := &mergeStore{aliases: make(map[string]string), doc: doc}
+	if doc == nil {
+		return ms
+	}
+	var merges []DeviceMerge
+	if err := doc.load(&merges); err != nil {
+		log.Printf("Error reading device merges from %s: %v", doc, err)
+		return ms
+	}
+	for _, m := range merges {
+		ms.aliases[m.Device] = m.Into
+	}
+	return ms
+}
+
+// save writes the merges back to their document; caller holds ms.mu
+func (ms *mergeStore) save() {
+	if ms.doc == nil {
+		return
+	}
+	if err := ms.doc.save(ms.listLocked()); err != nil {
+		log.Printf("Error writing device merges to %s: %v", ms.doc, err)
+	}
+}
+
+// listLocked returns the merges sorted by device; caller holds ms.mu
+func (ms *mergeStore) listLocked() []DeviceMerge {
+	list := make([]DeviceMerge, 0, len(ms.aliases))
+	for device, into := range ms.aliases {
+		list = append(list, DeviceMerge{Device: device, Into: into})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+// list returns every merge
+func (ms *mergeStore) list() []DeviceMerge {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.listLocked()
+}
+
+// resolve returns the key device is counted under
+func (ms *mergeStore) resolve(device string) string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if into, ok := ms.aliases[device]; ok {
+		return into
+	}
+	return device
+}
+
+// add counts from as into, along with the devices merged into from before
+func (ms *mergeStore) add(from, into string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for device, target := range ms.aliases {
+		if target == from {
+			ms.aliases[device] = into
+		}
+	}
+	delete(ms.aliases, into)
+	ms.aliases[from] = into
+	ms.save()
+}
+
+// remove stops counting device as another; it reports whether it was merged
+func (ms *mergeStore) remove(device string) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.aliases[device]; !ok {
+		return false
+	}
+	delete(ms.aliases, device)
+	ms.save()
+	return true
+}
+
+// merge adds the counters and identities of o to d
+func (d *DeviceStats) merge(o *DeviceStats) {
+	d.BytesSent += o.BytesSent
+	d.BytesRecv += o.BytesRecv
+	d.PacketsSent += o.PacketsSent
+	d.PacketsRecv += o.PacketsRecv
+	d.DNSAllowed += o.DNSAllowed
+	d.DNSBlocked += o.DNSBlocked
+	d.LANBytes += o.LANBytes
+	d.WANBytes += o.WANBytes
+	for _, pair := range [][2]*ProtocolCounter{
+		{&d.Protocols.TCP, &o.Protocols.TCP}, {&d.Protocols.UDP, &o.Protocols.UDP},
+		{&d.Protocols.ICMP, &o.Protocols.ICMP}, {&d.Protocols.ARP, &o.Protocols.ARP},
+		{&d.Protocols.Other, &o.Protocols.Other},
+	} {
+		pair[0].Bytes += pair[1].Bytes
+		pair[0].Packets += pair[1].Packets
+	}
+	if d.rate == nil {
+		d.rate = &rateCounter{}
+	}
+	d.rate.merge(o.rate)
+	if o.FirstSeen.Before(d.FirstSeen) {
+		d.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen.After(d.LastSeen) {
+		d.LastSeen = o.LastSeen
+	}
+	for _, ip := range o.IPs {
+		if len(d.IPs) < maxIPsPerDevice && !containsString(d.IPs, ip) {
+			d.IPs = append(d.IPs, ip)
+		}
+	}
+	for _, iface := range o.Interfaces {
+		if !containsString(d.Interfaces, iface) {
+			d.Interfaces = append(d.Interfaces, iface)
+		}
+	}
+	if d.IP == "" {
+		d.IP = o.IP
+	}
+	if d.Hostname == "" {
+		d.Hostname = o.Hostname
+	}
+	if d.Classification == nil {
+		d.Classification = o.Classification
+	}
+}
+
+// MergeDevices folds device from into device into and names it: counters
+// and history are summed and from's traffic is counted as into's from now
+// on. Per-device detail such as destinations and ports starts over under
+// into. It returns a copy of the merged device, or false when either device
+// is unknown.
+func (bm *BandwidthMonitor) MergeDevices(from, into, name string) (DeviceStats, bool) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	src, ok := bm.devices.get(from)
+	dst, ok2 := bm.devices.get(into)
+	if !ok || !ok2 {
+		return DeviceStats{}, false
+	}
+	dst.merge(src)
+	bm.devices.remove(from)
+	bm.merges.add(from, into)
+	bm.history.merge(from, into)
+	if bm.series != nil {
+		if err := bm.series.merge(from, into); err != nil {
+			log.Printf("Error merging traffic history of %s into %s: %v", from, into, err)
+		}
+	}
+	bm.forgetDevice(from)
+	bm.labels.set(from, "")
+	bm.labels.set(into, name)
+	dst.Label = name
+
+	merged := *dst
+	merged.fillWindow(time.Now())
+	return merged, true
+}
+
+// REST API: Merge two devices into one, e.g.
+// {"from": "<wifi mac>", "into": "<ethernet mac>", "name": "Laptop"}. The
+// name becomes the merged device's label; without one it keeps its own
+// label, or takes the other device's.
+func (bm *BandwidthMonitor) handleMergeDevices(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		From string `json:"from"`
+		Into string `json:"into"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if body.From == "" || body.Into == "" || body.From == body.Into {
+		http.Error(w, "from and into must name two different devices", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(body.Name)
+	if len(name) > maxLabelLength {
+		http.Error(w, "name must be at most 64 characters", http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		if name = bm.labels.get(body.Into); name == "" {
+			name = bm.labels.get(body.From)
+		}
+	}
+
+	merged, ok := bm.MergeDevices(body.From, body.Into, name)
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Merged device %s into %s", body.From, body.Into)
+	writeEncoded(w, r, merged)
+}
+
+// REST API: List merged devices
+func (bm *BandwidthMonitor) handleGetMerges(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.merges.list())
+}
+
+// REST API: Undo a merge for traffic from now on; counters already summed
+// stay with the device it was merged into
+func (bm *BandwidthMonitor) handleDeleteMerge(w http.ResponseWriter, r *http.Request) {
+	if !bm.merges.remove(mux.Vars(r)["mac"]) {
+		http.Error(w, "Merge not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes every exported metric
+const metricsNamespace = "lantt"
+
+// Per-device metrics carry these labels; hostname is the custom label or
+// the discovered name
+var deviceMetricLabels = []string{"mac", "ip", "hostname"}
+
+// metricsCollector exports the monitor's counters to Prometheus, read from
+// the live state on every scrape
+type metricsCollector struct {
+	bm *BandwidthMonitor
+
+	deviceBytesSent     *prometheus.Desc
+	deviceBytesRecv     *prometheus.Desc
+	devicePacketsSent   *prometheus.Desc
+	devicePacketsRecv   *prometheus.Desc
+	bytesSent           *prometheus.Desc
+	bytesRecv           *prometheus.Desc
+	packets             *prometheus.Desc
+	activeDevices       *prometheus.Desc
+	unattributedBytes   *prometheus.Desc
+	unattributedPackets *prometheus.Desc
+	pcapReceived        *prometheus.Desc
+	pcapDropped         *prometheus.Desc
+	pcapIfDropped       *prometheus.Desc
+}
+
+// newMetricsCollector describes the exported metrics
+func newMetricsCollector(bm *BandwidthMonitor) *metricsCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, labels, nil)
+	}
+	return &metricsCollector{
+		bm:                  bm,
+		deviceBytesSent:     desc("device_bytes_sent_total", "Bytes sent by a device.", deviceMetricLabels...),
+		deviceBytesRecv:     desc("device_bytes_received_total", "Bytes received by a device.", deviceMetricLabels...),
+		devicePacketsSent:   desc("device_packets_sent_total", "Packets sent by a device.", deviceMetricLabels...),
+		devicePacketsRecv:   desc("device_packets_received_total", "Packets received by a device.", deviceMetricLabels...),
+		bytesSent:           desc("bytes_sent_total", "Bytes sent by all listed devices."),
+		bytesRecv:           desc("bytes_received_total", "Bytes received by all listed devices."),
+		packets:             desc("packets_total", "Packets sent and received by all listed devices."),
+		activeDevices:       desc("active_devices", "Devices currently listed."),
+		unattributedBytes:   desc("unattributed_bytes_total", "Bytes of packets without any usable address."),
+		unattributedPackets: desc("unattributed_packets_total", "Packets without any usable address."),
+		pcapReceived:        desc("pcap_packets_received_total", "Packets received by the capture handle since it was opened.", "interface"),
+		pcapDropped:         desc("pcap_packets_dropped_total", "Packets dropped for lack of buffer space since the capture handle was opened.", "interface"),
+		pcapIfDropped:       desc("pcap_interface_packets_dropped_total", "Packets dropped by the interface or driver since the capture handle was opened.", "interface"),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		c.deviceBytesSent, c.deviceBytesRecv, c.devicePacketsSent, c.devicePacketsRecv,
+		c.bytesSent, c.bytesRecv, c.packets, c.activeDevices,
+		c.unattributedBytes, c.unattributedPackets,
+		c.pcapReceived, c.pcapDropped, c.pcapIfDropped,
+	} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+
+	stats := c.bm.GetNetworkStats()
+	for _, dev := range stats.Devices {
+		labels := []string{dev.MAC, dev.IP, dev.friendlyName()}
+		counter(c.deviceBytesSent, dev.BytesSent, labels...)
+		counter(c.deviceBytesRecv, dev.BytesRecv, labels...)
+		counter(c.devicePacketsSent, dev.PacketsSent, labels...)
+		counter(c.devicePacketsRecv, dev.PacketsRecv, labels...)
+	}
+	counter(c.bytesSent, stats.TotalSent)
+	counter(c.bytesRecv, stats.TotalRecv)
+	counter(c.packets, stats.TotalPackets)
+	ch <- prometheus.MustNewConstMetric(c.activeDevices, prometheus.GaugeValue, float64(stats.ActiveDevices))
+	counter(c.unattributedBytes, stats.UnattributedBytes)
+	counter(c.unattributedPackets, stats.UnattributedPackets)
+
+	for _, cc := range c.bm.captureCounters() {
+		counter(c.pcapReceived, cc.Received, cc.Interface)
+		counter(c.pcapDropped, cc.Dropped, cc.Interface)
+		counter(c.pcapIfDropped, cc.IfDropped, cc.Interface)
+	}
+}
+
+// metricsHandler serves the monitor's metrics, plus Go runtime and process
+// metrics, in the Prometheus exposition format
+func (bm *BandwidthMonitor) metricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		newMetricsCollector(bm),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Name-service ports watched for device names
+const (
+	portNetBIOSNS = 137
+	portMDNS      = 5353
+	portLLMNR     = 5355
+)
+
+// Name sources
+const (
+	NameSourceMDNS    = "mdns"
+	NameSourceLLMNR   = "llmnr"
+	NameSourceNetBIOS = "netbios"
+	// Names the LAN's Pi-hole/AdGuard knows its clients by (-dns-filter);
+	// they are set by an administrator or DHCP and win over announced names
+	NameSourceDNSFilter = "dns-filter"
+)
+
+// Name discovery limits
+const (
+	// maxDiscoveredNames caps the addresses names are remembered for
+	maxDiscoveredNames = 4096
+	// nameProbeInterval is how often unnamed devices are probed (-name-probe)
+	nameProbeInterval = 5 * time.Minute
+	// nameProbeRetry is how long an address is left alone after a probe
+	nameProbeRetry = time.Hour
+	// nameProbeSpacing and nameProbeTimeout pace and bound single probes
+	nameProbeSpacing = 200 * time.Millisecond
+	nameProbeTimeout = time.Second
+)
+
+// NetBIOS resource record types
+const (
+	nbnsTypeNB     = 0x20 // name to address
+	nbnsTypeNBSTAT = 0x21 // node status (names registered on a host)
+)
+
+// discoveredName is a name a device announced for one of its addresses
+type discoveredName struct {
+	name   string
+	source string
+	seen   time.Time
+}
+
+// nameDiscovery remembers device names learned from mDNS, LLMNR and NetBIOS
+// traffic, by IP address
+type nameDiscovery struct {
+	mu    sync.RWMutex
+	names map[string]discoveredName
+}
+
+// newNameDiscovery creates an empty name table
+func newNameDiscovery() *nameDiscovery {
+	return &nameDiscovery{names: make(map[string]discoveredName)}
+}
+
+// learn records name for ip and reports whether it changed
+func (nd *nameDiscovery) learn(ip, name, source string, now time.Time) bool {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	old, ok := nd.names[ip]
+	if !ok && len(nd.names) >= maxDiscoveredNames {
+		return false
+	}
+	if ok && old.source == NameSourceDNSFilter && source != NameSourceDNSFilter {
+		return false
+	}
+	nd.names[ip] = discoveredName{name: name, source: source, seen: now}
+	return !ok || old.name != name
+}
+
+// lookup returns the name learned for ip
+func (nd *nameDiscovery) lookup(ip string) (string, bool) {
+	nd.mu.RLock()
+	defer nd.mu.RUnlock()
+	n, ok := nd.names[ip]
+	return n.name, ok
+}
+
+// ObserveNames learns device names from name-service packets and sets the
+// Hostname of the devices using the named addresses
+func (bm *BandwidthMonitor) ObserveNames(pi *packetInfo) {
+	payload := pi.payload
+	if pi.transport != "udp" || len(payload) == 0 {
+		return
+	}
+	var found map[string]string
+	var source string
+	switch {
+	case pi.srcPort == portMDNS || pi.dstPort == portMDNS:
+		found, source = dnsAddressNames(payload, ".local"), NameSourceMDNS
+	case pi.srcPort == portLLMNR:
+		found, source = dnsAddressNames(payload, ""), NameSourceLLMNR
+	case pi.srcPort == portNetBIOSNS || pi.dstPort == portNetBIOSNS:
+		found, source = netbiosNames(payload), NameSourceNetBIOS
+	}
+	now := time.Now()
+	for ip, name := range found {
+		if bm.names.learn(ip, name, source, now) {
+			bm.applyHostname(ip, name)
+		}
+	}
+}
+
+// applyHostname names every device using ip
+func (bm *BandwidthMonitor) applyHostname(ip, name string) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	bm.devices.all(func(_ string, dev *DeviceStats) {
+		if dev.IP == ip || containsString(dev.IPs, ip) {
+			dev.Hostname = name
+		}
+	})
+}
+
+// dnsAddressNames returns the address records of an mDNS or LLMNR response
+// as ip -> host name, with suffix (e.g. ".local") removed
+func dnsAddressNames(payload []byte, suffix string) map[string]string {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil || !msg.QR {
+		return nil
+	}
+	found := make(map[string]string)
+	records := append(msg.Answers, msg.Additionals...)
+	for _, rr := range records {
+		if rr.Type != layers.DNSTypeA && rr.Type != layers.DNSTypeAAAA || rr.IP == nil {
+			continue
+		}
+		name := strings.TrimSuffix(string(rr.Name), ".")
+		if suffix != "" {
+			if !strings.HasSuffix(strings.ToLower(name), suffix) {
+				continue
+			}
+			name = name[:len(name)-len(suffix)]
+		}
+		// Service instance names are not host names
+		if name == "" || strings.HasPrefix(name, "_") || strings.Contains(name, "._") {
+			continue
+		}
+		found[rr.IP.String()] = name
+	}
+	return found
+}
+
+// netbiosNames returns the unique workstation and server names registered
+// or answered in a NetBIOS name-service packet as ip -> name
+func netbiosNames(payload []byte) map[string]string {
+	var msg layers.DNS
+	if err := msg.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil {
+		return nil
+	}
+	found := make(map[string]string)
+	records := append(msg.Answers, msg.Additionals...)
+	for _, rr := range records {
+		if rr.Type != nbnsTypeNB {
+			continue
+		}
+		name, suffix, ok := decodeNetBIOSName(rr.Name)
+		if !ok || (suffix != 0x00 && suffix != 0x20) {
+			continue
+		}
+		// NB_FLAGS (2 bytes, high bit = group name) then an IPv4 address
+		for data := rr.Data; len(data) >= 6; data = data[6:] {
+			flags := binary.BigEndian.Uint16(data[:2])
+			ip := net.IP(data[2:6])
+			if flags&0x8000 == 0 && !ip.IsUnspecified() {
+				found[ip.String()] = name
+			}
+		}
+	}
+	return found
+}
+
+// decodeNetBIOSName undoes the first-level encoding of a NetBIOS name (32
+// letters, one per nibble), returning the trimmed name and its suffix byte
+func decodeNetBIOSName(label []byte) (string, byte, bool) {
+	if i := strings.IndexByte(string(label), '.'); i >= 0 {
+		label = label[:i] // drop the scope
+	}
+	if len(label) != 32 {
+		return "", 0, false
+	}
+	raw := make([]byte, 16)
+	for i := range raw {
+		hi, lo := label[2*i]-'A', label[2*i+1]-'A'
+		if hi > 15 || lo > 15 {
+			return "", 0, false
+		}
+		raw[i] = hi<<4 | lo
+	}
+	name := strings.TrimRight(string(raw[:15]), " \x00")
+	return name, raw[15], name != "" && name != "*"
+}
+
+// netbiosStatusQuery is a node status request for the wildcard name "*"
+var netbiosStatusQuery = func() []byte {
+	q := []byte{
+		0x00, 0x00, // ID, set per query
+		0x00, 0x00, // flags: query
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // one question
+		0x20, 'C', 'K',
+	}
+	for i := 0; i < 30; i++ {
+		q = append(q, 'A')
+	}
+	return append(q, 0x00, 0x00, nbnsTypeNBSTAT, 0x00, 0x01)
+}()
+
+// probeNetBIOSName asks ip for the names registered on it and returns its
+// unique workstation name
+func probeNetBIOSName(ip string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("udp4", net.JoinHostPort(ip, "137"), timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(netbiosStatusQuery); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return parseNetBIOSStatus(buf[:n])
+}
+
+// parseNetBIOSStatus extracts the unique workstation name from a node status
+// response. gopacket decodes type 0x21 as SRV, so the answer is parsed here.
+func parseNetBIOSStatus(resp []byte) (string, error) {
+	errMalformed := errors.New("malformed NetBIOS status response")
+	if len(resp) < 12 || binary.BigEndian.Uint16(resp[6:8]) == 0 {
+		return "", errMalformed
+	}
+	// Answer name: the 34-byte encoded name or a 2-byte compression pointer
+	off := 12
+	if off < len(resp) && resp[off]&0xc0 == 0xc0 {
+		off += 2
+	} else {
+		for off < len(resp) && resp[off] != 0 {
+			off += int(resp[off]) + 1
+		}
+		off++
+	}
+	// type, class, TTL, rdlength, then the name count
+	if off+11 > len(resp) || binary.BigEndian.Uint16(resp[off:off+2]) != nbnsTypeNBSTAT {
+		return "", errMalformed
+	}
+	off += 10
+	count := int(resp[off])
+	off++
+	for i := 0; i < count && off+18 <= len(resp); i, off = i+1, off+18 {
+		entry := resp[off : off+18]
+		flags := binary.BigEndian.Uint16(entry[16:18])
+		if entry[15] == 0x00 && flags&0x8000 == 0 {
+			if name := strings.TrimRight(string(entry[:15]), " \x00"); name != "" {
+				return name, nil
+			}
+		}
+	}
+	return "", errors.New("no workstation name in NetBIOS status response")
+}
+
+// probeNamesPeriodically sends NetBIOS node status queries to private IPv4
+// devices that have no name yet, until stop is closed
+func (bm *BandwidthMonitor) probeNamesPeriodically(stop <-chan struct{}) {
+	probed := make(map[string]time.Time)
+	ticker := time.NewTicker(nameProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		for ip, at := range probed {
+			if now.Sub(at) > nameProbeRetry {
+				delete(probed, ip)
+			}
+		}
+		bm.mutex.RLock()
+		var ips []string
+		bm.devices.each(func(_ string, dev *DeviceStats) {
+			addr := net.ParseIP(dev.IP)
+			if dev.Hostname == "" && addr != nil && addr.To4() != nil && addr.IsPrivate() {
+				if _, ok := probed[dev.IP]; !ok {
+					ips = append(ips, dev.IP)
+				}
+			}
+		})
+		bm.mutex.RUnlock()
+
+		for _, ip := range ips {
+			select {
+			case <-stop:
+				return
+			case <-time.After(nameProbeSpacing):
+			}
+			probed[ip] = time.Now()
+			name, err := probeNetBIOSName(ip, nameProbeTimeout)
+			if err != nil {
+				continue
+			}
+			if bm.names.learn(ip, name, NameSourceNetBIOS, time.Now()) {
+				bm.applyHostname(ip, name)
+			}
+		}
+	}
+}
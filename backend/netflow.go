@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Flow export formats (-flow-export-format)
+const (
+	FlowExportIPFIX    = "ipfix"    // RFC 7011, version 10
+	FlowExportNetFlow9 = "netflow9" // RFC 3954
+)
+
+// Flow export tuning
+const (
+	// flowExportMTU bounds an export datagram, below typical path MTUs
+	flowExportMTU = 1400
+	// Templates are resent this often and every flowTemplatePackets
+	// datagrams, so a collector started later learns them (UDP has no
+	// session to announce them on)
+	flowTemplateInterval = time.Minute
+	flowTemplatePackets  = 20
+	// Template IDs of the two record layouts
+	flowTemplateIPv4 = 256
+	flowTemplateIPv6 = 257
+)
+
+// Information elements exported per flow (IANA IPFIX numbers; NetFlow v9
+// shares them, except for the timestamps)
+const (
+	ieOctetDeltaCount      = 1
+	iePacketDeltaCount     = 2
+	ieProtocolIdentifier   = 4
+	ieSourceTransportPort  = 7
+	ieSourceIPv4Address    = 8
+	ieIngressInterface     = 10
+	ieDestTransportPort    = 11
+	ieDestIPv4Address      = 12
+	ieLastSwitched         = 21 // NetFlow v9: sysUptime in ms
+	ieFirstSwitched        = 22
+	ieSourceIPv6Address    = 27
+	ieDestIPv6Address      = 28
+	ieSourceMacAddress     = 56
+	ieDestMacAddress       = 80
+	ieFlowEndReason        = 136
+	ieFlowStartMillis      = 152 // IPFIX: Unix time in ms
+	ieFlowEndMillis        = 153
+	flowEndReasonIdle      = 1
+	flowEndReasonActive    = 2
+	flowEndReasonEnd       = 3
+	flowEndReasonForced    = 4
+	flowEndReasonResources = 5
+)
+
+// flowField is one field of a template: an information element and its size
+type flowField struct {
+	id, length uint16
+}
+
+// flowExporter sends closed flows as NetFlow v9 or IPFIX records to one
+// collector over UDP, so the monitor doubles as a flow probe for ntopng,
+// ElastiFlow or nfdump. Flows are exported when the flow table closes them;
+// -flow-active-timeout bounds how late a long flow is reported.
+type flowExporter struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	format   string
+	start    time.Time // NetFlow v9 sysUptime origin
+	sequence uint32    // IPFIX: data records sent; NetFlow v9: datagrams sent
+	// Template refresh state
+	sinceTemplate int
+	lastTemplate  time.Time
+	ifindex       map[string]uint32
+	failing       bool // last send failed; logged once until one succeeds
+}
+
+// newFlowExporter connects to collector (host:port) for format
+func newFlowExporter(collector, format string) (*flowExporter, error) {
+	if format != FlowExportIPFIX && format != FlowExportNetFlow9 {
+		return nil, fmt.Errorf("unknown format %q (want ipfix or netflow9)", format)
+	}
+	if _, _, err := net.SplitHostPort(collector); err != nil {
+		return nil, fmt.Errorf("collector %q: want host:port", collector)
+	}
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	return &flowExporter{conn: conn, format: format, start: time.Now(), ifindex: make(map[string]uint32)}, nil
+}
+
+// template returns the fields of the IPv4 or IPv6 record layout
+func (e *flowExporter) template(v6 bool) []flowField {
+	src, dst, addrLen := uint16(ieSourceIPv4Address), uint16(ieDestIPv4Address), uint16(4)
+	if v6 {
+		src, dst, addrLen = ieSourceIPv6Address, ieDestIPv6Address, 16
+	}
+	start, end, timeLen := uint16(ieFlowStartMillis), uint16(ieFlowEndMillis), uint16(8)
+	if e.format == FlowExportNetFlow9 {
+		start, end, timeLen = ieFirstSwitched, ieLastSwitched, 4
+	}
+	return []flowField{
+		{src, addrLen}, {dst, addrLen},
+		{ieSourceTransportPort, 2}, {ieDestTransportPort, 2},
+		{ieProtocolIdentifier, 1},
+		{ieOctetDeltaCount, 8}, {iePacketDeltaCount, 8},
+		{start, timeLen}, {end, timeLen},
+		{ieSourceMacAddress, 6}, {ieDestMacAddress, 6},
+		{ieIngressInterface, 4},
+		{ieFlowEndReason, 1},
+	}
+}
+
+// recordSize is the encoded size of one data record of a template
+func recordSize(fields []flowField) int {
+	n := 0
+	for _, f := range fields {
+		n += int(f.length)
+	}
+	return n
+}
+
+// flowProtocolNumber maps a flow's protocol name to its IP protocol number
+func flowProtocolNumber(protocol string, v6 bool) uint8 {
+	switch protocol {
+	case "tcp":
+		return 6
+	case "udp":
+		return 17
+	case "icmp":
+		if v6 {
+			return 58
+		}
+		return 1
+	}
+	return 0
+}
+
+// flowEndReason maps why a flow closed to its IPFIX flowEndReason
+func flowEndReason(reason string) uint8 {
+	switch reason {
+	case FlowClosedIdle:
+		return flowEndReasonIdle
+	case FlowClosedActive:
+		return flowEndReasonActive
+	case FlowClosedEnd:
+		return flowEndReasonEnd
+	case FlowClosedEvicted:
+		return flowEndReasonResources
+	}
+	return flowEndReasonForced
+}
+
+// interfaceIndex returns the ifIndex of a capture interface, 0 if unknown;
+// caller holds e.mu
+func (e *flowExporter) interfaceIndex(name string) uint32 {
+	if i, ok := e.ifindex[name]; ok {
+		return i
+	}
+	var index uint32
+	if iface, err := net.InterfaceByName(name); err == nil {
+		index = uint32(iface.Index)
+	}
+	e.ifindex[name] = index
+	return index
+}
+
+// uptime is the NetFlow v9 sysUptime of t in milliseconds
+func (e *flowExporter) uptime(t time.Time) uint32 {
+	if t.Before(e.start) {
+		return 0
+	}
+	return uint32(t.Sub(e.start) / time.Millisecond)
+}
+
+// appendRecord encodes the data record of f; caller holds e.mu
+func (e *flowExporter) appendRecord(b []byte, f *FlowRecord, src, dst net.IP) []byte {
+	b = append(b, src...)
+	b = append(b, dst...)
+	b = binary.BigEndian.AppendUint16(b, f.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, f.DstPort)
+	b = append(b, flowProtocolNumber(f.Protocol, len(src) == net.IPv6len))
+	b = binary.BigEndian.AppendUint64(b, f.Bytes)
+	b = binary.BigEndian.AppendUint64(b, f.Packets)
+	if e.format == FlowExportNetFlow9 {
+		b = binary.BigEndian.AppendUint32(b, e.uptime(f.Start))
+		b = binary.BigEndian.AppendUint32(b, e.uptime(f.End))
+	} else {
+		b = binary.BigEndian.AppendUint64(b, uint64(f.Start.UnixMilli()))
+		b = binary.BigEndian.AppendUint64(b, uint64(f.End.UnixMilli()))
+	}
+	b = appendMAC(b, f.SrcMAC)
+	b = appendMAC(b, f.DstMAC)
+	b = binary.BigEndian.AppendUint32(b, e.interfaceIndex(f.Interface))
+	return append(b, flowEndReason(f.Reason))
+}
+
+// appendMAC encodes a MAC address, zeros when there is none
+func appendMAC(b []byte, mac string) []byte {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return append(b, 0, 0, 0, 0, 0, 0)
+	}
+	return append(b, hw...)
+}
+
+// appendTemplates encodes a template set announcing both layouts
+func (e *flowExporter) appendTemplates(b []byte) []byte {
+	setID := uint16(2)
+	if e.format == FlowExportNetFlow9 {
+		setID = 0
+	}
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, setID)
+	b = binary.BigEndian.AppendUint16(b, 0) // length, set below
+	for _, t := range []struct {
+		id uint16
+		v6 bool
+	}{{flowTemplateIPv4, false}, {flowTemplateIPv6, true}} {
+		fields := e.template(t.v6)
+		b = binary.BigEndian.AppendUint16(b, t.id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// export sends closed flows to the collector; a flow table subscriber
+func (e *flowExporter) export(records []FlowRecord) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var v4, v6 []*FlowRecord
+	for i := range records {
+		f := &records[i]
+		src, dst := net.ParseIP(f.SrcIP), net.ParseIP(f.DstIP)
+		if src == nil || dst == nil {
+			continue
+		}
+		if src.To4() != nil && dst.To4() != nil {
+			v4 = append(v4, f)
+		} else {
+			v6 = append(v6, f)
+		}
+	}
+	e.send(flowTemplateIPv4, v4, false)
+	e.send(flowTemplateIPv6, v6, true)
+}
+
+// send encodes flows of one layout into as many datagrams as needed;
+// caller holds e.mu
+func (e *flowExporter) send(templateID uint16, flows []*FlowRecord, v6 bool) {
+	size := recordSize(e.template(v6))
+	for len(flows) > 0 {
+		now := time.Now()
+		withTemplates := e.sinceTemplate >= flowTemplatePackets || now.Sub(e.lastTemplate) >= flowTemplateInterval
+		headerLen := 16
+		if e.format == FlowExportNetFlow9 {
+			headerLen = 20
+		}
+		b := make([]byte, headerLen, flowExportMTU)
+		records := 0
+		if withTemplates {
+			b = e.appendTemplates(b)
+			records += 2
+			e.sinceTemplate, e.lastTemplate = 0, now
+		}
+		// Data set: as many records as fit, padded to 4 bytes for NetFlow v9
+		n := min(len(flows), (flowExportMTU-len(b)-4-3)/size)
+		setStart := len(b)
+		b = binary.BigEndian.AppendUint16(b, templateID)
+		b = binary.BigEndian.AppendUint16(b, 0)
+		for _, f := range flows[:n] {
+			src, dst := net.ParseIP(f.SrcIP), net.ParseIP(f.DstIP)
+			if !v6 {
+				src, dst = src.To4(), dst.To4()
+			}
+			b = e.appendRecord(b, f, src, dst)
+		}
+		if e.format == FlowExportNetFlow9 {
+			for (len(b)-setStart)%4 != 0 {
+				b = append(b, 0)
+			}
+		}
+		binary.BigEndian.PutUint16(b[setStart+2:], uint16(len(b)-setStart))
+		records += n
+		flows = flows[n:]
+
+		if e.format == FlowExportNetFlow9 {
+			binary.BigEndian.PutUint16(b[0:], 9)
+			binary.BigEndian.PutUint16(b[2:], uint16(records))
+			binary.BigEndian.PutUint32(b[4:], e.uptime(now))
+			binary.BigEndian.PutUint32(b[8:], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(b[12:], e.sequence)
+			binary.BigEndian.PutUint32(b[16:], 0) // source ID
+			e.sequence++
+		} else {
+			binary.BigEndian.PutUint16(b[0:], 10)
+			binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+			binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+			binary.BigEndian.PutUint32(b[8:], e.sequence)
+			binary.BigEndian.PutUint32(b[12:], 0) // observation domain
+			e.sequence += uint32(n)
+		}
+		e.sinceTemplate++
+
+		if _, err := e.conn.Write(b); err != nil {
+			if !e.failing {
+				log.Printf("Error exporting flows to %s: %v", e.conn.RemoteAddr(), err)
+				e.failing = true
+			}
+			continue
+		}
+		if e.failing {
+			log.Printf("Exporting flows to %s again", e.conn.RemoteAddr())
+			e.failing = false
+		}
+	}
+}
+
+// Close closes the exporter's socket
+func (e *flowExporter) Close() error { return e.conn.Close() }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits for new-destination tracking
+const maxNewDestAlertsPerHr = 10 // per device, to keep a chatty device from flooding alerts
+
+// maxKnownDestinations is per device; beyond it new destinations are not
+// learned (see resourceProfile)
+var maxKnownDestinations = 2000
+
+// KnownDestination is a destination a device has talked to
+type KnownDestination struct {
+	Key       string    `json:"key"` // AS label when available, else the network prefix
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+// deviceDestinations is the learned destination set of one device
+type deviceDestinations struct {
+	firstSeen   time.Time
+	known       map[string]time.Time
+	alertWindow time.Time // start of the current alert-rate hour
+	alertCount  int
+}
+
+// newDestTracker learns which destinations each device talks to and raises
+// a low-severity alert when a device reaches somewhere new after its
+// learning period. It is a lightweight behavioral IDS signal, not a verdict.
+type newDestTracker struct {
+	mu       sync.Mutex
+	devices  map[string]*deviceDestinations
+	learning time.Duration
+	// classify maps an external IP to a destination key
+	classify func(ip net.IP) string
+}
+
+// newNewDestTracker creates a tracker with the given learning period
+func newNewDestTracker(learning time.Duration) *newDestTracker {
+	return &newDestTracker{
+		devices:  make(map[string]*deviceDestinations),
+		learning: learning,
+		classify: prefixDestination,
+	}
+}
+
+// prefixDestination groups IPv4 destinations by /24 and IPv6 by /48, so one
+// service spread over neighbouring addresses counts as one destination.
+func prefixDestination(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// observe records that device contacted dstIP. It returns the destination
+// key, whether it is new after the learning period, and whether that is
+// worth an alert (new ones beyond the hourly alert budget are not).
+func (t *newDestTracker) observe(device string, dstIP net.IP, now time.Time) (key string, isNew, alert bool) {
+	key = t.classify(dstIP)
+	if key == "" {
+		return "", false, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d, ok := t.devices[device]
+	if !ok {
+		d = &deviceDestinations{firstSeen: now, known: make(map[string]time.Time)}
+		t.devices[device] = d
+	}
+	if _, seen := d.known[key]; seen || len(d.known) >= maxKnownDestinations {
+		return key, false, false
+	}
+	d.known[key] = now
+
+	// Still learning what is normal for this device
+	if now.Sub(d.firstSeen) < t.learning {
+		return key, false, false
+	}
+
+	if now.Sub(d.alertWindow) >= time.Hour {
+		d.alertWindow = now
+		d.alertCount = 0
+	}
+	d.alertCount++
+	return key, true, d.alertCount <= maxNewDestAlertsPerHr
+}
+
+// forget drops the learned destinations of device
+func (t *newDestTracker) forget(device string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.devices, device)
+}
+
+// reset drops the learned destinations of every device
+func (t *newDestTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.devices = make(map[string]*deviceDestinations)
+}
+
+// list returns the known destinations of a device, oldest first
+func (t *newDestTracker) list(device string) ([]KnownDestination, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[device]
+	if !ok {
+		return nil, false
+	}
+	result := make([]KnownDestination, 0, len(d.known))
+	for key, first := range d.known {
+		result = append(result, KnownDestination{Key: key, FirstSeen: first})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].FirstSeen.Equal(result[j].FirstSeen) {
+			return result[i].FirstSeen.Before(result[j].FirstSeen)
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result, true
+}
+
+// ObserveDestination feeds an outbound packet into new-destination detection.
+// Only traffic from a private address to a public one is considered.
+func (bm *BandwidthMonitor) ObserveDestination(srcMAC, srcIP, dstIP string) {
+	src, dst := net.ParseIP(srcIP), net.ParseIP(dstIP)
+	if src == nil || dst == nil || !src.IsPrivate() || !isPublicIP(dst) {
+		return
+	}
+	device := bm.deviceKey(srcMAC, srcIP)
+	if device == "" {
+		return
+	}
+	key, isNew, alert := bm.newDest.observe(device, dst, time.Now())
+	if isNew {
+		bm.risk.noteNewDestination(device)
+	}
+	if alert {
+		bm.alerts.raise("new-destination", SeverityInfo, device,
+			"%s contacted a new destination %s (%s)", device, key, dstIP)
+	}
+}
+
+// isPublicIP reports whether ip is a globally routable unicast address
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// REST API: Known destinations of a device
+func (bm *BandwidthMonitor) handleGetDestinations(w http.ResponseWriter, r *http.Request) {
+	list, ok := bm.newDest.list(mux.Vars(r)["mac"])
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, list)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds every outbound notification
+const notifyTimeout = 10 * time.Second
+
+// Notifier delivers a rendered alert to an external channel
+type Notifier interface {
+	Notify(alert Alert, text string) error
+}
+
+// NotifierConfig configures one notification channel
+type NotifierConfig struct {
+	Type string `json:"type"` // "slack", "webhook" or "email"
+
+	// slack / webhook
+	URL string `json:"url,omitempty"`
+
+	// email
+	SMTPHost string   `json:"smtpHost,omitempty"` // host:port
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// newNotifier builds a Notifier from its configuration
+func newNotifier(cfg NotifierConfig) (Notifier, error) {
+	switch cfg.Type {
+	case "slack":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("slack notifier needs a url")
+		}
+		return &slackNotifier{url: cfg.URL}, nil
+	case "webhook":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhook notifier needs a url")
+		}
+		return &webhookNotifier{url: cfg.URL}, nil
+	case "email":
+		if cfg.SMTPHost == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return nil, fmt.Errorf("email notifier needs smtpHost, from and to")
+		}
+		return &emailNotifier{cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", cfg.Type)
+}
+
+// notifyClient is shared by the HTTP-based notifiers
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// postJSON posts v as JSON to url and checks for a 2xx response
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// slackNotifier posts to a Slack incoming webhook
+type slackNotifier struct {
+	url string
+}
+
+func (n *slackNotifier) Notify(alert Alert, text string) error {
+	return postJSON(n.url, map[string]string{"text": text})
+}
+
+// webhookNotifier posts the alert and its rendered text as JSON, suitable
+// for SMS gateways and home automation
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) Notify(alert Alert, text string) error {
+	return postJSON(n.url, map[string]interface{}{"alert": alert, "text": text})
+}
+
+// emailNotifier sends plain-text mail over SMTP
+type emailNotifier struct {
+	cfg NotifierConfig
+}
+
+func (n *emailNotifier) Notify(alert Alert, text string) error {
+	subject := fmt.Sprintf("[%s] %s", alert.Severity, alert.Type)
+	if alert.Device != "" {
+		subject += " " + alert.Device
+	}
+	if alert.Type == AlertWeeklyReport {
+		subject = alert.Message
+	}
+	msg := "From: " + n.cfg.From + "\r\n" +
+		"To: " + strings.Join(n.cfg.To, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + strings.ReplaceAll(text, "\n", "\r\n")
+
+	return sendMail(n.cfg, []byte(msg))
+}
+
+// sendMail is smtp.SendMail bounded by notifyTimeout, so an SMTP server
+// that never answers cannot stall the alert and escalation senders
+func sendMail(cfg NotifierConfig, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", cfg.SMTPHost, notifyTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(notifyTimeout)); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(cfg.SMTPHost)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
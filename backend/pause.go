@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CapturePause is whether packets are being accounted
+type CapturePause struct {
+	Paused   bool      `json:"paused"`
+	Released bool      `json:"released"` // capture handles closed while paused
+	Since    time.Time `json:"since,omitempty"`
+}
+
+// capturePause stops packet accounting without stopping the server, e.g.
+// while another capture tool runs on the same box. A released pause also
+// closes the capture handles until resume.
+type capturePause struct {
+	paused  atomic.Bool // checked for every packet
+	mu      sync.Mutex
+	state   CapturePause
+	resumed chan struct{} // closed on resume
+}
+
+// newCapturePause creates the pause state of a running capture
+func newCapturePause() *capturePause {
+	p := &capturePause{resumed: make(chan struct{})}
+	close(p.resumed)
+	return p
+}
+
+// pause stops accounting, and with release closes the handles too; it
+// reports whether captures must restart to close their handles
+func (p *capturePause) pause(release bool) (CapturePause, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.state.Paused {
+		p.state = CapturePause{Paused: true, Since: time.Now()}
+		p.resumed = make(chan struct{})
+		p.paused.Store(true)
+	}
+	restart := release && !p.state.Released
+	if restart {
+		p.state.Released = true
+	}
+	return p.state, restart
+}
+
+// resume accounts packets again, reopening released handles
+func (p *capturePause) resume() CapturePause {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state.Paused {
+		p.state = CapturePause{}
+		p.paused.Store(false)
+		close(p.resumed)
+	}
+	return p.state
+}
+
+// status returns the pause state
+func (p *capturePause) status() CapturePause {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// wait blocks while the handles are released; it returns false if stop is
+// closed first
+func (p *capturePause) wait(stop <-chan struct{}) bool {
+	p.mu.Lock()
+	released, resumed := p.state.Released, p.resumed
+	p.mu.Unlock()
+	if !released {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// REST API: Pause packet accounting; {"release": true} also closes the
+// capture handles until resume
+func (bm *BandwidthMonitor) handlePauseCapture(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Release bool `json:"release"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	state, restart := bm.pause.pause(body.Release)
+	if restart {
+		bm.RestartCapture()
+	}
+	log.Printf("Capture paused (released handles: %v)", state.Released)
+	writeEncoded(w, r, state)
+}
+
+// REST API: Resume packet accounting
+func (bm *BandwidthMonitor) handleResumeCapture(w http.ResponseWriter, r *http.Request) {
+	state := bm.pause.resume()
+	log.Printf("Capture resumed")
+	writeEncoded(w, r, state)
+}
+
+// REST API: Show whether the capture is paused
+func (bm *BandwidthMonitor) handleGetCapturePause(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.pause.status())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapFlushInterval bounds how stale the file on disk may be, so the newest
+// packets are visible when the file is opened in Wireshark
+const pcapFlushInterval = time.Second
+
+// pcapHeaderSize is the size of the pcap file header
+const pcapHeaderSize = 24
+
+// rollingPcapWriter writes captured packets to path, rotating it to path.1,
+// path.2, ... once it exceeds maxSize and keeping at most maxFiles files.
+type rollingPcapWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu        sync.Mutex
+	file      *os.File
+	buf       *bufio.Writer
+	w         *pcapgo.Writer
+	size      int64
+	linkType  layers.LinkType
+	snaplen   uint32
+	lastFlush time.Time
+}
+
+// newRollingPcapWriter creates a writer; files are created on start
+func newRollingPcapWriter(path string, maxSize int64, maxFiles int) (*rollingPcapWriter, error) {
+	if maxSize <= pcapHeaderSize {
+		return nil, fmt.Errorf("pcap max size must exceed %d bytes", pcapHeaderSize)
+	}
+	if maxFiles < 1 {
+		return nil, fmt.Errorf("pcap max files must be at least 1")
+	}
+	return &rollingPcapWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}, nil
+}
+
+// start prepares the writer for a capture handle. A new file is begun when
+// the link type changes, since a pcap file holds a single link type.
+func (pw *rollingPcapWriter) start(linkType layers.LinkType, snaplen uint32) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.file != nil && linkType == pw.linkType {
+		return nil
+	}
+	pw.linkType, pw.snaplen = linkType, snaplen
+	return pw.rotate()
+}
+
+// rotate closes the current file, shifts the older ones and opens a fresh
+// file; caller holds pw.mu
+func (pw *rollingPcapWriter) rotate() error {
+	if pw.file != nil {
+		pw.buf.Flush()
+		pw.file.Close()
+		pw.file = nil
+		os.Remove(fmt.Sprintf("%s.%d", pw.path, pw.maxFiles-1))
+		for i := pw.maxFiles - 2; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", pw.path, i), fmt.Sprintf("%s.%d", pw.path, i+1))
+		}
+		if pw.maxFiles > 1 {
+			os.Rename(pw.path, pw.path+".1")
+		}
+	}
+
+	f, err := os.Create(pw.path)
+	if err != nil {
+		return err
+	}
+	pw.file = f
+	pw.buf = bufio.NewWriter(f)
+	pw.w = pcapgo.NewWriter(pw.buf)
+	pw.size = pcapHeaderSize
+	pw.lastFlush = time.Now()
+	return pw.w.WriteFileHeader(pw.snaplen, pw.linkType)
+}
+
+// write appends one packet, rotating first if it would overflow the file
+func (pw *rollingPcapWriter) write(ci gopacket.CaptureInfo, data []byte) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.file == nil {
+		return
+	}
+	record := int64(16 + len(data))
+	if pw.size+record > pw.maxSize && pw.size > pcapHeaderSize {
+		if err := pw.rotate(); err != nil {
+			log.Printf("Error rotating pcap file %s: %v", pw.path, err)
+			pw.close()
+			return
+		}
+	}
+	if err := pw.w.WritePacket(ci, data); err != nil {
+		log.Printf("Error writing pcap file %s: %v", pw.path, err)
+		return
+	}
+	pw.size += record
+	if time.Since(pw.lastFlush) >= pcapFlushInterval {
+		pw.buf.Flush()
+		pw.lastFlush = time.Now()
+	}
+}
+
+// close flushes and closes the current file; caller holds pw.mu
+func (pw *rollingPcapWriter) close() {
+	if pw.file == nil {
+		return
+	}
+	pw.buf.Flush()
+	pw.file.Close()
+	pw.file = nil
+}
+
+// Close flushes and closes the current file
+func (pw *rollingPcapWriter) Close() {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPortsPerDevice caps the per-device port breakdown (see resourceProfile)
+var maxPortsPerDevice = 1000
+
+// portServices names well-known ports for display
+var portServices = map[uint16]string{
+	20: "ftp-data", 21: "ftp", 22: "ssh", 23: "telnet", 25: "smtp", 53: "dns",
+	67: "dhcp", 68: "dhcp", 80: "http", 110: "pop3", 123: "ntp", 137: "netbios",
+	138: "netbios", 139: "netbios", 143: "imap", 161: "snmp", 389: "ldap",
+	443: "https", 445: "smb", 465: "smtps", 500: "ipsec", 514: "syslog",
+	587: "submission", 853: "dns-over-tls", 993: "imaps", 995: "pop3s",
+	1194: "openvpn", 1883: "mqtt", 1900: "ssdp", 3074: "xbox-live",
+	3389: "rdp", 3478: "stun", 4500: "ipsec-nat", 5060: "sip", 5353: "mdns",
+	5900: "vnc", 6881: "bittorrent", 6882: "bittorrent", 6883: "bittorrent",
+	6889: "bittorrent", 6969: "bittorrent-tracker", 8080: "http-alt",
+	8443: "https-alt", 8883: "mqtts", 32400: "plex", 51820: "wireguard",
+}
+
+// PortUsage is a device's traffic on one transport port
+type PortUsage struct {
+	Transport string `json:"transport"` // "tcp" or "udp"
+	Port      uint16 `json:"port"`
+	Service   string `json:"service,omitempty"`
+	BytesSent uint64 `json:"bytesSent"`
+	BytesRecv uint64 `json:"bytesRecv"`
+	Packets   uint64 `json:"packets"`
+}
+
+// portKey identifies a transport port
+type portKey struct {
+	transport string
+	port      uint16
+}
+
+// portUsage accumulates per-device traffic by service port
+type portUsage struct {
+	mu      sync.Mutex
+	devices map[string]map[portKey]*PortUsage
+}
+
+// newPortUsage creates an empty per-device port accumulator
+func newPortUsage() *portUsage {
+	return &portUsage{devices: make(map[string]map[portKey]*PortUsage)}
+}
+
+// add records size bytes on a port for device
+func (u *portUsage) add(device, transport string, port uint16, size, packets uint64, sent bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	byPort, ok := u.devices[device]
+	if !ok {
+		byPort = make(map[portKey]*PortUsage)
+		u.devices[device] = byPort
+	}
+	key := portKey{transport, port}
+	entry, ok := byPort[key]
+	if !ok {
+		if len(byPort) >= maxPortsPerDevice {
+			return
+		}
+		entry = &PortUsage{Transport: transport, Port: port, Service: portServices[port]}
+		byPort[key] = entry
+	}
+	if sent {
+		entry.BytesSent += size
+	} else {
+		entry.BytesRecv += size
+	}
+	entry.Packets += packets
+}
+
+// forget drops the port breakdown of device
+func (u *portUsage) forget(device string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.devices, device)
+}
+
+// reset drops the port breakdown of every device
+func (u *portUsage) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.devices = make(map[string]map[portKey]*PortUsage)
+}
+
+// top returns the n ports the device exchanged most bytes on
+func (u *portUsage) top(device string, n int) ([]PortUsage, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	byPort, ok := u.devices[device]
+	if !ok {
+		return nil, false
+	}
+	result := make([]PortUsage, 0, len(byPort))
+	for _, entry := range byPort {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		ti, tj := result[i].BytesSent+result[i].BytesRecv, result[j].BytesSent+result[j].BytesRecv
+		if ti != tj {
+			return ti > tj
+		}
+		if result[i].Port != result[j].Port {
+			return result[i].Port < result[j].Port
+		}
+		return result[i].Transport < result[j].Transport
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result, true
+}
+
+// servicePort picks the service side of a connection: the lower port, since
+// clients use high ephemeral ports. This holds for both directions of a
+// conversation, so requests and replies land on the same entry.
+func servicePort(srcPort, dstPort uint16) uint16 {
+	if srcPort != 0 && srcPort < dstPort {
+		return srcPort
+	}
+	return dstPort
+}
+
+// ObservePorts accounts a TCP/UDP packet to the service port of both ends
+func (bm *BandwidthMonitor) ObservePorts(pi *packetInfo, packets uint64) {
+	if pi.transport == "" {
+		return
+	}
+	port := servicePort(pi.srcPort, pi.dstPort)
+	if src := bm.deviceKey(pi.srcMAC, pi.srcIP); src != "" {
+		bm.ports.add(src, pi.transport, port, pi.size, packets, true)
+	}
+	if dst := bm.deviceKey(pi.dstMAC, pi.dstIP); dst != "" {
+		bm.ports.add(dst, pi.transport, port, pi.size, packets, false)
+	}
+}
+
+// REST API: Top destination ports of a device (?n=, default 10)
+func (bm *BandwidthMonitor) handleGetDevicePorts(w http.ResponseWriter, r *http.Request) {
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	list, ok := bm.ports.top(mux.Vars(r)["mac"], n)
+	if !ok {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, list)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureProfile controls how much work is done per captured packet
+type CaptureProfile struct {
+	Name        string `json:"name"`
+	SampleRate  int    `json:"sampleRate"`  // account 1 in N packets and scale counters by N (1 = every packet)
+	HostSignals bool   `json:"hostSignals"` // TTL/TCP-timestamp inspection used by tethering detection
+	DNSLog      bool   `json:"dnsLog"`      // log the DNS queries of each device
+	SNILog      bool   `json:"sniLog"`      // log the TLS server names each device connects to
+}
+
+// ProfileSchedule switches to Profile whenever Cron matches
+type ProfileSchedule struct {
+	Cron    string `json:"cron"`
+	Profile string `json:"profile"`
+
+	schedule *cronSchedule
+}
+
+// profilesConfig is the on-disk format of the -profiles-file
+type profilesConfig struct {
+	Default  string            `json:"default"`
+	Profiles []CaptureProfile  `json:"profiles"`
+	Schedule []ProfileSchedule `json:"schedule"`
+}
+
+// ProfileState is the JSON view of the profile manager
+type ProfileState struct {
+	Active   CaptureProfile    `json:"active"`
+	Source   string            `json:"source"` // "default", "schedule" or "api"
+	Since    time.Time         `json:"since"`
+	Profiles []CaptureProfile  `json:"profiles"`
+	Schedule []ProfileSchedule `json:"schedule"`
+}
+
+// builtinProfiles are always available and may be redefined in the profiles file
+var builtinProfiles = []CaptureProfile{
+	{Name: "full", SampleRate: 1, HostSignals: true, DNSLog: true, SNILog: true},
+	{Name: "sampled", SampleRate: 10, HostSignals: false},
+}
+
+// profileManager holds the capture profiles and applies the schedule
+type profileManager struct {
+	mu       sync.Mutex
+	profiles map[string]CaptureProfile
+	schedule []ProfileSchedule
+	def      string
+	source   string
+	since    time.Time
+	// sampleRate, when set by -sample-rate, replaces every profile's
+	sampleRate int
+	// scheduled is the index of the schedule entry matching the previous
+	// tick, -1 for none
+	scheduled int
+
+	// active is read on every packet, so it is swapped atomically
+	active atomic.Pointer[CaptureProfile]
+}
+
+// newProfileManager creates a manager with the built-in profiles, extended by
+// the profiles file at path when set.
+func newProfileManager(path string) (*profileManager, error) {
+	pm := &profileManager{
+		profiles: make(map[string]CaptureProfile),
+		def:      "full",
+	}
+	for _, p := range builtinProfiles {
+		pm.profiles[p.Name] = p
+	}
+
+	if path != "" {
+		var cfg profilesConfig
+		if err := loadJSONFile(path, &cfg); err != nil {
+			return nil, fmt.Errorf("reading profiles file %s: %v", path, err)
+		}
+		for _, p := range cfg.Profiles {
+			if p.SampleRate < 1 {
+				p.SampleRate = 1
+			}
+			pm.profiles[p.Name] = p
+		}
+		if cfg.Default != "" {
+			pm.def = cfg.Default
+		}
+		for _, entry := range cfg.Schedule {
+			sched, err := parseCron(entry.Cron)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := pm.profiles[entry.Profile]; !ok {
+				return nil, fmt.Errorf("schedule %q refers to unknown profile %q", entry.Cron, entry.Profile)
+			}
+			entry.schedule = sched
+			pm.schedule = append(pm.schedule, entry)
+		}
+	}
+	if _, ok := pm.profiles[pm.def]; !ok {
+		return nil, fmt.Errorf("default profile %q is not defined", pm.def)
+	}
+
+	now := time.Now()
+	pm.scheduled = pm.matching(now.Truncate(time.Minute))
+	pm.activate(pm.initialProfile(now))
+	return pm, nil
+}
+
+// setDefault changes the default profile, activating it unless the
+// schedule or API picked another
+func (pm *profileManager) setDefault(name string) error {
+	pm.mu.Lock()
+	if _, ok := pm.profiles[name]; !ok {
+		pm.mu.Unlock()
+		return fmt.Errorf("default profile %q is not defined", name)
+	}
+	pm.def = name
+	source := pm.source
+	pm.mu.Unlock()
+	if source == "default" {
+		pm.activate(name, "default")
+	}
+	return nil
+}
+
+// setSampleRate makes every profile account 1 in n packets, whatever its
+// own sample rate
+func (pm *profileManager) setSampleRate(n int) error {
+	if n < 1 {
+		return fmt.Errorf("sample rate %d must be at least 1", n)
+	}
+	pm.mu.Lock()
+	pm.sampleRate = n
+	name, source := pm.active.Load().Name, pm.source
+	pm.mu.Unlock()
+	pm.activate(name, source)
+	return nil
+}
+
+// initialProfile works out which profile the schedule would have selected
+// most recently, looking back up to a week; otherwise the default applies.
+func (pm *profileManager) initialProfile(now time.Time) (string, string) {
+	t := now.Truncate(time.Minute)
+	for i := 0; i < 7*24*60 && len(pm.schedule) > 0; i++ {
+		if i := pm.matching(t); i >= 0 {
+			return pm.schedule[i].Profile, "schedule"
+		}
+		t = t.Add(-time.Minute)
+	}
+	return pm.def, "default"
+}
+
+// activate switches the active profile; caller must not hold pm.mu
+func (pm *profileManager) activate(name, source string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	p := pm.profiles[name]
+	if pm.sampleRate > 0 {
+		p.SampleRate = pm.sampleRate
+	}
+	if cur := pm.active.Load(); cur != nil && cur.Name == name && cur.SampleRate == p.SampleRate && pm.source == source {
+		return
+	}
+	pm.active.Store(&p)
+	pm.source = source
+	pm.since = time.Now()
+	log.Printf("Capture profile %q active (%s)", name, source)
+}
+
+// current returns the active profile
+func (pm *profileManager) current() *CaptureProfile {
+	return pm.active.Load()
+}
+
+// matching returns the index of the first schedule entry matching t, or -1
+func (pm *profileManager) matching(t time.Time) int {
+	for i, entry := range pm.schedule {
+		if entry.schedule.matches(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// tick applies the schedule entry matching t when it differs from the one
+// matching the previous tick, so an entry matching a whole range of minutes
+// switches once. A manual override lasts until the next scheduled switch.
+func (pm *profileManager) tick(t time.Time) {
+	i := pm.matching(t)
+	pm.mu.Lock()
+	changed := i != pm.scheduled
+	pm.scheduled = i
+	pm.mu.Unlock()
+	if changed && i >= 0 {
+		pm.activate(pm.schedule[i].Profile, "schedule")
+	}
+}
+
+// state returns a snapshot for the API
+func (pm *profileManager) state() ProfileState {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	profiles := make([]CaptureProfile, 0, len(pm.profiles))
+	for _, p := range pm.profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return ProfileState{
+		Active:   *pm.active.Load(),
+		Source:   pm.source,
+		Since:    pm.since,
+		Profiles: profiles,
+		Schedule: append([]ProfileSchedule(nil), pm.schedule...),
+	}
+}
+
+// runProfileSchedule applies the schedule at the start of every minute until stop is closed
+func (bm *BandwidthMonitor) runProfileSchedule(stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-stop:
+			return
+		case <-time.After(next.Sub(now)):
+			bm.profiles.tick(next)
+		}
+	}
+}
+
+// REST API: Show the active capture profile, available profiles and schedule
+func (bm *BandwidthMonitor) handleGetProfile(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.profiles.state())
+}
+
+// REST API: Switch capture profile until the next scheduled change
+func (bm *BandwidthMonitor) handlePutProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	bm.profiles.mu.Lock()
+	_, ok := bm.profiles.profiles[req.Name]
+	bm.profiles.mu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown profile", http.StatusNotFound)
+		return
+	}
+	bm.profiles.activate(req.Name, "api")
+	writeEncoded(w, r, bm.profiles.state())
+}
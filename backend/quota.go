@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Quota periods; a day starts at local midnight, a week on Monday
+const (
+	QuotaDaily  = "day"
+	QuotaWeekly = "week"
+)
+
+// QuotaRule caps the traffic of a device, such as a child's tablet. When
+// the bytes sent and received within the current period reach LimitBytes
+// a "quota" alert is raised, which shaping rules can act on; when the
+// period ends the usage starts over and "quota-reset" is raised.
+type QuotaRule struct {
+	Device     string `json:"device"`
+	Name       string `json:"name,omitempty"`
+	LimitBytes uint64 `json:"limitBytes"`
+	Period     string `json:"period"` // QuotaDaily or QuotaWeekly
+}
+
+// QuotaStatus is a rule together with the usage of its current period
+type QuotaStatus struct {
+	QuotaRule
+	UsedBytes   uint64    `json:"usedBytes"`
+	PeriodStart time.Time `json:"periodStart"`
+	Exceeded    bool      `json:"exceeded"`
+}
+
+// quotaState tracks one rule between evaluations. Usage is summed from
+// counter deltas, so resetting the stats does not reset the quota; it is
+// kept in memory and counts from startup in the first period.
+type quotaState struct {
+	periodStart time.Time
+	lastBytes   uint64
+	primed      bool
+	used        uint64
+	alerted     bool
+}
+
+// quotaMonitor evaluates quota rules once per minute
+type quotaMonitor struct {
+	mu    sync.Mutex
+	rules map[string]QuotaRule
+	state map[string]*quotaState
+	doc   document // optional place the rules are persisted to
+}
+
+// newQuotaMonitor creates a monitor, loading rules from doc when set
+func newQuotaMonitor(doc document) *quotaMonitor {
+	q := &quotaMonitor{
+		rules: make(map[string]QuotaRule),
+		state: make(map[string]*quotaState),
+		doc:   doc,
+	}
+	if doc == nil {
+		return q
+	}
+	var rules []QuotaRule
+	if err := doc.load(&rules); err != nil {
+		log.Printf("Error reading quota rules from %s: %v", doc, err)
+		return q
+	}
+	for _, rule := range rules {
+		q.rules[rule.Device] = rule
+	}
+	return q
+}
+
+// save writes the rules back to their document; caller holds q.mu
+func (q *quotaMonitor) save() {
+	if q.doc == nil {
+		return
+	}
+	list := make([]QuotaRule, 0, len(q.rules))
+	for _, rule := range q.rules {
+		list = append(list, rule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	if err := q.doc.save(list); err != nil {
+		log.Printf("Error writing quota rules to %s: %v", q.doc, err)
+	}
+}
+
+// set adds or replaces a rule, keeping the usage of the current period
+// when only the limit changed
+func (q *quotaMonitor) set(rule QuotaRule) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if old, ok := q.rules[rule.Device]; ok && old.Period != rule.Period {
+		delete(q.state, rule.Device)
+	} else if st, ok := q.state[rule.Device]; ok {
+		st.alerted = false
+	}
+	q.rules[rule.Device] = rule
+	q.save()
+}
+
+// remove deletes a rule; it reports whether it existed
+func (q *quotaMonitor) remove(device string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.rules[device]; !ok {
+		return false
+	}
+	delete(q.rules, device)
+	delete(q.state, device)
+	q.save()
+	return true
+}
+
+// quotaPeriodStart returns the start of the period containing now
+func quotaPeriodStart(period string, now time.Time) time.Time {
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if period == QuotaWeekly {
+		// Weeks start on Monday
+		start = start.AddDate(0, 0, -(int(start.Weekday())+6)%7)
+	}
+	return start
+}
+
+// evaluate adds the traffic since the last evaluation to every rule
+func (q *quotaMonitor) evaluate(bm *BandwidthMonitor, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	totals := make(map[string]uint64, len(q.rules))
+	bm.mutex.RLock()
+	for key := range q.rules {
+		if dev, ok := bm.devices.load(key, now); ok {
+			totals[key] = dev.BytesSent + dev.BytesRecv
+		}
+	}
+	bm.mutex.RUnlock()
+
+	for key, rule := range q.rules {
+		start := quotaPeriodStart(rule.Period, now)
+		st, ok := q.state[key]
+		if !ok {
+			st = &quotaState{periodStart: start}
+			q.state[key] = st
+		}
+		if !st.periodStart.Equal(start) {
+			if st.alerted {
+				bm.alerts.raise("quota-reset", SeverityInfo, key,
+					"%s %s quota starts over after using %.1f MB", quotaLabel(rule), quotaAdjective(rule.Period), float64(st.used)/(1<<20))
+			}
+			st.periodStart, st.used, st.alerted = start, 0, false
+		}
+
+		total := totals[key]
+		switch {
+		case !st.primed:
+			// First sample: only establish a baseline
+			st.primed = true
+		case total < st.lastBytes:
+			// Counters reset since: all of total is new
+			st.used += total
+		default:
+			st.used += total - st.lastBytes
+		}
+		st.lastBytes = total
+
+		if !st.alerted && st.used >= rule.LimitBytes {
+			st.alerted = true
+			bm.alerts.raise("quota", SeverityWarning, key,
+				"%s used %.1f MB of its %s quota of %.1f MB", quotaLabel(rule), float64(st.used)/(1<<20), quotaAdjective(rule.Period), float64(rule.LimitBytes)/(1<<20))
+		}
+	}
+}
+
+// statuses returns all rules with their current usage, sorted by device key
+func (q *quotaMonitor) statuses(now time.Time) []QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	result := make([]QuotaStatus, 0, len(q.rules))
+	for key, rule := range q.rules {
+		st := QuotaStatus{QuotaRule: rule, PeriodStart: quotaPeriodStart(rule.Period, now)}
+		if s, ok := q.state[key]; ok && s.periodStart.Equal(st.PeriodStart) {
+			st.UsedBytes = s.used
+			st.Exceeded = s.alerted
+		}
+		result = append(result, st)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
+
+// quotaLabel returns the friendliest name of a rule's device
+func quotaLabel(rule QuotaRule) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return rule.Device
+}
+
+// quotaAdjective names a period in alert messages
+func quotaAdjective(period string) string {
+	if period == QuotaWeekly {
+		return "weekly"
+	}
+	return "daily"
+}
+
+// watchQuotasPeriodically evaluates quota rules once per minute until stop is closed
+func (bm *BandwidthMonitor) watchQuotasPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.quotas.evaluate(bm, now)
+		}
+	}
+}
+
+// REST API: List quota rules and the usage of their current period
+func (bm *BandwidthMonitor) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.quotas.statuses(time.Now()))
+}
+
+// REST API: Create or replace the quota rule of a device
+func (bm *BandwidthMonitor) handlePutQuota(w http.ResponseWriter, r *http.Request) {
+	var rule QuotaRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rule.Device = mux.Vars(r)["mac"]
+	if rule.Period == "" {
+		rule.Period = QuotaDaily
+	}
+	if rule.LimitBytes == 0 || (rule.Period != QuotaDaily && rule.Period != QuotaWeekly) {
+		http.Error(w, "limitBytes must be positive and period day or week", http.StatusBadRequest)
+		return
+	}
+	bm.quotas.set(rule)
+	writeEncoded(w, r, rule)
+}
+
+// REST API: Delete the quota rule of a device
+func (bm *BandwidthMonitor) handleDeleteQuota(w http.ResponseWriter, r *http.Request) {
+	if !bm.quotas.remove(mux.Vars(r)["mac"]) {
+		http.Error(w, "Quota rule not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateBuckets caps the client addresses tracked by the rate limiter; full
+// buckets are forgotten first
+const maxRateBuckets = 4096
+
+// rateBucket is the token bucket of one client address
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits requests per client address with token buckets: rate
+// requests per second on average, bursts of up to burst
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*rateBucket
+}
+
+// newRateLimiter creates a limiter, or nil when rate is not positive
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, burst: math.Max(float64(burst), 1), buckets: make(map[string]*rateBucket)}
+}
+
+// allow takes a token for addr; when none is left it returns how long until
+// the next one
+func (l *rateLimiter) allow(addr string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[addr]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.prune(now)
+		}
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[addr] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets the buckets that have refilled, or all of them if none
+// has; caller holds l.mu
+func (l *rateLimiter) prune(now time.Time) {
+	for addr, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, addr)
+		}
+	}
+	if len(l.buckets) >= maxRateBuckets {
+		clear(l.buckets)
+	}
+}
+
+// rateLimit answers 429 to clients sending more /api and /metrics requests
+// than -api-rate allows. The event stream is a single long request and is
+// left alone; WebSockets are capped by count instead (see wsAdmit).
+func (bm *BandwidthMonitor) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if bm.limiter == nil || path == "/api/stream" || (!strings.HasPrefix(path, "/api/") && path != "/metrics") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := bm.limiter.allow(hostOnly(r.RemoteAddr), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wsAdmit reports whether another WebSocket from remoteAddr fits within
+// -max-ws-clients and -max-ws-per-ip
+func (bm *BandwidthMonitor) wsAdmit(remoteAddr string) bool {
+	bm.clientsMu.RLock()
+	defer bm.clientsMu.RUnlock()
+	if bm.maxWSClients > 0 && len(bm.clients) >= bm.maxWSClients {
+		return false
+	}
+	if bm.maxWSPerIP <= 0 {
+		return true
+	}
+	host, n := hostOnly(remoteAddr), 0
+	for _, c := range bm.clients {
+		if hostOnly(c.remoteAddr) == host {
+			n++
+		}
+	}
+	return n < bm.maxWSPerIP
+}
@@ -0,0 +1,109 @@
+package main
+
+import "time"
+
+// maxRateWindow is the longest window rates can be averaged over
+const maxRateWindow = 60 * time.Second
+
+// rateWindow is the averaging window of DeviceStats rates (-rate-window)
+var rateWindow = 5 * time.Second
+
+// rateCounter keeps a device's traffic per second over the last
+// maxRateWindow, so rates are available without diffing snapshots
+type rateCounter struct {
+	sent, recv [60]uint64 // per second, indexed by Unix second mod 60
+	second     int64      // Unix second of the most recent slot
+}
+
+// add counts size bytes at now
+func (c *rateCounter) add(now time.Time, size uint64, sent bool) {
+	c.advance(now.Unix())
+	// Late packets (clock steps) land in the most recent slot
+	i := c.second % 60
+	if sent {
+		c.sent[i] += size
+	} else {
+		c.recv[i] += size
+	}
+}
+
+// advance moves the most recent slot to sec, clearing the slots of the
+// seconds without traffic since the previous one
+func (c *rateCounter) advance(sec int64) {
+	if sec <= c.second {
+		return
+	}
+	for s := c.second + 1; s <= sec && s <= c.second+int64(len(c.sent)); s++ {
+		c.sent[s%60], c.recv[s%60] = 0, 0
+	}
+	c.second = sec
+}
+
+// merge adds the traffic of o that is still within c's window
+func (c *rateCounter) merge(o *rateCounter) {
+	if o == nil || o.second == 0 {
+		return
+	}
+	c.advance(o.second)
+	for s := o.second - int64(len(o.sent)) + 1; s <= o.second; s++ {
+		if c.second-s < int64(len(c.sent)) {
+			c.sent[s%60] += o.sent[s%60]
+			c.recv[s%60] += o.recv[s%60]
+		}
+	}
+}
+
+// fillWindow sets the Duration, rates and recent traffic of a copy of a
+// device. A device seen for less than rateWindow is averaged over the time
+// it was seen, so a newcomer's rates are not understated.
+func (d *DeviceStats) fillWindow(now time.Time) {
+	window := now.Sub(d.FirstSeen)
+	d.Duration = window.Seconds()
+	window = max(min(window, rateWindow), time.Second)
+	sent, recv, recentSent, recentRecv := d.rate.sums(now, window)
+	n := float64(window / time.Second)
+	d.RateSentBps, d.RateRecvBps = float64(sent)/n, float64(recv)/n
+	d.RecentBytes = recentSent + recentRecv
+}
+
+// sums returns the bytes sent and received in the last window of whole
+// seconds before now and in the last maxRateWindow, in one pass over the
+// ring since fillWindow needs both for every device of every snapshot
+func (c *rateCounter) sums(now time.Time, window time.Duration) (sent, recv, recentSent, recentRecv uint64) {
+	n := int64(window / time.Second)
+	end := now.Unix() // the second in progress is left out
+	if c == nil || c.second < end-int64(len(c.sent)) {
+		return 0, 0, 0, 0
+	}
+	for s := end - int64(len(c.sent)); s < end; s++ {
+		if s > c.second || c.second-s >= int64(len(c.sent)) {
+			continue
+		}
+		recentSent += c.sent[s%60]
+		recentRecv += c.recv[s%60]
+		if s >= end-n {
+			sent += c.sent[s%60]
+			recv += c.recv[s%60]
+		}
+	}
+	return sent, recv, recentSent, recentRecv
+}
+
+// bps returns the average bytes per second sent and received over the last
+// window of whole seconds before now; a nil counter has no traffic
+func (c *rateCounter) bps(now time.Time, window time.Duration) (sent, recv float64) {
+	n := int64(window / time.Second)
+	end := now.Unix() // the second in progress is left out
+	// Idle devices, most of a large network, skip the ring
+	if c == nil || n <= 0 || c.second < end-n {
+		return 0, 0
+	}
+	for s := end - n; s < end; s++ {
+		if s > c.second || c.second-s >= int64(len(c.sent)) {
+			continue
+		}
+		sent += float64(c.sent[s%60])
+		recv += float64(c.recv[s%60])
+	}
+	return sent / float64(n), recv / float64(n)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// reloader re-reads the configuration (SIGHUP or POST /api/admin/reload)
+// and applies what can change at runtime: the capture filter, the broadcast
+// interval and the escalation file. Stats and WebSocket clients are kept;
+// other settings take effect on the next restart.
+type reloader struct {
+	mu         sync.Mutex
+	flags      *flag.FlagSet
+	given      map[string]bool // flags given on the command line, which a reload keeps
+	configFile string
+	ticker     *time.Ticker // broadcast ticker
+	// Values at startup or the previous reload; only a changed setting is
+	// applied, so a reload does not undo e.g. a filter set through the API
+	filter         string
+	interval       int
+	escalationFile string
+}
+
+// settings re-reads every flag as a string: command-line values, else
+// LANTT_* variables, else the -config file, else the default
+func (rl *reloader) settings() (map[string]string, error) {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	rl.flags.VisitAll(func(f *flag.Flag) {
+		fs.String(f.Name, f.DefValue, f.Usage)
+		if rl.given[f.Name] {
+			fs.Set(f.Name, f.Value.String())
+		}
+	})
+	if err := applyEnvironment(fs, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if rl.configFile != "" {
+		if err := applyConfigFile(fs, rl.configFile); err != nil {
+			return nil, fmt.Errorf("%s: %v", rl.configFile, err)
+		}
+	}
+	settings := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) { settings[f.Name] = f.Value.String() })
+	return settings, nil
+}
+
+// reload applies the changed runtime settings and returns their names.
+// Everything is validated before anything is applied.
+func (bm *BandwidthMonitor) reload() ([]string, error) {
+	rl := bm.reloader
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	settings, err := rl.settings()
+	if err != nil {
+		return nil, err
+	}
+	interval, err := strconv.Atoi(settings["interval"])
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid interval %q", settings["interval"])
+	}
+	var esc *escalator
+	escalationFile := settings["escalation-file"]
+	if escalationFile != rl.escalationFile {
+		if bm.escalations == nil || escalationFile == "" {
+			return nil, fmt.Errorf("turning -escalation-file on or off needs a restart")
+		}
+		if esc, err = loadEscalator(escalationFile); err != nil {
+			return nil, fmt.Errorf("escalation file: %v", err)
+		}
+	}
+
+	var changed []string
+	if filter := settings["filter"]; filter != rl.filter {
+		if err := bm.SetCaptureFilter(filter); err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+		rl.filter = filter
+		changed = append(changed, "filter")
+	}
+	if interval != rl.interval {
+		rl.ticker.Reset(time.Duration(interval) * time.Second)
+		rl.interval = interval
+		changed = append(changed, "interval")
+	}
+	if esc != nil {
+		bm.escalations.replace(esc)
+		rl.escalationFile = escalationFile
+		changed = append(changed, "escalation-file")
+	}
+	return changed, nil
+}
+
+// reloadLogged reloads and logs the outcome
+func (bm *BandwidthMonitor) reloadLogged(trigger string) ([]string, error) {
+	changed, err := bm.reload()
+	if err != nil {
+		log.Printf("Configuration reload (%s) failed: %v", trigger, err)
+	} else {
+		log.Printf("Configuration reloaded (%s), changed: %v", trigger, changed)
+	}
+	return changed, err
+}
+
+// REST API: Reload the configuration, as SIGHUP does
+func (bm *BandwidthMonitor) handleReload(w http.ResponseWriter, r *http.Request) {
+	changed, err := bm.reloadLogged("requested by " + r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	writeEncoded(w, r, map[string]interface{}{"status": "reloaded", "changed": changed})
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Replication roles
+const (
+	RolePrimary  = "primary"
+	RoleFollower = "follower"
+)
+
+// Replication timing and limits
+const (
+	replicationRetry      = 5 * time.Second  // between attempts to reach the primary
+	maxReplicaMessageSize = 64 * 1024 * 1024 // the first update carries every device
+)
+
+// grpcJSONCodec lets the replication service speak gRPC without generated
+// protobuf code; messages are the JSON of the Go types below
+type grpcJSONCodec struct{}
+
+func (grpcJSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (grpcJSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (grpcJSONCodec) Name() string                               { return "json" }
+
+func init() {
+	encoding.RegisterCodec(grpcJSONCodec{})
+}
+
+// followRequest opens a replication stream
+type followRequest struct {
+	Name string `json:"name"` // follower's host name, for the primary's status
+}
+
+// replicaBucket is one historyStep bucket of the in-memory device history
+type replicaBucket struct {
+	Start time.Time         `json:"start"`
+	Sent  map[string]uint64 `json:"sent"`
+	Recv  map[string]uint64 `json:"recv"`
+}
+
+// replicaState is one update streamed to followers. The first is full: the
+// whole device table and the in-memory history. Later ones carry only the
+// devices changed since the previous update and those removed. Labels are
+// always sent whole.
+type replicaState struct {
+	Time             time.Time               `json:"time"`
+	MeasurementStart time.Time               `json:"measurementStart"`
+	Full             bool                    `json:"full,omitempty"`
+	Devices          map[string]*DeviceStats `json:"devices"`
+	Removed          []string                `json:"removed,omitempty"`
+	Labels           []DeviceLabel           `json:"labels"`
+	History          []replicaBucket         `json:"history,omitempty"`
+}
+
+// replicator is implemented by the monitor serving the replication stream
+type replicator interface {
+	follow(req *followRequest, stream grpc.ServerStream) error
+}
+
+// replicationService is the gRPC service lantt.Replication with its single
+// server-streaming method Follow
+var replicationService = grpc.ServiceDesc{
+	ServiceName: "lantt.Replication",
+	HandlerType: (*replicator)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Follow",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			var req followRequest
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			return srv.(replicator).follow(&req, stream)
+		},
+	}},
+	Metadata: "replication.go",
+}
+
+// ReplicaFollower is a follower connected to this instance
+type ReplicaFollower struct {
+	Name  string    `json:"name"`
+	Addr  string    `json:"addr"`
+	Since time.Time `json:"since"`
+}
+
+// ReplicationStatus is this instance's part in replication
+type ReplicationStatus struct {
+	Role       string            `json:"role"`
+	Primary    string            `json:"primary,omitempty"`    // followed replication address
+	Connected  bool              `json:"connected"`            // follower: stream from the primary open
+	LastUpdate time.Time         `json:"lastUpdate,omitempty"` // follower: last update received
+	Lease      float64           `json:"leaseSeconds,omitempty"`
+	PromotedAt time.Time         `json:"promotedAt,omitempty"`
+	Followers  []ReplicaFollower `json:"followers"`
+}
+
+// replication tracks the replication role: a primary streams its state to
+// followers; a follower mirrors the primary until it is promoted, then
+// starts capturing itself
+type replication struct {
+	mu         sync.Mutex
+	role       string
+	primary    string
+	lease      time.Duration
+	connected  bool
+	lastUpdate time.Time
+	promotedAt time.Time
+	promoted   chan struct{} // closed on promotion
+	followers  map[uint64]ReplicaFollower
+	nextID     uint64
+}
+
+// newReplication creates the replication state; a non-empty primary makes
+// this instance its follower
+func newReplication(primary string, lease time.Duration) *replication {
+	r := &replication{role: RolePrimary, primary: primary, lease: lease,
+		promoted: make(chan struct{}), followers: make(map[uint64]ReplicaFollower)}
+	if primary != "" {
+		r.role = RoleFollower
+	}
+	return r
+}
+
+// following reports whether this instance is still a follower
+func (r *replication) following() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role == RoleFollower
+}
+
+// promote makes a follower the primary; it reports whether it was a follower
+func (r *replication) promote(reason string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != RoleFollower {
+		return false
+	}
+	r.role, r.connected, r.promotedAt = RolePrimary, false, time.Now()
+	close(r.promoted)
+	log.Printf("Promoted to primary: %s", reason)
+	return true
+}
+
+// expired reports whether the primary's lease ran out: no update for longer
+// than the lease since the last one. The lease is only armed by the first
+// update, so a follower that never reached the primary (a partition, a
+// wrong address) keeps following instead of becoming a second primary.
+func (r *replication) expired(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lease > 0 && !r.lastUpdate.IsZero() && now.Sub(r.lastUpdate) > r.lease
+}
+
+// received notes an update from the primary
+func (r *replication) received(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected, r.lastUpdate = true, now
+}
+
+// disconnected notes the end of the stream from the primary
+func (r *replication) disconnected() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connected = false
+}
+
+// addFollower records a connected follower and returns its id
+func (r *replication) addFollower(f ReplicaFollower) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	r.followers[r.nextID] = f
+	return r.nextID
+}
+
+// removeFollower forgets a disconnected follower
+func (r *replication) removeFollower(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.followers, id)
+}
+
+// status returns the replication status
+func (r *replication) status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := ReplicationStatus{Role: r.role, Primary: r.primary, Connected: r.connected, LastUpdate: r.lastUpdate,
+		Lease: r.lease.Seconds(), PromotedAt: r.promotedAt, Followers: make([]ReplicaFollower, 0, len(r.followers))}
+	for _, f := range r.followers {
+		s.Followers = append(s.Followers, f)
+	}
+	slices.SortFunc(s.Followers, func(a, b ReplicaFollower) int { return a.Since.Compare(b.Since) })
+	return s
+}
+
+// export returns the history buckets for a follower
+func (h *deviceHistory) export() []replicaBucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make([]replicaBucket, 0, len(h.buckets))
+	for _, b := range h.buckets {
+		rb := replicaBucket{Start: b.start, Sent: make(map[string]uint64, len(b.devices)), Recv: make(map[string]uint64, len(b.devices))}
+		for key, t := range b.devices {
+			rb.Sent[key], rb.Recv[key] = t.sent, t.recv
+		}
+		buckets = append(buckets, rb)
+	}
+	return buckets
+}
+
+// restore takes the primary's history buckets when they reach further back
+// than the ones recorded here
+func (h *deviceHistory) restore(buckets []replicaBucket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(buckets) <= len(h.buckets) {
+		return
+	}
+	h.buckets = h.buckets[:0]
+	for _, rb := range buckets {
+		b := historyBucket{start: rb.Start, devices: make(map[string]traffic, len(rb.Sent))}
+		for key, sent := range rb.Sent {
+			b.devices[key] = traffic{sent, rb.Recv[key]}
+		}
+		h.buckets = append(h.buckets, b)
+	}
+}
+
+// list returns every label
+func (ls *labelStore) list() []DeviceLabel {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	list := make([]DeviceLabel, 0, len(ls.labels))
+	for device, name := range ls.labels {
+		list = append(list, DeviceLabel{Device: device, Name: name})
+	}
+	return list
+}
+
+// replace swaps in the primary's labels, saving them when they changed
+func (ls *labelStore) replace(labels []DeviceLabel) {
+	next := make(map[string]string, len(labels))
+	for _, l := range labels {
+		next[l.Device] = l.Name
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if maps.Equal(ls.labels, next) {
+		return
+	}
+	ls.labels = next
+	ls.save()
+}
+
+// replicaState snapshots the state a follower mirrors. sent holds the
+// fingerprint of every device as last sent to the follower and is updated;
+// unless full, only devices whose fingerprint changed are included. A full
+// update adds the in-memory history for a follower that just connected.
+func (bm *BandwidthMonitor) replicaState(sent map[string]uint64, full bool) *replicaState {
+	state := &replicaState{Time: time.Now(), Full: full}
+	bm.mutex.RLock()
+	state.MeasurementStart = bm.measurementStart
+	devices := make(map[string]*DeviceStats, bm.devices.len())
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		d := *dev
+		d.IPs = slices.Clone(dev.IPs)
+		d.Interfaces = slices.Clone(dev.Interfaces)
+		d.NATSignals = slices.Clone(dev.NATSignals)
+		d.RiskFactors = maps.Clone(dev.RiskFactors)
+		d.fillWindow(state.Time)
+		devices[key] = &d
+	})
+	bm.mutex.RUnlock()
+
+	state.Devices = make(map[string]*DeviceStats)
+	for key, d := range devices {
+		fp := replicaFingerprint(d)
+		if prev, ok := sent[key]; full || !ok || prev != fp {
+			sent[key] = fp
+			state.Devices[key] = d
+		}
+	}
+	for key := range sent {
+		if _, ok := devices[key]; !ok {
+			delete(sent, key)
+			state.Removed = append(state.Removed, key)
+		}
+	}
+	state.Labels = bm.labels.list()
+	if full {
+		state.History = bm.history.export()
+	}
+	return state
+}
+
+// replicaFingerprint hashes the JSON of a device, to tell whether it
+// changed since the previous update. The rate window fields are left out:
+// they change with the clock alone, and followers work them out from
+// their own rate counters.
+func replicaFingerprint(d *DeviceStats) uint64 {
+	c := *d
+	c.Duration, c.RateSentBps, c.RateRecvBps, c.RecentBytes = 0, 0, 0, 0
+	h := fnv.New64a()
+	json.NewEncoder(h).Encode(&c)
+	return h.Sum64()
+}
+
+// applyReplica mirrors an update from the primary. A full update replaces
+// the device table; otherwise the changed devices are updated and removed
+// ones dropped. Traffic since the previous update feeds the local rate
+// counters, so a follower shows rates (at update resolution) and keeps them
+// when promoted.
+func (bm *BandwidthMonitor) applyReplica(state *replicaState) {
+	now := time.Now()
+	bm.mutex.Lock()
+	for key, d := range state.Devices {
+		if cur, ok := bm.devices.get(key); ok {
+			d.rate, d.nat = cur.rate, cur.nat
+			if d.BytesSent >= cur.BytesSent && d.BytesRecv >= cur.BytesRecv {
+				d.rate.add(now, d.BytesSent-cur.BytesSent, true)
+				d.rate.add(now, d.BytesRecv-cur.BytesRecv, false)
+			}
+		} else {
+			d.rate = &rateCounter{}
+		}
+		bm.devices.set(key, d)
+	}
+	if state.Full {
+		bm.devices.all(func(key string, _ *DeviceStats) {
+			if _, ok := state.Devices[key]; !ok {
+				bm.devices.remove(key)
+				bm.forgetDevice(key)
+			}
+		})
+	}
+	for _, key := range state.Removed {
+		if bm.devices.remove(key) {
+			bm.forgetDevice(key)
+		}
+	}
+	bm.measurementStart = state.MeasurementStart
+	bm.mutex.Unlock()
+
+	bm.labels.replace(state.Labels)
+	if len(state.History) > 0 {
+		bm.history.restore(state.History)
+	}
+}
+
+// replicationAuthorized checks the credentials of a follower: with
+// authentication configured it must present an API key or -auth-token as
+// "authorization: Bearer" metadata
+func (bm *BandwidthMonitor) replicationAuthorized(ctx context.Context) bool {
+	if !bm.authRequired() && bm.authToken == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		r := &http.Request{Header: http.Header{"Authorization": {v}}}
+		token := bearerToken(r)
+		if bm.matchAPIKey(token) != "" || tokenMatches(token, bm.authToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// follow streams the state to one follower every -replication-interval
+// until it disconnects: all of it at first, then what changed
+func (bm *BandwidthMonitor) follow(req *followRequest, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	if !bm.replicationAuthorized(ctx) {
+		return status.Error(codes.Unauthenticated, "missing or invalid API key")
+	}
+	if bm.replication.following() {
+		return status.Error(codes.FailedPrecondition, "this instance is a follower")
+	}
+	f := ReplicaFollower{Name: req.Name, Since: time.Now()}
+	if p, ok := peer.FromContext(ctx); ok {
+		f.Addr = p.Addr.String()
+	}
+	id := bm.replication.addFollower(f)
+	defer bm.replication.removeFollower(id)
+	log.Printf("Follower %s (%s) connected", f.Name, f.Addr)
+	defer log.Printf("Follower %s (%s) disconnected", f.Name, f.Addr)
+
+	ticker := time.NewTicker(bm.replicationInterval)
+	defer ticker.Stop()
+	sent := make(map[string]uint64)
+	for first := true; ; first = false {
+		if err := stream.SendMsg(bm.replicaState(sent, first)); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// newReplicationServer creates the gRPC server of -replication-listen,
+// using the HTTPS certificate when there is one
+func (bm *BandwidthMonitor) newReplicationServer(tlsConf *tls.Config) *grpc.Server {
+	var opts []grpc.ServerOption
+	if tlsConf != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf.Clone())))
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&replicationService, bm)
+	return server
+}
+
+// dialPrimary connects to the primary's replication address; with caFile
+// the connection uses TLS verified against it
+func dialPrimary(addr, caFile string) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool})
+	}
+	return grpc.NewClient(addr, grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(grpcJSONCodec{}.Name()), grpc.MaxCallRecvMsgSize(maxReplicaMessageSize)))
+}
+
+// followPrimary mirrors the primary over conn, reconnecting after errors,
+// until stop is closed or this instance is promoted. With a lease, it
+// promotes itself when the primary stays silent longer than the lease.
+func (bm *BandwidthMonitor) followPrimary(conn *grpc.ClientConn, key string, stop <-chan struct{}) {
+	r := bm.replication
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+key)
+	}
+
+	leaseCheck := time.NewTicker(time.Second)
+	defer leaseCheck.Stop()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				cancel()
+				return
+			case <-r.promoted:
+				cancel()
+				return
+			case now := <-leaseCheck.C:
+				if r.expired(now) {
+					r.promote(fmt.Sprintf("no update from %s within the %s lease", r.primary, r.lease))
+				}
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if err := bm.receiveReplica(ctx, conn); err != nil && ctx.Err() == nil {
+			log.Printf("Replication from %s: %v", r.primary, err)
+		}
+		r.disconnected()
+		select {
+		case <-ctx.Done():
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+// receiveReplica opens one replication stream and applies its updates
+// until it fails or ctx ends
+func (bm *BandwidthMonitor) receiveReplica(ctx context.Context, conn *grpc.ClientConn) error {
+	stream, err := conn.NewStream(ctx, &replicationService.Streams[0], "/"+replicationService.ServiceName+"/Follow")
+	if err != nil {
+		return err
+	}
+	name, _ := os.Hostname()
+	if err := stream.SendMsg(&followRequest{Name: name}); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		var state replicaState
+		if err := stream.RecvMsg(&state); err != nil {
+			return err
+		}
+		if !bm.replication.following() {
+			return nil
+		}
+		bm.applyReplica(&state)
+		bm.replication.received(time.Now())
+	}
+}
+
+// REST API: Replication role, the followed primary and connected followers
+func (bm *BandwidthMonitor) handleGetReplication(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.replication.status())
+}
+
+// REST API: Promote this follower to primary: it stops mirroring and starts
+// capturing. Only promote once the old primary is down for good, or both
+// will count the same traffic.
+func (bm *BandwidthMonitor) handlePromote(w http.ResponseWriter, r *http.Request) {
+	if !bm.replication.promote("requested by " + r.RemoteAddr) {
+		http.Error(w, "Not a follower", http.StatusConflict)
+		return
+	}
+	writeEncoded(w, r, bm.replication.status())
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportTopDevices is how many devices the weekly report lists
+const reportTopDevices = 10
+
+// What the totals of a weekly report cover
+const (
+	ReportBasisHistory    = "history"     // the last seven days, from the -history-db
+	ReportBasisSinceStart = "since-start" // the live counters since startup or the last reset
+)
+
+// WeeklyReport summarizes the last week of monitoring
+type WeeklyReport struct {
+	GeneratedAt time.Time      `json:"generatedAt"`
+	PeriodStart time.Time      `json:"periodStart"`
+	PeriodEnd   time.Time      `json:"periodEnd"`
+	Basis       string         `json:"basis"` // ReportBasisHistory or ReportBasisSinceStart
+	TotalSent   uint64         `json:"totalSent"`
+	TotalRecv   uint64         `json:"totalRecv"`
+	TopDevices  []*DeviceStats `json:"topDevices"`
+	SLO         []SLOStatus    `json:"slo"`
+	// Weekly ranking with rank changes, when -history-db is set
+	Leaderboard []LeaderboardEntry `json:"leaderboard,omitempty"`
+}
+
+// BuildWeeklyReport assembles the weekly report. With the -history-db the
+// totals and top devices cover the last seven days (or the history's
+// retention, if shorter); without it only the live counters exist, so the
+// report covers the time since the monitor started or was reset and says so.
+func (bm *BandwidthMonitor) BuildWeeklyReport() *WeeklyReport {
+	if bm.series != nil {
+		report, err := bm.weeklyReportFromHistory(time.Now())
+		if err == nil {
+			return report
+		}
+		log.Printf("Error reading traffic history for the weekly report: %v", err)
+	}
+
+	stats := bm.GetNetworkStats()
+	bm.mutex.RLock()
+	start := bm.measurementStart
+	bm.mutex.RUnlock()
+
+	// Busiest first, whatever order -sort gives the device list
+	top := append([]*DeviceStats(nil), stats.Devices...)
+	sort.SliceStable(top, func(i, j int) bool {
+		return top[i].BytesSent+top[i].BytesRecv > top[j].BytesSent+top[j].BytesRecv
+	})
+	if len(top) > reportTopDevices {
+		top = top[:reportTopDevices]
+	}
+	return &WeeklyReport{
+		GeneratedAt: stats.Timestamp,
+		PeriodStart: start,
+		PeriodEnd:   stats.Timestamp,
+		Basis:       ReportBasisSinceStart,
+		TotalSent:   stats.TotalSent,
+		TotalRecv:   stats.TotalRecv,
+		TopDevices:  top,
+		SLO:         bm.slo.statuses(),
+	}
+}
+
+// weeklyReportFromHistory builds the weekly report from the -history-db,
+// ranking devices by their traffic within the period
+func (bm *BandwidthMonitor) weeklyReportFromHistory(now time.Time) (*WeeklyReport, error) {
+	period := 7 * 24 * time.Hour
+	if r := bm.series.retention; r > 0 && r < period {
+		period = r
+	}
+	start := now.Add(-period)
+	totals, err := bm.series.totals(start, now)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &WeeklyReport{
+		GeneratedAt: now,
+		PeriodStart: start,
+		PeriodEnd:   now,
+		Basis:       ReportBasisHistory,
+		TopDevices:  []*DeviceStats{},
+		SLO:         bm.slo.statuses(),
+	}
+	for _, t := range totals {
+		report.TotalSent += t.sent
+		report.TotalRecv += t.recv
+	}
+	ranked := rankDevices(totals)
+	if len(ranked) > reportTopDevices {
+		ranked = ranked[:reportTopDevices]
+	}
+	bm.mutex.RLock()
+	for _, key := range ranked {
+		// The current device supplies names and addresses; the byte
+		// counters are replaced by the period's
+		dev, ok := bm.devices.load(key, now)
+		if !ok {
+			dev = DeviceStats{MAC: key, Label: bm.labels.get(key)}
+		}
+		dev.BytesSent, dev.BytesRecv = totals[key].sent, totals[key].recv
+		report.TopDevices = append(report.TopDevices, &dev)
+	}
+	bm.mutex.RUnlock()
+
+	if lb, err := bm.buildLeaderboard(PeriodWeek, reportTopDevices, now); err == nil {
+		report.Leaderboard = lb.Entries
+	} else {
+		log.Printf("Error building leaderboard: %v", err)
+	}
+	return report, nil
+}
+
+// AlertWeeklyReport is the alert type the scheduled weekly report is
+// handed to notifiers as; email uses its message as the subject
+const AlertWeeklyReport = "weekly-report"
+
+// sendWeeklyReport renders the weekly report and sends it through the named
+// notifiers of the -escalation-file
+func (bm *BandwidthMonitor) sendWeeklyReport(names []string) {
+	text, err := bm.templates.render("report-weekly.tmpl", bm.BuildWeeklyReport())
+	if err != nil {
+		log.Printf("Error rendering the weekly report: %v", err)
+		return
+	}
+	// The report's first line doubles as the subject
+	subject, _, _ := strings.Cut(text, "\n")
+	alert := Alert{Type: AlertWeeklyReport, Severity: SeverityInfo, Message: subject, Time: time.Now()}
+	for _, name := range names {
+		n, ok := bm.escalations.notifier(name)
+		if !ok {
+			log.Printf("Error sending the weekly report: unknown notifier %q", name)
+			continue
+		}
+		if err := n.Notify(alert, text); err != nil {
+			log.Printf("Error sending the weekly report via %s: %v", name, err)
+		}
+	}
+}
+
+// runReportSchedule sends the weekly report through notifiers at the start
+// of every minute schedule matches, until stop is closed
+func (bm *BandwidthMonitor) runReportSchedule(schedule *cronSchedule, notifiers []string, stop <-chan struct{}) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-stop:
+			return
+		case <-time.After(next.Sub(now)):
+			if schedule.matches(next) {
+				bm.sendWeeklyReport(notifiers)
+			}
+		}
+	}
+}
+
+// REST API: Weekly report
+func (bm *BandwidthMonitor) handleGetWeeklyReport(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.BuildWeeklyReport())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reverse DNS tuning
+const (
+	// rdnsScanInterval is how often devices are checked for names to resolve
+	rdnsScanInterval = 10 * time.Second
+	// rdnsTTL is how long a resolved name is trusted before it is looked up again
+	rdnsTTL = time.Hour
+	// rdnsNegativeTTL delays retrying an address that has no PTR record
+	rdnsNegativeTTL = 10 * time.Minute
+	// rdnsTimeout bounds a single PTR lookup
+	rdnsTimeout = 2 * time.Second
+	// maxRDNSCache caps cached addresses; expired entries are pruned first
+	maxRDNSCache = 4096
+)
+
+// rdnsEntry is a cached PTR result; name is empty for a failed lookup
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// hostnameResolver does rate-limited, cached PTR lookups for device IPs
+type hostnameResolver struct {
+	mu       sync.Mutex
+	cache    map[string]rdnsEntry
+	resolver *net.Resolver
+	// interval is the minimum spacing between lookups that miss the cache
+	interval time.Duration
+}
+
+// newHostnameResolver creates a resolver doing at most rate lookups per second
+func newHostnameResolver(rate float64) *hostnameResolver {
+	return &hostnameResolver{
+		cache:    make(map[string]rdnsEntry),
+		resolver: net.DefaultResolver,
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+// cached returns the cached name of ip and whether it is still fresh
+func (r *hostnameResolver) cached(ip string, now time.Time) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[ip]
+	return e.name, ok && now.Before(e.expires)
+}
+
+// store caches the result of a lookup, pruning when the cache is full
+func (r *hostnameResolver) store(ip, name string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.cache[ip]; !ok && len(r.cache) >= maxRDNSCache {
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxRDNSCache {
+			clear(r.cache)
+		}
+	}
+	ttl := rdnsTTL
+	if name == "" {
+		ttl = rdnsNegativeTTL
+	}
+	r.cache[ip] = rdnsEntry{name: name, expires: now.Add(ttl)}
+}
+
+// lookup resolves ip to its first PTR name without the trailing dot, or ""
+func (r *hostnameResolver) lookup(ip string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	names, err := r.resolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// resolveHostnamesPeriodically fills DeviceStats.Hostname from reverse DNS.
+// Fresh cache entries are applied directly; other addresses are looked up
+// one at a time, no faster than the resolver's rate, until stop is closed.
+func (bm *BandwidthMonitor) resolveHostnamesPeriodically(r *hostnameResolver, stop <-chan struct{}) {
+	ticker := time.NewTicker(rdnsScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		// Copy addresses to avoid holding the lock during network calls
+		bm.mutex.RLock()
+		ips := make(map[string]string) // device key -> ip
+		bm.devices.each(func(key string, dev *DeviceStats) {
+			// Names a device announces itself win over reverse DNS
+			if _, ok := bm.names.lookup(dev.IP); dev.IP != "" && !ok {
+				ips[key] = dev.IP
+			}
+		})
+		bm.mutex.RUnlock()
+
+		for key, ip := range ips {
+			name, fresh := r.cached(ip, time.Now())
+			if !fresh {
+				select {
+				case <-stop:
+					return
+				case <-time.After(r.interval):
+				}
+				name = r.lookup(ip)
+				r.store(ip, name, time.Now())
+			}
+			if name == "" {
+				continue
+			}
+			bm.mutex.Lock()
+			if dev, ok := bm.devices.get(key); ok && dev.IP == ip {
+				dev.Hostname = name
+			}
+			bm.mutex.Unlock()
+		}
+	}
+}
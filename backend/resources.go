@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// evictionInterval is how often idle and surplus devices are evicted
+const evictionInterval = time.Minute
+
+// resourceProfile bounds how much state the monitor keeps. The defaults suit
+// a desktop or small server. "low-memory" targets a Raspberry Pi on a mirror
+// port: under 64 MB resident with up to 256 devices, however long it runs,
+// by sampling 1 in 10 packets, keeping a day of SLO history, capping every
+// per-device breakdown and evicting devices idle for 30 minutes. "campus"
+// targets conference and campus networks with six-figure MAC counts: the
+// per-device breakdowns shrink so their sum stays bounded, updates carry the
+// top devices only and devices gone for two hours are archived.
+type resourceProfile struct {
+	name string
+	// captureProfile is the default capture profile unless -profiles-file is given
+	captureProfile string
+	// maxDevices caps tracked devices, evicting the longest idle (0 = no cap)
+	maxDevices int
+	// deviceIdleTTL evicts devices not seen for this long (0 = never)
+	deviceIdleTTL time.Duration
+	// broadcastTopN limits WebSocket updates to the busiest devices (0 = all)
+	broadcastTopN int
+	// Retention and per-device breakdown caps
+	sloWindow            int // minutes
+	maxAlerts            int
+	maxKnownDestinations int
+	maxASNsPerDevice     int
+	maxPortsPerDevice    int
+	maxIPsPerDevice      int
+	maxFlows             int
+	historyRetention     time.Duration
+}
+
+// resourceProfiles are the presets selectable with -profile
+var resourceProfiles = map[string]resourceProfile{
+	"default": {
+		name:                 "default",
+		sloWindow:            7 * 24 * 60,
+		maxAlerts:            1000,
+		maxKnownDestinations: 2000,
+		maxASNsPerDevice:     500,
+		maxPortsPerDevice:    1000,
+		maxIPsPerDevice:      16,
+		maxFlows:             65536,
+		historyRetention:     24 * time.Hour,
+	},
+	"low-memory": {
+		name:                 "low-memory",
+		captureProfile:       "sampled",
+		maxDevices:           256,
+		deviceIdleTTL:        30 * time.Minute,
+		broadcastTopN:        25,
+		sloWindow:            24 * 60,
+		maxAlerts:            200,
+		maxKnownDestinations: 200,
+		maxASNsPerDevice:     50,
+		maxPortsPerDevice:    50,
+		maxIPsPerDevice:      4,
+		maxFlows:             4096,
+		historyRetention:     6 * time.Hour,
+	},
+	"campus": {
+		name:                 "campus",
+		maxDevices:           500000,
+		deviceIdleTTL:        2 * time.Hour,
+		broadcastTopN:        500,
+		sloWindow:            7 * 24 * 60,
+		maxAlerts:            5000,
+		maxKnownDestinations: 100,
+		maxASNsPerDevice:     20,
+		maxPortsPerDevice:    50,
+		maxIPsPerDevice:      4,
+		maxFlows:             1 << 20,
+		historyRetention:     6 * time.Hour,
+	},
+}
+
+// lookupResourceProfile returns the named preset
+func lookupResourceProfile(name string) (resourceProfile, error) {
+	p, ok := resourceProfiles[name]
+	if !ok {
+		return resourceProfile{}, fmt.Errorf("unknown profile %q (want default, low-memory or campus)", name)
+	}
+	return p, nil
+}
+
+// apply sets the package-wide retention limits; call before capture starts
+func (p resourceProfile) apply() {
+	sloWindow = p.sloWindow
+	maxAlerts = p.maxAlerts
+	maxKnownDestinations = p.maxKnownDestinations
+	maxASNsPerDevice = p.maxASNsPerDevice
+	maxPortsPerDevice = p.maxPortsPerDevice
+	maxIPsPerDevice = p.maxIPsPerDevice
+	maxFlows = p.maxFlows
+	historyRetention = p.historyRetention
+}
+
+// forgetDevice drops the per-device state kept outside bm.devices
+func (bm *BandwidthMonitor) forgetDevice(key string) {
+	bm.risk.forget(key)
+	bm.newDest.forget(key)
+	bm.domains.forget(key)
+	bm.asnUsage.forget(key)
+	bm.geoUsage.forget(key)
+	bm.ports.forget(key)
+	bm.discovery.forget(key)
+	bm.history.forget(key)
+	bm.activity.forget(key)
+	bm.dnsFilter.forget(key)
+}
+
+// evictDevices removes devices idle longer than the profile's TTL and, above
+// its device cap, the longest idle ones, moving them to the archive. It
+// returns how many were evicted.
+func (bm *BandwidthMonitor) evictDevices(now time.Time) int {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+
+	var idle []string
+	if ttl := bm.resources.deviceIdleTTL; ttl > 0 {
+		bm.devices.all(func(key string, dev *DeviceStats) {
+			if now.Sub(dev.LastSeen) > ttl {
+				idle = append(idle, key)
+			}
+		})
+		bm.removeDevices(idle, now)
+	}
+	n := len(idle)
+	if limit := bm.resources.maxDevices; limit > 0 {
+		n += bm.evictLeastRecent(limit, now)
+	}
+	return n
+}
+
+// makeRoomForDevice evicts the least recently seen devices when a new one
+// would exceed the device cap, so the map never outgrows it between
+// eviction runs. It frees an eighth of the cap at once, which keeps the sort
+// off the path of most new devices. Caller holds bm.mutex.
+func (bm *BandwidthMonitor) makeRoomForDevice(now time.Time) {
+	limit := bm.resources.maxDevices
+	if limit <= 0 || bm.devices.len() < limit {
+		return
+	}
+	bm.evictLeastRecent(max(limit-max(limit/8, 1), 0), now)
+}
+
+// evictLeastRecent removes the least recently seen devices above keep and
+// returns how many; caller holds bm.mutex
+func (bm *BandwidthMonitor) evictLeastRecent(keep int, now time.Time) int {
+	if bm.devices.len() <= keep {
+		return 0
+	}
+	// Sorted on a copy of LastSeen, not with table lookups per comparison
+	type seen struct {
+		key      string
+		lastSeen time.Time
+	}
+	devices := make([]seen, 0, bm.devices.len())
+	bm.devices.all(func(key string, dev *DeviceStats) {
+		devices = append(devices, seen{key, dev.LastSeen})
+	})
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].lastSeen.Before(devices[j].lastSeen)
+	})
+	keys := make([]string, len(devices)-keep)
+	for i := range keys {
+		keys[i] = devices[i].key
+	}
+	bm.removeDevices(keys, now)
+	return len(keys)
+}
+
+// removeDevices moves devices to the archive and drops their other state;
+// caller holds bm.mutex
+func (bm *BandwidthMonitor) removeDevices(keys []string, now time.Time) {
+	archived := make([]DeviceStats, 0, len(keys))
+	for _, key := range keys {
+		dev, _ := bm.devices.get(key)
+		archived = append(archived, *dev)
+		bm.devices.remove(key)
+		bm.forgetDevice(key)
+	}
+	bm.devicesEvicted += uint64(len(keys))
+	bm.archive.add(archived, now)
+}
+
+// evictDevicesPeriodically applies the eviction policy until stop is closed
+func (bm *BandwidthMonitor) evictDevicesPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(evictionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if n := bm.evictDevices(now); n > 0 {
+				log.Printf("Evicted %d idle devices", n)
+			}
+		}
+	}
+}
+
+// TableUsage is the size of a bounded table against its cap
+type TableUsage struct {
+	Entries int    `json:"entries"`
+	Limit   int    `json:"limit"` // 0 = no cap
+	Evicted uint64 `json:"evicted"`
+}
+
+// ResourceUsage is the monitor's memory budget and how much of it is used
+type ResourceUsage struct {
+	Profile       string         `json:"profile"`
+	Devices       TableUsage     `json:"devices"`
+	Flows         TableUsage     `json:"flows"`
+	Accounting    QueueUsage     `json:"accounting"`
+	DeviceTTL     float64        `json:"deviceTtl"` // seconds; 0 = never
+	ArchivedLimit int            `json:"archivedLimit"`
+	HeapAlloc     uint64         `json:"heapAlloc"`
+	Sys           uint64         `json:"sys"`
+	Maps          map[string]int `json:"maps"`
+}
+
+// resourceUsage measures the bounded tables and the heap
+func (bm *BandwidthMonitor) resourceUsage() ResourceUsage {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	u := ResourceUsage{
+		Profile:       bm.resources.name,
+		DeviceTTL:     bm.resources.deviceIdleTTL.Seconds(),
+		ArchivedLimit: bm.archive.limit,
+		HeapAlloc:     m.HeapAlloc,
+		Sys:           m.Sys,
+		Maps:          bm.mapSizes(),
+		Accounting:    bm.statsQueue.usage(),
+	}
+	bm.mutex.RLock()
+	u.Devices = TableUsage{Entries: bm.devices.len(), Limit: bm.resources.maxDevices, Evicted: bm.devicesEvicted}
+	bm.mutex.RUnlock()
+	bm.flows.mu.Lock()
+	u.Flows = TableUsage{Entries: len(bm.flows.flows), Limit: maxFlows, Evicted: bm.flows.evictedTotal}
+	bm.flows.mu.Unlock()
+	return u
+}
+
+// REST API: Table sizes against their caps (-max-devices, -max-flows), the
+// accounting queue and heap usage
+func (bm *BandwidthMonitor) handleGetResources(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.resourceUsage())
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Risk scoring parameters. Each factor contributes up to its weight; the
+// score is their sum, 0-100.
+const (
+	riskWeightPlaintext   = 25.0
+	riskWeightBlocklist   = 30.0
+	riskWeightScan        = 20.0
+	riskWeightNight       = 10.0
+	riskWeightNewDest     = 15.0
+	riskBlocklistSatur    = 5               // blocklisted flows for the full weight
+	riskNewDestSatur      = 20              // new destinations for the full weight
+	riskScanThreshold     = 100             // distinct targets failing probes per minute counted as a scan
+	riskScanMemory        = 24 * time.Hour  // how long a scan keeps counting
+	riskProbeTimeout      = 5 * time.Second // a SYN unanswered this long probed a filtered port
+	riskMaxProbes         = 1024            // SYNs awaiting an answer tracked per device
+	riskNightStartHour    = 0               // local hours considered unusual
+	riskNightEndHour      = 5               // (exclusive)
+	riskRecomputeInterval = 30 * time.Second
+)
+
+// plaintextPorts are well-known ports of protocols that send data unencrypted
+var plaintextPorts = map[uint16]bool{
+	21: true, 23: true, 25: true, 80: true, 110: true, 143: true,
+	389: true, 513: true, 514: true, 1883: true, 5900: true, 8080: true,
+}
+
+// riskState accumulates risk signals for one device
+type riskState struct {
+	totalBytes     uint64
+	plaintextBytes uint64
+	nightBytes     uint64
+	blocklistFlows map[string]struct{} // up to riskBlocklistSatur flows to blocklisted addresses
+	newDests       int
+	lastScan       time.Time
+	scanMinute     time.Time
+	scanTargets    map[string]struct{}  // targets whose probe failed this minute
+	probes         map[string]time.Time // TCP targets sent a SYN, awaiting the SYN-ACK
+}
+
+// failProbe counts target as probed without success, flagging a scan once
+// riskScanThreshold targets fail within a minute
+func (st *riskState) failProbe(target string, now time.Time) {
+	minute := now.Truncate(time.Minute)
+	if !minute.Equal(st.scanMinute) {
+		st.scanMinute = minute
+		st.scanTargets = make(map[string]struct{})
+	}
+	if len(st.scanTargets) < riskScanThreshold {
+		st.scanTargets[target] = struct{}{}
+		if len(st.scanTargets) == riskScanThreshold {
+			st.lastScan = now
+		}
+	}
+}
+
+// expireProbes fails the probes unanswered for riskProbeTimeout
+func (st *riskState) expireProbes(now time.Time) {
+	for target, sent := range st.probes {
+		if now.Sub(sent) >= riskProbeTimeout {
+			delete(st.probes, target)
+			st.failProbe(target, now)
+		}
+	}
+}
+
+// riskTracker collects per-device risk signals
+type riskTracker struct {
+	mu        sync.Mutex
+	devices   map[string]*riskState
+	blocklist *ipBlocklist
+}
+
+// newRiskTracker creates an empty tracker
+func newRiskTracker() *riskTracker {
+	return &riskTracker{devices: make(map[string]*riskState)}
+}
+
+// state returns the state of a device, creating it; caller holds t.mu
+func (t *riskTracker) state(device string) *riskState {
+	st, ok := t.devices[device]
+	if !ok {
+		st = &riskState{}
+		t.devices[device] = st
+	}
+	return st
+}
+
+// observe feeds one packet sent by device into the risk signals. Probes
+// are only tracked with sampled set false, as sampling drops most answers.
+func (t *riskTracker) observe(device string, pi *packetInfo, sampled bool, now time.Time) {
+	dst := net.ParseIP(pi.dstIP)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.state(device)
+
+	st.totalBytes += pi.size
+	if plaintextPorts[pi.dstPort] || plaintextPorts[pi.srcPort] {
+		st.plaintextBytes += pi.size
+	}
+	if h := now.Hour(); h >= riskNightStartHour && h < riskNightEndHour {
+		st.nightBytes += pi.size
+	}
+	if len(st.blocklistFlows) < riskBlocklistSatur && dst != nil && t.blocklist.contains(dst) {
+		if st.blocklistFlows == nil {
+			st.blocklistFlows = make(map[string]struct{})
+		}
+		st.blocklistFlows[fmt.Sprintf("%s %d %s:%d", pi.transport, pi.srcPort, pi.dstIP, pi.dstPort)] = struct{}{}
+	}
+
+	// Scan behaviour: connection attempts to many targets that refuse or
+	// ignore them; answered SYNs are forgotten in observeAnswer
+	if pi.tcpSYN && !sampled {
+		if st.probes == nil {
+			st.probes = make(map[string]time.Time)
+		}
+		if len(st.probes) >= riskMaxProbes {
+			st.expireProbes(now)
+		}
+		target := fmt.Sprintf("%s:%d", pi.dstIP, pi.dstPort)
+		if _, ok := st.probes[target]; !ok && len(st.probes) < riskMaxProbes {
+			st.probes[target] = now
+		}
+	}
+}
+
+// observeAnswer feeds one packet received by device into its probes: a
+// SYN-ACK completes a connection, while a RST to a pending SYN or an ICMP
+// port unreachable for a UDP datagram reveals a closed port
+func (t *riskTracker) observeAnswer(device string, pi *packetInfo, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.devices[device]
+	if !ok {
+		return
+	}
+	if pi.unreachable != "" {
+		st.failProbe(pi.unreachable, now)
+		return
+	}
+	target := fmt.Sprintf("%s:%d", pi.srcIP, pi.srcPort)
+	if _, pending := st.probes[target]; !pending {
+		return
+	}
+	delete(st.probes, target)
+	if !pi.tcpSYNACK {
+		st.failProbe(target, now)
+	}
+}
+
+// noteNewDestination counts a never-before-seen destination for device
+func (t *riskTracker) noteNewDestination(device string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state(device).newDests++
+}
+
+// forget drops the risk signals of device
+func (t *riskTracker) forget(device string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.devices, device)
+}
+
+// reset drops the risk signals of every device
+func (t *riskTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.devices = make(map[string]*riskState)
+}
+
+// score computes the risk score and its factors for a device
+func (t *riskTracker) score(device string, now time.Time) (float64, map[string]float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.devices[device]
+	if !ok {
+		return 0, nil
+	}
+	st.expireProbes(now)
+
+	factors := make(map[string]float64)
+	if st.totalBytes > 0 {
+		factors["plaintext"] = riskWeightPlaintext * float64(st.plaintextBytes) / float64(st.totalBytes)
+		factors["unusualHours"] = riskWeightNight * float64(st.nightBytes) / float64(st.totalBytes)
+	}
+	factors["blocklist"] = riskWeightBlocklist * float64(len(st.blocklistFlows)) / riskBlocklistSatur
+	if !st.lastScan.IsZero() && now.Sub(st.lastScan) < riskScanMemory {
+		factors["scanning"] = riskWeightScan
+	}
+	factors["newDestinations"] = riskWeightNewDest * math.Min(float64(st.newDests), riskNewDestSatur) / riskNewDestSatur
+
+	var total float64
+	for name, v := range factors {
+		v = math.Round(v*10) / 10
+		factors[name] = v
+		total += v
+	}
+	return math.Min(total, 100), factors
+}
+
+// ObserveRisk feeds a packet standing in for weight packets into risk
+// scoring for the device that sent it, and for the device receiving it when
+// it answers a probe
+func (bm *BandwidthMonitor) ObserveRisk(pi *packetInfo, weight uint64) {
+	now := time.Now()
+	if weight == 1 && (pi.tcpSYNACK || pi.tcpEnd || pi.unreachable != "") {
+		if dst := net.ParseIP(pi.dstIP); dst != nil && dst.IsPrivate() {
+			if device := bm.deviceKey(pi.dstMAC, pi.dstIP); device != "" {
+				bm.risk.observeAnswer(device, pi, now)
+			}
+		}
+	}
+	src := net.ParseIP(pi.srcIP)
+	if src == nil || !src.IsPrivate() {
+		return
+	}
+	if device := bm.deviceKey(pi.srcMAC, pi.srcIP); device != "" {
+		bm.risk.observe(device, pi, weight > 1, now)
+	}
+}
+
+// updateRiskScoresPeriodically copies fresh risk scores into DeviceStats
+func (bm *BandwidthMonitor) updateRiskScoresPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(riskRecomputeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.mutex.RLock()
+			keys := make([]string, 0, bm.devices.len())
+			bm.devices.each(func(key string, _ *DeviceStats) {
+				keys = append(keys, key)
+			})
+			bm.mutex.RUnlock()
+
+			for _, key := range keys {
+				score, factors := bm.risk.score(key, now)
+				bm.mutex.Lock()
+				if dev, ok := bm.devices.get(key); ok {
+					dev.RiskScore = score
+					dev.RiskFactors = factors
+				}
+				bm.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// ipBlocklist is a set of IPs and networks loaded from a file
+type ipBlocklist struct {
+	ips  map[string]struct{}
+	nets []*net.IPNet
+}
+
+// loadBlocklist reads one IP or CIDR per line; blank lines and # comments are ignored
+func loadBlocklist(path string) (*ipBlocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bl := &ipBlocklist{ips: make(map[string]struct{})}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			bl.nets = append(bl.nets, n)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("%s:%d: invalid address %q", path, line, entry)
+		}
+		bl.ips[ip.String()] = struct{}{}
+	}
+	return bl, scanner.Err()
+}
+
+// contains reports whether ip is blocklisted
+func (bl *ipBlocklist) contains(ip net.IP) bool {
+	if bl == nil {
+		return false
+	}
+	if _, ok := bl.ips[ip.String()]; ok {
+		return true
+	}
+	for _, n := range bl.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Router advertisement tracking limits
+const (
+	maxRouters       = 256       // advertising routers tracked
+	raAlertInterval  = time.Hour // between repeated alerts for the same router
+	raPrefixInfoSize = 30        // bytes of a prefix information option after type and length
+)
+
+// RouterInfo is a device seen sending IPv6 router advertisements
+type RouterInfo struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`       // link-local source of the advertisements
+	Prefixes  []string  `json:"prefixes"` // advertised in the last advertisement
+	Lifetime  int       `json:"lifetime"` // seconds as default router; 0 means "not a default router"
+	Trusted   bool      `json:"trusted"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Count     uint64    `json:"count"`
+
+	lastAlert time.Time
+}
+
+// routerAdvertTracker watches IPv6 router advertisements. Routers listed as
+// allowed or, without a list, seen during the learning period after startup
+// are trusted;
+// any other sender is a rogue router (an attack, or a misconfigured device
+// handing out its own prefix) and raises an alert.
+type routerAdvertTracker struct {
+	mu        sync.Mutex
+	routers   map[string]*RouterInfo
+	allowed   map[string]bool
+	learnTill time.Time
+}
+
+// newRouterAdvertTracker creates a tracker trusting the allowed MACs, or
+// when there are none, routers seen within learning from now
+func newRouterAdvertTracker(allowed []string, learning time.Duration, now time.Time) *routerAdvertTracker {
+	if len(allowed) > 0 {
+		learning = 0
+	}
+	t := &routerAdvertTracker{
+		routers:   make(map[string]*RouterInfo),
+		allowed:   make(map[string]bool, len(allowed)),
+		learnTill: now.Add(learning),
+	}
+	for _, mac := range allowed {
+		t.allowed[mac] = true
+	}
+	return t
+}
+
+// parseMACList parses a comma-separated list of MAC addresses into their
+// canonical lowercase form
+func parseMACList(s string) ([]string, error) {
+	var macs []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		hw, err := net.ParseMAC(f)
+		if err != nil {
+			return nil, err
+		}
+		macs = append(macs, hw.String())
+	}
+	return macs, nil
+}
+
+// raPrefixes returns the prefixes announced in the options of an advertisement
+func raPrefixes(ra *layers.ICMPv6RouterAdvertisement) []string {
+	prefixes := make([]string, 0)
+	for _, opt := range ra.Options {
+		if opt.Type != layers.ICMPv6OptPrefixInfo || len(opt.Data) != raPrefixInfoSize {
+			continue
+		}
+		prefix := net.IPNet{IP: net.IP(opt.Data[14:30]), Mask: net.CIDRMask(int(opt.Data[0]), 128)}
+		prefixes = append(prefixes, prefix.String())
+	}
+	return prefixes
+}
+
+// raSourceMAC returns the sender's link-layer address option, if present
+func raSourceMAC(ra *layers.ICMPv6RouterAdvertisement) string {
+	for _, opt := range ra.Options {
+		if opt.Type == layers.ICMPv6OptSourceAddress && len(opt.Data) == 6 {
+			return net.HardwareAddr(opt.Data).String()
+		}
+	}
+	return ""
+}
+
+// observe records an advertisement from mac. It returns the router's state
+// and whether the advertisement is rogue and due an alert.
+func (t *routerAdvertTracker) observe(mac, ip string, ra *layers.ICMPv6RouterAdvertisement, now time.Time) (RouterInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.routers[mac]
+	if !ok {
+		if len(t.routers) >= maxRouters {
+			// Still report rogues past the cap, just without tracking them
+			r = &RouterInfo{MAC: mac, FirstSeen: now}
+		} else {
+			r = &RouterInfo{MAC: mac, FirstSeen: now, Trusted: t.allowed[mac] || now.Before(t.learnTill)}
+			t.routers[mac] = r
+		}
+	}
+	r.IP = ip
+	r.Prefixes = raPrefixes(ra)
+	r.Lifetime = int(ra.RouterLifetime)
+	r.LastSeen = now
+	r.Count++
+	if r.Trusted || now.Sub(r.lastAlert) < raAlertInterval {
+		return *r, false
+	}
+	r.lastAlert = now
+	return *r, true
+}
+
+// list returns the advertising routers, most recently seen first
+func (t *routerAdvertTracker) list() []RouterInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]RouterInfo, 0, len(t.routers))
+	for _, r := range t.routers {
+		result = append(result, *r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].LastSeen.Equal(result[j].LastSeen) {
+			return result[i].LastSeen.After(result[j].LastSeen)
+		}
+		return result[i].MAC < result[j].MAC
+	})
+	return result
+}
+
+// ObserveRouterAdvert feeds an IPv6 router advertisement into rogue router detection
+func (bm *BandwidthMonitor) ObserveRouterAdvert(srcMAC, srcIP string, ra *layers.ICMPv6RouterAdvertisement) {
+	if srcMAC == "" {
+		// Links without Ethernet headers: rely on the advertised address
+		srcMAC = raSourceMAC(ra)
+	}
+	if srcMAC == "" {
+		return
+	}
+	router, alert := bm.routerAdverts.observe(srcMAC, srcIP, ra, time.Now())
+	if !alert {
+		return
+	}
+	prefixes := "no prefixes"
+	if len(router.Prefixes) > 0 {
+		prefixes = "prefixes " + strings.Join(router.Prefixes, ", ")
+	}
+	bm.alerts.raise("rogue-router-advertisement", SeverityCritical, bm.deviceKey(srcMAC, srcIP),
+		"Unexpected IPv6 router advertisement from %s (%s): %s, router lifetime %s",
+		srcMAC, srcIP, prefixes, time.Duration(router.Lifetime)*time.Second)
+}
+
+// REST API: Devices seen sending IPv6 router advertisements
+func (bm *BandwidthMonitor) handleGetRouters(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.routerAdverts.list())
+}
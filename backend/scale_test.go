@@ -0,0 +1,141 @@
+package main
+
+// Benchmarks of the per-tick work on conference and campus networks with
+// six-figure device counts. Run them with
+//
+//	go test -run '^$' -bench . -benchmem
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// benchDeviceCounts are the table sizes benchmarked
+var benchDeviceCounts = []int{1000, 10000, 100000}
+
+// benchMAC and benchIP are the addresses of the i-th benchmark device:
+// 192.168.0.0/16 first, then ULAs once that is used up
+func benchMAC(i int) string {
+	return fmt.Sprintf("02:42:%02x:%02x:%02x:%02x", byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+}
+
+func benchIP(i int) string {
+	if i < 1<<16 {
+		return fmt.Sprintf("192.168.%d.%d", i>>8, i&0xff)
+	}
+	return fmt.Sprintf("fd00::%x", i)
+}
+
+// benchMonitor returns a monitor with n devices that each sent to the
+// gateway, with different amounts so the sort has work to do
+func benchMonitor(b *testing.B, n int) *BandwidthMonitor {
+	b.Helper()
+	bm := NewBandwidthMonitor("")
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		bm.UpdateStatsWeighted("eth0", benchMAC(i), macGateway.String(), benchIP(i), ipServer.String(), "tcp", uint64(64+r.Intn(1<<20)), 1)
+	}
+	return bm
+}
+
+// benchTraffic adds traffic to one device in a hundred, as between two ticks
+func benchTraffic(bm *BandwidthMonitor, n int, r *rand.Rand) {
+	for j := 0; j < max(n/100, 1); j++ {
+		i := r.Intn(n)
+		bm.UpdateStatsWeighted("eth0", benchMAC(i), macGateway.String(), benchIP(i), ipServer.String(), "tcp", uint64(64+r.Intn(1<<16)), 1)
+	}
+}
+
+// BenchmarkGetNetworkStats measures the snapshot every broadcast tick takes,
+// with some traffic between ticks so the order changes a little
+func BenchmarkGetNetworkStats(b *testing.B) {
+	for _, n := range benchDeviceCounts {
+		b.Run(fmt.Sprintf("devices=%d", n), func(b *testing.B) {
+			bm := benchMonitor(b, n)
+			bm.GetNetworkStats() // the first tick has no previous order
+			r := rand.New(rand.NewSource(2))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				benchTraffic(bm, n, r)
+				b.StartTimer()
+				bm.GetNetworkStats()
+			}
+		})
+	}
+}
+
+// BenchmarkSortDevices measures a sort without a previous order, as for
+// ?sort= or the first tick
+func BenchmarkSortDevices(b *testing.B) {
+	for _, n := range benchDeviceCounts {
+		b.Run(fmt.Sprintf("devices=%d", n), func(b *testing.B) {
+			stats := benchMonitor(b, n).GetNetworkStats()
+			devices := make([]*DeviceStats, len(stats.Devices))
+			r := rand.New(rand.NewSource(3))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				copy(devices, stats.Devices)
+				r.Shuffle(len(devices), func(i, j int) { devices[i], devices[j] = devices[j], devices[i] })
+				b.StartTimer()
+				sortDevices(devices, []string{SortRate, SortName, SortBytes})
+			}
+		})
+	}
+}
+
+// BenchmarkBroadcastEncode measures encoding the update "all" clients get
+func BenchmarkBroadcastEncode(b *testing.B) {
+	for _, n := range benchDeviceCounts {
+		b.Run(fmt.Sprintf("devices=%d", n), func(b *testing.B) {
+			bm := benchMonitor(b, n)
+			top := bm.topStats(bm.GetNetworkStats())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := (jsonCodec{}).Marshal(top); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestStatsPages checks that paging through the device list visits every
+// device once, in order
+func TestStatsPages(t *testing.T) {
+	bm := NewBandwidthMonitor("")
+	for i := 0; i < 250; i++ {
+		bm.UpdateStatsWeighted("eth0", benchMAC(i), macGateway.String(), benchIP(i), ipServer.String(), "tcp", uint64(1000+i), 1)
+	}
+	stats := bm.GetNetworkStats()
+	if len(stats.Devices) != 250 {
+		t.Fatalf("got %d devices, want 250", len(stats.Devices))
+	}
+	seen := make(map[string]bool)
+	for offset := 0; offset < 250; offset += 100 {
+		page := stats.page(offset, 100)
+		if page.Offset != offset || page.DevicesOmitted != 250-len(page.Devices) {
+			t.Fatalf("page at %d: offset %d, %d omitted", offset, page.Offset, page.DevicesOmitted)
+		}
+		for i, dev := range page.Devices {
+			if seen[dev.MAC] {
+				t.Fatalf("%s listed twice", dev.MAC)
+			}
+			seen[dev.MAC] = true
+			if want := benchMAC(249 - offset - i); dev.MAC != want {
+				t.Fatalf("position %d: got %s, want %s", offset+i, dev.MAC, want)
+			}
+		}
+	}
+	if len(seen) != 250 {
+		t.Fatalf("pages listed %d devices, want 250", len(seen))
+	}
+
+	// The order follows the traffic from one snapshot to the next
+	bm.UpdateStatsWeighted("eth0", benchMAC(0), macGateway.String(), benchIP(0), ipServer.String(), "tcp", 1<<20, 1)
+	if got := bm.GetNetworkStats().Devices[0].MAC; got != benchMAC(0) {
+		t.Fatalf("busiest device is %s, want %s", got, benchMAC(0))
+	}
+}
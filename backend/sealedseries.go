@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// sealedMinutesSchema holds the history when -encryption-key is set: one row
+// per minute with the traffic of every device sealed together, so neither
+// device addresses nor amounts are stored in plaintext; only the minutes
+// that saw traffic are visible.
+const sealedMinutesSchema = `CREATE TABLE IF NOT EXISTS sealed_minutes (
+	minute INTEGER PRIMARY KEY, -- Unix time of the minute's start
+	data   BLOB    NOT NULL     -- sealed JSON: device -> [bytes sent, received, packets sent, received]
+)`
+
+// checkSealing makes the tables match the key: with a key, plaintext
+// minutes written before encryption was enabled are sealed; without one,
+// sealed minutes cannot be read
+func (s *seriesDB) checkSealing() error {
+	if s.sealer == nil {
+		var sealed bool
+		if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM sealed_minutes)`).Scan(&sealed); err != nil {
+			return err
+		}
+		if sealed {
+			return errors.New("history is encrypted; set -encryption-key or -encryption-key-file")
+		}
+		return nil
+	}
+
+	rows, err := s.db.Query(`SELECT minute, device, bytes_sent, bytes_recv, packets_sent, packets_recv FROM device_minutes`)
+	if err != nil {
+		return err
+	}
+	minutes := make(map[int64]map[string]deviceCounters)
+	n := 0
+	for rows.Next() {
+		var minute int64
+		var device string
+		var c [4]int64
+		if err := rows.Scan(&minute, &device, &c[0], &c[1], &c[2], &c[3]); err != nil {
+			rows.Close()
+			return err
+		}
+		if minutes[minute] == nil {
+			minutes[minute] = make(map[string]deviceCounters)
+		}
+		minutes[minute][device] = deviceCounters{uint64(c[0]), uint64(c[1]), uint64(c[2]), uint64(c[3])}
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || n == 0 {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = s.addSealedMinutes(tx, minutes)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM device_minutes`)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Encrypted %d plaintext history rows", n)
+	return nil
+}
+
+// sealMinute seals the traffic of one minute
+func (s *seriesDB) sealMinute(devices map[string]deviceCounters) ([]byte, error) {
+	plain := make(map[string][4]uint64, len(devices))
+	for device, c := range devices {
+		plain[device] = [4]uint64{c.bytesSent, c.bytesRecv, c.packetsSent, c.packetsRecv}
+	}
+	data, err := json.Marshal(plain)
+	if err != nil {
+		return nil, err
+	}
+	return s.sealer.seal(data), nil
+}
+
+// openMinute returns the traffic of a minute sealed by sealMinute
+func (s *seriesDB) openMinute(minute int64, sealed []byte) (map[string]deviceCounters, error) {
+	data, err := s.sealer.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("history minute %s: %v", time.Unix(minute, 0).Format(time.RFC3339), err)
+	}
+	var plain map[string][4]uint64
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return nil, fmt.Errorf("history minute %s: %v", time.Unix(minute, 0).Format(time.RFC3339), err)
+	}
+	devices := make(map[string]deviceCounters, len(plain))
+	for device, c := range plain {
+		devices[device] = deviceCounters{c[0], c[1], c[2], c[3]}
+	}
+	return devices, nil
+}
+
+// addSealedMinutes adds traffic to sealed minutes, opening and resealing
+// the minutes that already have some
+func (s *seriesDB) addSealedMinutes(tx *sql.Tx, minutes map[int64]map[string]deviceCounters) error {
+	for minute, deltas := range minutes {
+		if len(deltas) == 0 {
+			continue
+		}
+		devices := make(map[string]deviceCounters, len(deltas))
+		var sealed []byte
+		switch err := tx.QueryRow(`SELECT data FROM sealed_minutes WHERE minute = ?`, minute).Scan(&sealed); {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return err
+		default:
+			if devices, err = s.openMinute(minute, sealed); err != nil {
+				return err
+			}
+		}
+		for device, d := range deltas {
+			devices[device] = devices[device].plus(d)
+		}
+		if err := s.putSealedMinute(tx, minute, devices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putSealedMinute replaces the traffic of a minute
+func (s *seriesDB) putSealedMinute(tx *sql.Tx, minute int64, devices map[string]deviceCounters) error {
+	data, err := s.sealMinute(devices)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO sealed_minutes (minute, data) VALUES (?, ?)
+		ON CONFLICT (minute) DO UPDATE SET data = excluded.data`, minute, data)
+	return err
+}
+
+// mergeSealed moves the sealed minutes of device from onto device into
+func (s *seriesDB) mergeSealed(tx *sql.Tx, from, into string) error {
+	// Every minute has to be opened to find the device, so they are read
+	// before any is rewritten
+	rows, err := tx.Query(`SELECT minute, data FROM sealed_minutes`)
+	if err != nil {
+		return err
+	}
+	changed := make(map[int64]map[string]deviceCounters)
+	for rows.Next() {
+		var minute int64
+		var sealed []byte
+		if err := rows.Scan(&minute, &sealed); err != nil {
+			rows.Close()
+			return err
+		}
+		devices, err := s.openMinute(minute, sealed)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if c, ok := devices[from]; ok {
+			devices[into] = devices[into].plus(c)
+			delete(devices, from)
+			changed[minute] = devices
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for minute, devices := range changed {
+		if err := s.putSealedMinute(tx, minute, devices); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachSealedMinute opens the sealed minutes in [from, to) in order
+func (s *seriesDB) eachSealedMinute(from, to time.Time, fn func(minute int64, devices map[string]deviceCounters)) error {
+	rows, err := s.db.Query(`SELECT minute, data FROM sealed_minutes WHERE minute >= ? AND minute < ? ORDER BY minute`,
+		from.Unix(), to.Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var minute int64
+		var sealed []byte
+		if err := rows.Scan(&minute, &sealed); err != nil {
+			return err
+		}
+		devices, err := s.openMinute(minute, sealed)
+		if err != nil {
+			return err
+		}
+		fn(minute, devices)
+	}
+	return rows.Err()
+}
+
+// downsampleSealed is downsample over the sealed minutes
+func (s *seriesDB) downsampleSealed(from, to time.Time, step time.Duration) ([]seriesRow, error) {
+	type stepDevice struct {
+		step   int
+		device string
+	}
+	sums := make(map[stepDevice]traffic)
+	stepSeconds := int64(step / time.Second)
+	err := s.eachSealedMinute(from, to, func(minute int64, devices map[string]deviceCounters) {
+		i := int((minute - from.Unix()) / stepSeconds)
+		for device, c := range devices {
+			t := sums[stepDevice{i, device}]
+			sums[stepDevice{i, device}] = traffic{t.sent + c.bytesSent, t.recv + c.bytesRecv}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]seriesRow, 0, len(sums))
+	for k, t := range sums {
+		result = append(result, seriesRow{step: k.step, device: k.device, traffic: t})
+	}
+	return result, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxServicePairs caps the client-server pairs tracked per service summary
+const maxServicePairs = 4096
+
+// Internal service categories
+const (
+	ServiceCategoryFile  = "file"
+	ServiceCategoryPrint = "print"
+)
+
+// lanService is a file or print service recognised by its server port
+type lanService struct {
+	name     string
+	category string
+}
+
+// lanServices are the file and print services summarised per client and
+// server, by transport port
+var lanServices = map[portKey]lanService{
+	{"tcp", 445}:  {"smb", ServiceCategoryFile},
+	{"tcp", 139}:  {"smb", ServiceCategoryFile}, // SMB over NetBIOS
+	{"tcp", 2049}: {"nfs", ServiceCategoryFile},
+	{"udp", 2049}: {"nfs", ServiceCategoryFile},
+	{"tcp", 548}:  {"afp", ServiceCategoryFile},
+	{"tcp", 631}:  {"ipp", ServiceCategoryPrint},
+	{"tcp", 515}:  {"lpd", ServiceCategoryPrint},
+	{"tcp", 9100}: {"jetdirect", ServiceCategoryPrint},
+}
+
+// ServicePair is one client's use of a file or print service on one server.
+// Written is client to server (uploads, print jobs), Read the replies.
+type ServicePair struct {
+	Service      string    `json:"service"`
+	Category     string    `json:"category"`
+	ClientIP     string    `json:"clientIp"`
+	ClientMAC    string    `json:"clientMac,omitempty"`
+	ClientName   string    `json:"clientName,omitempty"`
+	ServerIP     string    `json:"serverIp"`
+	ServerMAC    string    `json:"serverMac,omitempty"`
+	ServerName   string    `json:"serverName,omitempty"`
+	BytesWritten uint64    `json:"bytesWritten"`
+	BytesRead    uint64    `json:"bytesRead"`
+	Packets      uint64    `json:"packets"`
+	Connections  uint64    `json:"connections"` // TCP connections opened
+	WriteRateBps float64   `json:"writeRateBps"`
+	ReadRateBps  float64   `json:"readRateBps"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+
+	rate *rateCounter // sent = written, recv = read
+}
+
+// ServiceTotal is a service's traffic over all its clients and servers
+type ServiceTotal struct {
+	Service      string  `json:"service"`
+	Category     string  `json:"category"`
+	BytesWritten uint64  `json:"bytesWritten"`
+	BytesRead    uint64  `json:"bytesRead"`
+	Clients      int     `json:"clients"`
+	Servers      int     `json:"servers"`
+	RateBps      float64 `json:"rateBps"` // both directions
+}
+
+// ServiceSummary is the file and print service usage, busiest first
+type ServiceSummary struct {
+	Since    time.Time      `json:"since"`
+	Services []ServiceTotal `json:"services"`
+	Pairs    []ServicePair  `json:"pairs"`
+}
+
+// servicePairKey identifies a client-server pair of one service
+type servicePairKey struct {
+	service, client, server string
+}
+
+// serviceUsage accumulates file and print service traffic per client-server
+// pair
+type serviceUsage struct {
+	mu    sync.Mutex
+	pairs map[servicePairKey]*ServicePair
+	since time.Time
+}
+
+// newServiceUsage creates an empty service accumulator
+func newServiceUsage() *serviceUsage {
+	return &serviceUsage{pairs: make(map[servicePairKey]*ServicePair), since: time.Now()}
+}
+
+// observe accounts a packet of a file or print service to its pair
+func (u *serviceUsage) observe(pi *packetInfo, packets uint64, now time.Time) {
+	if pi.transport == "" || pi.srcIP == "" || pi.dstIP == "" {
+		return
+	}
+	// The server is the end on the service port; the client's ephemeral
+	// port is checked second in case it collides with one
+	toServer := true
+	svc, ok := lanServices[portKey{pi.transport, pi.dstPort}]
+	if !ok {
+		if svc, ok = lanServices[portKey{pi.transport, pi.srcPort}]; !ok {
+			return
+		}
+		toServer = false
+	}
+	clientIP, clientMAC, serverIP, serverMAC := pi.srcIP, pi.srcMAC, pi.dstIP, pi.dstMAC
+	if !toServer {
+		clientIP, clientMAC, serverIP, serverMAC = pi.dstIP, pi.dstMAC, pi.srcIP, pi.srcMAC
+	}
+	key := servicePairKey{svc.name, clientIP, serverIP}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	pair, ok := u.pairs[key]
+	if !ok {
+		if len(u.pairs) >= maxServicePairs {
+			return
+		}
+		pair = &ServicePair{Service: svc.name, Category: svc.category, ClientIP: clientIP, ServerIP: serverIP,
+			FirstSeen: now, rate: &rateCounter{}}
+		u.pairs[key] = pair
+	}
+	if pair.ClientMAC == "" {
+		pair.ClientMAC = clientMAC
+	}
+	if pair.ServerMAC == "" {
+		pair.ServerMAC = serverMAC
+	}
+	if toServer {
+		pair.BytesWritten += pi.size
+	} else {
+		pair.BytesRead += pi.size
+	}
+	pair.rate.add(now, pi.size, toServer)
+	pair.Packets += packets
+	if pi.tcpSYN && toServer {
+		pair.Connections++
+	}
+	pair.LastSeen = now
+}
+
+// reset drops all pairs, starting the summary over
+func (u *serviceUsage) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pairs = make(map[servicePairKey]*ServicePair)
+	u.since = time.Now()
+}
+
+// summary returns the pairs matching service and server (empty for any),
+// with the totals of every service, both busiest first; at most n pairs
+// when n > 0
+func (u *serviceUsage) summary(service, server string, n int, now time.Time) ServiceSummary {
+	u.mu.Lock()
+	result := ServiceSummary{Since: u.since, Services: make([]ServiceTotal, 0), Pairs: make([]ServicePair, 0)}
+	totals := make(map[string]*ServiceTotal)
+	clients := make(map[string]map[string]bool)
+	servers := make(map[string]map[string]bool)
+	for _, p := range u.pairs {
+		pair := *p
+		pair.WriteRateBps, pair.ReadRateBps = p.rate.bps(now, rateWindow)
+		t, ok := totals[p.Service]
+		if !ok {
+			t = &ServiceTotal{Service: p.Service, Category: p.Category}
+			totals[p.Service] = t
+			clients[p.Service] = make(map[string]bool)
+			servers[p.Service] = make(map[string]bool)
+		}
+		t.BytesWritten += p.BytesWritten
+		t.BytesRead += p.BytesRead
+		t.RateBps += pair.WriteRateBps + pair.ReadRateBps
+		clients[p.Service][p.ClientIP] = true
+		servers[p.Service][p.ServerIP] = true
+		if (service == "" || p.Service == service) && (server == "" || p.ServerIP == server) {
+			result.Pairs = append(result.Pairs, pair)
+		}
+	}
+	u.mu.Unlock()
+
+	for name, t := range totals {
+		t.Clients, t.Servers = len(clients[name]), len(servers[name])
+		result.Services = append(result.Services, *t)
+	}
+	sort.Slice(result.Services, func(i, j int) bool {
+		a, b := result.Services[i], result.Services[j]
+		if ta, tb := a.BytesWritten+a.BytesRead, b.BytesWritten+b.BytesRead; ta != tb {
+			return ta > tb
+		}
+		return a.Service < b.Service
+	})
+	sort.Slice(result.Pairs, func(i, j int) bool {
+		a, b := result.Pairs[i], result.Pairs[j]
+		if ta, tb := a.BytesWritten+a.BytesRead, b.BytesWritten+b.BytesRead; ta != tb {
+			return ta > tb
+		}
+		if a.ServerIP != b.ServerIP {
+			return a.ServerIP < b.ServerIP
+		}
+		return a.ClientIP < b.ClientIP
+	})
+	if n > 0 && len(result.Pairs) > n {
+		result.Pairs = result.Pairs[:n]
+	}
+	return result
+}
+
+// ObserveServices accounts SMB, NFS, AFP and print traffic per client and
+// server
+func (bm *BandwidthMonitor) ObserveServices(pi *packetInfo, packets uint64) {
+	bm.services.observe(pi, packets, time.Now())
+}
+
+// REST API: File and print service usage (SMB, NFS, AFP, IPP, ...) per
+// client-server pair, busiest first, answering who is hammering the NAS.
+// ?service= and ?server= (IP) filter the pairs, ?n= limits them (default 50).
+func (bm *BandwidthMonitor) handleGetServiceUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n := 50
+	if s := q.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	summary := bm.services.summary(q.Get("service"), q.Get("server"), n, time.Now())
+	for i := range summary.Pairs {
+		p := &summary.Pairs[i]
+		p.ClientName = bm.endpointName(p.ClientMAC, p.ClientIP)
+		p.ServerName = bm.endpointName(p.ServerMAC, p.ServerIP)
+	}
+	writeEncoded(w, r, summary)
+}
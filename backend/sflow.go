@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// sFlow v5 structures read by the collector (sflow.org/sflow_version_5.txt)
+const (
+	sflowFlowSample         = 1 // enterprise 0 sample formats
+	sflowExpandedFlowSample = 3
+	sflowRawPacketHeader    = 1 // flow record format
+	// Header protocols of a raw packet header record
+	sflowHeaderEthernet = 1
+	sflowHeaderIPv4     = 11
+	sflowHeaderIPv6     = 12
+)
+
+// sflowReader reads the XDR-encoded fields of an sFlow datagram
+type sflowReader struct {
+	b   []byte
+	err error
+}
+
+// u32 reads a 32-bit unsigned integer
+func (r *sflowReader) u32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errors.New("datagram truncated")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+// bytes reads n bytes, skipping the XDR padding to a multiple of 4
+func (r *sflowReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || n < 0 || len(r.b) < padded {
+		r.err = errors.New("datagram truncated")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+// sflowDecoders decodes sampled headers, one decoder per header protocol;
+// like packetDecoder they serve one listener goroutine
+type sflowDecoders map[uint32]*packetDecoder
+
+// newSFlowDecoders creates the decoders of the supported header protocols
+func newSFlowDecoders() sflowDecoders {
+	return sflowDecoders{
+		sflowHeaderEthernet: newPacketDecoder(layers.LinkTypeEthernet),
+		sflowHeaderIPv4:     newPacketDecoder(layers.LinkTypeIPv4),
+		sflowHeaderIPv6:     newPacketDecoder(layers.LinkTypeIPv6),
+	}
+}
+
+// handleSFlow accounts the packet samples of an sFlow v5 datagram. Each
+// sampled header goes through the same decoding as captured packets,
+// weighted by the sampling rate; counter samples are ignored.
+func (c *flowCollector) handleSFlow(decoders sflowDecoders, data []byte, addr string) {
+	r := &sflowReader{b: data}
+	if v := r.u32(); r.err == nil && v != 5 {
+		c.record(CollectorSFlow, addr, 0, 0, 0, fmt.Errorf("unsupported version %d", v))
+		return
+	}
+	// The agent address identifies the switch even behind NAT
+	switch r.u32() {
+	case 1:
+		if agent := r.bytes(4); agent != nil {
+			addr = net.IP(agent).String()
+		}
+	case 2:
+		if agent := r.bytes(16); agent != nil {
+			addr = net.IP(agent).String()
+		}
+	}
+	r.u32() // sub-agent ID
+	r.u32() // sequence number
+	r.u32() // uptime
+	samples := r.u32()
+	iface := CollectorSFlow + ":" + addr
+
+	var records, bytes uint64
+	for i := uint32(0); i < samples && r.err == nil; i++ {
+		format, length := r.u32(), r.u32()
+		sample := &sflowReader{b: r.bytes(int(length)), err: r.err}
+		if r.err != nil {
+			break
+		}
+		if format != sflowFlowSample && format != sflowExpandedFlowSample {
+			continue
+		}
+		sample.u32() // sequence number
+		sample.u32() // source ID (type and index when expanded)
+		if format == sflowExpandedFlowSample {
+			sample.u32()
+		}
+		rate := uint64(sample.u32())
+		sample.u32() // sample pool
+		sample.u32() // drops
+		if format == sflowExpandedFlowSample {
+			sample.u32() // input interface format and value
+			sample.u32()
+			sample.u32() // output interface format and value
+			sample.u32()
+		} else {
+			sample.u32() // input and output interface
+			sample.u32()
+		}
+		flowRecords := sample.u32()
+		for j := uint32(0); j < flowRecords && sample.err == nil; j++ {
+			recordFormat, recordLength := sample.u32(), sample.u32()
+			rec := &sflowReader{b: sample.bytes(int(recordLength)), err: sample.err}
+			if sample.err != nil || recordFormat != sflowRawPacketHeader {
+				continue
+			}
+			protocol := rec.u32()
+			frameLength := uint64(rec.u32())
+			stripped := uint64(rec.u32())
+			header := rec.bytes(int(rec.u32()))
+			dec, ok := decoders[protocol]
+			if rec.err != nil || !ok {
+				continue
+			}
+			// The length on the wire less what the agent stripped (the FCS)
+			if stripped < frameLength {
+				frameLength -= stripped
+			}
+			weight := max(rate, 1)
+			c.bm.processFrame(c.bm.statsQueue, dec, header, frameLength, weight, iface, nil)
+			bytes += frameLength * weight
+			records++
+		}
+		if sample.err != nil {
+			r.err = sample.err
+		}
+	}
+	c.record(CollectorSFlow, addr, records, bytes, 0, r.err)
+}
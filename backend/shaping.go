@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Shaping command limits
+const (
+	shapingTick           = 10 * time.Second
+	shapingCommandTimeout = 10 * time.Second
+)
+
+// ShapingRule turns alerts into enforcement: when an alert of one of Types
+// (with at least MinSeverity) fires for a device, the Apply commands run,
+// e.g. a tc class or nftables limit for the device's address. Remove undoes
+// them after Duration, when an alert of one of LiftOn fires for the device
+// (say quota-reset for a "quota" rule), when lifted over the API, or on
+// shutdown.
+//
+// Commands are argument lists run without a shell. Each argument is a
+// text/template over {{.Device}}, {{.MAC}}, {{.IP}}, {{.Rule}},
+// {{.AlertType}} and {{.AlertID}}.
+//
+// For example, to throttle a child's tablet to 1 Mbit/s once its daily
+// quota (PUT /api/quotas/{mac}) is used up, until the quota starts over
+// at midnight, given an nftables set "throttled" that a rate-limiting
+// forward rule matches on:
+//
+//	{"rules": [{
+//	  "name": "quota-throttle",
+//	  "types": ["quota"],
+//	  "liftOn": ["quota-reset"],
+//	  "apply": [["nft", "add", "element", "inet", "filter", "throttled", "{ {{.IP}} }"]],
+//	  "remove": [["nft", "delete", "element", "inet", "filter", "throttled", "{ {{.IP}} }"]]
+//	}]}
+type ShapingRule struct {
+	Name        string     `json:"name"`
+	Types       []string   `json:"types"` // required, so nothing is enforced by accident
+	MinSeverity string     `json:"minSeverity,omitempty"`
+	Devices     []string   `json:"devices,omitempty"`  // device keys; any when empty
+	Apply       [][]string `json:"apply"`              // commands limiting the device
+	Remove      [][]string `json:"remove,omitempty"`   // commands lifting the limit
+	Duration    string     `json:"duration,omitempty"` // lift after, e.g. "1h"; empty = until lifted
+	LiftOn      []string   `json:"liftOn,omitempty"`   // alert types lifting the limit early
+
+	apply, remove [][]*template.Template
+	duration      time.Duration
+}
+
+// matches reports whether the rule applies to alert
+func (r *ShapingRule) matches(alert Alert) bool {
+	if alert.Device == "" {
+		return false
+	}
+	if r.MinSeverity != "" && severityRank[alert.Severity] < severityRank[r.MinSeverity] {
+		return false
+	}
+	if len(r.Devices) > 0 && !containsString(r.Devices, alert.Device) {
+		return false
+	}
+	return containsString(r.Types, alert.Type)
+}
+
+// shapingConfig is the on-disk format of the -shaping-file
+type shapingConfig struct {
+	Rules []ShapingRule `json:"rules"`
+}
+
+// shapingTarget is what command templates are executed with
+type shapingTarget struct {
+	Device, MAC, IP, Rule, AlertType string
+	AlertID                          uint64
+}
+
+// ShapedDevice is a device currently limited by a shaping rule
+type ShapedDevice struct {
+	Device  string     `json:"device"`
+	Rule    string     `json:"rule"`
+	AlertID uint64     `json:"alertId"`
+	Since   time.Time  `json:"since"`
+	Until   *time.Time `json:"until,omitempty"`
+
+	rule   *ShapingRule
+	target shapingTarget
+}
+
+// shaper applies and lifts shaping rules. Commands run in order on one
+// worker, so a limit is never lifted before it was applied.
+type shaper struct {
+	mu     sync.Mutex
+	rules  []*ShapingRule
+	active map[string]*ShapedDevice // by device key
+	queue  [][]string               // commands waiting to run
+	wake   chan struct{}
+	run    func(argv []string) error
+}
+
+// loadShaper reads the shaping file at path
+func loadShaper(path string) (*shaper, error) {
+	var cfg shapingConfig
+	if err := loadJSONFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	s := &shaper{active: make(map[string]*ShapedDevice), wake: make(chan struct{}, 1), run: runShapingCommand}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if len(r.Types) == 0 || len(r.Apply) == 0 {
+			return nil, fmt.Errorf("rule %q: needs types and apply", r.Name)
+		}
+		if _, ok := severityRank[r.MinSeverity]; r.MinSeverity != "" && !ok {
+			return nil, fmt.Errorf("rule %q: invalid minSeverity %q", r.Name, r.MinSeverity)
+		}
+		if r.Duration != "" {
+			d, err := time.ParseDuration(r.Duration)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("rule %q: invalid duration %q", r.Name, r.Duration)
+			}
+			r.duration = d
+		}
+		var err error
+		if r.apply, err = parseShapingCommands(r.Apply); err != nil {
+			return nil, fmt.Errorf("rule %q apply: %v", r.Name, err)
+		}
+		if r.remove, err = parseShapingCommands(r.Remove); err != nil {
+			return nil, fmt.Errorf("rule %q remove: %v", r.Name, err)
+		}
+		s.rules = append(s.rules, r)
+	}
+	return s, nil
+}
+
+// parseShapingCommands parses the argument templates of commands
+func parseShapingCommands(commands [][]string) ([][]*template.Template, error) {
+	parsed := make([][]*template.Template, 0, len(commands))
+	for i, argv := range commands {
+		if len(argv) == 0 {
+			return nil, fmt.Errorf("command %d is empty", i)
+		}
+		args := make([]*template.Template, 0, len(argv))
+		for _, arg := range argv {
+			t, err := template.New("").Option("missingkey=error").Parse(arg)
+			if err != nil {
+				return nil, fmt.Errorf("command %d: %v", i, err)
+			}
+			args = append(args, t)
+		}
+		parsed = append(parsed, args)
+	}
+	return parsed, nil
+}
+
+// expandShapingCommands renders commands for target
+func expandShapingCommands(commands [][]*template.Template, target shapingTarget) ([][]string, error) {
+	expanded := make([][]string, 0, len(commands))
+	for _, args := range commands {
+		argv := make([]string, 0, len(args))
+		for _, t := range args {
+			var b strings.Builder
+			if err := t.Execute(&b, target); err != nil {
+				return nil, err
+			}
+			argv = append(argv, b.String())
+		}
+		expanded = append(expanded, argv)
+	}
+	return expanded, nil
+}
+
+// runShapingCommand runs one command, logging its output on failure
+func runShapingCommand(argv []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shapingCommandTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// enqueue schedules commands; caller holds s.mu
+func (s *shaper) enqueue(commands [][]string) {
+	s.queue = append(s.queue, commands...)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// shape applies the first rule matching alert to its device. A device
+// already limited keeps its limit, extended when the rule has a duration.
+func (s *shaper) shape(alert Alert, target shapingTarget) {
+	if s.liftsOn(alert) {
+		s.lift(alert.Device)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sd, ok := s.active[alert.Device]; ok {
+		if sd.rule.matches(alert) && sd.Until != nil {
+			until := alert.Time.Add(sd.rule.duration)
+			sd.Until = &until
+		}
+		return
+	}
+	for _, r := range s.rules {
+		if !r.matches(alert) {
+			continue
+		}
+		target.Rule, target.AlertType, target.AlertID = r.Name, alert.Type, alert.ID
+		commands, err := expandShapingCommands(r.apply, target)
+		if err != nil {
+			log.Printf("Error expanding shaping rule %q for %s: %v", r.Name, alert.Device, err)
+			return
+		}
+		sd := &ShapedDevice{Device: alert.Device, Rule: r.Name, AlertID: alert.ID, Since: alert.Time, rule: r, target: target}
+		if r.duration > 0 {
+			until := alert.Time.Add(r.duration)
+			sd.Until = &until
+		}
+		s.active[alert.Device] = sd
+		s.enqueue(commands)
+		log.Printf("Shaping %s by rule %q after alert %d", alert.Device, r.Name, alert.ID)
+		return
+	}
+}
+
+// liftsOn reports whether alert lifts the limit of its device
+func (s *shaper) liftsOn(alert Alert) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sd, ok := s.active[alert.Device]
+	return ok && containsString(sd.rule.LiftOn, alert.Type)
+}
+
+// lift removes the limit on device; it reports whether there was one
+func (s *shaper) lift(device string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sd, ok := s.active[device]
+	if !ok {
+		return false
+	}
+	delete(s.active, device)
+	commands, err := expandShapingCommands(sd.rule.remove, sd.target)
+	if err != nil {
+		log.Printf("Error expanding shaping rule %q for %s: %v", sd.Rule, device, err)
+		return true
+	}
+	s.enqueue(commands)
+	log.Printf("Lifted shaping of %s (rule %q)", device, sd.Rule)
+	return true
+}
+
+// expire lifts the limits whose duration has passed
+func (s *shaper) expire(now time.Time) {
+	s.mu.Lock()
+	var expired []string
+	for device, sd := range s.active {
+		if sd.Until != nil && now.After(*sd.Until) {
+			expired = append(expired, device)
+		}
+	}
+	s.mu.Unlock()
+	for _, device := range expired {
+		s.lift(device)
+	}
+}
+
+// list returns the limited devices
+func (s *shaper) list() []ShapedDevice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ShapedDevice, 0, len(s.active))
+	for _, sd := range s.active {
+		list = append(list, *sd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	return list
+}
+
+// drain runs the queued commands
+func (s *shaper) drain() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		argv := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		if err := s.run(argv); err != nil {
+			log.Printf("Shaping command %q failed: %v", argv, err)
+		}
+	}
+}
+
+// shapeAlert is the alert subscriber applying shaping rules
+func (bm *BandwidthMonitor) shapeAlert(alert Alert) {
+	target := shapingTarget{Device: alert.Device}
+	bm.mutex.RLock()
+	if dev, ok := bm.devices.load(alert.Device, time.Now()); ok {
+		target.MAC, target.IP = dev.MAC, dev.IP
+	}
+	bm.mutex.RUnlock()
+	bm.shaping.shape(alert, target)
+}
+
+// liftAll lifts every limit and runs the commands before returning; called
+// on shutdown so no limit outlives the monitor that would have removed it
+func (s *shaper) liftAll() {
+	for _, sd := range s.list() {
+		s.lift(sd.Device)
+	}
+	s.drain()
+}
+
+// runShaping runs shaping commands and lifts expired limits until stop is
+// closed
+func (bm *BandwidthMonitor) runShaping(stop <-chan struct{}) {
+	ticker := time.NewTicker(shapingTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.shaping.expire(now)
+		case <-bm.shaping.wake:
+		}
+		bm.shaping.drain()
+	}
+}
+
+// REST API: Devices limited by shaping rules
+func (bm *BandwidthMonitor) handleGetShaping(w http.ResponseWriter, r *http.Request) {
+	if bm.shaping == nil {
+		http.Error(w, "Traffic shaping not configured (-shaping-file)", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, bm.shaping.list())
+}
+
+// REST API: Lift the limit on a device now
+func (bm *BandwidthMonitor) handleLiftShaping(w http.ResponseWriter, r *http.Request) {
+	if bm.shaping == nil {
+		http.Error(w, "Traffic shaping not configured (-shaping-file)", http.StatusNotFound)
+		return
+	}
+	if !bm.shaping.lift(mux.Vars(r)["mac"]) {
+		http.Error(w, "Device not shaped", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "lifted"})
+}
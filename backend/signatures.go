@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signatureAlertInterval limits alerts of one rule for one device
+const signatureAlertInterval = 10 * time.Minute
+
+// SignatureRule raises a "signature" alert for packets of Protocol to or
+// from one of Ports whose payload (as far as the snaplen captured it)
+// contains Contains (text, or Hex bytes) or matches Regex. It is no IDS:
+// there is no stream reassembly, so a pattern split across packets is
+// missed. Examples: telnet logins (tcp/23, "login:"), SMBv1 (tcp/445, hex
+// "ff534d42").
+type SignatureRule struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Protocol    string   `json:"protocol,omitempty"` // tcp, udp or empty for both
+	Ports       []uint16 `json:"ports,omitempty"`    // source or destination; any when empty
+	Contains    string   `json:"contains,omitempty"`
+	Hex         string   `json:"hex,omitempty"`
+	Regex       string   `json:"regex,omitempty"`
+	NoCase      bool     `json:"nocase,omitempty"` // Contains ignores case
+	Severity    string   `json:"severity,omitempty"`
+
+	pattern []byte
+	regex   *regexp.Regexp
+	hits    uint64
+	last    time.Time
+}
+
+// matches reports whether a packet's payload and ports match the rule.
+// lower holds the lowercased payload, filled in by the first NoCase rule
+// that needs it, so a packet is lowercased at most once.
+func (r *SignatureRule) matches(pi *packetInfo, lower *[]byte) bool {
+	if r.Protocol != "" && r.Protocol != pi.transport {
+		return false
+	}
+	if len(r.Ports) > 0 && !containsPort(r.Ports, pi.srcPort) && !containsPort(r.Ports, pi.dstPort) {
+		return false
+	}
+	if r.pattern != nil {
+		if r.NoCase {
+			if *lower == nil {
+				*lower = bytes.ToLower(pi.payload)
+			}
+			if !bytes.Contains(*lower, r.pattern) {
+				return false
+			}
+		} else if !bytes.Contains(pi.payload, r.pattern) {
+			return false
+		}
+	}
+	return r.regex == nil || r.regex.Match(pi.payload)
+}
+
+// containsPort reports whether list contains port
+func containsPort(list []uint16, port uint16) bool {
+	for _, p := range list {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureConfig is the on-disk format of the -signatures-file
+type signatureConfig struct {
+	Rules []SignatureRule `json:"rules"`
+}
+
+// SignatureStatus is a rule with how often it matched
+type SignatureStatus struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Severity    string     `json:"severity"`
+	Hits        uint64     `json:"hits"`
+	LastHit     *time.Time `json:"lastHit,omitempty"`
+}
+
+// signatureMatcher applies signature rules to captured payloads
+type signatureMatcher struct {
+	mu        sync.Mutex
+	rules     []*SignatureRule
+	lastAlert map[string]time.Time // by rule and device
+	lastPrune time.Time
+}
+
+// loadSignatures reads the rules file at path
+func loadSignatures(path string) (*signatureMatcher, error) {
+	var cfg signatureConfig
+	if err := loadJSONFile(path, &cfg); err != nil {
+		return nil, err
+	}
+	m := &signatureMatcher{lastAlert: make(map[string]time.Time)}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d: needs a name", i)
+		}
+		r.Protocol = strings.ToLower(r.Protocol)
+		if r.Protocol != "" && r.Protocol != "tcp" && r.Protocol != "udp" {
+			return nil, fmt.Errorf("rule %q: invalid protocol %q (want tcp, udp or empty)", r.Name, r.Protocol)
+		}
+		if r.Severity == "" {
+			r.Severity = SeverityWarning
+		}
+		if _, ok := severityRank[r.Severity]; !ok {
+			return nil, fmt.Errorf("rule %q: invalid severity %q", r.Name, r.Severity)
+		}
+		switch {
+		case r.Contains != "" && r.Hex != "":
+			return nil, fmt.Errorf("rule %q: contains and hex are exclusive", r.Name)
+		case r.Contains != "":
+			r.pattern = []byte(r.Contains)
+		case r.Hex != "":
+			b, err := hex.DecodeString(strings.ReplaceAll(r.Hex, " ", ""))
+			if err != nil || len(b) == 0 {
+				return nil, fmt.Errorf("rule %q: invalid hex %q", r.Name, r.Hex)
+			}
+			r.pattern = b
+		}
+		if r.NoCase && r.pattern != nil {
+			r.pattern = bytes.ToLower(r.pattern)
+		}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+			}
+			r.regex = re
+		}
+		if r.pattern == nil && r.regex == nil {
+			return nil, fmt.Errorf("rule %q: needs contains, hex or regex", r.Name)
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m, nil
+}
+
+// match returns the rules matching a packet that are due an alert for
+// device, counting every match
+func (m *signatureMatcher) match(pi *packetInfo, device string, now time.Time) []*SignatureRule {
+	var due []*SignatureRule
+	var lower []byte
+	for _, r := range m.rules {
+		if !r.matches(pi, &lower) {
+			continue
+		}
+		m.mu.Lock()
+		m.prune(now)
+		r.hits++
+		r.last = now
+		key := r.Name + "|" + device
+		if now.Sub(m.lastAlert[key]) >= signatureAlertInterval {
+			m.lastAlert[key] = now
+			due = append(due, r)
+		}
+		m.mu.Unlock()
+	}
+	return due
+}
+
+// prune forgets alert times older than signatureAlertInterval, at most once
+// per interval, so lastAlert only holds devices alerted on recently;
+// caller holds m.mu
+func (m *signatureMatcher) prune(now time.Time) {
+	if now.Sub(m.lastPrune) < signatureAlertInterval {
+		return
+	}
+	m.lastPrune = now
+	for key, t := range m.lastAlert {
+		if now.Sub(t) >= signatureAlertInterval {
+			delete(m.lastAlert, key)
+		}
+	}
+}
+
+// status lists the rules with their hit counts
+func (m *signatureMatcher) status() []SignatureStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]SignatureStatus, 0, len(m.rules))
+	for _, r := range m.rules {
+		s := SignatureStatus{Name: r.Name, Description: r.Description, Severity: r.Severity, Hits: r.hits}
+		if !r.last.IsZero() {
+			last := r.last
+			s.LastHit = &last
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// ObserveSignatures raises alerts for payloads matching signature rules
+func (bm *BandwidthMonitor) ObserveSignatures(pi *packetInfo) {
+	if bm.signatures == nil || len(pi.payload) == 0 {
+		return
+	}
+	device := bm.deviceKey(pi.srcMAC, pi.srcIP)
+	for _, r := range bm.signatures.match(pi, device, time.Now()) {
+		what := r.Name
+		if r.Description != "" {
+			what += " (" + r.Description + ")"
+		}
+		bm.alerts.raise("signature", r.Severity, device, "Signature %s matched %s %s:%d -> %s:%d",
+			what, pi.transport, pi.srcIP, pi.srcPort, pi.dstIP, pi.dstPort)
+	}
+}
+
+// REST API: Signature rules and how often they matched
+func (bm *BandwidthMonitor) handleGetSignatures(w http.ResponseWriter, r *http.Request) {
+	if bm.signatures == nil {
+		http.Error(w, "Signature rules not configured (-signatures-file)", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, bm.signatures.status())
+}
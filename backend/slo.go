@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sloWindow is how much per-minute compliance history is kept per objective;
+// the resource profile may shorten it
+var sloWindow = 7 * 24 * 60 // one week of minutes
+
+// SLOObjective defines what "healthy" means for a critical device.
+// A minute is compliant when the device was seen during it and, if
+// MinRateBps is set, moved at least that many bytes per second on average.
+type SLOObjective struct {
+	Device             string  `json:"device"`               // device key (MAC, or IP for MAC-less devices)
+	Name               string  `json:"name,omitempty"`       // friendly label, e.g. "Front door camera"
+	MinRateBps         float64 `json:"minRateBps,omitempty"` // minimum average throughput per minute
+	AvailabilityTarget float64 `json:"availabilityTarget"`   // percent of minutes that must be compliant
+}
+
+// SLOStatus reports compliance of one objective over the tracked window
+type SLOStatus struct {
+	SLOObjective
+	EvaluatedMinutes int     `json:"evaluatedMinutes"`
+	CompliantMinutes int     `json:"compliantMinutes"`
+	OfflineMinutes   int     `json:"offlineMinutes"`
+	Availability     float64 `json:"availability"` // percent
+	Met              bool    `json:"met"`
+}
+
+// sloHistory is the rolling per-minute record of one objective
+type sloHistory struct {
+	minutes   []sloMinute // oldest first, capped at sloWindow
+	lastBytes uint64
+	primed    bool
+}
+
+// sloMinute is the outcome of evaluating one minute
+type sloMinute struct {
+	online    bool
+	compliant bool
+}
+
+// sloTracker evaluates objectives once per minute
+type sloTracker struct {
+	mu         sync.Mutex
+	objectives map[string]SLOObjective
+	history    map[string]*sloHistory
+	doc        document // optional place the objectives are persisted to
+}
+
+// newSLOTracker creates a tracker, loading objectives from doc when set
+func newSLOTracker(doc document) *sloTracker {
+	t := &sloTracker{
+		objectives: make(map[string]SLOObjective),
+		history:    make(map[string]*sloHistory),
+		doc:        doc,
+	}
+	if doc == nil {
+		return t
+	}
+	var objectives []SLOObjective
+	if err := doc.load(&objectives); err != nil {
+		log.Printf("Error reading SLOs from %s: %v", doc, err)
+		return t
+	}
+	for _, o := range objectives {
+		t.objectives[o.Device] = o
+	}
+	return t
+}
+
+// save writes the objectives back to their document; caller holds t.mu
+func (t *sloTracker) save() {
+	if t.doc == nil {
+		return
+	}
+	list := make([]SLOObjective, 0, len(t.objectives))
+	for _, o := range t.objectives {
+		list = append(list, o)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Device < list[j].Device })
+	if err := t.doc.save(list); err != nil {
+		log.Printf("Error writing SLOs to %s: %v", t.doc, err)
+	}
+}
+
+// set adds or replaces an objective
+func (t *sloTracker) set(o SLOObjective) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.objectives[o.Device]; !ok || prev.MinRateBps != o.MinRateBps {
+		// A changed definition starts a fresh compliance record
+		delete(t.history, o.Device)
+	}
+	t.objectives[o.Device] = o
+	t.save()
+}
+
+// remove deletes an objective; it reports whether it existed
+func (t *sloTracker) remove(device string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.objectives[device]; !ok {
+		return false
+	}
+	delete(t.objectives, device)
+	delete(t.history, device)
+	t.save()
+	return true
+}
+
+// evaluate records one minute of compliance for every objective
+func (t *sloTracker) evaluate(bm *BandwidthMonitor, interval time.Duration, now time.Time) {
+	// Snapshot the counters of tracked devices
+	type sample struct {
+		bytes    uint64
+		lastSeen time.Time
+		exists   bool
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	samples := make(map[string]sample, len(t.objectives))
+	bm.mutex.RLock()
+	for key := range t.objectives {
+		if dev, ok := bm.devices.load(key, time.Now()); ok {
+			samples[key] = sample{bytes: dev.BytesSent + dev.BytesRecv, lastSeen: dev.LastSeen, exists: true}
+		}
+	}
+	bm.mutex.RUnlock()
+
+	for key, o := range t.objectives {
+		h, ok := t.history[key]
+		if !ok {
+			h = &sloHistory{}
+			t.history[key] = h
+		}
+		s := samples[key]
+
+		var m sloMinute
+		m.online = s.exists && now.Sub(s.lastSeen) <= interval
+		// Counter went backwards (stats reset): take this minute as a new baseline
+		if !h.primed || s.bytes < h.lastBytes {
+			h.lastBytes = s.bytes
+			h.primed = true
+			m.compliant = m.online && o.MinRateBps == 0
+		} else {
+			rate := float64(s.bytes-h.lastBytes) / interval.Seconds()
+			h.lastBytes = s.bytes
+			m.compliant = m.online && rate >= o.MinRateBps
+		}
+
+		h.minutes = append(h.minutes, m)
+		if len(h.minutes) > sloWindow {
+			h.minutes = h.minutes[len(h.minutes)-sloWindow:]
+		}
+	}
+}
+
+// statuses returns compliance for all objectives, sorted by device key
+func (t *sloTracker) statuses() []SLOStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]SLOStatus, 0, len(t.objectives))
+	for key, o := range t.objectives {
+		st := SLOStatus{SLOObjective: o, Availability: 100, Met: true}
+		if h, ok := t.history[key]; ok && len(h.minutes) > 0 {
+			for _, m := range h.minutes {
+				st.EvaluatedMinutes++
+				if m.compliant {
+					st.CompliantMinutes++
+				}
+				if !m.online {
+					st.OfflineMinutes++
+				}
+			}
+			st.Availability = 100 * float64(st.CompliantMinutes) / float64(st.EvaluatedMinutes)
+			st.Met = st.Availability >= o.AvailabilityTarget
+		}
+		result = append(result, st)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
+
+// trackSLOsPeriodically evaluates objectives once per minute until stop is closed
+func (bm *BandwidthMonitor) trackSLOsPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.slo.evaluate(bm, time.Minute, now)
+		}
+	}
+}
+
+// REST API: List SLO objectives and their compliance
+func (bm *BandwidthMonitor) handleGetSLOs(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.slo.statuses())
+}
+
+// REST API: Create or replace the SLO objective of a device
+func (bm *BandwidthMonitor) handlePutSLO(w http.ResponseWriter, r *http.Request) {
+	var o SLOObjective
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	o.Device = mux.Vars(r)["mac"]
+	if o.AvailabilityTarget <= 0 || o.AvailabilityTarget > 100 || o.MinRateBps < 0 {
+		http.Error(w, "availabilityTarget must be in (0, 100] and minRateBps must not be negative", http.StatusBadRequest)
+		return
+	}
+	bm.slo.set(o)
+	writeEncoded(w, r, o)
+}
+
+// REST API: Delete the SLO objective of a device
+func (bm *BandwidthMonitor) handleDeleteSLO(w http.ResponseWriter, r *http.Request) {
+	if !bm.slo.remove(mux.Vars(r)["mac"]) {
+		http.Error(w, "SLO not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Rate smoothing modes a WebSocket client can ask for (?smoothing= or
+// {"smoothing":"ewma:30s"}): stable numbers for wall displays, raw spikes
+// for troubleshooting
+const (
+	SmoothingWindow = "window" // average over -rate-window (the default)
+	SmoothingRaw    = "raw"    // the last whole second
+	SmoothingEWMA   = "ewma"   // exponentially weighted, time constant ewma:<d>
+)
+
+// defaultEWMAWindow is the time constant of "ewma" without a duration
+const defaultEWMAWindow = 10 * time.Second
+
+// rateSmoothing is how a client's device rates are computed; the zero
+// value is SmoothingWindow
+type rateSmoothing struct {
+	mode   string
+	window time.Duration // EWMA time constant
+}
+
+// parseSmoothing parses "window", "raw", "ewma" or "ewma:<duration>"
+func parseSmoothing(s string) (rateSmoothing, error) {
+	mode, arg, hasArg := strings.Cut(strings.ToLower(strings.TrimSpace(s)), ":")
+	switch {
+	case mode == SmoothingWindow && !hasArg, mode == "" && !hasArg:
+		return rateSmoothing{}, nil
+	case mode == SmoothingRaw && !hasArg:
+		return rateSmoothing{mode: SmoothingRaw}, nil
+	case mode == SmoothingEWMA:
+		window := defaultEWMAWindow
+		if hasArg {
+			d, err := time.ParseDuration(arg)
+			if err != nil || d < time.Second || d > maxRateWindow {
+				return rateSmoothing{}, fmt.Errorf("invalid EWMA window %q (want 1s to %v)", arg, maxRateWindow)
+			}
+			window = d
+		}
+		return rateSmoothing{mode: SmoothingEWMA, window: window}, nil
+	}
+	return rateSmoothing{}, fmt.Errorf("unknown smoothing %q (want window, raw or ewma[:duration])", s)
+}
+
+// String is the smoothing as accepted by parseSmoothing
+func (s rateSmoothing) String() string {
+	switch s.mode {
+	case SmoothingRaw:
+		return SmoothingRaw
+	case SmoothingEWMA:
+		return fmt.Sprintf("%s:%v", SmoothingEWMA, s.window)
+	}
+	return SmoothingWindow
+}
+
+// isDefault reports whether the rates in a snapshot already match s
+func (s rateSmoothing) isDefault() bool {
+	return s.mode == ""
+}
+
+// rates returns a device's sent and received bytes/s under s
+func (s rateSmoothing) rates(d *DeviceStats, now time.Time) (sent, recv float64) {
+	switch s.mode {
+	case SmoothingRaw:
+		return d.rate.bps(now, time.Second)
+	case SmoothingEWMA:
+		// Like fillWindow, a newcomer is weighted over the time it was seen
+		seen := max(min(now.Sub(d.FirstSeen), maxRateWindow), time.Second)
+		return d.rate.ewma(now, s.window, seen)
+	}
+	window := max(min(now.Sub(d.FirstSeen), rateWindow), time.Second)
+	return d.rate.bps(now, window)
+}
+
+// ewma returns the bytes per second sent and received over the whole
+// seconds of the last span before now, each second weighted by
+// exp(-age/tau) so recent traffic counts most; a nil counter has no traffic
+func (c *rateCounter) ewma(now time.Time, tau, span time.Duration) (sent, recv float64) {
+	n := int64(span / time.Second)
+	if c == nil || n <= 0 {
+		return 0, 0
+	}
+	end := now.Unix() // the second in progress is left out
+	var total float64
+	for age := int64(0); age < n; age++ {
+		w := math.Exp(-float64(age) * float64(time.Second) / float64(tau))
+		total += w
+		s := end - 1 - age
+		if s > c.second || c.second-s >= int64(len(c.sent)) {
+			continue
+		}
+		sent += w * float64(c.sent[s%60])
+		recv += w * float64(c.recv[s%60])
+	}
+	return sent / total, recv / total
+}
+
+// smoothStats returns stats with each device's rates recomputed under s
+// from the live counters; devices gone since the snapshot keep theirs
+func (bm *BandwidthMonitor) smoothStats(stats *NetworkStats, s rateSmoothing) *NetworkStats {
+	if s.isDefault() {
+		return stats
+	}
+	smoothed := *stats
+	smoothed.Devices = make([]*DeviceStats, 0, len(stats.Devices))
+	now := time.Now()
+	bm.mutex.RLock()
+	for _, dev := range stats.Devices {
+		devCopy := *dev
+		bm.devices.view(bm.deviceKey(dev.MAC, dev.IP), func(live *DeviceStats) {
+			devCopy.RateSentBps, devCopy.RateRecvBps = s.rates(live, now)
+		})
+		smoothed.Devices = append(smoothed.Devices, &devCopy)
+	}
+	bm.mutex.RUnlock()
+	return &smoothed
+}
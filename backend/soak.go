@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Soak telemetry: self-metrics sampled hourly, to tell a slow leak from
+// normal growth over months of unattended running
+const (
+	soakInterval   = time.Hour
+	maxSoakSamples = 24 * 365 // a year of hourly samples, across restarts
+)
+
+// SoakSample is the monitor's own resource usage at one point in time
+type SoakSample struct {
+	Time       time.Time `json:"time"`
+	Uptime     float64   `json:"uptime"` // seconds since this run started; drops mark restarts
+	HeapAlloc  uint64    `json:"heapAlloc"`
+	HeapInuse  uint64    `json:"heapInuse"`
+	HeapObjs   uint64    `json:"heapObjects"`
+	Sys        uint64    `json:"sys"` // memory obtained from the OS
+	NumGC      uint32    `json:"numGC"`
+	Goroutines int       `json:"goroutines"`
+	// Entries of the monitor's long-lived maps and slices, by name
+	Maps map[string]int `json:"maps"`
+}
+
+// SoakReport is the soak history with growth trends of the current run
+type SoakReport struct {
+	Since   time.Time    `json:"since"` // start of the current run
+	Current SoakSample   `json:"current"`
+	Samples []SoakSample `json:"samples"` // oldest first
+	// Least-squares growth per day over the current run's samples (0 until
+	// there are two)
+	HeapGrowthPerDay      float64 `json:"heapGrowthPerDay"` // bytes
+	GoroutineGrowthPerDay float64 `json:"goroutineGrowthPerDay"`
+}
+
+// soakRecorder keeps soak samples, optionally persisted so they span restarts
+type soakRecorder struct {
+	mu      sync.Mutex
+	samples []SoakSample
+	doc     document
+}
+
+// newSoakRecorder creates a recorder, loading earlier samples from doc when set
+func newSoakRecorder(doc document) *soakRecorder {
+	sr := &soakRecorder{doc: doc}
+	if doc == nil {
+		return sr
+	}
+	if err := doc.load(&sr.samples); err != nil {
+		log.Printf("Error reading soak samples from %s: %v", doc, err)
+	}
+	return sr
+}
+
+// record appends a sample and saves the history
+func (sr *soakRecorder) record(s SoakSample) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.samples = append(sr.samples, s)
+	if len(sr.samples) > maxSoakSamples {
+		sr.samples = sr.samples[len(sr.samples)-maxSoakSamples:]
+	}
+	if sr.doc == nil {
+		return
+	}
+	if err := sr.doc.save(sr.samples); err != nil {
+		log.Printf("Error writing soak samples to %s: %v", sr.doc, err)
+	}
+}
+
+// list copies the samples
+func (sr *soakRecorder) list() []SoakSample {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return append([]SoakSample(nil), sr.samples...)
+}
+
+// mapSizes counts the entries the monitor keeps in its long-lived state
+func (bm *BandwidthMonitor) mapSizes() map[string]int {
+	sizes := map[string]int{"destinations": 0, "asns": 0, "countries": 0, "ports": 0}
+
+	bm.mutex.RLock()
+	sizes["devices"] = bm.devices.len()
+	bm.mutex.RUnlock()
+	bm.vlanMu.Lock()
+	sizes["vlans"] = len(bm.vlans)
+	bm.vlanMu.Unlock()
+
+	bm.clientsMu.RLock()
+	sizes["clients"] = len(bm.clients)
+	bm.clientsMu.RUnlock()
+
+	bm.flows.mu.Lock()
+	sizes["flows"] = len(bm.flows.flows)
+	sizes["closedFlows"] = len(bm.flows.closed)
+	bm.flows.mu.Unlock()
+
+	bm.alerts.mu.RLock()
+	sizes["alerts"] = len(bm.alerts.alerts)
+	bm.alerts.mu.RUnlock()
+
+	bm.newDest.mu.Lock()
+	for _, d := range bm.newDest.devices {
+		sizes["destinations"] += len(d.known)
+	}
+	bm.newDest.mu.Unlock()
+
+	bm.asnUsage.mu.Lock()
+	for _, d := range bm.asnUsage.devices {
+		sizes["asns"] += len(d)
+	}
+	bm.asnUsage.mu.Unlock()
+
+	bm.geoUsage.mu.Lock()
+	for _, d := range bm.geoUsage.devices {
+		sizes["countries"] += len(d)
+	}
+	bm.geoUsage.mu.Unlock()
+
+	bm.ports.mu.Lock()
+	for _, d := range bm.ports.devices {
+		sizes["ports"] += len(d)
+	}
+	bm.ports.mu.Unlock()
+
+	bm.risk.mu.Lock()
+	sizes["risk"] = len(bm.risk.devices)
+	bm.risk.mu.Unlock()
+
+	bm.discovery.mu.Lock()
+	sizes["discovery"] = len(bm.discovery.devices)
+	bm.discovery.mu.Unlock()
+
+	bm.names.mu.RLock()
+	sizes["names"] = len(bm.names.names)
+	bm.names.mu.RUnlock()
+
+	bm.routerAdverts.mu.Lock()
+	sizes["routers"] = len(bm.routerAdverts.routers)
+	bm.routerAdverts.mu.Unlock()
+
+	bm.history.mu.Lock()
+	sizes["historyBuckets"] = len(bm.history.buckets)
+	bm.history.mu.Unlock()
+
+	bm.activity.mu.Lock()
+	sizes["activityBuckets"] = len(bm.activity.buckets)
+	bm.activity.mu.Unlock()
+	return sizes
+}
+
+// soakSample measures the monitor at now
+func (bm *BandwidthMonitor) soakSample(now time.Time) SoakSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return SoakSample{
+		Time:       now,
+		Uptime:     now.Sub(bm.startTime).Seconds(),
+		HeapAlloc:  m.HeapAlloc,
+		HeapInuse:  m.HeapInuse,
+		HeapObjs:   m.HeapObjects,
+		Sys:        m.Sys,
+		NumGC:      m.NumGC,
+		Goroutines: runtime.NumGoroutine(),
+		Maps:       bm.mapSizes(),
+	}
+}
+
+// recordSoakPeriodically samples the monitor every soakInterval until stop is closed
+func (bm *BandwidthMonitor) recordSoakPeriodically(stop <-chan struct{}) {
+	bm.soak.record(bm.soakSample(time.Now()))
+	ticker := time.NewTicker(soakInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.soak.record(bm.soakSample(now))
+		}
+	}
+}
+
+// growthPerDay fits a line through (time, value) points by least squares
+// and returns its slope per day
+func growthPerDay(times []time.Time, values []float64) float64 {
+	if len(times) < 2 {
+		return 0
+	}
+	var sx, sy float64
+	xs := make([]float64, len(times))
+	for i, t := range times {
+		xs[i] = t.Sub(times[0]).Hours() / 24
+		sx += xs[i]
+		sy += values[i]
+	}
+	n := float64(len(times))
+	mx, my := sx/n, sy/n
+	var num, den float64
+	for i := range xs {
+		num += (xs[i] - mx) * (values[i] - my)
+		den += (xs[i] - mx) * (xs[i] - mx)
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// buildSoakReport combines the history with a fresh sample
+func (bm *BandwidthMonitor) buildSoakReport(now time.Time) *SoakReport {
+	report := &SoakReport{Since: bm.startTime, Current: bm.soakSample(now), Samples: bm.soak.list()}
+	var times []time.Time
+	var heap, goroutines []float64
+	for _, s := range report.Samples {
+		if s.Time.Before(bm.startTime) {
+			continue // earlier runs
+		}
+		times = append(times, s.Time)
+		heap = append(heap, float64(s.HeapAlloc))
+		goroutines = append(goroutines, float64(s.Goroutines))
+	}
+	report.HeapGrowthPerDay = growthPerDay(times, heap)
+	report.GoroutineGrowthPerDay = growthPerDay(times, goroutines)
+	return report
+}
+
+// REST API: Hourly self-metrics (heap, goroutines, map sizes) and their
+// growth trend, for checking stability over long runs
+func (bm *BandwidthMonitor) handleGetSoak(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.buildSoakReport(time.Now()))
+}
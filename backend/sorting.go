@@ -0,0 +1,180 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Device sort keys (-sort and ?sort=)
+const (
+	SortBytes    = "bytes"    // lifetime traffic, highest first
+	SortRate     = "rate"     // current rate over -rate-window, highest first
+	SortRecent   = "recent"   // traffic in the last minute, highest first
+	SortLastSeen = "lastSeen" // most recently active first
+	SortName     = "name"     // label or hostname A-Z, unnamed last
+	SortRisk     = "risk"     // risk score, highest first
+)
+
+// deviceSortKey is a device with the values it is sorted by, computed once
+// per sort instead of in each of the n log n comparisons
+type deviceSortKey struct {
+	dev   *DeviceStats
+	key   string // device key, for deviceOrder
+	bytes uint64
+	rate  float64
+	name  string // lowercase friendly name, only when sorting by name
+}
+
+// deviceOrders compare two devices by one key; negative sorts a first
+var deviceOrders = map[string]func(a, b *deviceSortKey) int{
+	SortBytes: func(a, b *deviceSortKey) int {
+		return cmp.Compare(b.bytes, a.bytes)
+	},
+	SortRate: func(a, b *deviceSortKey) int {
+		return cmp.Compare(b.rate, a.rate)
+	},
+	SortRecent: func(a, b *deviceSortKey) int {
+		return cmp.Compare(b.dev.RecentBytes, a.dev.RecentBytes)
+	},
+	SortLastSeen: func(a, b *deviceSortKey) int {
+		return b.dev.LastSeen.Compare(a.dev.LastSeen)
+	},
+	SortName: func(a, b *deviceSortKey) int {
+		if (a.name == "") != (b.name == "") {
+			return cmp.Compare(b.name, a.name) // the named one first
+		}
+		return cmp.Compare(a.name, b.name)
+	},
+	SortRisk: func(a, b *deviceSortKey) int {
+		return cmp.Compare(b.dev.RiskScore, a.dev.RiskScore)
+	},
+}
+
+// parseSortKeys splits a comma-separated list of sort keys. Lifetime bytes
+// are appended as last key unless listed, so "risk" sorts by risk, then
+// traffic.
+func parseSortKeys(s string) ([]string, error) {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if _, ok := deviceOrders[k]; !ok {
+			return nil, fmt.Errorf("unknown sort key %q", k)
+		}
+		if !containsString(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	if !containsString(keys, SortBytes) {
+		keys = append(keys, SortBytes)
+	}
+	return keys, nil
+}
+
+// sortDevices orders devices by keys, each breaking the ties of the one
+// before. Remaining ties are broken by MAC and IP so the order does not
+// depend on map iteration.
+func sortDevices(devices []*DeviceStats, keys []string) {
+	sortKeys := make([]deviceSortKey, len(devices))
+	for i, dev := range devices {
+		sortKeys[i] = newDeviceSortKey(dev, keys)
+	}
+	sorted := sortDeviceKeys(sortKeys, keys)
+	for i, k := range sorted {
+		devices[i] = k.dev
+	}
+}
+
+// newDeviceSortKey computes the values dev is sorted by under keys
+func newDeviceSortKey(dev *DeviceStats, keys []string) deviceSortKey {
+	k := deviceSortKey{
+		dev:   dev,
+		bytes: dev.BytesSent + dev.BytesRecv,
+		rate:  dev.RateSentBps + dev.RateRecvBps,
+	}
+	if containsString(keys, SortName) {
+		k.name = strings.ToLower(dev.friendlyName())
+	}
+	return k
+}
+
+// sortDeviceKeys returns devices sorted by keys. pdqsort finishes input that
+// is already nearly in order in about linear time, which deviceOrder relies
+// on.
+func sortDeviceKeys(devices []deviceSortKey, keys []string) []*deviceSortKey {
+	orders := make([]func(a, b *deviceSortKey) int, len(keys))
+	for i, k := range keys {
+		orders[i] = deviceOrders[k]
+	}
+	sorted := make([]*deviceSortKey, len(devices))
+	for i := range devices {
+		sorted[i] = &devices[i]
+	}
+	slices.SortFunc(sorted, func(a, b *deviceSortKey) int {
+		for _, order := range orders {
+			if c := order(a, b); c != 0 {
+				return c
+			}
+		}
+		if c := cmp.Compare(a.dev.MAC, b.dev.MAC); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.dev.IP, b.dev.IP)
+	})
+	return sorted
+}
+
+// deviceOrder sorts the device list of successive stats snapshots. Rankings
+// change little from one tick to the next, so the devices are first laid
+// out in the previous snapshot's order, leaving the sort an almost sorted
+// list. With six-figure device counts this keeps the per-tick sort from
+// dominating the broadcast.
+type deviceOrder struct {
+	mu   sync.Mutex
+	rank map[string]int // device key -> position in the previous snapshot
+}
+
+// newDeviceOrder creates an order without history
+func newDeviceOrder() *deviceOrder {
+	return &deviceOrder{rank: make(map[string]int)}
+}
+
+// sort orders devices, stored under deviceKeys (same indexes), by keys
+func (o *deviceOrder) sort(devices []*DeviceStats, deviceKeys []string, keys []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Previous positions first, in order, then devices new to the list
+	slots := make([]int, len(o.rank))
+	for i := range slots {
+		slots[i] = -1
+	}
+	var newcomers []int
+	for i, key := range deviceKeys {
+		if r, ok := o.rank[key]; ok {
+			slots[r] = i
+		} else {
+			newcomers = append(newcomers, i)
+		}
+	}
+	sortKeys := make([]deviceSortKey, 0, len(devices))
+	for _, i := range append(slots, newcomers...) {
+		if i >= 0 {
+			k := newDeviceSortKey(devices[i], keys)
+			k.key = deviceKeys[i]
+			sortKeys = append(sortKeys, k)
+		}
+	}
+	sorted := sortDeviceKeys(sortKeys, keys)
+
+	clear(o.rank)
+	for r, k := range sorted {
+		o.rank[k.key] = r
+		devices[r], deviceKeys[r] = k.dev, k.key
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sseKeepAlive is how often an idle stream gets a comment line, so proxies
+// do not time it out between updates
+const sseKeepAlive = 30 * time.Second
+
+// sseHub fans stats updates out to Server-Sent Events streams
+type sseHub struct {
+	mu      sync.Mutex
+	streams map[chan []byte]bool
+}
+
+// newSSEHub creates a hub without streams
+func newSSEHub() *sseHub {
+	return &sseHub{streams: make(map[chan []byte]bool)}
+}
+
+// add registers a stream and returns its queue
+func (h *sseHub) add() chan []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []byte, wsSendQueue)
+	h.streams[ch] = true
+	return ch
+}
+
+// remove unregisters a stream; its queue is closed unless publish already
+// dropped it
+func (h *sseHub) remove(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams[ch] {
+		delete(h.streams, ch)
+		close(ch)
+	}
+}
+
+// publish queues data on every stream. A stream too far behind is dropped:
+// its queue is closed, which ends the response.
+func (h *sseHub) publish(data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.streams {
+		select {
+		case ch <- data:
+		default:
+			delete(h.streams, ch)
+			close(ch)
+		}
+	}
+}
+
+// active reports whether any stream is open
+func (h *sseHub) active() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.streams) > 0
+}
+
+// publishStream sends a stats update to the SSE streams
+func (bm *BandwidthMonitor) publishStream(stats *NetworkStats) {
+	if !bm.streams.active() {
+		return
+	}
+	data, err := jsonCodec{}.Marshal(stats)
+	if err != nil {
+		log.Printf("Error encoding stats for streams: %v", err)
+		return
+	}
+	bm.streams.publish(data)
+}
+
+// writeSSE writes one event, pushing it past the server's write timeout
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, data []byte) error {
+	rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// REST API: Server-Sent Events stream of the NetworkStats WebSocket clients
+// get, for EventSource, curl and proxies that do not pass WebSockets. Takes
+// the same auth token as the WebSocket.
+func (bm *BandwidthMonitor) handleStream(w http.ResponseWriter, r *http.Request) {
+	if !bm.authorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	rc := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("X-Accel-Buffering", "no") // nginx would hold events back
+	w.WriteHeader(http.StatusOK)
+
+	ch := bm.streams.add()
+	defer bm.streams.remove(ch)
+	log.Printf("Event stream opened from %s", r.RemoteAddr)
+	defer log.Printf("Event stream closed from %s", r.RemoteAddr)
+
+	// Send initial data
+	data, err := jsonCodec{}.Marshal(bm.GetNetworkStats())
+	if err != nil {
+		log.Printf("Error encoding initial data: %v", err)
+		return
+	}
+	if err := writeSSE(w, rc, data); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data, ok := <-ch:
+			if !ok {
+				log.Printf("Event stream from %s is not keeping up; closing", r.RemoteAddr)
+				return
+			}
+			if err := writeSSE(w, rc, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
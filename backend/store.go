@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// errNotFound is returned by Store.Get for a missing key
+var errNotFound = errors.New("not found")
+
+// Store is a small key-value persistence backend. Keys live in named
+// buckets; values are JSON documents.
+type Store interface {
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	// Keys lists the keys of a bucket in ascending order
+	Keys(bucket string) ([]string, error)
+	Close() error
+}
+
+// Store backends
+const (
+	StoreJSON   = "json"   // one JSON file per bucket; simple, rewrites the bucket on every change
+	StoreBolt   = "bolt"   // single bbolt file; copy-on-write pages suit flash storage
+	StoreSQLite = "sqlite" // single SQLite database in WAL mode
+)
+
+// openStore opens the named backend at path. An empty path puts the store
+// under dataDir (or the working directory).
+func openStore(backend, path, dataDir string) (Store, error) {
+	if path == "" {
+		name := map[string]string{StoreJSON: "store", StoreBolt: "state.bolt", StoreSQLite: "state.sqlite"}[backend]
+		path = filepath.Join(dataDir, name)
+	}
+	switch backend {
+	case StoreJSON:
+		return openJSONStore(path)
+	case StoreBolt:
+		return openBoltStore(path)
+	case StoreSQLite:
+		return openSQLiteStore(path)
+	}
+	return nil, fmt.Errorf("unknown store %q (want json, bolt or sqlite)", backend)
+}
+
+// jsonStore keeps each bucket in dir/<bucket>.json, rewritten atomically
+type jsonStore struct {
+	mu      sync.Mutex
+	dir     string
+	buckets map[string]map[string]json.RawMessage
+}
+
+// openJSONStore opens (creating) a JSON store directory
+func openJSONStore(dir string) (*jsonStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &jsonStore{dir: dir, buckets: make(map[string]map[string]json.RawMessage)}, nil
+}
+
+// bucket loads a bucket on first use; caller holds s.mu
+func (s *jsonStore) bucket(name string) (map[string]json.RawMessage, error) {
+	if b, ok := s.buckets[name]; ok {
+		return b, nil
+	}
+	b := make(map[string]json.RawMessage)
+	if err := loadJSONFile(filepath.Join(s.dir, name+".json"), &b); err != nil {
+		return nil, err
+	}
+	s.buckets[name] = b
+	return b, nil
+}
+
+func (s *jsonStore) Get(bucket, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := b[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return v, nil
+}
+
+func (s *jsonStore) Put(bucket, key string, value []byte) error {
+	if !json.Valid(value) {
+		return fmt.Errorf("value for %s/%s is not JSON", bucket, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	b[key] = append(json.RawMessage(nil), value...)
+	return saveJSONFile(filepath.Join(s.dir, bucket+".json"), b)
+}
+
+func (s *jsonStore) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	if _, ok := b[key]; !ok {
+		return nil
+	}
+	delete(b, key)
+	return saveJSONFile(filepath.Join(s.dir, bucket+".json"), b)
+}
+
+func (s *jsonStore) Keys(bucket string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *jsonStore) Close() error { return nil }
+
+// document is one persisted JSON value: either a standalone file (the
+// -slo-file style flags) or a key in the configured Store.
+type document interface {
+	load(v interface{}) error // a missing document leaves v untouched
+	save(v interface{}) error
+	String() string
+}
+
+// fileDocument is a document kept in its own JSON file, encrypted with
+// -encryption-key
+type fileDocument string
+
+func (d fileDocument) load(v interface{}) error { return loadDocumentFile(string(d), v) }
+func (d fileDocument) save(v interface{}) error { return saveDocumentFile(string(d), v) }
+func (d fileDocument) String() string           { return string(d) }
+
+// storeDocument is a document kept under a key of a Store
+type storeDocument struct {
+	store       Store
+	bucket, key string
+}
+
+func (d storeDocument) load(v interface{}) error {
+	data, err := d.store.Get(d.bucket, d.key)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (d storeDocument) save(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return d.store.Put(d.bucket, d.key, data)
+}
+
+func (d storeDocument) String() string { return "store:" + d.bucket + "/" + d.key }
+
+// persistedDocument picks where a document lives: the file given by its
+// flag, else the configured store, else nowhere (nil).
+func persistedDocument(path string, store Store, bucket, key string) document {
+	if path != "" {
+		return fileDocument(path)
+	}
+	if store != nil {
+		return storeDocument{store: store, bucket: bucket, key: key}
+	}
+	return nil
+}
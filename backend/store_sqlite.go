@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore is a Store backed by a single SQLite table
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens (creating) a SQLite database. WAL mode keeps
+// writes sequential, which is kinder to SD cards than in-place updates.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		value  BLOB NOT NULL,
+		PRIMARY KEY (bucket, key)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM kv WHERE bucket = ? AND key = ?`, bucket, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (s *sqliteStore) Put(bucket, key string, value []byte) error {
+	_, err := s.db.Exec(`INSERT INTO kv (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`, bucket, key, value)
+	return err
+}
+
+func (s *sqliteStore) Delete(bucket, key string) error {
+	_, err := s.db.Exec(`DELETE FROM kv WHERE bucket = ? AND key = ?`, bucket, key)
+	return err
+}
+
+func (s *sqliteStore) Keys(bucket string) ([]string, error) {
+	rows, err := s.db.Query(`SELECT key FROM kv WHERE bucket = ? ORDER BY key`, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) Close() error { return s.db.Close() }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// summaryTopDevices is how many devices a run summary lists
+const summaryTopDevices = 10
+
+// CaptureCounters are libpcap's packet counters of one capture interface
+type CaptureCounters struct {
+	Interface string `json:"interface"`
+	Received  uint64 `json:"received"`
+	Dropped   uint64 `json:"dropped"`   // no room in the kernel buffer
+	IfDropped uint64 `json:"ifDropped"` // dropped by the interface or driver
+}
+
+// captureCounters reads the counters of every open capture handle
+func (bm *BandwidthMonitor) captureCounters() []CaptureCounters {
+	bm.captureMu.Lock()
+	defer bm.captureMu.Unlock()
+	list := make([]CaptureCounters, 0, len(bm.captureHandles))
+	for iface, handle := range bm.captureHandles {
+		ps, err := handle.Stats()
+		if err != nil {
+			log.Printf("Error reading capture statistics of %s: %v", iface, err)
+			continue
+		}
+		list = append(list, CaptureCounters{Interface: iface, Received: uint64(ps.PacketsReceived),
+			Dropped: uint64(ps.PacketsDropped), IfDropped: uint64(ps.PacketsIfDropped)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Interface < list[j].Interface })
+	return list
+}
+
+// RunSummary is the final report of a run: totals, the busiest devices and
+// how much the capture dropped
+type RunSummary struct {
+	Start               time.Time         `json:"start"`
+	End                 time.Time         `json:"end"`
+	Duration            float64           `json:"duration"` // seconds
+	TotalSent           uint64            `json:"totalSent"`
+	TotalRecv           uint64            `json:"totalRecv"`
+	TotalPackets        uint64            `json:"totalPackets"`
+	Devices             int               `json:"devices"`
+	UnattributedBytes   uint64            `json:"unattributedBytes"`
+	UnattributedPackets uint64            `json:"unattributedPackets"`
+	Top                 []*DeviceStats    `json:"top"`
+	Capture             []CaptureCounters `json:"capture"`
+}
+
+// Summary reports the measurement period so far
+func (bm *BandwidthMonitor) Summary() RunSummary {
+	stats := bm.GetNetworkStats()
+	top := stats.Devices
+	if len(top) > summaryTopDevices {
+		top = top[:summaryTopDevices]
+	}
+	return RunSummary{
+		Start:               stats.MeasurementStart,
+		End:                 stats.Timestamp,
+		Duration:            stats.MonitorDuration,
+		TotalSent:           stats.TotalSent,
+		TotalRecv:           stats.TotalRecv,
+		TotalPackets:        stats.TotalPackets,
+		Devices:             stats.ActiveDevices,
+		UnattributedBytes:   stats.UnattributedBytes,
+		UnattributedPackets: stats.UnattributedPackets,
+		Top:                 top,
+		Capture:             bm.captureCounters(),
+	}
+}
+
+// writeSummaryText writes s for people
+func writeSummaryText(w io.Writer, s RunSummary) {
+	lf := lookupLocale("")
+	fmt.Fprintln(w, "=== LAN Traffic Tracker summary ===")
+	fmt.Fprintf(w, "Period:  %s to %s (%s)\n", s.Start.Format(time.DateTime), s.End.Format(time.DateTime),
+		time.Duration(s.Duration*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(w, "Traffic: %s sent, %s received, %d packets, %d devices\n",
+		lf.formatBytes(s.TotalSent), lf.formatBytes(s.TotalRecv), s.TotalPackets, s.Devices)
+	if s.UnattributedPackets > 0 {
+		fmt.Fprintf(w, "Unattributed: %s in %d packets\n", lf.formatBytes(s.UnattributedBytes), s.UnattributedPackets)
+	}
+	if len(s.Top) > 0 {
+		fmt.Fprintf(w, "\nTop %d devices:\n", len(s.Top))
+		writeDeviceTable(w, s.Top, s.Duration)
+	}
+	if len(s.Capture) > 0 {
+		fmt.Fprintln(w, "\nCapture:")
+		for _, c := range s.Capture {
+			fmt.Fprintf(w, "  %s: %d packets received, %d dropped by the kernel, %d dropped by the interface\n",
+				c.Interface, c.Received, c.Dropped, c.IfDropped)
+		}
+	}
+}
+
+// reportSummary prints the run summary to stdout and, with -summary-file,
+// writes it there too: as JSON when the name ends in .json, else as text
+func (bm *BandwidthMonitor) reportSummary(file string) {
+	s := bm.Summary()
+	writeSummaryText(os.Stdout, s)
+	if file == "" {
+		return
+	}
+	var err error
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		err = saveJSONFile(file, s)
+	} else {
+		var b strings.Builder
+		writeSummaryText(&b, s)
+		err = os.WriteFile(file, []byte(b.String()), 0o644)
+	}
+	if err != nil {
+		log.Printf("Error writing summary to %s: %v", file, err)
+		return
+	}
+	log.Printf("Summary written to %s", file)
+}
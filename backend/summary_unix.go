@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// summarySignals print the run summary without stopping (SIGUSR1)
+var summarySignals = []os.Signal{syscall.SIGUSR1}
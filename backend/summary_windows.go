@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// summarySignals print the run summary without stopping; Windows has no
+// SIGUSR1, so there the summary only comes at shutdown
+var summarySignals []os.Signal
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Restart backoff for panicking workers
+const (
+	superviseMinBackoff = time.Second
+	superviseMaxBackoff = 30 * time.Second
+	// superviseHealthyRun is how long a worker must run before a panic
+	// restarts it with the minimum backoff again
+	superviseHealthyRun = 5 * time.Minute
+)
+
+// supervise runs fn and restarts it after a panic, with exponential backoff
+// that starts over once fn has run healthily for superviseHealthyRun, until
+// fn returns normally or stop is closed. Each panic is logged with its
+// stack trace and raised as a critical "worker-panic" alert, so a bad packet
+// degrades one worker for a moment instead of silently killing accounting.
+func (bm *BandwidthMonitor) supervise(name string, stop <-chan struct{}, fn func()) {
+	backoff := superviseMinBackoff
+	for {
+		started := time.Now()
+		if !runRecovered(bm, name, fn) {
+			return
+		}
+		if time.Since(started) >= superviseHealthyRun {
+			backoff = superviseMinBackoff
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		log.Printf("Restarting worker %s", name)
+		if backoff *= 2; backoff > superviseMaxBackoff {
+			backoff = superviseMaxBackoff
+		}
+	}
+}
+
+// runRecovered runs fn and reports whether it panicked
+func runRecovered(bm *BandwidthMonitor, name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			log.Printf("Worker %s panicked: %v\n%s", name, r, debug.Stack())
+			bm.alerts.raise("worker-panic", SeverityCritical, "", "worker %s panicked: %v", name, r)
+		}
+	}()
+	fn()
+	return false
+}
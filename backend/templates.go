@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Built-in templates, used unless <data-dir>/templates/<name> exists
+var defaultTemplates = map[string]string{
+	"report-weekly.tmpl": `{{label "report-title"}} {{date .PeriodStart}} – {{date .PeriodEnd}}{{if eq .Basis "since-start"}} ({{label "report-since-start"}}){{end}}
+
+{{label "report-total-sent"}}: {{bytes .TotalSent}}
+{{label "report-total-received"}}: {{bytes .TotalRecv}}
+
+{{label "report-top-devices"}}:
+{{range $i, $d := .TopDevices}}{{add $i 1}}. {{deviceName $d}}  ↑ {{bytes $d.BytesSent}}  ↓ {{bytes $d.BytesRecv}}
+{{else}}({{label "report-no-traffic"}})
+{{end}}{{if .SLO}}
+{{label "report-service-levels"}}:
+{{range .SLO}}- {{if .Name}}{{.Name}}{{else}}{{.Device}}{{end}}: {{label "report-slo" (percent .Availability) (percent .AvailabilityTarget) (number .OfflineMinutes)}}{{if not .Met}}  ** {{label "report-slo-missed"}} **{{end}}
+{{end}}{{end}}
+{{label "report-generated" (datetime .GeneratedAt)}}
+`,
+	"alert.tmpl": `[{{.Severity}}] {{.Type}}{{if .Device}} ({{.Device}}){{end}}
+{{.Message}}
+{{datetime .Time}}
+`,
+}
+
+// defaultLabels are the fixed texts of the built-in templates, used through
+// {{label "name" args...}}; args fill the label's fmt verbs. A locale file
+// in the data dir can translate them.
+var defaultLabels = map[string]string{
+	"report-title":          "LAN traffic report",
+	"report-since-start":    "since monitoring started",
+	"report-total-sent":     "Total sent",
+	"report-total-received": "Total received",
+	"report-top-devices":    "Top devices",
+	"report-no-traffic":     "no traffic recorded",
+	"report-service-levels": "Service levels",
+	"report-slo":            "%s of %s target, offline %s min",
+	"report-slo-missed":     "MISSED",
+	"report-generated":      "Generated %s",
+}
+
+// localeFile is the format of <data-dir>/locales/<tag>.json, which adds a
+// locale or adjusts a built-in one; empty fields keep the built-in value
+// (English for locales not built in) and labels translate defaultLabels.
+// Example de.json:
+//
+//	{"decimal": ",", "thousands": ".", "date": "02.01.2006", "datetime": "02.01.2006 15:04",
+//	 "labels": {"report-title": "LAN-Verkehrsbericht", "report-top-devices": "Top-Geräte"}}
+type localeFile struct {
+	Decimal   string            `json:"decimal"`
+	Thousands string            `json:"thousands"`
+	Date      string            `json:"date"`
+	Datetime  string            `json:"datetime"`
+	Labels    map[string]string `json:"labels"`
+}
+
+// localeFormat describes how numbers and dates are written in a locale
+type localeFormat struct {
+	decimal   string
+	thousands string
+	date      string // Go time layout
+	datetime  string
+}
+
+// locales maps language tags (and bare languages) to formats
+var locales = map[string]localeFormat{
+	"en":    {".", ",", "Jan 2, 2006", "Jan 2, 2006 15:04"},
+	"en-us": {".", ",", "01/02/2006", "01/02/2006 3:04 PM"},
+	"en-gb": {".", ",", "02/01/2006", "02/01/2006 15:04"},
+	"de":    {",", ".", "02.01.2006", "02.01.2006 15:04"},
+	"fr":    {",", " ", "02/01/2006", "02/01/2006 15:04"},
+	"es":    {",", ".", "02/01/2006", "02/01/2006 15:04"},
+	"it":    {",", ".", "02/01/2006", "02/01/2006 15:04"},
+	"nl":    {",", ".", "02-01-2006", "02-01-2006 15:04"},
+	"pt":    {",", ".", "02/01/2006", "02/01/2006 15:04"},
+	"sv":    {",", " ", "2006-01-02", "2006-01-02 15:04"},
+	"pl":    {",", " ", "02.01.2006", "02.01.2006 15:04"},
+	"ja":    {".", ",", "2006/01/02", "2006/01/02 15:04"},
+}
+
+// normalizeLocale turns tags such as "de_DE.UTF-8" into "de-de"
+func normalizeLocale(tag string) string {
+	tag = strings.ToLower(strings.SplitN(tag, ".", 2)[0])
+	return strings.ReplaceAll(tag, "_", "-")
+}
+
+// lookupLocale resolves tags such as "de_DE.UTF-8", "pt-BR" or "fr"
+func lookupLocale(tag string) localeFormat {
+	tag = normalizeLocale(tag)
+	if f, ok := locales[tag]; ok {
+		return f
+	}
+	if f, ok := locales[strings.SplitN(tag, "-", 2)[0]]; ok {
+		return f
+	}
+	return locales["en"]
+}
+
+// formatNumber formats f with the given number of decimals and locale separators
+func (lf localeFormat) formatNumber(f float64, decimals int) string {
+	s := fmt.Sprintf("%.*f", decimals, math.Abs(f))
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+	var b strings.Builder
+	if f < 0 {
+		b.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(lf.thousands)
+		}
+		b.WriteRune(c)
+	}
+	if frac != "" {
+		b.WriteString(lf.decimal)
+		b.WriteString(frac)
+	}
+	return b.String()
+}
+
+// formatBytes formats a byte count with binary units
+func (lf localeFormat) formatBytes(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return lf.formatNumber(v, 0) + " " + units[i]
+	}
+	return lf.formatNumber(v, 1) + " " + units[i]
+}
+
+// templateRenderer renders reports and notifications from user-overridable
+// templates and locales
+type templateRenderer struct {
+	dir       string // <data-dir>/templates, empty for built-ins only
+	localeDir string // <data-dir>/locales, empty for built-ins only
+	tag       string // normalized -locale
+	locale    localeFormat
+}
+
+// newTemplateRenderer creates a renderer for the given data dir and locale tag
+func newTemplateRenderer(dataDir, locale string) *templateRenderer {
+	r := &templateRenderer{tag: normalizeLocale(locale), locale: lookupLocale(locale)}
+	if dataDir != "" {
+		r.dir = filepath.Join(dataDir, "templates")
+		r.localeDir = filepath.Join(dataDir, "locales")
+	}
+	return r
+}
+
+// loadLocale returns the locale format and labels, applying the first of
+// <tag>.json and <language>.json found in the locales dir. Like templates,
+// the file is read on every render.
+func (r *templateRenderer) loadLocale() (localeFormat, map[string]string, error) {
+	lf, labels := r.locale, defaultLabels
+	if r.localeDir == "" || r.tag == "" {
+		return lf, labels, nil
+	}
+	names := []string{r.tag}
+	if lang := strings.SplitN(r.tag, "-", 2)[0]; lang != r.tag {
+		names = append(names, lang)
+	}
+	for _, name := range names {
+		var file *localeFile
+		path := filepath.Join(r.localeDir, name+".json")
+		if err := loadJSONFile(path, &file); err != nil {
+			return lf, labels, fmt.Errorf("reading %s: %v", path, err)
+		}
+		if file == nil {
+			continue
+		}
+		if file.Decimal != "" {
+			lf.decimal = file.Decimal
+		}
+		if file.Thousands != "" {
+			lf.thousands = file.Thousands
+		}
+		if file.Date != "" {
+			lf.date = file.Date
+		}
+		if file.Datetime != "" {
+			lf.datetime = file.Datetime
+		}
+		labels = make(map[string]string, len(defaultLabels))
+		for k, v := range defaultLabels {
+			labels[k] = v
+		}
+		for k, v := range file.Labels {
+			labels[k] = v
+		}
+		break
+	}
+	return lf, labels, nil
+}
+
+// funcs returns the template helpers bound to a locale and its labels
+func (r *templateRenderer) funcs(lf localeFormat, labels map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"bytes": lf.formatBytes,
+		"number": func(v interface{}) string {
+			switch n := v.(type) {
+			case int:
+				return lf.formatNumber(float64(n), 0)
+			case uint64:
+				return lf.formatNumber(float64(n), 0)
+			case float64:
+				return lf.formatNumber(n, 2)
+			}
+			return fmt.Sprint(v)
+		},
+		"percent":  func(f float64) string { return lf.formatNumber(f, 1) + " %" },
+		"date":     func(t time.Time) string { return t.Local().Format(lf.date) },
+		"datetime": func(t time.Time) string { return t.Local().Format(lf.datetime) },
+		"add":      func(a, b int) int { return a + b },
+		"label": func(name string, args ...interface{}) string {
+			text, ok := labels[name]
+			if !ok {
+				return name
+			}
+			if len(args) == 0 {
+				return text
+			}
+			return fmt.Sprintf(text, args...)
+		},
+		"deviceName": func(d *DeviceStats) string {
+			if name := d.friendlyName(); name != "" {
+				return name
+			}
+			if d.IP != "" {
+				return d.IP
+			}
+			return d.MAC
+		},
+	}
+}
+
+// load returns the named template, preferring an override in the data dir.
+// Overrides are read on every render so edits apply without a restart.
+func (r *templateRenderer) load(name string) (*template.Template, error) {
+	lf, labels, err := r.loadLocale()
+	if err != nil {
+		return nil, err
+	}
+	text := defaultTemplates[name]
+	if r.dir != "" {
+		data, err := os.ReadFile(filepath.Join(r.dir, name))
+		if err == nil {
+			text = string(data)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return template.New(name).Funcs(r.funcs(lf, labels)).Parse(text)
+}
+
+// render executes the named template with data
+func (r *templateRenderer) render(name string, data interface{}) (string, error) {
+	tmpl, err := r.load(name)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderAlert formats an alert for notification channels
+func (r *templateRenderer) RenderAlert(alert Alert) (string, error) {
+	return r.render("alert.tmpl", alert)
+}
+
+// REST API: Weekly report rendered through the report template
+func (bm *BandwidthMonitor) handleGetWeeklyReportText(w http.ResponseWriter, r *http.Request) {
+	text, err := bm.templates.render("report-weekly.tmpl", bm.BuildWeeklyReport())
+	if err != nil {
+		http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
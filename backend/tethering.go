@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Thresholds for the tethering/NAT heuristics. A signal only fires once it has
+// been backed by enough packets to rule out a handful of oddballs.
+const (
+	natMinSamples      = 20              // packets inspected before any verdict
+	natMinForwarded    = 10              // packets with a decremented TTL
+	natForwardedRatio  = 0.10            // share of packets with a decremented TTL
+	natMinFamilyCount  = 10              // packets per initial-TTL family (OS fingerprint)
+	natMinClockSamples = 5               // TCP timestamps per independent clock
+	natMaxClocks       = 8               // clocks tracked per device
+	natClockIdle       = 5 * time.Minute // clocks not seen for this long are dropped
+)
+
+// natClock is one TCP timestamp (TSval) sequence seen from a device.
+// Each host keeps its own clock, so several unrelated sequences behind one MAC
+// mean several hosts.
+type natClock struct {
+	lastTS   uint32
+	lastSeen time.Time
+	samples  int
+}
+
+// natTracker accumulates the raw observations used to decide whether a device
+// is sharing its connection (hotspot, travel router, NAT).
+type natTracker struct {
+	samples   int
+	forwarded int
+	families  map[uint8]int // initial TTL -> packet count
+	clocks    []*natClock
+}
+
+// initialTTL maps an observed TTL to the most likely initial TTL of the sender.
+func initialTTL(ttl uint8) uint8 {
+	switch {
+	case ttl <= 32:
+		return 32
+	case ttl <= 64:
+		return 64
+	case ttl <= 128:
+		return 128
+	default:
+		return 255
+	}
+}
+
+// observeTTL records the TTL of a packet originated by the device.
+func (t *natTracker) observeTTL(ttl uint8) {
+	if ttl == 0 {
+		return
+	}
+	if t.families == nil {
+		t.families = make(map[uint8]int)
+	}
+	initial := initialTTL(ttl)
+	t.samples++
+	t.families[initial]++
+	// A LAN host talks to us directly, so anything below the initial TTL
+	// has already crossed a router on the device itself.
+	if initial-ttl >= 1 {
+		t.forwarded++
+	}
+}
+
+// observeTimestamp records a TCP TSval and assigns it to a matching clock,
+// starting a new clock when it fits none of the known ones.
+func (t *natTracker) observeTimestamp(tsval uint32, now time.Time) {
+	if tsval == 0 {
+		return
+	}
+	// Drop clocks that went quiet
+	kept := t.clocks[:0]
+	for _, c := range t.clocks {
+		if now.Sub(c.lastSeen) < natClockIdle {
+			kept = append(kept, c)
+		}
+	}
+	t.clocks = kept
+
+	for _, c := range t.clocks {
+		// TSval ticks at most at 1kHz; allow a second of slack plus a little
+		// reordering in the other direction.
+		elapsed := now.Sub(c.lastSeen).Milliseconds()
+		diff := int64(int32(tsval - c.lastTS))
+		if diff >= -100 && diff <= elapsed+1000 {
+			if diff > 0 {
+				c.lastTS = tsval
+			}
+			c.lastSeen = now
+			c.samples++
+			return
+		}
+	}
+	if len(t.clocks) >= natMaxClocks {
+		return
+	}
+	t.clocks = append(t.clocks, &natClock{lastTS: tsval, lastSeen: now, samples: 1})
+}
+
+// signals evaluates the accumulated observations and returns the reasons the
+// device looks like it is sharing its connection, or nil.
+func (t *natTracker) signals() []string {
+	var reasons []string
+	if t.samples >= natMinSamples && t.forwarded >= natMinForwarded &&
+		float64(t.forwarded)/float64(t.samples) >= natForwardedRatio {
+		reasons = append(reasons, fmt.Sprintf("ttl-decrement: %d of %d packets forwarded", t.forwarded, t.samples))
+	}
+
+	var families []int
+	for initial, count := range t.families {
+		if count >= natMinFamilyCount {
+			families = append(families, int(initial))
+		}
+	}
+	if len(families) > 1 {
+		sort.Ints(families)
+		reasons = append(reasons, fmt.Sprintf("os-fingerprints: initial TTLs %v", families))
+	}
+
+	clocks := 0
+	for _, c := range t.clocks {
+		if c.samples >= natMinClockSamples {
+			clocks++
+		}
+	}
+	if clocks > 1 {
+		reasons = append(reasons, fmt.Sprintf("clock-skew: %d independent TCP clocks", clocks))
+	}
+	return reasons
+}
+
+// ObserveHostSignals feeds per-packet host fingerprinting data (IPv4 TTL and
+// TCP timestamp) for the sending device into the tethering detector.
+// Only unicast TCP from private addresses is considered: traffic the
+// gateway forwards in from the internet would otherwise look like NAT, and
+// multicast chatter (IGMP, SSDP, mDNS) goes out with fixed TTLs of 1 to 255
+// whatever the host's OS. TTLs come from handshakes only, whose initial TTL
+// no application overrides.
+func (bm *BandwidthMonitor) ObserveHostSignals(pi *packetInfo, ttl uint8, tsval uint32) {
+	src := net.ParseIP(pi.srcIP)
+	if src == nil || src.To4() == nil {
+		return
+	}
+	if !src.IsPrivate() {
+		// Only a router puts internet sources on the LAN; its own packets
+		// cross its routing stack, so their TTLs say nothing about tethering
+		if pi.srcMAC != "" && isPublicIP(src) {
+			bm.gateways.LoadOrStore(pi.srcMAC, true)
+		}
+		return
+	}
+	if pi.transport != "tcp" {
+		return
+	}
+	if dst := net.ParseIP(pi.dstIP); dst == nil || dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+		return
+	}
+	if _, gateway := bm.gateways.Load(pi.srcMAC); gateway {
+		return
+	}
+	key := bm.deviceKey(pi.srcMAC, pi.srcIP)
+	if key == "" {
+		return
+	}
+	if !pi.tcpSYN && !pi.tcpSYNACK {
+		ttl = 0
+	}
+	if ttl == 0 && tsval == 0 {
+		return
+	}
+
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	bm.devices.update(key, func(dev *DeviceStats) {
+		if dev.nat == nil {
+			dev.nat = &natTracker{}
+		}
+		dev.nat.observeTTL(ttl)
+		dev.nat.observeTimestamp(tsval, time.Now())
+
+		// Replace rather than mutate so snapshot copies never share a slice being written
+		dev.NATSignals = dev.nat.signals()
+		dev.NATSuspected = len(dev.NATSignals) > 0
+	})
+}
+
+// REST API: List devices suspected of tethering / connection sharing
+func (bm *BandwidthMonitor) handleGetTethering(w http.ResponseWriter, r *http.Request) {
+	stats := bm.GetNetworkStats()
+	suspected := make([]*DeviceStats, 0)
+	for _, dev := range stats.Devices {
+		if dev.NATSuspected {
+			suspected = append(suspected, dev)
+		}
+	}
+	writeEncoded(w, r, suspected)
+}
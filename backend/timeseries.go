@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// seriesPruneInterval is how often minutes past the retention are deleted
+const seriesPruneInterval = time.Hour
+
+// deviceCounters are the cumulative traffic counters of a device
+type deviceCounters struct {
+	bytesSent, bytesRecv, packetsSent, packetsRecv uint64
+}
+
+// since returns the traffic between prev and c; a counter that went
+// backwards (stats reset) counts from zero
+func (c deviceCounters) since(prev deviceCounters) deviceCounters {
+	if c.bytesSent < prev.bytesSent || c.bytesRecv < prev.bytesRecv {
+		prev = deviceCounters{}
+	}
+	return deviceCounters{c.bytesSent - prev.bytesSent, c.bytesRecv - prev.bytesRecv,
+		c.packetsSent - prev.packetsSent, c.packetsRecv - prev.packetsRecv}
+}
+
+// plus returns the sum of c and d
+func (c deviceCounters) plus(d deviceCounters) deviceCounters {
+	return deviceCounters{c.bytesSent + d.bytesSent, c.bytesRecv + d.bytesRecv,
+		c.packetsSent + d.packetsSent, c.packetsRecv + d.packetsRecv}
+}
+
+// addMinuteSQL adds traffic to a device's minute
+const addMinuteSQL = `INSERT INTO device_minutes
+	(minute, device, bytes_sent, bytes_recv, packets_sent, packets_recv) VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (minute, device) DO UPDATE SET
+		bytes_sent = bytes_sent + excluded.bytes_sent,
+		bytes_recv = bytes_recv + excluded.bytes_recv,
+		packets_sent = packets_sent + excluded.packets_sent,
+		packets_recv = packets_recv + excluded.packets_recv`
+
+// seriesDB stores per-device traffic per minute in SQLite, so history
+// survives restarts. Each flush writes the traffic since the previous one.
+// With -encryption-key the minutes are sealed (see sealedseries.go) and
+// summed in Go rather than in SQL.
+type seriesDB struct {
+	mu        sync.Mutex
+	db        *sql.DB
+	retention time.Duration
+	last      map[string]deviceCounters // counters at the previous flush
+	primed    bool
+	lastPrune time.Time
+	// Optional write-ahead journal of the traffic since the last flush, and
+	// the counters it was last written at
+	journal     *journal
+	journalLast map[string]deviceCounters
+	sealer      *atRestCipher // seals the minutes when set
+}
+
+// openSeriesDB opens (creating) the time-series database at path
+func openSeriesDB(path string, retention time.Duration) (*seriesDB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS device_minutes (
+		minute       INTEGER NOT NULL, -- Unix time of the minute's start
+		device       TEXT    NOT NULL,
+		bytes_sent   INTEGER NOT NULL,
+		bytes_recv   INTEGER NOT NULL,
+		packets_sent INTEGER NOT NULL,
+		packets_recv INTEGER NOT NULL,
+		PRIMARY KEY (minute, device)
+	)`)
+	if err == nil {
+		_, err = db.Exec(sealedMinutesSchema)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &seriesDB{db: db, retention: retention, last: make(map[string]deviceCounters), sealer: atRest}
+	if err := s.checkSealing(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// flush writes the traffic of every device since the previous flush into
+// the minute just ended (or, mid-minute, the one in progress). The first
+// flush only sets the baseline; a counter that went backwards (stats reset)
+// counts from zero.
+func (s *seriesDB) flush(current map[string]deviceCounters, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, primed := s.last, s.primed
+	s.last, s.primed = current, true
+	if !primed {
+		return s.resetJournal(current)
+	}
+	minute := now.Add(-time.Second).Truncate(time.Minute).Unix()
+
+	deltas := make(map[string]deviceCounters)
+	for device, cur := range current {
+		if d := cur.since(last[device]); d != (deviceCounters{}) {
+			deltas[device] = d
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.addMinutes(tx, map[int64]map[string]deviceCounters{minute: deltas}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := s.resetJournal(current); err != nil {
+		return err
+	}
+
+	if s.retention > 0 && now.Sub(s.lastPrune) >= seriesPruneInterval {
+		s.lastPrune = now
+		table := "device_minutes"
+		if s.sealer != nil {
+			table = "sealed_minutes"
+		}
+		if _, err := s.db.Exec(`DELETE FROM `+table+` WHERE minute < ?`, now.Add(-s.retention).Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMinutes adds traffic to the minutes it belongs to, by minute and device
+func (s *seriesDB) addMinutes(tx *sql.Tx, minutes map[int64]map[string]deviceCounters) error {
+	if s.sealer != nil {
+		return s.addSealedMinutes(tx, minutes)
+	}
+	stmt, err := tx.Prepare(addMinuteSQL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for minute, devices := range minutes {
+		for device, d := range devices {
+			if _, err := stmt.Exec(minute, device, int64(d.bytesSent), int64(d.bytesRecv), int64(d.packetsSent), int64(d.packetsRecv)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// merge moves the stored traffic of device from onto device into, keeping
+// the flush baseline in step with their summed counters
+func (s *seriesDB) merge(from, into string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if s.sealer != nil {
+		err = s.mergeSealed(tx, from, into)
+	} else {
+		err = mergeMinutes(tx, from, into)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if c, ok := s.last[from]; ok {
+		s.last[into] = s.last[into].plus(c)
+		delete(s.last, from)
+	}
+	return nil
+}
+
+// mergeMinutes moves the plaintext minutes of device from onto device into
+func mergeMinutes(tx *sql.Tx, from, into string) error {
+	// WHERE true tells the parser ON CONFLICT belongs to the INSERT
+	_, err := tx.Exec(`INSERT INTO device_minutes
+		(minute, device, bytes_sent, bytes_recv, packets_sent, packets_recv)
+		SELECT minute, ?, bytes_sent, bytes_recv, packets_sent, packets_recv FROM device_minutes WHERE device = ? AND true
+		ON CONFLICT (minute, device) DO UPDATE SET
+			bytes_sent = bytes_sent + excluded.bytes_sent,
+			bytes_recv = bytes_recv + excluded.bytes_recv,
+			packets_sent = packets_sent + excluded.packets_sent,
+			packets_recv = packets_recv + excluded.packets_recv`, into, from)
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM device_minutes WHERE device = ?`, from)
+	}
+	return err
+}
+
+// Close closes the database and its journal
+func (s *seriesDB) Close() error {
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	return s.db.Close()
+}
+
+// deviceCounterSnapshot copies the counters of every device
+func (bm *BandwidthMonitor) deviceCounterSnapshot() map[string]deviceCounters {
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	result := make(map[string]deviceCounters, bm.devices.len())
+	bm.devices.each(func(key string, dev *DeviceStats) {
+		result[key] = deviceCounters{dev.BytesSent, dev.BytesRecv, dev.PacketsSent, dev.PacketsRecv}
+	})
+	return result
+}
+
+// flushSeries writes the device traffic since the previous flush
+func (bm *BandwidthMonitor) flushSeries() {
+	if err := bm.series.flush(bm.deviceCounterSnapshot(), time.Now()); err != nil {
+		log.Printf("Error writing traffic history: %v", err)
+	}
+}
+
+// flushSeriesPeriodically writes per-minute device traffic at every minute
+// boundary until stop is closed
+func (bm *BandwidthMonitor) flushSeriesPeriodically(stop <-chan struct{}) {
+	bm.flushSeries()
+	next := time.Now().Truncate(time.Minute).Add(time.Minute)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(next)):
+			bm.flushSeries()
+			next = next.Add(time.Minute)
+		}
+	}
+}
+
+// totals sums the traffic of every device over the minutes in [from, to)
+func (s *seriesDB) totals(from, to time.Time) (map[string]traffic, error) {
+	if s.sealer != nil {
+		result := make(map[string]traffic)
+		err := s.eachSealedMinute(from, to, func(minute int64, devices map[string]deviceCounters) {
+			for device, c := range devices {
+				t := result[device]
+				result[device] = traffic{t.sent + c.bytesSent, t.recv + c.bytesRecv}
+			}
+		})
+		return result, err
+	}
+	rows, err := s.db.Query(`SELECT device, SUM(bytes_sent), SUM(bytes_recv) FROM device_minutes
+		WHERE minute >= ? AND minute < ? GROUP BY device`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]traffic)
+	for rows.Next() {
+		var device string
+		var sent, recv int64
+		if err := rows.Scan(&device, &sent, &recv); err != nil {
+			return nil, err
+		}
+		result[device] = traffic{uint64(sent), uint64(recv)}
+	}
+	return result, rows.Err()
+}
+
+// seriesRow is the traffic of one device in one step of a downsampled query
+type seriesRow struct {
+	step   int // index of the step from the query's start
+	device string
+	traffic
+}
+
+// downsample sums device traffic over the minutes in [from, to) into steps of
+// length step counted from from; from must be minute-aligned
+func (s *seriesDB) downsample(from, to time.Time, step time.Duration) ([]seriesRow, error) {
+	if s.sealer != nil {
+		return s.downsampleSealed(from, to, step)
+	}
+	rows, err := s.db.Query(`SELECT (minute - ?) / ? AS step, device, SUM(bytes_sent), SUM(bytes_recv)
+		FROM device_minutes WHERE minute >= ? AND minute < ? GROUP BY step, device`,
+		from.Unix(), int64(step/time.Second), from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []seriesRow
+	for rows.Next() {
+		var row seriesRow
+		var sent, recv int64
+		if err := rows.Scan(&row.step, &row.device, &sent, &recv); err != nil {
+			return nil, err
+		}
+		row.traffic = traffic{uint64(sent), uint64(recv)}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
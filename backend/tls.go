@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Self-signed certificate lifetime; a stored one is replaced this long
+// before it expires
+const (
+	selfSignedValidity = 365 * 24 * time.Hour
+	selfSignedRenew    = 30 * 24 * time.Hour
+)
+
+// tlsConfig returns the server's TLS configuration: the -tls-cert/-tls-key
+// pair when given, else with selfSigned a certificate generated for hosts.
+// A generated certificate is kept under dataDir (when set) so browsers
+// that were told to trust it keep doing so across restarts.
+func tlsConfig(certFile, keyFile string, selfSigned bool, dataDir string, hosts []string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+		}
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	case selfSigned:
+		cert, err = selfSignedCertificate(dataDir, hosts)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}, nil
+}
+
+// selfSignedCertificate loads the certificate stored under dataDir, or
+// generates (and stores) a new one when there is none or it expires soon
+func selfSignedCertificate(dataDir string, hosts []string) (tls.Certificate, error) {
+	var certFile, keyFile string
+	if dataDir != "" {
+		certFile, keyFile = filepath.Join(dataDir, "tls", "cert.pem"), filepath.Join(dataDir, "tls", "key.pem")
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && cert.Leaf != nil && time.Until(cert.Leaf.NotAfter) > selfSignedRenew {
+			return cert, nil
+		}
+	}
+
+	certPEM, keyPEM, err := generateCertificate(hosts, time.Now())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if certFile != "" {
+		if err := os.MkdirAll(filepath.Dir(certFile), 0o700); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Printf("Generated self-signed TLS certificate %s", certFile)
+	} else {
+		log.Printf("Generated self-signed TLS certificate (not kept without -data-dir)")
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// generateCertificate creates a self-signed ECDSA certificate for hosts
+// (names and IP addresses), returning it and its key PEM-encoded
+func generateCertificate(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"LAN Traffic Tracker"}, CommonName: "lantt self-signed"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" && !containsString(tmpl.DNSNames, h) {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// certificateHosts are the names a self-signed certificate is issued for:
+// localhost, this machine's host name and the addresses it is reached at
+func certificateHosts(bindHost, localIP string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	for _, h := range []string{localIP, bindHost} {
+		if ip := net.ParseIP(h); h != "" && (ip == nil || !ip.IsUnspecified()) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
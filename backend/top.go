@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// runTop is the "top" subcommand: capture for -duration without the HTTP
+// server, then print the busiest devices as a table or JSON. Ctrl-C ends
+// the capture early. It returns the exit status.
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	var deviceNames stringList
+	fs.Var(&deviceNames, "device", "Network device to capture on; comma-separated or repeated for several")
+	duration := fs.Duration("duration", 30*time.Second, "How long to capture")
+	filter := fs.String("filter", "", "BPF capture filter")
+	limit := fs.Int("n", 20, "Devices to list (0 = all)")
+	sortKeys := fs.String("sort", SortBytes, "Device order: comma-separated keys of bytes, rate, recent, lastSeen, name or risk")
+	accountingFlag := fs.String("accounting", "auto", "Key devices by mac, ip or auto")
+	jsonOut := fs.Bool("json", false, "Print JSON instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s top [flags]\n\nCapture for a while and print the busiest devices.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *duration <= 0 {
+		fmt.Fprintln(os.Stderr, "-duration must be positive")
+		return 2
+	}
+	keys, err := parseSortKeys(*sortKeys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -sort: %v\n", err)
+		return 2
+	}
+
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(devices) == 0 {
+		fmt.Fprintln(os.Stderr, "No devices found")
+		return 1
+	}
+	deviceNames, localIP := selectDevices(deviceNames, devices)
+
+	monitor := NewBandwidthMonitor(localIP)
+	monitor.sortKeys = keys
+	monitor.captureFilter = *filter
+	modes := make(map[string]bool)
+	handles := make(map[string]*pcap.Handle)
+	for _, name := range deviceNames {
+		source := captureSource{device: name, snaplen: defaultSnaplen, promisc: true, timeout: captureReadTimeout, restart: make(chan struct{}, 1), fanout: 1}
+		handle, err := source.open()
+		if err == nil && *filter != "" {
+			if err = handle.SetBPFFilter(*filter); err != nil {
+				handle.Close()
+			}
+		}
+		if err != nil {
+			for _, h := range handles {
+				h.Close()
+			}
+			fmt.Fprintf(os.Stderr, "Error opening device %s: %v\n", name, err)
+			return 1
+		}
+		modes[autoAccountingMode(name, devices, handle.LinkType())] = true
+		monitor.captures = append(monitor.captures, source)
+		handles[name] = handle
+	}
+	switch *accountingFlag {
+	case AccountingMAC, AccountingIP:
+		monitor.accounting = *accountingFlag
+	case "auto":
+		if len(modes) == 1 && modes[AccountingIP] {
+			monitor.accounting = AccountingIP
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -accounting %q (want mac, ip or auto)\n", *accountingFlag)
+		return 2
+	}
+
+	// Progress goes to stderr so stdout stays clean for scripts
+	log.SetOutput(os.Stderr)
+	log.Printf("Capturing on %v for %s", []string(deviceNames), *duration)
+	monitor.withAccounting(func() {
+		stop := make(chan struct{})
+		done := make(chan struct{}, len(monitor.captures))
+		for _, source := range monitor.captures {
+			source, handle := source, handles[source.device]
+			go func() {
+				monitor.runCapture(source, handle, stop)
+				done <- struct{}{}
+			}()
+		}
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-time.After(*duration):
+		case <-interrupt:
+		}
+		close(stop)
+		for range monitor.captures {
+			<-done
+		}
+	})
+
+	stats := monitor.GetNetworkStats()
+	if *limit > 0 && len(stats.Devices) > *limit {
+		stats.DevicesOmitted = len(stats.Devices) - *limit
+		stats.Devices = stats.Devices[:*limit]
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	printTop(stats)
+	return 0
+}
+
+// printTop writes stats as a table with each device's average rates over
+// the capture
+func printTop(stats *NetworkStats) {
+	lf := lookupLocale("")
+	writeDeviceTable(os.Stdout, stats.Devices, stats.MonitorDuration)
+	fmt.Printf("\n%d devices in %.0fs: %s sent, %s received", stats.ActiveDevices, stats.MonitorDuration,
+		lf.formatBytes(stats.TotalSent), lf.formatBytes(stats.TotalRecv))
+	if stats.DevicesOmitted > 0 {
+		fmt.Printf(" (%d more devices not listed)", stats.DevicesOmitted)
+	}
+	fmt.Println()
+}
+
+// writeDeviceTable writes devices as a table, with rates averaged over the
+// seconds their counters cover
+func writeDeviceTable(w io.Writer, devices []*DeviceStats, seconds float64) {
+	lf := lookupLocale("")
+	secs := max(seconds, 1)
+	rate := func(n uint64) string { return lf.formatBytes(uint64(float64(n)/secs)) + "/s" }
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tIP\tNAME\tSENT\tRECEIVED\tSENT/S\tRECV/S\tPACKETS")
+	for _, d := range devices {
+		key := d.MAC
+		if key == "" {
+			key = d.IP
+		}
+		name := d.friendlyName()
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", key, d.IP, name, lf.formatBytes(d.BytesSent), lf.formatBytes(d.BytesRecv),
+			rate(d.BytesSent), rate(d.BytesRecv), d.PacketsSent+d.PacketsRecv)
+	}
+	tw.Flush()
+}
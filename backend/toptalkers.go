@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recent-activity tracking for top talkers
+const (
+	activityStep = 10 * time.Second // resolution of windows
+	maxTopWindow = time.Hour
+)
+
+// activityBucket is the traffic of every active device during one step
+type activityBucket struct {
+	start   time.Time
+	devices map[string]deviceCounters // only devices with traffic in the step
+}
+
+// recentActivity keeps per-device traffic of the last maxTopWindow in
+// activityStep buckets, so "who is busy right now" does not depend on
+// cumulative counters. Like deviceHistory, idle devices cost nothing.
+type recentActivity struct {
+	mu      sync.Mutex
+	buckets []activityBucket // oldest first
+	last    map[string]deviceCounters
+	lastAt  time.Time
+}
+
+// newRecentActivity creates an empty tracker
+func newRecentActivity() *recentActivity {
+	return &recentActivity{last: make(map[string]deviceCounters)}
+}
+
+// deltas returns the traffic of each device since the previous sample; a
+// counter that went backwards (stats reset) counts from zero. Caller holds a.mu.
+func (a *recentActivity) deltas(current map[string]deviceCounters) map[string]deviceCounters {
+	result := make(map[string]deviceCounters)
+	for key, cur := range current {
+		prev := a.last[key]
+		if cur.bytesSent < prev.bytesSent || cur.bytesRecv < prev.bytesRecv {
+			prev = deviceCounters{}
+		}
+		d := deviceCounters{cur.bytesSent - prev.bytesSent, cur.bytesRecv - prev.bytesRecv,
+			cur.packetsSent - prev.packetsSent, cur.packetsRecv - prev.packetsRecv}
+		if d != (deviceCounters{}) {
+			result[key] = d
+		}
+	}
+	return result
+}
+
+// sample closes the bucket of the step ending at now
+func (a *recentActivity) sample(current map[string]deviceCounters, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.lastAt.IsZero() {
+		a.buckets = append(a.buckets, activityBucket{start: a.lastAt, devices: a.deltas(current)})
+		if keep := int(maxTopWindow / activityStep); len(a.buckets) > keep {
+			a.buckets = a.buckets[len(a.buckets)-keep:]
+		}
+	}
+	a.last = current
+	a.lastAt = now
+}
+
+// forget drops the sampling baseline of device; its past buckets stay
+func (a *recentActivity) forget(device string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.last, device)
+}
+
+// drop removes device from the window, as if it had been idle
+func (a *recentActivity) drop(device string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, b := range a.buckets {
+		delete(b.devices, device)
+	}
+	delete(a.last, device)
+}
+
+// reset empties the window
+func (a *recentActivity) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buckets = nil
+	a.last = make(map[string]deviceCounters)
+}
+
+// totals sums the traffic of each device from since up to now, including the
+// step in progress (taken from current)
+func (a *recentActivity) totals(current map[string]deviceCounters, since time.Time) map[string]deviceCounters {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make(map[string]deviceCounters)
+	add := func(devices map[string]deviceCounters) {
+		for k, d := range devices {
+			t := result[k]
+			result[k] = deviceCounters{t.bytesSent + d.bytesSent, t.bytesRecv + d.bytesRecv,
+				t.packetsSent + d.packetsSent, t.packetsRecv + d.packetsRecv}
+		}
+	}
+	for _, b := range a.buckets {
+		if !b.start.Before(since) {
+			add(b.devices)
+		}
+	}
+	if !a.lastAt.IsZero() {
+		add(a.deltas(current))
+	}
+	return result
+}
+
+// recordActivityPeriodically samples device counters every activityStep until stop is closed
+func (bm *BandwidthMonitor) recordActivityPeriodically(stop <-chan struct{}) {
+	bm.activity.sample(bm.deviceCounterSnapshot(), time.Now())
+	ticker := time.NewTicker(activityStep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bm.activity.sample(bm.deviceCounterSnapshot(), now)
+		}
+	}
+}
+
+// TopTalker is a device's traffic over a top-talkers window
+type TopTalker struct {
+	Rank        int     `json:"rank"`
+	Device      string  `json:"device"`
+	Name        string  `json:"name,omitempty"`
+	IP          string  `json:"ip,omitempty"`
+	BytesSent   uint64  `json:"bytesSent"`
+	BytesRecv   uint64  `json:"bytesRecv"`
+	PacketsSent uint64  `json:"packetsSent"`
+	PacketsRecv uint64  `json:"packetsRecv"`
+	RateBps     float64 `json:"rateBps"` // bytes per second sent and received over the window
+}
+
+// TopTalkers ranks devices by their traffic over a recent window
+type TopTalkers struct {
+	Window  int         `json:"window"` // seconds
+	By      string      `json:"by"`
+	Since   time.Time   `json:"since"`
+	Devices []TopTalker `json:"devices"`
+}
+
+// topTalkers ranks the n devices moving the most bytes or packets over the
+// window before now. Only devices /api/stats lists are ranked.
+func (bm *BandwidthMonitor) topTalkers(n int, window time.Duration, by string, now time.Time) *TopTalkers {
+	since := now.Add(-window)
+	totals := bm.activity.totals(bm.deviceCounterSnapshot(), since)
+	// Tracking may have started less than a window ago
+	span := min(window, now.Sub(bm.startTime))
+
+	result := &TopTalkers{Window: int(window / time.Second), By: by, Since: since, Devices: make([]TopTalker, 0)}
+	bm.mutex.RLock()
+	for k, t := range totals {
+		dev, ok := bm.devices.load(k, now)
+		if !ok || !bm.includeDevice(&dev) {
+			continue
+		}
+		result.Devices = append(result.Devices, TopTalker{
+			Device:      k,
+			Name:        dev.friendlyName(),
+			IP:          dev.IP,
+			BytesSent:   t.bytesSent,
+			BytesRecv:   t.bytesRecv,
+			PacketsSent: t.packetsSent,
+			PacketsRecv: t.packetsRecv,
+			RateBps:     float64(t.bytesSent+t.bytesRecv) / max(span.Seconds(), 1),
+		})
+	}
+	bm.mutex.RUnlock()
+
+	key := func(t TopTalker) uint64 {
+		if by == "packets" {
+			return t.PacketsSent + t.PacketsRecv
+		}
+		return t.BytesSent + t.BytesRecv
+	}
+	sort.Slice(result.Devices, func(i, j int) bool {
+		ki, kj := key(result.Devices[i]), key(result.Devices[j])
+		if ki != kj {
+			return ki > kj
+		}
+		return result.Devices[i].Device < result.Devices[j].Device
+	})
+	if len(result.Devices) > n {
+		result.Devices = result.Devices[:n]
+	}
+	for i := range result.Devices {
+		result.Devices[i].Rank = i + 1
+	}
+	return result
+}
+
+// REST API: Heaviest devices over a recent ?window= (default 5m, at most 1h),
+// top ?n= (default 10), ranked ?by=bytes (default) or packets
+func (bm *BandwidthMonitor) handleGetTopTalkers(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	n := 10
+	if s := q.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	window := 5 * time.Minute
+	if s := q.Get("window"); s != "" {
+		var err error
+		window, err = time.ParseDuration(s)
+		if err != nil || window < activityStep || window > maxTopWindow {
+			http.Error(w, "Invalid window parameter (10s to 1h)", http.StatusBadRequest)
+			return
+		}
+	}
+	by := q.Get("by")
+	switch by {
+	case "":
+		by = "bytes"
+	case "bytes", "packets":
+	default:
+		http.Error(w, "Invalid by parameter (bytes or packets)", http.StatusBadRequest)
+		return
+	}
+	writeEncoded(w, r, bm.topTalkers(n, window, by, time.Now()))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUpdateURL is the release endpoint checked for newer versions; any
+// endpoint answering like the GitHub latest-release API works
+const defaultUpdateURL = "https://api.github.com/repos/simorina/LAN-TrafficTracker/releases/latest"
+
+// UpdateStatus is the outcome of the last release check
+type UpdateStatus struct {
+	Current   string    `json:"current"`
+	Latest    string    `json:"latest,omitempty"`
+	Available bool      `json:"available"`     // Latest is newer than Current
+	URL       string    `json:"url,omitempty"` // release notes of Latest
+	CheckedAt time.Time `json:"checkedAt,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// releaseInfo is the part of a latest-release response read
+type releaseInfo struct {
+	TagName    string `json:"tag_name"`
+	HTMLURL    string `json:"html_url"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// updateChecker periodically asks a release endpoint whether a newer version
+// exists. It only reports it; installing is left to the operator.
+type updateChecker struct {
+	url    string
+	client *http.Client
+
+	mu       sync.Mutex
+	status   UpdateStatus
+	notified string // latest version already logged
+}
+
+// newUpdateChecker creates a checker of the release endpoint at releaseURL
+func newUpdateChecker(releaseURL string) (*updateChecker, error) {
+	u, err := url.Parse(releaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", releaseURL)
+	}
+	return &updateChecker{
+		url:    releaseURL,
+		client: &http.Client{Timeout: notifyTimeout},
+		status: UpdateStatus{Current: version},
+	}, nil
+}
+
+// parseVersion splits "v1.2.3" (or "1.2", with an optional "-rc1" suffix)
+// into its numeric parts
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+// newerVersion reports whether latest is a later release than current; a
+// development build ("dev") is never reported as outdated
+func newerVersion(latest, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := 0; i < max(len(l), len(c)); i++ {
+		var a, b int
+		if i < len(l) {
+			a = l[i]
+		}
+		if i < len(c) {
+			b = c[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
+
+// check asks the release endpoint for the latest version
+func (uc *updateChecker) check() {
+	req, err := http.NewRequest(http.MethodGet, uc.url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "lantt/"+version)
+	var release releaseInfo
+	_, err = getJSON(uc.client, req, &release)
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.status.CheckedAt = time.Now()
+	if err != nil {
+		// Keep the last known release; the next check may succeed
+		uc.status.Error = err.Error()
+		return
+	}
+	uc.status.Error = ""
+	if release.Draft || release.Prerelease || release.TagName == "" {
+		return
+	}
+	uc.status.Latest = release.TagName
+	uc.status.URL = release.HTMLURL
+	uc.status.Available = newerVersion(release.TagName, version)
+	if uc.status.Available && uc.notified != release.TagName {
+		log.Printf("Update available: %s (running %s) %s", release.TagName, version, release.HTMLURL)
+		uc.notified = release.TagName
+	}
+}
+
+// current returns the outcome of the last check
+func (uc *updateChecker) current() UpdateStatus {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.status
+}
+
+// available returns the newer version when there is one
+func (uc *updateChecker) available() string {
+	if uc == nil {
+		return ""
+	}
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	if !uc.status.Available {
+		return ""
+	}
+	return uc.status.Latest
+}
+
+// checkPeriodically checks at startup and then every interval until stop is
+// closed
+func (uc *updateChecker) checkPeriodically(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		uc.check()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User roles: viewers see everything and may comment on alerts; only admins
+// change state (resets, renames, alert state and assignees, capture
+// control, configuration and accounts)
+const (
+	RoleViewer = "viewer"
+	RoleAdmin  = "admin"
+)
+
+// Account and session limits
+const (
+	sessionCookie     = "lantt_session"
+	sessionTTL        = 7 * 24 * time.Hour
+	maxUsers          = 256
+	maxSessions       = 4096
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+// userNamePattern is what a user name may look like
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dummyPasswordHash is compared against for unknown users, so a failed
+// login takes as long whether or not the user exists
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return hash
+})
+
+// User is an account allowed to use the dashboard and API
+type User struct {
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	PasswordHash string `json:"passwordHash,omitempty"` // bcrypt; never sent to clients
+}
+
+// session is a logged-in user
+type session struct {
+	user    string
+	expires time.Time
+}
+
+// userStore keeps the accounts and their sessions. Sessions live in memory
+// only; a restart logs everyone out.
+type userStore struct {
+	mu       sync.RWMutex
+	users    map[string]User
+	sessions map[string]session // by token
+	doc      document           // optional place the accounts are persisted to
+}
+
+// newUserStore creates a store, loading accounts from doc when set
+func newUserStore(doc document) *userStore {
+	us := &userStore{users: make(map[string]User), sessions: make(map[string]session), doc: doc}
+	if doc == nil {
+		return us
+	}
+	var users []User
+	if err := doc.load(&users); err != nil {
+		log.Printf("Error reading users from %s: %v", doc, err)
+		return us
+	}
+	for _, u := range users {
+		us.users[u.Name] = u
+	}
+	return us
+}
+
+// save writes the accounts back to their document; caller holds us.mu
+func (us *userStore) save() {
+	if us.doc == nil {
+		return
+	}
+	list := make([]User, 0, len(us.users))
+	for _, u := range us.users {
+		list = append(list, u)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	if err := us.doc.save(list); err != nil {
+		log.Printf("Error writing users to %s: %v", us.doc, err)
+	}
+}
+
+// configured reports whether any account exists; without one the API stays
+// open (or guarded by -api-key alone)
+func (us *userStore) configured() bool {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	return len(us.users) > 0
+}
+
+// list returns the accounts without their password hashes
+func (us *userStore) list() []User {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	list := make([]User, 0, len(us.users))
+	for _, u := range us.users {
+		list = append(list, User{Name: u.Name, Role: u.Role})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// set creates or updates an account; an empty password keeps the current one
+func (us *userStore) set(name, role, password string) error {
+	if !userNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	if role != RoleViewer && role != RoleAdmin {
+		return fmt.Errorf("role must be %s or %s", RoleViewer, RoleAdmin)
+	}
+	var hash []byte
+	if password != "" {
+		if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+			return fmt.Errorf("password must be %d to %d characters", minPasswordLength, maxPasswordLength)
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return err
+		}
+	}
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	u, exists := us.users[name]
+	if !exists && len(us.users) >= maxUsers {
+		return fmt.Errorf("too many users")
+	}
+	if !exists && hash == nil {
+		return fmt.Errorf("a new user needs a password")
+	}
+	u.Name, u.Role = name, role
+	if hash != nil {
+		u.PasswordHash = string(hash)
+		us.dropSessions(name) // a changed password logs the user out everywhere
+	}
+	us.users[name] = u
+	us.save()
+	return nil
+}
+
+// remove deletes an account and its sessions; it reports whether it existed
+func (us *userStore) remove(name string) bool {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if _, ok := us.users[name]; !ok {
+		return false
+	}
+	delete(us.users, name)
+	us.dropSessions(name)
+	us.save()
+	return true
+}
+
+// dropSessions ends the sessions of user; caller holds us.mu
+func (us *userStore) dropSessions(user string) {
+	for token, s := range us.sessions {
+		if s.user == user {
+			delete(us.sessions, token)
+		}
+	}
+}
+
+// login checks a password and starts a session, returning its token
+func (us *userStore) login(name, password string, now time.Time) (string, User, bool) {
+	us.mu.RLock()
+	u, ok := us.users[name]
+	us.mu.RUnlock()
+	hash := dummyPasswordHash()
+	if ok {
+		hash = []byte(u.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok {
+		return "", User{}, false
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", User{}, false
+	}
+	token := hex.EncodeToString(buf)
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if len(us.sessions) >= maxSessions {
+		for t, s := range us.sessions {
+			if now.After(s.expires) {
+				delete(us.sessions, t)
+			}
+		}
+		if len(us.sessions) >= maxSessions {
+			return "", User{}, false
+		}
+	}
+	us.sessions[token] = session{user: name, expires: now.Add(sessionTTL)}
+	return token, User{Name: u.Name, Role: u.Role}, true
+}
+
+// logout ends the session of token
+func (us *userStore) logout(token string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.sessions, token)
+}
+
+// session returns the user logged in with token; the role is the account's
+// current one, so role changes apply to open sessions
+func (us *userStore) session(token string) (User, bool) {
+	if token == "" {
+		return User{}, false
+	}
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	s, ok := us.sessions[token]
+	if !ok || time.Now().After(s.expires) {
+		return User{}, false
+	}
+	u, ok := us.users[s.user]
+	return User{Name: u.Name, Role: u.Role}, ok
+}
+
+// sessionToken returns the session token of a request: the session cookie
+// of browsers, else the bearer token or ?token= of API clients
+func sessionToken(r *http.Request) string {
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return requestToken(r)
+}
+
+// principalKey is the request context key of the authenticated principal
+type principalKey struct{}
+
+// principal is who a request was made by
+type principal struct {
+	Name   string // empty for API keys and unauthenticated access
+	Role   string
+	APIKey string // name of the API key used, if any
+}
+
+// withPrincipal returns r carrying p
+func withPrincipal(r *http.Request, p principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// principalOf returns who made r; requests that bypassed authentication
+// have no role
+func principalOf(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+// authRequired reports whether the API needs credentials
+func (bm *BandwidthMonitor) authRequired() bool {
+	return len(bm.apiKeys) > 0 || bm.users.configured()
+}
+
+// identify returns the principal behind the API key or a session of r
+func (bm *BandwidthMonitor) identify(r *http.Request) (principal, bool) {
+	if name := bm.matchAPIKey(bearerToken(r)); name != "" {
+		return principal{Role: RoleAdmin, APIKey: name}, true
+	}
+	if u, ok := bm.users.session(sessionToken(r)); ok {
+		return principal{Name: u.Name, Role: u.Role}, true
+	}
+	return principal{}, false
+}
+
+// adminOnly restricts a handler to admins
+func (bm *BandwidthMonitor) adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principalOf(r).Role != RoleAdmin {
+			http.Error(w, "Forbidden: admin role required", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// REST API: Log in with {"name": "...", "password": "..."}. Browsers get a
+// session cookie; the returned token works as bearer token for API clients.
+func (bm *BandwidthMonitor) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	token, u, ok := bm.users.login(body.Name, body.Password, now)
+	if !ok {
+		log.Printf("Failed login for %q from %s", body.Name, r.RemoteAddr)
+		http.Error(w, "Invalid user name or password", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  now.Add(sessionTTL),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode, // other sites cannot ride the session
+	})
+	writeEncoded(w, r, map[string]interface{}{"name": u.Name, "role": u.Role, "token": token, "expiresAt": now.Add(sessionTTL)})
+}
+
+// REST API: End the current session
+func (bm *BandwidthMonitor) handleLogout(w http.ResponseWriter, r *http.Request) {
+	bm.users.logout(sessionToken(r))
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	writeEncoded(w, r, map[string]string{"status": "logged out"})
+}
+
+// REST API: Who the request is made by
+func (bm *BandwidthMonitor) handleGetMe(w http.ResponseWriter, r *http.Request) {
+	p := principalOf(r)
+	writeEncoded(w, r, User{Name: p.Name, Role: p.Role})
+}
+
+// REST API: List the accounts
+func (bm *BandwidthMonitor) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.users.list())
+}
+
+// REST API: Create or update an account with {"role": "viewer", "password": "..."};
+// the password may be left out when updating
+func (bm *BandwidthMonitor) handlePutUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Role     string `json:"role"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := bm.users.set(name, body.Role, body.Password); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeEncoded(w, r, User{Name: name, Role: body.Role})
+}
+
+// REST API: Delete an account
+func (bm *BandwidthMonitor) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if !bm.users.remove(mux.Vars(r)["name"]) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
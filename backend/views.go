@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// View limits
+const (
+	maxViewsPerUser = 100
+	maxViewSize     = 64 << 10 // bytes of config per view
+)
+
+// defaultViewUser owns views saved without a known user
+const defaultViewUser = "default"
+
+// View is a named dashboard configuration (layout, filters, charts) saved
+// by a frontend. The config is opaque to the backend.
+type View struct {
+	User      string          `json:"user"`
+	Name      string          `json:"name"`
+	Config    json.RawMessage `json:"config"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// viewKey identifies a view
+type viewKey struct {
+	user, name string
+}
+
+// viewStore keeps saved views per user
+type viewStore struct {
+	mu    sync.RWMutex
+	views map[viewKey]View
+	doc   document // optional place the views are persisted to
+}
+
+// newViewStore creates a store, loading views from doc when set
+func newViewStore(doc document) *viewStore {
+	vs := &viewStore{views: make(map[viewKey]View), doc: doc}
+	if doc == nil {
+		return vs
+	}
+	var views []View
+	if err := doc.load(&views); err != nil {
+		log.Printf("Error reading views from %s: %v", doc, err)
+		return vs
+	}
+	for _, v := range views {
+		vs.views[viewKey{v.User, v.Name}] = v
+	}
+	return vs
+}
+
+// save writes the views back to their document; caller holds vs.mu
+func (vs *viewStore) save() {
+	if vs.doc == nil {
+		return
+	}
+	if err := vs.doc.save(vs.sorted("")); err != nil {
+		log.Printf("Error writing views to %s: %v", vs.doc, err)
+	}
+}
+
+// sorted returns the views of user (all users if empty) ordered by user and
+// name; caller holds vs.mu
+func (vs *viewStore) sorted(user string) []View {
+	list := make([]View, 0)
+	for _, v := range vs.views {
+		if user == "" || v.User == user {
+			list = append(list, v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].User != list[j].User {
+			return list[i].User < list[j].User
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// list returns the views of user
+func (vs *viewStore) list(user string) []View {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	return vs.sorted(user)
+}
+
+// get returns one view of user
+func (vs *viewStore) get(user, name string) (View, bool) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	v, ok := vs.views[viewKey{user, name}]
+	return v, ok
+}
+
+// put adds or replaces a view; it reports false when user has too many views
+func (vs *viewStore) put(v View) bool {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	key := viewKey{v.User, v.Name}
+	if _, ok := vs.views[key]; !ok && len(vs.sorted(v.User)) >= maxViewsPerUser {
+		return false
+	}
+	vs.views[key] = v
+	vs.save()
+	return true
+}
+
+// remove deletes a view; it reports whether it existed
+func (vs *viewStore) remove(user, name string) bool {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	key := viewKey{user, name}
+	if _, ok := vs.views[key]; !ok {
+		return false
+	}
+	delete(vs.views, key)
+	vs.save()
+	return true
+}
+
+// viewUser is the user views are saved for: the logged-in user, the name
+// an authenticating reverse proxy passes in X-Remote-User, else
+// defaultViewUser
+func viewUser(r *http.Request) string {
+	if p := principalOf(r); p.Name != "" {
+		return p.Name
+	}
+	if u := r.Header.Get("X-Remote-User"); u != "" {
+		return u
+	}
+	return defaultViewUser
+}
+
+// REST API: List the saved views of the requesting user
+func (bm *BandwidthMonitor) handleGetViews(w http.ResponseWriter, r *http.Request) {
+	writeEncoded(w, r, bm.views.list(viewUser(r)))
+}
+
+// REST API: Get one saved view
+func (bm *BandwidthMonitor) handleGetView(w http.ResponseWriter, r *http.Request) {
+	v, ok := bm.views.get(viewUser(r), mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, v)
+}
+
+// REST API: Save a view; the body is its config, any JSON document
+func (bm *BandwidthMonitor) handlePutView(w http.ResponseWriter, r *http.Request) {
+	var config json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxViewSize)).Decode(&config); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	v := View{User: viewUser(r), Name: mux.Vars(r)["name"], Config: config, UpdatedAt: time.Now()}
+	if !bm.views.put(v) {
+		http.Error(w, "Too many saved views", http.StatusConflict)
+		return
+	}
+	writeEncoded(w, r, v)
+}
+
+// REST API: Delete a saved view
+func (bm *BandwidthMonitor) handleDeleteView(w http.ResponseWriter, r *http.Request) {
+	if !bm.views.remove(viewUser(r), mux.Vars(r)["name"]) {
+		http.Error(w, "View not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
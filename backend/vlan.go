@@ -0,0 +1,62 @@
+package main
+
+import "sort"
+
+// VLANStats totals the traffic of one 802.1Q VLAN
+type VLANStats struct {
+	ID      uint16 `json:"id"`
+	Bytes   uint64 `json:"bytes"`
+	Packets uint64 `json:"packets"`
+	Devices int    `json:"devices"`
+}
+
+// ObserveVLAN accounts a tagged packet to its VLAN and records the VLAN on
+// the devices involved
+func (bm *BandwidthMonitor) ObserveVLAN(pi *packetInfo, packets uint64) {
+	if pi.vlan == 0 {
+		return
+	}
+	src, dst := bm.deviceKey(pi.srcMAC, pi.srcIP), bm.deviceKey(pi.dstMAC, pi.dstIP)
+
+	bm.vlanMu.Lock()
+	v, ok := bm.vlans[pi.vlan]
+	if !ok {
+		v = &VLANStats{ID: pi.vlan}
+		bm.vlans[pi.vlan] = v
+	}
+	v.Bytes += pi.size
+	v.Packets += packets
+	bm.vlanMu.Unlock()
+
+	bm.mutex.RLock()
+	defer bm.mutex.RUnlock()
+	for _, key := range []string{src, dst} {
+		bm.devices.update(key, func(dev *DeviceStats) {
+			dev.VLAN = pi.vlan
+		})
+	}
+}
+
+// vlanTotals returns per-VLAN totals ordered by ID, counting the devices
+// last seen on each; caller holds bm.mutex
+func (bm *BandwidthMonitor) vlanTotals(devices []*DeviceStats) []VLANStats {
+	bm.vlanMu.Lock()
+	defer bm.vlanMu.Unlock()
+	if len(bm.vlans) == 0 {
+		return nil
+	}
+	counts := make(map[uint16]int)
+	for _, dev := range devices {
+		if dev.VLAN != 0 {
+			counts[dev.VLAN]++
+		}
+	}
+	result := make([]VLANStats, 0, len(bm.vlans))
+	for id, v := range bm.vlans {
+		entry := *v
+		entry.Devices = counts[id]
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// Web Push tuning
+const (
+	// pushTTL is how long (seconds) a push service holds an undelivered alert
+	pushTTL = 24 * 60 * 60
+	// maxPushSubscriptions caps subscribed browsers
+	maxPushSubscriptions = 100
+)
+
+// pushState is the persisted Web Push document: the server's VAPID key pair
+// and the browsers subscribed to alerts
+type pushState struct {
+	VAPIDPublicKey  string                 `json:"vapidPublicKey"`
+	VAPIDPrivateKey string                 `json:"vapidPrivateKey"`
+	Subscriptions   []webpush.Subscription `json:"subscriptions"`
+}
+
+// pushNotifier delivers alerts to subscribed browsers with Web Push, so they
+// arrive while the dashboard tab is closed
+type pushNotifier struct {
+	mu          sync.Mutex
+	state       pushState
+	doc         document
+	contact     string // VAPID subject, a mailto: or https: URL
+	minSeverity string
+}
+
+// newPushNotifier loads the push document, generating the VAPID key pair on
+// first use
+func newPushNotifier(doc document, contact, minSeverity string) (*pushNotifier, error) {
+	if _, ok := severityRank[minSeverity]; !ok {
+		return nil, fmt.Errorf("unknown severity %q", minSeverity)
+	}
+	p := &pushNotifier{doc: doc, contact: contact, minSeverity: minSeverity}
+	if err := doc.load(&p.state); err != nil {
+		return nil, err
+	}
+	if p.state.VAPIDPrivateKey == "" {
+		priv, pub, err := webpush.GenerateVAPIDKeys()
+		if err != nil {
+			return nil, err
+		}
+		p.state.VAPIDPrivateKey, p.state.VAPIDPublicKey = priv, pub
+		if err := doc.save(p.state); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated Web Push VAPID keys in %s", doc)
+	}
+	return p, nil
+}
+
+// save writes the push document back; caller holds p.mu
+func (p *pushNotifier) save() {
+	if err := p.doc.save(p.state); err != nil {
+		log.Printf("Error writing push subscriptions to %s: %v", p.doc, err)
+	}
+}
+
+// subscribe adds or refreshes a browser subscription; it reports false when
+// the subscription limit is reached
+func (p *pushNotifier) subscribe(s webpush.Subscription) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.state.Subscriptions {
+		if p.state.Subscriptions[i].Endpoint == s.Endpoint {
+			p.state.Subscriptions[i] = s
+			p.save()
+			return true
+		}
+	}
+	if len(p.state.Subscriptions) >= maxPushSubscriptions {
+		return false
+	}
+	p.state.Subscriptions = append(p.state.Subscriptions, s)
+	p.save()
+	return true
+}
+
+// unsubscribe removes the subscription with endpoint; it reports whether it existed
+func (p *pushNotifier) unsubscribe(endpoint string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, s := range p.state.Subscriptions {
+		if s.Endpoint == endpoint {
+			p.state.Subscriptions = append(p.state.Subscriptions[:i], p.state.Subscriptions[i+1:]...)
+			p.save()
+			return true
+		}
+	}
+	return false
+}
+
+// notifyAlert pushes an alert to every subscribed browser; subscriptions the
+// push service reports as gone are dropped
+func (p *pushNotifier) notifyAlert(alert Alert) {
+	if severityRank[alert.Severity] < severityRank[p.minSeverity] {
+		return
+	}
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	subs := append([]webpush.Subscription(nil), p.state.Subscriptions...)
+	opts := &webpush.Options{
+		HTTPClient:      notifyClient,
+		Subscriber:      p.contact,
+		VAPIDPublicKey:  p.state.VAPIDPublicKey,
+		VAPIDPrivateKey: p.state.VAPIDPrivateKey,
+		TTL:             pushTTL,
+		Topic:           fmt.Sprintf("alert-%d", alert.ID),
+	}
+	if alert.Severity == SeverityCritical {
+		opts.Urgency = webpush.UrgencyHigh
+	}
+	p.mu.Unlock()
+
+	// Sending can take seconds per browser; keep it off the detector's path
+	go func() {
+		for i := range subs {
+			resp, err := webpush.SendNotification(payload, &subs[i], opts)
+			if err != nil {
+				log.Printf("Error sending push notification: %v", err)
+				continue
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+				p.unsubscribe(subs[i].Endpoint)
+			case resp.StatusCode >= 300:
+				log.Printf("Push service rejected notification: %s", resp.Status)
+			}
+		}
+	}()
+}
+
+// REST API: The VAPID public key browsers subscribe with (applicationServerKey)
+func (bm *BandwidthMonitor) handleGetPushKey(w http.ResponseWriter, r *http.Request) {
+	if bm.push == nil {
+		http.Error(w, "Web Push not configured", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"publicKey": bm.push.state.VAPIDPublicKey})
+}
+
+// REST API: Subscribe a browser (a PushSubscription as JSON) to alerts
+func (bm *BandwidthMonitor) handlePostPushSubscription(w http.ResponseWriter, r *http.Request) {
+	if bm.push == nil {
+		http.Error(w, "Web Push not configured", http.StatusNotFound)
+		return
+	}
+	var s webpush.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Endpoint == "" || s.Keys.Auth == "" || s.Keys.P256dh == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !bm.push.subscribe(s) {
+		http.Error(w, "Too many push subscriptions", http.StatusConflict)
+		return
+	}
+	writeEncodedStatus(w, r, http.StatusCreated, map[string]string{"status": "subscribed"})
+}
+
+// REST API: Unsubscribe a browser ({"endpoint": "..."})
+func (bm *BandwidthMonitor) handleDeletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	if bm.push == nil {
+		http.Error(w, "Web Push not configured", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Endpoint == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !bm.push.unsubscribe(body.Endpoint) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	writeEncoded(w, r, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkOrigin decides whether a WebSocket upgrade may proceed based on its
+// Origin header. With no allowlist only pages served from the same host
+// (any port, so the dev server on :5173 still works) are accepted; "*"
+// allows every origin. Requests without an Origin are not from a browser
+// and are left to the token check.
+func (bm *BandwidthMonitor) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(bm.wsOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Hostname(), hostOnly(r.Host))
+	}
+	for _, allowed := range bm.wsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostOnly strips the port from a Host header value
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+// parseOriginList splits a comma-separated -ws-origins value
+func parseOriginList(s string) []string {
+	var origins []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// requestToken returns the auth token of a request, from an
+// "Authorization: Bearer" header or, for browsers that cannot set headers
+// on a WebSocket, the ?token= query parameter.
+func requestToken(r *http.Request) string {
+	if token := bearerToken(r); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorized reports whether r carries the configured auth token, the API
+// key or a user session; without any configured every request is
+// authorized.
+func (bm *BandwidthMonitor) authorized(r *http.Request) bool {
+	if bm.authToken == "" && !bm.authRequired() {
+		return true
+	}
+	token := requestToken(r)
+	if tokenMatches(token, bm.authToken) || bm.matchAPIKey(token) != "" {
+		return true
+	}
+	_, ok := bm.users.session(sessionToken(r))
+	return ok
+}
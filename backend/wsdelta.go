@@ -0,0 +1,82 @@
+package main
+
+import "sort"
+
+// WebSocket update kinds in delta mode (?mode=delta)
+const (
+	UpdateFull  = "full"
+	UpdateDelta = "delta"
+)
+
+// wsFullSnapshotEvery is how many delta updates are sent between full
+// snapshots, so a client that missed or misapplied one resynchronizes
+const wsFullSnapshotEvery = 30
+
+// deviceSnapshot is what a delta client last received of a device; a
+// device goes into the next delta when any of it changed
+type deviceSnapshot struct {
+	counters           deviceCounters
+	rateSent, rateRecv float64
+	recent             uint64
+	name               string
+	natSuspected       bool
+	riskScore          float64
+}
+
+// snapshotOf captures the fields compared between updates
+func snapshotOf(dev *DeviceStats) deviceSnapshot {
+	return deviceSnapshot{
+		counters:     deviceCounters{dev.BytesSent, dev.BytesRecv, dev.PacketsSent, dev.PacketsRecv},
+		rateSent:     dev.RateSentBps,
+		rateRecv:     dev.RateRecvBps,
+		recent:       dev.RecentBytes,
+		name:         dev.friendlyName(),
+		natSuspected: dev.NATSuspected,
+		riskScore:    dev.RiskScore,
+	}
+}
+
+// deltaUpdate turns a snapshot into the next update for a delta-mode client:
+// a full snapshot at first and every wsFullSnapshotEvery updates, otherwise
+// only the devices that changed since the previous update, plus the keys of
+// those no longer listed. Totals are always complete.
+func (c *wsClient) deltaUpdate(stats *NetworkStats, keyOf func(*DeviceStats) string) *NetworkStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update := *stats
+	sent := make(map[string]deviceSnapshot, len(stats.Devices))
+	for _, dev := range stats.Devices {
+		sent[keyOf(dev)] = snapshotOf(dev)
+	}
+
+	if c.sent == nil || c.sinceFull >= wsFullSnapshotEvery {
+		update.Update = UpdateFull
+		c.sinceFull = 0
+	} else {
+		update.Update = UpdateDelta
+		c.sinceFull++
+		update.Devices = make([]*DeviceStats, 0)
+		for _, dev := range stats.Devices {
+			if prev, ok := c.sent[keyOf(dev)]; !ok || prev != snapshotOf(dev) {
+				update.Devices = append(update.Devices, dev)
+			}
+		}
+		for key := range c.sent {
+			if _, ok := sent[key]; !ok {
+				update.Removed = append(update.Removed, key)
+			}
+		}
+		sort.Strings(update.Removed)
+	}
+	c.sent = sent
+	return &update
+}
+
+// update returns what to send c for stats: stats itself, or a delta for
+// delta-mode clients
+func (c *wsClient) update(bm *BandwidthMonitor, stats *NetworkStats) *NetworkStats {
+	if !c.delta {
+		return stats
+	}
+	return c.deltaUpdate(stats, func(dev *DeviceStats) string { return bm.deviceKey(dev.MAC, dev.IP) })
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket keepalive and flow control
+const (
+	// wsWriteWait bounds every write; a client that stops reading is
+	// dropped instead of stalling anything else
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may stay silent; pings every
+	// wsPingPeriod keep a live one answering, so half-open connections
+	// (e.g. a NAT mapping that expired) are noticed
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsMaxMessageSize caps control messages from clients
+	wsMaxMessageSize = 4096
+	// wsSendQueue is how many messages may wait for a client; a client
+	// further behind is disconnected rather than sent stale updates
+	wsSendQueue = 64
+)
+
+// wsOutgoing is a message waiting in a client's send queue
+type wsOutgoing struct {
+	data     []byte
+	snapshot time.Time // when the data was current, for lag
+}
+
+// queue hands data to the client's write pump without blocking. It reports
+// false when the client is gone or too far behind, in which case the
+// connection is closed and the read loop unregisters the client.
+func (c *wsClient) queue(data []byte, snapshot time.Time) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.out <- wsOutgoing{data: data, snapshot: snapshot}:
+		return true
+	default:
+		log.Printf("WebSocket client %d (%s) is not keeping up; disconnecting", c.id, c.remoteAddr)
+		c.conn.Close()
+		return false
+	}
+}
+
+// keepAlive makes reads fail once the client stops answering pings and caps
+// the size of what it may send
+func (c *wsClient) keepAlive() {
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+}
+
+// writePump is the only writer of the connection: it sends queued messages
+// and pings until c.done is closed or a write fails
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(c.codec.MessageType(), m.data); err != nil {
+				log.Printf("Error writing to WebSocket client %d: %v", c.id, err)
+				c.conn.Close()
+				return
+			}
+			c.recordSend(m.snapshot, len(m.data))
+			if c.apiKey != "" {
+				c.usage.wsSent(c.apiKey, len(m.data))
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WebSocket subscription topics. Anything else subscribes to a device by
+// key, MAC or IP. "all" is the default and only carries stats, so clients
+// that never subscribe see the same messages as before.
+const (
+	TopicAll    = "all"    // stats with every device
+	TopicTotals = "totals" // stats without devices
+	TopicFlows  = "flows"  // closed flow records
+	TopicAlerts = "alerts" // new alerts
+)
+
+// maxSubscriptions caps the topics and devices one client subscribes to
+const maxSubscriptions = 256
+
+// maxBroadcastDevices caps the devices of one "all" update. On networks with
+// more devices, clients page through the rest with {"page":...}; encoding
+// every device for every client each tick does not scale to a campus.
+const maxBroadcastDevices = 5000
+
+// WebSocket event types, sent next to the stats updates
+const (
+	EventAlert      = "alert"
+	EventFlows      = "flows"
+	EventSubscribed = "subscribed"
+	EventSmoothing  = "smoothing"
+	EventPage       = "page"
+	EventError      = "error"
+)
+
+// wsRequest is a control message from a WebSocket client, e.g.
+// {"subscribe":"aa:bb:cc:dd:ee:ff"}, {"unsubscribe":"alerts"},
+// {"smoothing":"ewma:30s"} or {"page":{"offset":5000,"limit":1000}}
+type wsRequest struct {
+	Subscribe   string  `json:"subscribe"`
+	Unsubscribe string  `json:"unsubscribe"`
+	Smoothing   string  `json:"smoothing"`
+	Page        *wsPage `json:"page"`
+}
+
+// wsPage is the slice of the sorted device list an "all" client receives;
+// a zero limit returns to the default top-N update
+type wsPage struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// WSEvent is a WebSocket message other than a stats update; Type tells them apart
+type WSEvent struct {
+	Type         string       `json:"type"`
+	Alert        *Alert       `json:"alert,omitempty"`
+	Flows        []FlowRecord `json:"flows,omitempty"`
+	Subscription []string     `json:"subscription,omitempty"`
+	Smoothing    string       `json:"smoothing,omitempty"`
+	Page         *wsPage      `json:"page,omitempty"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// topic is the subscription an event is delivered to
+func (e *WSEvent) topic() string {
+	switch e.Type {
+	case EventAlert:
+		return TopicAlerts
+	case EventFlows:
+		return TopicFlows
+	}
+	return ""
+}
+
+// subscribe adds topic to the client's subscriptions; "all" replaces them
+func (c *wsClient) subscribe(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topic = strings.ToLower(strings.TrimSpace(topic))
+	if topic == TopicAll {
+		c.subscriptions = map[string]bool{TopicAll: true}
+	} else if len(c.subscriptions) < maxSubscriptions {
+		delete(c.subscriptions, TopicAll)
+		c.subscriptions[topic] = true
+	}
+	return c.subscriptionList()
+}
+
+// unsubscribe removes topic; without subscriptions nothing is sent
+func (c *wsClient) unsubscribe(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subscriptions, strings.ToLower(strings.TrimSpace(topic)))
+	return c.subscriptionList()
+}
+
+// subscriptionList returns the sorted subscriptions; caller holds c.mu
+func (c *wsClient) subscriptionList() []string {
+	list := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		list = append(list, topic)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// wants reports whether the client subscribed to topic
+func (c *wsClient) wants(topic string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscriptions[topic]
+}
+
+// statsFor returns the stats update c subscribed to, or nil: top for "all",
+// otherwise stats narrowed to the subscribed devices (none for "totals")
+func (c *wsClient) statsFor(bm *BandwidthMonitor, stats, top *NetworkStats) *NetworkStats {
+	c.mu.Lock()
+	subs := c.subscriptions
+	smoothing := c.smoothing
+	page := c.page
+	all := subs[TopicAll]
+	devices := 0
+	for topic := range subs {
+		if topic != TopicTotals && topic != TopicFlows && topic != TopicAlerts {
+			devices++
+		}
+	}
+	if !all && devices == 0 && !subs[TopicTotals] {
+		c.mu.Unlock()
+		return nil
+	}
+	var update *NetworkStats
+	if all && page.Limit > 0 {
+		update = stats.page(page.Offset, page.Limit)
+	} else if all {
+		update = top
+	} else {
+		narrowed := *stats
+		narrowed.Devices = make([]*DeviceStats, 0, devices)
+		narrowed.DevicesOmitted = 0
+		for _, dev := range stats.Devices {
+			if subs[bm.deviceKey(dev.MAC, dev.IP)] || subs[dev.MAC] || subs[dev.IP] {
+				narrowed.Devices = append(narrowed.Devices, dev)
+			}
+		}
+		update = &narrowed
+	}
+	c.mu.Unlock()
+	return c.update(bm, bm.smoothStats(update, smoothing))
+}
+
+// setSmoothing changes how the client's device rates are computed
+func (c *wsClient) setSmoothing(s rateSmoothing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.smoothing = s
+}
+
+// setPage changes the devices the client's "all" updates list
+func (c *wsClient) setPage(p wsPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.page = p
+}
+
+// handleRequest applies a control message and returns the reply
+func (c *wsClient) handleRequest(data []byte) *WSEvent {
+	var req wsRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return &WSEvent{Type: EventError, Error: "invalid request: " + err.Error()}
+	}
+	var subs []string
+	switch {
+	case req.Page != nil:
+		if req.Page.Offset < 0 || req.Page.Limit < 0 || req.Page.Limit > maxBroadcastDevices {
+			return &WSEvent{Type: EventError, Error: fmt.Sprintf("invalid page (limit at most %d)", maxBroadcastDevices)}
+		}
+		c.setPage(*req.Page)
+		return &WSEvent{Type: EventPage, Page: req.Page}
+	case req.Smoothing != "":
+		s, err := parseSmoothing(req.Smoothing)
+		if err != nil {
+			return &WSEvent{Type: EventError, Error: err.Error()}
+		}
+		c.setSmoothing(s)
+		return &WSEvent{Type: EventSmoothing, Smoothing: s.String()}
+	case req.Subscribe != "":
+		subs = c.subscribe(req.Subscribe)
+	case req.Unsubscribe != "":
+		subs = c.unsubscribe(req.Unsubscribe)
+	default:
+		return &WSEvent{Type: EventError, Error: "expected subscribe, unsubscribe, smoothing or page"}
+	}
+	return &WSEvent{Type: EventSubscribed, Subscription: subs}
+}
+
+// publishAlert queues a new alert for "alerts" subscribers
+func (bm *BandwidthMonitor) publishAlert(alert Alert) {
+	bm.publishEvent(&WSEvent{Type: EventAlert, Alert: &alert})
+}
+
+// publishFlows queues closed flow records for "flows" subscribers
+func (bm *BandwidthMonitor) publishFlows(records []FlowRecord) {
+	bm.publishEvent(&WSEvent{Type: EventFlows, Flows: records})
+}
+
+// publishEvent hands an event to the broadcaster without blocking the
+// detector or worker that produced it
+func (bm *BandwidthMonitor) publishEvent(e *WSEvent) {
+	select {
+	case bm.events <- e:
+	default:
+		// Channel full, drop the event
+	}
+}
+
+// broadcastEvent sends an event to the clients subscribed to its topic
+func (bm *BandwidthMonitor) broadcastEvent(e *WSEvent) {
+	encoded := make(map[string][]byte)
+	bm.clientsMu.RLock()
+	defer bm.clientsMu.RUnlock()
+	for _, client := range bm.clients {
+		if !client.wants(e.topic()) {
+			continue
+		}
+		data, ok := encoded[client.codec.Name()]
+		if !ok {
+			var err error
+			if data, err = client.codec.Marshal(e); err != nil {
+				continue
+			}
+			encoded[client.codec.Name()] = data
+		}
+		client.queue(data, time.Now())
+	}
+}
+
+// send encodes v with the client's codec and queues it
+func (c *wsClient) send(v interface{}) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if !c.queue(data, time.Now()) {
+		return errors.New("client gone or not keeping up")
+	}
+	return nil
+}
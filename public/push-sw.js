@@ -0,0 +1,17 @@
+// Service worker showing K.E.E.P.E.R alerts delivered by Web Push
+self.addEventListener('push', (event) => {
+  const alert = event.data ? event.data.json() : {};
+  const title = `[${(alert.severity || 'info').toUpperCase()}] ${alert.type || 'Alert'}`;
+  event.waitUntil(
+    self.registration.showNotification(title, {
+      body: alert.message || '',
+      tag: alert.id ? `alert-${alert.id}` : undefined,
+      requireInteraction: alert.severity === 'critical',
+    })
+  );
+});
+
+self.addEventListener('notificationclick', (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow('/'));
+});
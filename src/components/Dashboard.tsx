@@ -14,6 +14,7 @@ import {
   Filler,
 } from 'chart.js';
 import { Line, Doughnut, Bar, Radar } from 'react-chartjs-2';
+import { enablePushNotifications, pushSupported } from '../push';
 import './Dashboard.css';
 
 // Register Chart.js components
@@ -37,10 +38,16 @@ interface DeviceStats {
   ip: string;
   bytesSent: number;
   bytesRecv: number;
+  rateSentBps: number;
+  rateRecvBps: number;
   packetsSent: number;
   packetsRecv: number;
+  lanBytes: number; // stayed on the LAN (-lan-subnets)
+  wanBytes: number; // to or from the internet
   lastSeen: string;
   hostname: string;
+  label?: string;
+  dnsQueriesToday?: number; // from Pi-hole/AdGuard Home (-dns-filter)
 }
 
 interface NetworkStats {
@@ -49,8 +56,14 @@ interface NetworkStats {
   totalRecv: number;
   totalPackets: number;
   activeDevices: number;
-  monitorDuration: number;
+  monitorDuration: number; // seconds since measurementStart
   timestamp: string;
+  measurementStart: string;
+  uptime: number;
+  sampleRate?: number; // 1 in N packets accounted; above 1 the counters are estimates
+  devicesOmitted?: number; // devices beyond this update's top N or page (counted in the totals)
+  offset?: number; // position of the first listed device when paging
+  newVersion?: string; // newer release available (backend -update-check)
 }
 
 interface ChartDataPoint {
@@ -58,15 +71,22 @@ interface ChartDataPoint {
   devices: Map<string, { upload: number; download: number }>;
 }
 
-// Utility: Get WebSocket URL
+// Utility: Get WebSocket URL (with the backend's -auth-token or -api-key, if configured)
 const getWebSocketUrl = (): string => {
+  const token = import.meta.env.VITE_WS_TOKEN || import.meta.env.VITE_API_KEY;
+  // Rate smoothing of the page (e.g. ?smoothing=ewma:30s on a wall display)
+  const smoothing = new URLSearchParams(window.location.search).get('smoothing');
+  const withParam = (url: string, name: string, value: string | null | undefined): string =>
+    value ? `${url}${url.includes('?') ? '&' : '?'}${name}=${encodeURIComponent(value)}` : url;
+  const withToken = (url: string): string =>
+    withParam(withParam(url, 'token', token), 'smoothing', smoothing);
   if (import.meta.env.VITE_WS_URL) {
-    return import.meta.env.VITE_WS_URL;
+    return withToken(import.meta.env.VITE_WS_URL);
   }
   const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
   const host = window.location.hostname;
   const port = import.meta.env.VITE_WS_PORT || '8080';
-  return `${protocol}//${host}:${port}/ws`;
+  return withToken(`${protocol}//${host}:${port}/ws`);
 };
 
 // Utility: Format bytes
@@ -104,10 +124,10 @@ const Dashboard: React.FC = () => {
   const [stats, setStats] = useState<NetworkStats | null>(null);
   const [connectionStatus, setConnectionStatus] = useState<'connecting' | 'connected' | 'disconnected'>('connecting');
   const [chartHistory, setChartHistory] = useState<ChartDataPoint[]>([]);
+  const [pushState, setPushState] = useState<'off' | 'on' | 'error'>('off');
   const [wsUrl, setWsUrl] = useState<string>('');
   const [currentTime, setCurrentTime] = useState<string>('');
   const wsRef = useRef<WebSocket | null>(null);
-  const previousStatsRef = useRef<Map<string, { sent: number; recv: number }>>(new Map());
   const reconnectTimeoutRef = useRef<NodeJS.Timeout | null>(null);
 
   const MAX_HISTORY_POINTS = 50;
@@ -164,23 +184,9 @@ const Dashboard: React.FC = () => {
           const deviceRates = new Map<string, { upload: number; download: number }>();
 
           data.devices.forEach((device) => {
-            const key = device.mac;
-            const prev = previousStatsRef.current.get(key);
-
-            if (prev) {
-              const uploadRate = device.bytesSent - prev.sent;
-              const downloadRate = device.bytesRecv - prev.recv;
-              deviceRates.set(key, {
-                upload: Math.max(0, uploadRate),
-                download: Math.max(0, downloadRate),
-              });
-            } else {
-              deviceRates.set(key, { upload: 0, download: 0 });
-            }
-
-            previousStatsRef.current.set(key, {
-              sent: device.bytesSent,
-              recv: device.bytesRecv,
+            deviceRates.set(device.mac, {
+              upload: device.rateSentBps ?? 0,
+              download: device.rateRecvBps ?? 0,
             });
           });
 
@@ -286,7 +292,7 @@ const Dashboard: React.FC = () => {
   const bandwidthChartData = {
     labels: chartHistory.map((point) => point.timestamp),
     datasets: stats?.devices.map((device, index) => ({
-      label: device.ip || device.mac.slice(0, 8),
+      label: device.label || device.hostname || device.ip || device.mac.slice(0, 8),
       data: chartHistory.map((point) => {
         const deviceData = point.devices.get(device.mac);
         return deviceData ? (deviceData.upload + deviceData.download) / 1024 : 0;
@@ -460,6 +466,9 @@ const Dashboard: React.FC = () => {
     );
   }
 
+  // The DNS column only appears when the backend reads a Pi-hole/AdGuard Home
+  const showDnsQueries = stats.devices.some((d) => d.dnsQueriesToday !== undefined);
+
   return (
     <div className="jarvis-dashboard">
       {/* Animated background grid */}
@@ -482,6 +491,23 @@ const Dashboard: React.FC = () => {
         </div>
         <div className="jarvis-header-right">
           <div className="jarvis-time">{currentTime}</div>
+          {pushSupported() && (
+            <button
+              className={`jarvis-status jarvis-push jarvis-push-${pushState}`}
+              disabled={pushState === 'on'}
+              title="Receive alert notifications while this tab is closed"
+              onClick={() =>
+                enablePushNotifications()
+                  .then(() => setPushState('on'))
+                  .catch((err) => {
+                    console.error('Push subscription failed:', err);
+                    setPushState('error');
+                  })
+              }
+            >
+              {pushState === 'on' ? 'ALERTS ON' : pushState === 'error' ? 'ALERTS UNAVAILABLE' : 'ENABLE ALERTS'}
+            </button>
+          )}
           <div className={`jarvis-status jarvis-status-${connectionStatus}`}>
             <span className="status-dot"></span>
             {connectionStatus.toUpperCase()}
@@ -611,7 +637,9 @@ const Dashboard: React.FC = () => {
                 <th>IP ADDRESS</th>
                 <th>UPLOAD</th>
                 <th>DOWNLOAD</th>
+                <th>INTERNET</th>
                 <th>PACKETS</th>
+                {showDnsQueries && <th>DNS TODAY</th>}
                 <th>STATUS</th>
               </tr>
             </thead>
@@ -640,7 +668,12 @@ const Dashboard: React.FC = () => {
                       <span className="data-value">{formatBytes(device.bytesRecv)}</span>
                       <span className="data-rate">{downloadRate} KB/s</span>
                     </td>
+                    <td className="data-cell">
+                      <span className="data-value">{formatBytes(device.wanBytes)}</span>
+                      <span className="data-rate">LAN {formatBytes(device.lanBytes)}</span>
+                    </td>
                     <td className="mono-font">{device.packetsSent + device.packetsRecv}</td>
+                    {showDnsQueries && <td className="mono-font">{device.dnsQueriesToday ?? '—'}</td>}
                     <td>
                       <span className="status-badge status-active">ACTIVE</span>
                     </td>
@@ -656,7 +689,16 @@ const Dashboard: React.FC = () => {
       <footer className="jarvis-footer">
         <div className="footer-text">
           LAST UPDATE: {new Date(stats.timestamp).toLocaleString()} • 
-          UPTIME: {Math.floor(stats.monitorDuration / 60)}m {Math.floor(stats.monitorDuration % 60)}s
+          UPTIME: {Math.floor(stats.uptime / 60)}m {Math.floor(stats.uptime % 60)}s
+          {stats.sampleRate && stats.sampleRate > 1 && (
+            <> • SAMPLED 1:{stats.sampleRate} (ESTIMATES)</>
+          )}
+          {(stats.devicesOmitted ?? 0) > 0 && (
+            <> • TOP {stats.devices.length} OF {stats.activeDevices} DEVICES</>
+          )}
+          {stats.newVersion && (
+            <> • UPDATE AVAILABLE: {stats.newVersion}</>
+          )}
         </div>
       </footer>
     </div>
@@ -0,0 +1,58 @@
+// Web Push subscription for backend alerts (see backend -push-file)
+
+// Utility: Get REST API base URL, alongside the WebSocket endpoint
+export const getApiUrl = (): string => {
+  if (import.meta.env.VITE_API_URL) {
+    return import.meta.env.VITE_API_URL;
+  }
+  const host = window.location.hostname;
+  const port = import.meta.env.VITE_WS_PORT || '8080';
+  return `${window.location.protocol}//${host}:${port}`;
+};
+
+// Utility: Headers for REST API requests, with the backend's -api-key if configured
+export const apiHeaders = (headers: Record<string, string> = {}): Record<string, string> => {
+  const key = import.meta.env.VITE_API_KEY;
+  return key ? { ...headers, Authorization: `Bearer ${key}` } : headers;
+};
+
+// Convert the base64url VAPID key to the bytes PushManager expects
+const decodeKey = (key: string): Uint8Array => {
+  const padded = (key + '='.repeat((4 - (key.length % 4)) % 4)).replace(/-/g, '+').replace(/_/g, '/');
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0));
+};
+
+export const pushSupported = (): boolean =>
+  'serviceWorker' in navigator && 'PushManager' in window && 'Notification' in window;
+
+// Ask for permission and subscribe this browser to alert notifications
+export const enablePushNotifications = async (): Promise<void> => {
+  if (!pushSupported()) {
+    throw new Error('Push notifications are not supported by this browser');
+  }
+  if ((await Notification.requestPermission()) !== 'granted') {
+    throw new Error('Notification permission denied');
+  }
+  const keyResponse = await fetch(`${getApiUrl()}/api/push/key`, { headers: apiHeaders() });
+  if (!keyResponse.ok) {
+    throw new Error('Push notifications are not enabled on the server');
+  }
+  const { publicKey } = await keyResponse.json();
+
+  const registration = await navigator.serviceWorker.register('/push-sw.js');
+  const subscription =
+    (await registration.pushManager.getSubscription()) ||
+    (await registration.pushManager.subscribe({
+      userVisibleOnly: true,
+      applicationServerKey: decodeKey(publicKey),
+    }));
+
+  const response = await fetch(`${getApiUrl()}/api/push/subscriptions`, {
+    method: 'POST',
+    headers: apiHeaders({ 'Content-Type': 'application/json' }),
+    body: JSON.stringify(subscription),
+  });
+  if (!response.ok) {
+    throw new Error(`Subscribing failed: ${response.status}`);
+  }
+};